@@ -0,0 +1,129 @@
+package fleetingd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+const (
+	archAMD64 = "amd64"
+	archARM64 = "arm64"
+)
+
+// cloud-hypervisor boots arm64 kernels only as uncompressed Image, the unpacked copy is stored next to the download
+const unpackedKernelSuffix = "_unpacked"
+
+// The PL011 UART of cloud-hypervisor's arm64 machine, where the kernel logs until the virtio console is up
+const arm64EarlyConsole = "earlycon=pl011,mmio,0x09000000 keep_bootcon"
+
+func checkHostArchitecture() error {
+	// Check the plugin was built for an architecture cloud-hypervisor and the image profiles support
+
+	switch runtime.GOARCH {
+	case archAMD64, archARM64:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported architecture %s, supported are %s and %s", runtime.GOARCH, archAMD64, archARM64)
+}
+
+func firmwareFileName() string {
+	// Get the name edk2 builds its cloud-hypervisor firmware for the host's architecture under
+
+	if runtime.GOARCH == archARM64 {
+		return "CLOUDHV_EFI.fd"
+	}
+
+	return "CLOUDHV.fd"
+}
+
+func (i *InstanceGroup) kernelCmdline(pmemRoot bool) string {
+	// Get the command line of directly booted kernels, only arm64 guests need the early console to log hangs before the virtio console
+
+	cmdline := fmt.Sprintf("console=hvc0 root=%s rw", i.imageProfile.RootDevice)
+
+	// The guest accesses the host's page cache of the root disk directly, so it doesn't cache it a second time
+	if pmemRoot {
+		cmdline = fmt.Sprintf("console=hvc0 root=%s rootflags=dax rw", i.pmemRootDevice())
+	}
+
+	if runtime.GOARCH == archARM64 {
+		return arm64EarlyConsole + " " + cmdline
+	}
+
+	return cmdline
+}
+
+func (i *InstanceGroup) getBootKernelPath() (string, error) {
+	// Get the path of the kernel cloud-hypervisor boots, which is the unpacked copy on arm64
+
+	kernelFilePath, err := i.getKernelFilePath()
+	if err != nil || kernelFilePath == "" || runtime.GOARCH != archARM64 {
+		return kernelFilePath, err
+	}
+
+	return kernelFilePath + unpackedKernelSuffix, nil
+}
+
+func (i *InstanceGroup) unpackKernel() error {
+	// Write the kernel cloud-hypervisor boots on arm64, Ubuntu's vmlinuz is a gzip compressed Image
+
+	kernelFilePath, err := i.getKernelFilePath()
+	if err != nil {
+		return err
+	}
+
+	bootKernelPath, err := i.getBootKernelPath()
+	if err != nil || bootKernelPath == kernelFilePath {
+		return err
+	}
+
+	source, err := os.Open(kernelFilePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	reader := bufio.NewReader(source)
+
+	magic, err := reader.Peek(2)
+	if err != nil {
+		return fmt.Errorf("could not read kernel %s: %w", kernelFilePath, err)
+	}
+
+	var kernel io.Reader = reader
+
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(kernel)
+		if err != nil {
+			return fmt.Errorf("could not unpack kernel %s: %w", kernelFilePath, err)
+		}
+		defer gzipReader.Close()
+
+		kernel = gzipReader
+	}
+
+	temporaryPath := bootKernelPath + ".tmp"
+
+	target, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, kernel)
+	if err != nil {
+		target.Close()
+		return fmt.Errorf("could not unpack kernel %s: %w", kernelFilePath, err)
+	}
+
+	err = target.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, bootKernelPath)
+}
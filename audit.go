@@ -0,0 +1,150 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/crypto/ssh"
+)
+
+// Written to vm_disk_directory, rotated copies get .1, .2, ... appended
+const auditLogFileName = "audit.jsonl"
+
+const defaultAuditLogMaxSizeMegabytes = 10
+const defaultAuditLogMaxFiles = 5
+
+const (
+	auditEventCreate      = "create"
+	auditEventAdopt       = "adopt"
+	auditEventReady       = "ready"
+	auditEventConnectInfo = "connect-info-issued"
+	auditEventDestroy     = "destroy"
+	auditEventCrash       = "crash"
+)
+
+// One line of the audit log, identifying an instance the way it was seen from the network and by the runner
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Instance string    `json:"instance"`
+
+	IP                 string `json:"ip"`
+	IP6                string `json:"ip6,omitempty"`
+	MAC                string `json:"mac"`
+	ExternalSSHAddress string `json:"external_ssh_address,omitempty"`
+	SSHKeyFingerprint  string `json:"ssh_key_fingerprint,omitempty"`
+
+	// Keys of vm_extra_authorized_keys the instance was created with
+	ExtraSSHKeyFingerprints []string `json:"extra_ssh_key_fingerprints,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Why a crashed instance exited
+	Reason string `json:"reason,omitempty"`
+}
+
+// Append-only record of the instances' lifecycles, a nil log records nothing
+type auditLog struct {
+	lock   sync.Mutex
+	logger hclog.Logger
+	file   rotatingFile
+
+	extraKeyFingerprints []string
+}
+
+func (i *InstanceGroup) openAuditLog() (*auditLog, error) {
+	// Open the audit log if vm_audit_log is set, entries are appended to the ones of earlier runs
+
+	if !i.VMAuditLog {
+		return nil, nil
+	}
+
+	if i.VMAuditLogMaxSizeMegabytes == 0 {
+		i.VMAuditLogMaxSizeMegabytes = defaultAuditLogMaxSizeMegabytes
+	}
+	if i.VMAuditLogMaxFiles == 0 {
+		i.VMAuditLogMaxFiles = defaultAuditLogMaxFiles
+	}
+
+	log := &auditLog{
+		logger:               i.logger,
+		extraKeyFingerprints: i.extraAuthorizedKeyFingerprints,
+		file: rotatingFile{
+			path:     filepath.Join(i.VMDiskDir, auditLogFileName),
+			maxSize:  int64(i.VMAuditLogMaxSizeMegabytes) * 1024 * 1024,
+			maxFiles: int(i.VMAuditLogMaxFiles),
+		},
+	}
+
+	err := log.file.open()
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+
+	return log, nil
+}
+
+func (i *Inventory) recordAuditEvent(event string, name string) {
+	// Record an event of an instance known by its name
+
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	instance, ok := i.instances[name]
+	if ok {
+		i.auditLog.record(event, instance, "")
+	}
+}
+
+func (a *auditLog) record(event string, instance *InstanceInfo, reason string) {
+	// Append an event of a job instance, failing to write it is logged but doesn't stop the instance
+
+	if a == nil || instance.Internal {
+		return
+	}
+
+	entry := auditEvent{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Instance: instance.Name,
+
+		IP:                 instance.InstanceTapIP,
+		IP6:                instance.InstanceTapIP6,
+		MAC:                instance.InstanceTapMacAddress,
+		ExternalSSHAddress: instance.ExternalSSHAddress,
+
+		Labels: instance.Labels,
+		Reason: reason,
+	}
+
+	// Only known for instances this run created, adopted ones may have been created with other keys
+	if event == auditEventCreate {
+		entry.ExtraSSHKeyFingerprints = a.extraKeyFingerprints
+	}
+
+	if instance.SSHPublicKey != nil {
+		publicKey, err := ssh.NewPublicKey(instance.SSHPublicKey)
+		if err == nil {
+			entry.SSHKeyFingerprint = ssh.FingerprintSHA256(publicKey)
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		a.logger.Error("could not write audit log", "instance", instance.Name, "event", event, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, err = a.file.Write(line)
+	if err != nil {
+		a.logger.Error("could not write audit log", "instance", instance.Name, "event", event, "error", err)
+	}
+}
@@ -0,0 +1,160 @@
+package fleetingd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// How often the benchmark asks for the instances' states while they boot, the plugin is asked just as often by the runner
+const benchmarkUpdateInterval = time.Second
+
+// Leaves the instances time to stop before they are killed
+const benchmarkShutdownTimeout = 2 * time.Minute
+
+func Benchmark(ctx context.Context, configPath string, count int) error {
+	// Boot count throwaway instances with the plugin_config in configPath, given as JSON, print how long the steps of their boots took and remove them again
+
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	instanceGroup := &InstanceGroup{}
+	err = json.Unmarshal(contents, instanceGroup)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", configPath, err)
+	}
+
+	// Init replaces the firewall table and the sockets of a running plugin
+	_, err = requestControlStatus(instanceGroup.VMDiskDir)
+	if err == nil {
+		return fmt.Errorf("the plugin is running with vm_disk_directory %s, stop it before benchmarking", instanceGroup.VMDiskDir)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "benchmark", Output: os.Stderr})
+
+	info, err := instanceGroup.Init(ctx, logger, provider.Settings{})
+	if err != nil {
+		return err
+	}
+
+	if count > info.MaxSize {
+		return errors.Join(fmt.Errorf("only %d instances fit into vm_subnet with this configuration", info.MaxSize), instanceGroup.stopWithoutDestroying(ctx))
+	}
+
+	// The teardown would destroy them, the plugin adopts them when it starts
+	if len(instanceGroup.inventory.GetInstanceStates()) > 0 {
+		return errors.Join(errors.New("instances of an earlier run are still around, remove them with the cleanup command first"), instanceGroup.stopWithoutDestroying(ctx))
+	}
+
+	err = instanceGroup.runBenchmark(ctx, count)
+
+	// Shutdown gets a context of its own so an interrupted benchmark is still torn down
+	shutdownContext, cancel := context.WithTimeout(context.Background(), benchmarkShutdownTimeout)
+	defer cancel()
+
+	return errors.Join(err, instanceGroup.Shutdown(shutdownContext))
+}
+
+func (i *InstanceGroup) runBenchmark(ctx context.Context, count int) error {
+	// Prepare the images, then boot the instances like the runner would and wait until they are ready or failed
+
+	// The prebuild runs once per image and would dwarf the boots
+	prebuildStarted := time.Now()
+	err := i.inventory.waitForPrebuild(ctx, i)
+	if err != nil {
+		return err
+	}
+	if i.inventory.prebuildErr != nil {
+		return fmt.Errorf("prebuild failed: %w", i.inventory.prebuildErr)
+	}
+	prebuildDuration := time.Since(prebuildStarted)
+
+	i.logger.Info("Booting instances.", "count", count)
+
+	booted, err := i.Increase(ctx, count)
+	if err != nil {
+		i.logger.Warn("Not all instances booted.", "booted", booted, "error", err)
+	}
+
+	// Readiness is only checked when the runner asks for the states
+	states := map[string]provider.State{}
+	for {
+		err = i.Update(ctx, func(instance string, state provider.State) {
+			states[instance] = state
+		})
+		if err != nil {
+			return err
+		}
+
+		creating := false
+		for _, state := range states {
+			creating = creating || state == provider.StateCreating
+		}
+		if !creating {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("benchmark cancelled: %w", ctx.Err())
+		case <-time.After(benchmarkUpdateInterval):
+		}
+	}
+
+	ready := 0
+	for _, state := range states {
+		if state == provider.StateRunning {
+			ready++
+		}
+	}
+
+	fmt.Printf("Prebuild:  %s\n", prebuildDuration.Round(time.Millisecond))
+	fmt.Printf("Instances: %d of %d ready\n\n", ready, count)
+
+	return i.printBenchmarkEvents(states)
+}
+
+func (i *InstanceGroup) printBenchmarkEvents(states map[string]provider.State) error {
+	// Print percentiles of the time from the start of a boot to each of its events, over the benchmark's instances
+
+	durations := map[string][]time.Duration{}
+	for _, event := range i.inventory.recentEvents.list("") {
+		if _, ok := states[event.Instance]; !ok {
+			continue
+		}
+
+		durations[event.Event] = append(durations[event.Event], time.Duration(event.ElapsedSeconds*float64(time.Second)))
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "EVENT\tCOUNT\tP50\tP90\tP99\tMAX")
+	for _, event := range bootEventNames {
+		values := durations[event]
+		if len(values) == 0 {
+			continue
+		}
+
+		slices.Sort(values)
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\t%s\n", event, len(values), percentile(values, 50), percentile(values, 90), percentile(values, 99), values[len(values)-1].Round(time.Millisecond))
+	}
+
+	return writer.Flush()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	// Get the nearest-rank percentile of sorted durations
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)].Round(time.Millisecond)
+}
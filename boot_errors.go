@@ -0,0 +1,121 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// What made a boot fail, matched with errors.Is on the errors of Increase
+var (
+	ErrCapacityExhausted = errors.New("capacity exhausted")
+	ErrImageUnavailable  = errors.New("image unavailable")
+	ErrHypervisorFailure = errors.New("hypervisor failure")
+	ErrNetworkSetup      = errors.New("network setup failure")
+	ErrPrebuildFailed    = errors.New("prebuild failure")
+)
+
+// A boot refused because the plugin shuts down, like a cancelled one it is no failure
+var errShuttingDown = fmt.Errorf("system is shutting down: %w", context.Canceled)
+
+// Counts the failures whose cause is none of the kinds, e.g. an instance directory which could not be created
+const otherBootFailureLabel = "other"
+
+// Label values of fleetingd_boot_failures_total, in the order they are reported
+var bootFailureKinds = []struct {
+	kind  error
+	label string
+}{
+	{ErrCapacityExhausted, "capacity_exhausted"},
+	{ErrImageUnavailable, "image_unavailable"},
+	{ErrHypervisorFailure, "hypervisor_failure"},
+	{ErrNetworkSetup, "network_setup_failure"},
+	{ErrPrebuildFailed, "prebuild_failure"},
+}
+
+// Kind of the errors of a boot phase which were not classified where they happened, the other phases leave them unclassified
+var bootPhaseFailures = map[string]error{
+	"disk":             ErrImageUnavailable,
+	"network":          ErrNetworkSetup,
+	"firewall":         ErrNetworkSetup,
+	"start hypervisor": ErrHypervisorFailure,
+	"restore":          ErrHypervisorFailure,
+}
+
+// Error of a failed boot, Kind is one of the Err variables and Err what went wrong
+type BootError struct {
+	Kind error
+	Err  error
+}
+
+func newBootError(kind error, err error) error {
+	// Classify the error of a boot, one which already is classified keeps its kind
+
+	if err == nil {
+		return nil
+	}
+
+	var bootErr *BootError
+	if errors.As(err, &bootErr) {
+		return err
+	}
+
+	return &BootError{Kind: kind, Err: err}
+}
+
+func classifyBootPhaseError(phase string, err error) error {
+	// Classify an error of a boot by the phase it failed in unless it already has a kind, cancelled boots are no failure
+
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	kind, ok := bootPhaseFailures[phase]
+	if !ok {
+		return err
+	}
+
+	return newBootError(kind, err)
+}
+
+func (e *BootError) Error() string {
+	// Lead with the kind, the runner only logs the message
+
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *BootError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+func (e *BootError) Transient() bool {
+	// Tell if booting again later may succeed, the other kinds repeat until the configuration or the host is fixed
+
+	// Capacity and hypervisor failures may clear up, image and network failures repeat until the configuration is fixed
+	return e.Kind == ErrCapacityExhausted || e.Kind == ErrHypervisorFailure
+}
+
+func prebuildBootError(err error) error {
+	// Classify the prebuild's error every boot fails with, images which could not be fetched are told apart from the rest
+
+	if errors.Is(err, ErrImageUnavailable) {
+		return err
+	}
+
+	return &BootError{Kind: ErrPrebuildFailed, Err: err}
+}
+
+func bootFailureLabel(err error) string {
+	// Get the label of fleetingd_boot_failures_total an error is counted under
+
+	var bootErr *BootError
+	if errors.As(err, &bootErr) {
+		for _, kind := range bootFailureKinds {
+			if kind.kind == bootErr.Kind {
+				return kind.label
+			}
+		}
+	}
+
+	return otherBootFailureLabel
+}
@@ -0,0 +1,52 @@
+package fleetingd
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Spreads the boots requested by the runner over time, so cloud-init doesn't run in all of them at once
+type bootLimiter struct {
+	lock sync.Mutex
+	// Earliest time the next boot may start
+	next time.Time
+}
+
+func (i *InstanceGroup) waitForBootSlot(ctx context.Context) error {
+	// Wait until a boot may start according to vm_boot_rate_per_minute, delayed further by up to vm_boot_jitter_seconds
+
+	if i.VMBootRatePerMinute == 0 && i.VMBootJitterSeconds == 0 {
+		return nil
+	}
+
+	var interval time.Duration
+	if i.VMBootRatePerMinute > 0 {
+		interval = time.Minute / time.Duration(i.VMBootRatePerMinute)
+	}
+
+	// Boots take the slots in the order they asked for them
+	i.bootLimiter.lock.Lock()
+	start := time.Now()
+	if i.bootLimiter.next.After(start) {
+		start = i.bootLimiter.next
+	}
+	i.bootLimiter.next = start.Add(interval)
+	i.bootLimiter.lock.Unlock()
+
+	// The jitter keeps a wave from starting in lockstep without delaying the following slots
+	if i.VMBootJitterSeconds > 0 {
+		start = start.Add(rand.N(time.Duration(i.VMBootJitterSeconds) * time.Second))
+	}
+
+	timer := time.NewTimer(time.Until(start))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,165 @@
+package fleetingd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const networkModeNAT = "nat"
+const networkModeBridge = "bridge"
+
+func (i *InstanceGroup) checkNetworkMode() error {
+	// Validate the network mode, bridged VMs get their address from the DHCP server on the bridge
+
+	// Only bridged taps are switched, NATed traffic leaves through the egress interface
+	if i.VMVLANID != 0 && i.NetworkMode != networkModeBridge {
+		return errors.New("vm_vlan_id can only be used with network_mode bridge")
+	}
+
+	switch i.NetworkMode {
+	case "":
+		i.NetworkMode = networkModeNAT
+		return nil
+	case networkModeNAT:
+		return nil
+	case networkModePasst:
+		return i.checkPasstNetworking()
+	case networkModeBridge:
+	default:
+		return fmt.Errorf("unknown network_mode '%s', must be one of: %s, %s, %s", i.NetworkMode, networkModeNAT, networkModeBridge, networkModePasst)
+	}
+
+	if i.NetworkBridge == "" {
+		return errors.New("network_mode is set to bridge but no network_bridge was configured")
+	}
+
+	// Restored VMs keep the template's address and vhost_user_net can't attach to a bridge
+	if i.VMSnapshotBoot || i.VMNetVhostUser || i.VMIPv6Prefix != "" {
+		return errors.New("network_mode bridge can not be combined with vm_snapshot_boot, vm_net_vhost_user or vm_ipv6_prefix")
+	}
+
+	bridge, err := net.InterfaceByName(i.NetworkBridge)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as network_bridge but can not be found: %w", i.NetworkBridge, err)
+	}
+
+	// The host reaches guests in a VLAN through its VLAN interface on the bridge
+	i.bridgeDevice = i.NetworkBridge
+	err = i.checkVLAN(bridge.Index)
+	if err != nil {
+		return err
+	}
+
+	hostDevice, err := net.InterfaceByName(i.bridgeDevice)
+	if err != nil {
+		return err
+	}
+
+	// The runner connects from the host's address on the bridge, so the guests need to allow SSH from it
+	addresses, err := hostDevice.Addrs()
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if ok && ipNet.IP.To4() != nil {
+			i.bridgeAddress = ipNet.IP.String()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s has no IPv4 address, the host needs one to reach the VMs", i.bridgeDevice)
+}
+
+func (i *InstanceGroup) isBridged() bool {
+	return i.NetworkMode == networkModeBridge
+}
+
+func (i *InstanceGroup) attachTapToBridge(tapName string) error {
+	// Attach an instance's tap device to the configured bridge
+
+	if !i.isBridged() {
+		return nil
+	}
+
+	_, err := runCommand(context.Background(), "ip", "link", "set", "dev", tapName, "master", i.NetworkBridge, "up")
+	if err != nil {
+		return fmt.Errorf("could not attach tap %s to bridge %s: %w", tapName, i.NetworkBridge, err)
+	}
+
+	return i.configureTapVLAN(tapName)
+}
+
+func lookupNeighborAddress(macAddress string, device string) (string, error) {
+	// Find the IPv4 address belonging to a MAC address in the kernel's ARP table, empty if there is none yet
+
+	arpTable, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return "", err
+	}
+	defer arpTable.Close()
+
+	scanner := bufio.NewScanner(arpTable)
+
+	// Skip header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+
+		// Incomplete entries have no flags set
+		if fields[2] == "0x0" || fields[5] != device {
+			continue
+		}
+
+		if strings.EqualFold(fields[3], macAddress) {
+			return fields[0], nil
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+func (i *Inventory) LearnInstanceAddress(instanceGroup *InstanceGroup, name string) error {
+	// Learn the address a bridged instance got from DHCP, the guest pings the host after boot so it shows up in the ARP table
+
+	if !instanceGroup.isBridged() {
+		return nil
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	instance, ok := i.instances[name]
+	if !ok {
+		return fmt.Errorf("instance %s not found", name)
+	}
+
+	if instance.InstanceTapIP != "" {
+		return nil
+	}
+
+	address, err := lookupNeighborAddress(instance.InstanceTapMacAddress, instanceGroup.bridgeDevice)
+	if err != nil {
+		return err
+	}
+
+	if address == "" {
+		return fmt.Errorf("address of instance %s has not been learned yet", name)
+	}
+
+	instance.InstanceTapIP = address
+	instance.logger.Info("learned instance address", "address", address)
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The slot's cache disk shows up in the guest as /dev/disk/by-id/virtio-fleetingd-cache
+const slotCacheDiskSerial = "fleetingd-cache"
+
+func (i *InstanceGroup) parseSlotCacheDisk() error {
+	// Parse the disk kept per slot for the next instance in it, it has to live outside the working directory which is wiped at prebuild
+
+	if i.VMSlotCacheDisk == "" {
+		return nil
+	}
+
+	// Restored VMs keep the disks of the template VM
+	if i.VMSnapshotBoot {
+		return errors.New("vm_slot_cache_disk can not be combined with vm_snapshot_boot")
+	}
+
+	disk, err := parseExtraDisk(i.VMSlotCacheDisk)
+	if err != nil {
+		return fmt.Errorf("invalid vm_slot_cache_disk: %w", err)
+	}
+
+	for _, extraDisk := range i.extraDisks {
+		if extraDisk.Mountpoint == disk.Mountpoint {
+			return fmt.Errorf("vm_slot_cache_disk uses mountpoint %s of an extra disk", disk.Mountpoint)
+		}
+	}
+
+	i.slotCacheDisk = &disk
+
+	return nil
+}
+
+func (i *InstanceGroup) getSlotCacheDiskPath(instanceIndex int) string {
+	// Get the path of a slot's cache disk, e.g. slot3_cache.img
+
+	return filepath.Join(i.VMDiskDir, fmt.Sprintf("slot%d_cache.img", instanceIndex))
+}
+
+func (i *InstanceGroup) ensureSlotCacheDisk(instanceIndex int) (string, error) {
+	// Create a slot's cache disk unless it exists with the configured size, a resized disk starts out empty again
+
+	diskPath := i.getSlotCacheDiskPath(instanceIndex)
+	size := int64(i.slotCacheDisk.SizeGB) * 1024 * 1024 * 1024
+
+	info, err := os.Stat(diskPath)
+	if err == nil && info.Size() == size {
+		return diskPath, nil
+	}
+	if err == nil {
+		i.logger.Info("Recreating cache disk with the configured size.", "path", diskPath, "size_gb", i.slotCacheDisk.SizeGB)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	diskFile, err := os.OpenFile(diskPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("could not create cache disk %s: %w", diskPath, err)
+	}
+
+	err = diskFile.Truncate(size)
+	if err != nil {
+		diskFile.Close()
+		return "", errors.Join(fmt.Errorf("could not create cache disk %s: %w", diskPath, err), os.Remove(diskPath))
+	}
+
+	return diskPath, diskFile.Close()
+}
+
+func (i *InstanceGroup) slotCacheDiskArgs(diskPath string) []string {
+	// Get the --disk argument of a slot's cache disk
+
+	if diskPath == "" {
+		return nil
+	}
+
+	diskArg := fmt.Sprintf("path=%s,serial=%s", diskPath, slotCacheDiskSerial)
+
+	if i.VMDiskDirectIO {
+		// Bypass the host page cache
+		diskArg += ",direct=on"
+	}
+
+	return []string{"--disk", diskArg + i.diskQueueOptions()}
+}
@@ -0,0 +1,210 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Highest capability the running kernel knows, newer ones than the build's are dropped too
+const capLastCapPath = "/proc/sys/kernel/cap_last_cap"
+
+var capabilityNames = map[string]int{
+	"chown":              unix.CAP_CHOWN,
+	"dac_override":       unix.CAP_DAC_OVERRIDE,
+	"dac_read_search":    unix.CAP_DAC_READ_SEARCH,
+	"fowner":             unix.CAP_FOWNER,
+	"fsetid":             unix.CAP_FSETID,
+	"kill":               unix.CAP_KILL,
+	"setgid":             unix.CAP_SETGID,
+	"setuid":             unix.CAP_SETUID,
+	"setpcap":            unix.CAP_SETPCAP,
+	"linux_immutable":    unix.CAP_LINUX_IMMUTABLE,
+	"net_bind_service":   unix.CAP_NET_BIND_SERVICE,
+	"net_broadcast":      unix.CAP_NET_BROADCAST,
+	"net_admin":          unix.CAP_NET_ADMIN,
+	"net_raw":            unix.CAP_NET_RAW,
+	"ipc_lock":           unix.CAP_IPC_LOCK,
+	"ipc_owner":          unix.CAP_IPC_OWNER,
+	"sys_module":         unix.CAP_SYS_MODULE,
+	"sys_rawio":          unix.CAP_SYS_RAWIO,
+	"sys_chroot":         unix.CAP_SYS_CHROOT,
+	"sys_ptrace":         unix.CAP_SYS_PTRACE,
+	"sys_pacct":          unix.CAP_SYS_PACCT,
+	"sys_admin":          unix.CAP_SYS_ADMIN,
+	"sys_boot":           unix.CAP_SYS_BOOT,
+	"sys_nice":           unix.CAP_SYS_NICE,
+	"sys_resource":       unix.CAP_SYS_RESOURCE,
+	"sys_time":           unix.CAP_SYS_TIME,
+	"sys_tty_config":     unix.CAP_SYS_TTY_CONFIG,
+	"mknod":              unix.CAP_MKNOD,
+	"lease":              unix.CAP_LEASE,
+	"audit_write":        unix.CAP_AUDIT_WRITE,
+	"audit_control":      unix.CAP_AUDIT_CONTROL,
+	"setfcap":            unix.CAP_SETFCAP,
+	"mac_override":       unix.CAP_MAC_OVERRIDE,
+	"mac_admin":          unix.CAP_MAC_ADMIN,
+	"syslog":             unix.CAP_SYSLOG,
+	"wake_alarm":         unix.CAP_WAKE_ALARM,
+	"block_suspend":      unix.CAP_BLOCK_SUSPEND,
+	"audit_read":         unix.CAP_AUDIT_READ,
+	"perfmon":            unix.CAP_PERFMON,
+	"bpf":                unix.CAP_BPF,
+	"checkpoint_restore": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+func (i *InstanceGroup) checkCapabilities() error {
+	// Check the capabilities host_retained_capabilities keeps on top of the ones the configuration needs
+
+	if !i.HostDropCapabilities {
+		if len(i.HostRetainedCapabilities) > 0 {
+			return errors.New("host_retained_capabilities requires host_drop_capabilities")
+		}
+		return nil
+	}
+
+	// Capabilities are per thread, only the runtime of a build without cgo can change them for all threads
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_CAPBSET_READ, 0, 0)
+	if errno == syscall.ENOTSUP {
+		return errors.New("host_drop_capabilities requires a build without cgo")
+	}
+
+	for _, name := range i.HostRetainedCapabilities {
+		_, ok := capabilityNames[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+		if !ok {
+			return fmt.Errorf("unknown capability '%s' in host_retained_capabilities", name)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) requiredCapabilities() map[string]bool {
+	// Get the capabilities booting, supervising and removing instances needs with this configuration, Init's setup isn't repeated
+
+	// Taps, their addresses and traffic shaping, the per instance firewall rules and cloud-hypervisor opening the taps
+	required := map[string]bool{"net_admin": true}
+
+	// cloud-hypervisor raises its limits, locks guest memory for devices and the instances' SSH keys are locked too
+	required["sys_resource"] = true
+	required["ipc_lock"] = true
+
+	if i.dnsForwarder != nil {
+		required["net_bind_service"] = true
+	}
+
+	// Handing the instance's files over, starting its processes as the user and signalling and removing them later
+	if i.hypervisorCredential != nil {
+		for _, name := range []string{"chown", "fowner", "dac_override", "setuid", "setgid", "kill"} {
+			required[name] = true
+		}
+	}
+
+	// passt started with the plugin's privileges switches to nobody itself
+	if i.NetworkMode == networkModePasst {
+		required["setuid"] = true
+		required["setgid"] = true
+	}
+
+	// Giving another user's hypervisor a core scheduling cookie
+	if i.VMSMTIsolation && i.hypervisorCredential != nil {
+		required["sys_ptrace"] = true
+	}
+
+	// Loading the per instance profiles
+	if i.VMMACConfinement == macConfinementAppArmor {
+		required["mac_admin"] = true
+	}
+
+	// Relabelling files owned by the hypervisor user
+	if i.VMMACConfinement == macConfinementSELinux {
+		required["fowner"] = true
+	}
+
+	for _, name := range i.HostRetainedCapabilities {
+		required[strings.TrimPrefix(strings.ToLower(name), "cap_")] = true
+	}
+
+	return required
+}
+
+func (i *InstanceGroup) dropCapabilities() error {
+	// Drop the capabilities the running plugin doesn't need from all its threads and the bounding set, the tools it runs only get what is left
+
+	if !i.HostDropCapabilities {
+		return nil
+	}
+
+	lastCap := unix.CAP_LAST_CAP
+	contents, err := os.ReadFile(capLastCapPath)
+	if err == nil {
+		value, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err == nil {
+			lastCap = value
+		}
+	}
+
+	required := i.requiredCapabilities()
+	keep := [2]uint32{}
+	for name := range required {
+		value := capabilityNames[name]
+		keep[value/32] |= 1 << (value % 32)
+	}
+
+	// The runtime applies the calls to all threads, including those started later
+	for value := 0; value <= lastCap; value++ {
+		if value < 64 && keep[value/32]&(1<<(value%32)) != 0 {
+			continue
+		}
+
+		_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(value), 0)
+		// Without CAP_SETPCAP the bounding set stays, the plugin was started with capabilities but not as root then
+		if errno == syscall.EPERM {
+			break
+		}
+		if errno != 0 && errno != syscall.EINVAL {
+			return fmt.Errorf("could not drop capability %d from the bounding set: %w", value, errno)
+		}
+	}
+
+	_, _, errno := syscall.AllThreadsSyscall6(syscall.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("could not clear the ambient capabilities: %w", errno)
+	}
+
+	// Only lowers the sets, a capability the plugin never had stays missing
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	err = unix.Capget(&header, &data[0])
+	if err != nil {
+		return fmt.Errorf("could not get the capabilities: %w", err)
+	}
+
+	for index := range data {
+		data[index].Effective &= keep[index]
+		data[index].Permitted &= keep[index]
+		data[index].Inheritable = 0
+	}
+
+	_, _, errno = syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("could not drop capabilities: %w", errno)
+	}
+
+	names := []string{}
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	i.logger.Info("Dropped capabilities.", "retained", strings.Join(names, ","))
+
+	return nil
+}
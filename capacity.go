@@ -0,0 +1,80 @@
+package fleetingd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func (i *Inventory) checkHostCapacity(instanceGroup *InstanceGroup) error {
+	// Refuse to boot an instance the host has no room for, the configured headroom has to be left after it started
+
+	if instanceGroup.HostReservedMemoryMegabytes > 0 {
+		availableMegabytes, err := getHostAvailableMemoryMegabytes()
+		if err != nil {
+			return fmt.Errorf("could not determine available host memory: %w", err)
+		}
+
+		// Instances which are still booting haven't touched most of their memory yet
+		i.lock.RLock()
+		bootingInstances := uint64(0)
+		for _, instance := range i.instances {
+			if instance.State == provider.StateCreating {
+				bootingInstances++
+			}
+		}
+		i.lock.RUnlock()
+
+		requiredMegabytes := (bootingInstances+1)*instanceGroup.VMMemoryMegabytes + instanceGroup.HostReservedMemoryMegabytes
+		if availableMegabytes < requiredMegabytes {
+			return fmt.Errorf("insufficient host memory: %d MB available, the instance and those still booting need %d MB with host_reserved_memory_mb", availableMegabytes, requiredMegabytes)
+		}
+	}
+
+	if instanceGroup.HostMinFreeDiskGigabytes > 0 {
+		freeBytes, _, err := getDiskSpace(instanceGroup.VMDiskDir)
+		if err != nil {
+			return fmt.Errorf("could not determine free space in %s: %w", instanceGroup.VMDiskDir, err)
+		}
+
+		// Overlays start out small but grow with what the jobs write
+		freeGigabytes := freeBytes / 1024 / 1024 / 1024
+		if freeGigabytes < instanceGroup.HostMinFreeDiskGigabytes {
+			return fmt.Errorf("insufficient disk space: %d GB free in %s, host_min_free_disk_gb is %d GB", freeGigabytes, instanceGroup.VMDiskDir, instanceGroup.HostMinFreeDiskGigabytes)
+		}
+	}
+
+	if instanceGroup.HostMaxLoadPerCPU > 0 {
+		load, err := getHostLoadAverage()
+		if err != nil {
+			return fmt.Errorf("could not determine host load: %w", err)
+		}
+
+		loadPerCPU := load / float64(runtime.NumCPU())
+		if loadPerCPU > instanceGroup.HostMaxLoadPerCPU {
+			return fmt.Errorf("host is overloaded: load average of %.2f per CPU exceeds host_max_load_per_cpu of %.2f", loadPerCPU, instanceGroup.HostMaxLoadPerCPU)
+		}
+	}
+
+	return nil
+}
+
+func getHostLoadAverage() (float64, error) {
+	// Read the load average of the last minute from /proc/loadavg
+
+	contents, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(contents))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected contents of /proc/loadavg: %s", contents)
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
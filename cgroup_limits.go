@@ -0,0 +1,86 @@
+package fleetingd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Mount point of the unified cgroup v2 hierarchy, systemd's slices are directories below it
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Headroom of the hypervisor on top of the guest's memory and CPUs, for its own threads, device emulation and page cache
+const defaultCgroupMemoryOverheadMegabytes = 256
+const defaultCgroupCPUOverheadPercent = 50
+
+func (i *InstanceGroup) checkCgroupLimits() error {
+	// Check the hypervisors can be limited, the limits are set on their systemd scopes
+
+	if !i.VMCgroupLimits {
+		return nil
+	}
+
+	if !i.VMSystemdScopes {
+		return errors.New("vm_cgroup_limits requires vm_systemd_scopes")
+	}
+
+	// Only cgroup v2 has memory.events, which tells the hypervisor was killed for its memory usage
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("vm_cgroup_limits requires the unified cgroup v2 hierarchy mounted at %s: %w", cgroupRoot, err)
+	}
+
+	if i.VMCgroupMemoryOverheadMegabytes == 0 {
+		i.VMCgroupMemoryOverheadMegabytes = defaultCgroupMemoryOverheadMegabytes
+	}
+	if i.VMCgroupCPUOverheadPercent == 0 {
+		i.VMCgroupCPUOverheadPercent = defaultCgroupCPUOverheadPercent
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) cgroupMemoryLimitMegabytes() uint64 {
+	return i.VMMemoryMegabytes + i.VMCgroupMemoryOverheadMegabytes
+}
+
+func (i *InstanceGroup) cgroupLimitProperties() []string {
+	// Get the scope properties setting memory.max and cpu.max of a hypervisor, swap would let it exceed its memory limit
+
+	if !i.VMCgroupLimits {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("MemoryMax=%dM", i.cgroupMemoryLimitMegabytes()),
+		"MemorySwapMax=0",
+		fmt.Sprintf("CPUQuota=%d%%", uint64(i.VMNumCPUCores)*100+i.VMCgroupCPUOverheadPercent),
+	}
+}
+
+func (i *InstanceGroup) countOOMKills(instanceName string) (uint64, error) {
+	// Count the processes killed in an instance's slice for exceeding their memory limit, the slice outlives the hypervisor's scope until the instance is cleaned up
+
+	if !i.VMCgroupLimits {
+		return 0, nil
+	}
+
+	contents, err := os.ReadFile(filepath.Join(instanceSliceCgroupPath(instanceName), "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		name, value, found := bytes.Cut(scanner.Bytes(), []byte(" "))
+		if found && string(name) == "oom_kill" {
+			return strconv.ParseUint(string(value), 10, 64)
+		}
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,120 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Lives next to the images, hashing a multi-GB image takes minutes
+const checksumCacheFileName = "checksums.json"
+
+// A file is only hashed again once its size or modification time changed, entries are keyed by algorithm and path
+type checksumCacheEntry struct {
+	Path      string    `json:"path"`
+	Algorithm string    `json:"algorithm"`
+	Checksum  string    `json:"checksum"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+}
+
+func (i *InstanceGroup) cachedFileChecksum(filePath string, algorithm string) (string, error) {
+	// Compute a file's checksum unless it is cached for the file's current size and modification time
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// Files verified with different algorithms, e.g. signed by their SHA256 but published with a SHA512, have one entry each
+	key := algorithm + ":" + filePath
+
+	i.checksumCacheLock.Lock()
+	entry, ok := i.loadChecksumCache()[key]
+	i.checksumCacheLock.Unlock()
+
+	if ok && entry.Algorithm == algorithm && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry.Checksum, nil
+	}
+
+	checksum, err := computeFileChecksum(filePath, algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	// Files are hashed in parallel, the cache may have changed in the meantime
+	i.checksumCacheLock.Lock()
+	defer i.checksumCacheLock.Unlock()
+
+	cache := i.loadChecksumCache()
+	cache[key] = checksumCacheEntry{
+		Path:      filePath,
+		Algorithm: algorithm,
+		Checksum:  checksum,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+	}
+
+	// Losing the cache only costs time
+	err = i.saveChecksumCache(cache)
+	if err != nil {
+		i.logger.Warn("could not save checksum cache", "error", err)
+	}
+
+	return checksum, nil
+}
+
+func (i *InstanceGroup) loadChecksumCache() map[string]checksumCacheEntry {
+	// Load the cached checksums, a missing or broken cache is an empty one
+
+	cache := map[string]checksumCacheEntry{}
+
+	contents, err := os.ReadFile(filepath.Join(i.VMDiskDir, checksumCacheFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, &cache)
+	}
+	if err != nil {
+		i.logger.Warn("ignoring unreadable checksum cache", "error", err)
+		return map[string]checksumCacheEntry{}
+	}
+
+	return cache
+}
+
+func (i *InstanceGroup) saveChecksumCache(cache map[string]checksumCacheEntry) error {
+	// Write the cached checksums, dropping the ones of files which are gone
+
+	for key, entry := range cache {
+		_, err := os.Stat(entry.Path)
+		if entry.Path == "" || errors.Is(err, fs.ErrNotExist) {
+			delete(cache, key)
+		}
+	}
+
+	contents, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	cachePath := filepath.Join(i.VMDiskDir, checksumCacheFileName)
+	temporaryPath := cachePath + ".tmp"
+
+	err = os.WriteFile(temporaryPath, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write checksum cache: %w", err)
+	}
+
+	err = os.Rename(temporaryPath, cachePath)
+	if err != nil {
+		return fmt.Errorf("could not write checksum cache: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/hashicorp/go-hclog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func Cleanup(configPath string, dryRun bool) error {
+	// Remove what a crashed plugin using the plugin_config in configPath, given as JSON, left on the host, dryRun only prints it
+
+	instanceGroup, err := loadCleanupConfig(configPath, "cleanup")
+	if err != nil {
+		return err
+	}
+
+	// A running plugin's instances aren't orphans, it cleans up after itself
+	_, err = requestControlStatus(instanceGroup.VMDiskDir)
+	if err == nil {
+		return fmt.Errorf("the plugin is running with vm_disk_directory %s, stop it before cleaning up", instanceGroup.VMDiskDir)
+	}
+
+	found, tables, hasRoutes, err := instanceGroup.findLeftovers()
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		printOrphans(instanceGroup, found, tables, hasRoutes)
+		return nil
+	}
+
+	err = instanceGroup.removeLeftovers(found, tables, hasRoutes)
+	if err != nil {
+		return err
+	}
+
+	instanceGroup.logger.Info("Cleaned up.", "slices", len(found.slices), "processes", len(found.processes), "taps", len(found.taps), "files", len(found.files), "tables", len(tables))
+
+	return nil
+}
+
+func loadCleanupConfig(configPath string, name string) (*InstanceGroup, error) {
+	// Read the plugin_config in configPath, given as JSON, for removing what the plugin left on the host without starting it
+
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceGroup := &InstanceGroup{}
+	err = json.Unmarshal(contents, instanceGroup)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", configPath, err)
+	}
+
+	if instanceGroup.VMDiskDir == "" {
+		return nil, fmt.Errorf("no vm_disk_directory in %s", configPath)
+	}
+
+	instanceGroup.logger = hclog.New(&hclog.LoggerOptions{Name: name, Output: os.Stderr})
+	instanceGroup.inventory = NewInventory()
+
+	// Defaults the routing table, the routes of an earlier run are cleaned up without egress_routes too
+	err = instanceGroup.parseEgressRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	return instanceGroup, nil
+}
+
+func (i *InstanceGroup) findLeftovers() (orphans, []string, bool, error) {
+	// Find the instances' leftovers, the nftables tables and whether there are egress routes
+
+	// Nothing is adopted, everything the instances left behind is an orphan
+	found := i.inventory.findOrphans(i)
+
+	var tables []string
+	if !i.usesPasst() {
+		var err error
+		tables, err = findFirewallTables()
+		if err != nil {
+			return orphans{}, nil, false, err
+		}
+	}
+
+	hasRoutes, err := i.hasEgressRoutes()
+	if err != nil {
+		return orphans{}, nil, false, err
+	}
+
+	return found, tables, hasRoutes, nil
+}
+
+func (i *InstanceGroup) removeLeftovers(found orphans, tables []string, hasRoutes bool) error {
+	// Remove what findLeftovers found
+
+	i.inventory.removeOrphans(i, found)
+
+	var errs []error
+
+	if slices.Contains(tables, firewallTableName) {
+		errs = append(errs, i.inventory.RemoveNftables())
+	}
+	if len(tables) > 0 {
+		errs = append(errs, removeLegacyFirewallTables())
+	}
+
+	if hasRoutes {
+		errs = append(errs, i.RemoveEgressRoutes())
+	}
+
+	return errors.Join(errs...)
+}
+
+func findFirewallTables() ([]string, error) {
+	// Get the names of the plugin's nftables table and those of earlier versions which exist
+
+	connection, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	existing, err := connection.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("could not list nftables tables: %w", err)
+	}
+
+	var tables []string
+	for _, table := range existing {
+		if table.Name == firewallTableName && table.Family == nftables.TableFamilyINet {
+			tables = append(tables, table.Name)
+			continue
+		}
+
+		for _, legacyTable := range legacyFirewallTables {
+			if table.Name == legacyTable.Name && table.Family == legacyTable.Family {
+				tables = append(tables, table.Name)
+			}
+		}
+	}
+
+	return tables, nil
+}
+
+func (i *InstanceGroup) hasEgressRoutes() (bool, error) {
+	// Check for routing rules pointing at egress_route_table or routes in it
+
+	rules, err := netlink.RuleList(unix.AF_INET)
+	if err != nil {
+		return false, fmt.Errorf("could not list routing rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		if rule.Table == i.EgressRouteTable {
+			return true, nil
+		}
+	}
+
+	routes, err := netlink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: i.EgressRouteTable}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false, fmt.Errorf("could not list egress routes: %w", err)
+	}
+
+	return len(routes) > 0, nil
+}
+
+func printOrphans(instanceGroup *InstanceGroup, found orphans, tables []string, hasRoutes bool) {
+	// Print what the cleanup would remove, one line each
+
+	lines := []string{}
+	for _, name := range found.slices {
+		lines = append(lines, fmt.Sprintf("slice %s", instanceSliceName(name)))
+	}
+	for _, process := range found.processes {
+		lines = append(lines, fmt.Sprintf("process %d of %s", process.pid, process.instanceName))
+	}
+	for _, name := range found.taps {
+		lines = append(lines, fmt.Sprintf("tap %s", name))
+	}
+	for _, name := range found.files {
+		lines = append(lines, fmt.Sprintf("file %s", filepath.Join(instanceGroup.VMDiskDir, vmWorkdir, name)))
+	}
+	for _, name := range tables {
+		lines = append(lines, fmt.Sprintf("nftables table %s", name))
+	}
+	if hasRoutes {
+		lines = append(lines, fmt.Sprintf("routing rules and routes of table %d", instanceGroup.EgressRouteTable))
+	}
+
+	if len(lines) == 0 {
+		fmt.Println("Nothing to clean up.")
+		return
+	}
+
+	for _, line := range lines {
+		fmt.Println("Would remove " + line)
+	}
+}
@@ -0,0 +1,82 @@
+package fleetingd
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// Fragments are cloud-config documents of their own, cloud-init merges them into the plugin's
+const cloudConfigHeader = "#cloud-config"
+
+// Lists like runcmd and write_files are appended to, keys the plugin sets are never replaced by a fragment
+const cloudConfigMergeType = "list(append)+dict(no_replace,recurse_list)+str()"
+
+func (i *InstanceGroup) checkCloudinitExtraUserdata() error {
+	// Validate the commands and user data fragments for the job instances, the header of the fragments is optional
+
+	if len(i.VMCloudinitExtraCmds) == 0 && len(i.VMCloudinitExtraUserdata) == 0 {
+		return nil
+	}
+
+	if i.usesIgnition() {
+		return fmt.Errorf("vm_cloudinit_extra_cmds and vm_cloudinit_extra_userdata can not be used with distro %s which is provisioned through Ignition", i.Distro)
+	}
+
+	for index, fragment := range i.VMCloudinitExtraUserdata {
+		fragment = strings.TrimSpace(fragment)
+		if fragment == "" || fragment == cloudConfigHeader {
+			return fmt.Errorf("fragment %d of vm_cloudinit_extra_userdata is empty", index+1)
+		}
+
+		// Other kinds of user data, e.g. scripts, would not be merged
+		if strings.HasPrefix(fragment, "#!") {
+			return fmt.Errorf("fragment %d of vm_cloudinit_extra_userdata is not a cloud-config document, use vm_cloudinit_extra_cmds for commands", index+1)
+		}
+	}
+
+	return nil
+}
+
+func mergeUserdataFragments(userData []byte, fragments []string) ([]byte, error) {
+	// Wrap the rendered user data and the fragments into a multipart document, cloud-init merges its parts in order
+
+	var contents bytes.Buffer
+	writer := multipart.NewWriter(&contents)
+
+	fmt.Fprintf(&contents, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", writer.Boundary())
+
+	parts := [][]byte{userData}
+	for _, fragment := range fragments {
+		fragment = strings.TrimSpace(fragment)
+		if !strings.HasPrefix(fragment, cloudConfigHeader) {
+			fragment = cloudConfigHeader + "\n" + fragment
+		}
+		parts = append(parts, []byte(fragment+"\n"))
+	}
+
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "text/cloud-config; charset=\"utf-8\"")
+		header.Set("Merge-Type", cloudConfigMergeType)
+
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = partWriter.Write(part)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not merge vm_cloudinit_extra_userdata: %w", err)
+	}
+
+	return contents.Bytes(), nil
+}
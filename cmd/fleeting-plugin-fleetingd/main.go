@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	fleetingd "github.com/helmholtzcloud/fleeting-plugin-fleetingd"
 	"gitlab.com/gitlab-org/fleeting/fleeting/plugin"
@@ -17,11 +21,349 @@ var license string
 
 func main() {
 	if len(os.Args) > 1 && os.Args[1] == "licenses" {
+		fmt.Println(fleetingd.FullVersion())
 		fmt.Println(licenseNotice)
 		fmt.Println("This software's license:")
 		fmt.Println(license)
 		return
 	}
 
+	// Without --json the fleeting module prints the version
+	if len(os.Args) > 2 && os.Args[1] == "version" && (os.Args[2] == "--json" || os.Args[2] == "-json") {
+		versionJSON()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "console" {
+		console(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && (os.Args[1] == "list" || os.Args[1] == "status") {
+		status(os.Args[1], os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "debug-bundle" {
+		debugBundle(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		render(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		doctor(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "prefetch-images" {
+		prefetchImages(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		cleanup(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "destroy-all" {
+		destroyAll(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "images" {
+		images(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		benchmark(os.Args[2:])
+		return
+	}
+
 	plugin.Main(&fleetingd.InstanceGroup{}, fleetingd.Version)
 }
+
+func versionJSON() {
+	// Print the version as JSON, e.g. fleeting-plugin-fleetingd version --json
+
+	output, err := fleetingd.VersionJSON()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println(string(output))
+}
+
+func console(args []string) {
+	// Attach to the serial port of a running instance, e.g. fleeting-plugin-fleetingd console -vm-disk-directory /tmp/fleetingd fleetingd1
+
+	flags := flag.NewFlagSet("console", flag.ExitOnError)
+	vmDiskDir := flags.String("vm-disk-directory", "/tmp/fleetingd", "vm_disk_directory of the plugin running the instance")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd console [-vm-disk-directory DIR] INSTANCE")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := fleetingd.AttachConsole(*vmDiskDir, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func status(command string, args []string) {
+	// Print the instances of the running plugin, status also prints the slot usage, e.g. fleeting-plugin-fleetingd status -vm-disk-directory /tmp/fleetingd
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	vmDiskDir := flags.String("vm-disk-directory", "/tmp/fleetingd", "vm_disk_directory of the running plugin")
+	asJSON := flags.Bool("json", false, "print the plugin's answer as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: fleeting-plugin-fleetingd %s [-vm-disk-directory DIR] [-json]\n", command)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := fleetingd.PrintStatus(*vmDiskDir, command == "status", *asJSON)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func debugBundle(args []string) {
+	// Collect what a support request needs from the running plugin, e.g. fleeting-plugin-fleetingd debug-bundle -vm-disk-directory /tmp/fleetingd
+
+	flags := flag.NewFlagSet("debug-bundle", flag.ExitOnError)
+	vmDiskDir := flags.String("vm-disk-directory", "/tmp/fleetingd", "vm_disk_directory of the running plugin")
+	output := flags.String("o", "fleetingd-debug.tar.gz", "where to write the bundle")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd debug-bundle [-vm-disk-directory DIR] [-o FILE]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := fleetingd.WriteDebugBundle(*vmDiskDir, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote %s, check it for secrets the redaction missed before sharing it.\n", *output)
+}
+
+func render(args []string) {
+	// Print what an instance would be booted with, e.g. fleeting-plugin-fleetingd render -config plugin_config.json fleetingd1
+
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	config := flags.String("config", "", "plugin_config of the runner as JSON")
+	prebuild := flags.Bool("prebuild", false, "render the prebuild VM's user data instead of a job instance's")
+	output := flags.String("o", "", "directory to write the files to instead of printing them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd render -config FILE [-prebuild] [-o DIR] [INSTANCE]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *config == "" || flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	instanceName := "fleetingd1"
+	if *prebuild {
+		instanceName = "fleetingd0"
+	}
+	if flags.NArg() == 1 {
+		instanceName = flags.Arg(0)
+	}
+
+	err := fleetingd.Render(*config, instanceName, *prebuild, *output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func doctor(args []string) {
+	// Check the host is ready for the plugin before a runner is configured, e.g. fleeting-plugin-fleetingd doctor -config plugin_config.json
+
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	config := flags.String("config", "", "plugin_config of the runner as JSON, the defaults are checked without")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd doctor [-config FILE]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	passed, err := fleetingd.Doctor(*config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if !passed {
+		os.Exit(1)
+	}
+}
+
+func prefetchImages(args []string) {
+	// Download and convert the images before the runner starts the plugin, e.g. fleeting-plugin-fleetingd prefetch-images -config plugin_config.json -prebuild
+
+	flags := flag.NewFlagSet("prefetch-images", flag.ExitOnError)
+	config := flags.String("config", "", "plugin_config of the runner as JSON")
+	prebuild := flags.Bool("prebuild", false, "also run the prebuild and keep its result as the golden image")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd prefetch-images -config FILE [-prebuild]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *config == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// Interrupting stops a download or the prebuild VM and cleans up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := fleetingd.PrefetchImages(ctx, *config, *prebuild)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func cleanup(args []string) {
+	// Remove the taps, processes, files and rules a crashed plugin left behind, e.g. fleeting-plugin-fleetingd cleanup -config plugin_config.json -dry-run
+
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	config := flags.String("config", "", "plugin_config of the runner as JSON")
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd cleanup -config FILE [-dry-run]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *config == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := fleetingd.Cleanup(*config, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func benchmark(args []string) {
+	// Measure how long instances take to boot, e.g. fleeting-plugin-fleetingd benchmark -config plugin_config.json -n 10
+
+	flags := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	config := flags.String("config", "", "plugin_config of the runner as JSON")
+	count := flags.Int("n", 5, "how many instances to boot")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd benchmark -config FILE [-n COUNT]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *config == "" || *count < 1 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// Interrupting stops the boots and tears the instances down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := fleetingd.Benchmark(ctx, *config, *count)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func destroyAll(args []string) {
+	// Destroy every instance when the runner is wedged, e.g. fleeting-plugin-fleetingd destroy-all -config plugin_config.json
+
+	flags := flag.NewFlagSet("destroy-all", flag.ExitOnError)
+	config := flags.String("config", "", "plugin_config of the runner as JSON")
+	force := flags.Bool("force", false, "destroy the instances even while the plugin is running")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd destroy-all -config FILE [-force]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *config == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := fleetingd.DestroyAll(*config, *force)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func images(args []string) {
+	// List or remove the cached images, e.g. fleeting-plugin-fleetingd images -config plugin_config.json -remove golden-0123456789abcdef.img
+
+	flags := flag.NewFlagSet("images", flag.ExitOnError)
+	config := flags.String("config", "", "plugin_config of the runner as JSON")
+	offline := flags.Bool("offline", false, "don't check upstream for newer images")
+	var remove []string
+	flags.Func("remove", "remove an image file from the listing, can be repeated", func(name string) error {
+		remove = append(remove, name)
+		return nil
+	})
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: fleeting-plugin-fleetingd images -config FILE [-offline] [-remove NAME]...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *config == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := fleetingd.Images(ctx, *config, *offline, remove)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
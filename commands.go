@@ -0,0 +1,133 @@
+package fleetingd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// Limit of short-lived tools like ip, tc, nft and systemctl, a hanging one must not block a boot or removal forever
+	defaultCommandTimeout = 2 * time.Minute
+
+	// Only the context limits the command, e.g. a conversion of a large image
+	noCommandTimeout time.Duration = -1
+
+	// How much of a failed command's error output is included in its error, the end explains the failure
+	maxCommandErrorOutput = 4096
+)
+
+// Runs the host tools the plugin shells out to, replaced to record or fake the commands
+var hostCommands commandRunner = &execRunner{logger: hclog.NewNullLogger()}
+
+// A command run to completion on the host
+type hostCommand struct {
+	// The program, looked up in PATH, and its arguments
+	Args []string
+	// Fed to the command's standard input if set
+	Stdin io.Reader
+	// Receives the standard output instead of it being returned, e.g. an uncompressed image
+	Stdout io.Writer
+	// How long the command may run, 0 uses defaultCommandTimeout
+	Timeout time.Duration
+}
+
+type commandRunner interface {
+	// Run a command and return its standard output, errors carry what it wrote to standard error
+	Run(ctx context.Context, command hostCommand) ([]byte, error)
+}
+
+// Error of a command which could not be started, failed or timed out
+type commandError struct {
+	Args   []string
+	Err    error
+	Stderr []byte
+}
+
+func (e *commandError) Error() string {
+	// Name the command and why it failed, secrets in its arguments or output are redacted
+
+	message := fmt.Sprintf("%s failed: %s", commandLine(e.Args), e.Err)
+
+	stderr := bytes.TrimSpace(e.Stderr)
+	if len(stderr) > maxCommandErrorOutput {
+		stderr = append([]byte("..."), stderr[len(stderr)-maxCommandErrorOutput:]...)
+	}
+	if len(stderr) > 0 {
+		message += ": " + string(redactSecrets(stderr))
+	}
+
+	return message
+}
+
+func (e *commandError) Unwrap() error {
+	return e.Err
+}
+
+type execRunner struct {
+	logger hclog.Logger
+}
+
+func (r *execRunner) Run(ctx context.Context, command hostCommand) ([]byte, error) {
+	// Run a command with a timeout, log it and collect its output
+
+	if len(command.Args) == 0 {
+		return nil, errors.New("no command given")
+	}
+
+	timeout := command.Timeout
+	if timeout == 0 {
+		timeout = defaultCommandTimeout
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command.Args[0], command.Args[1:]...)
+	cmd.Stdin = command.Stdin
+	cmd.Stdout = &stdout
+	if command.Stdout != nil {
+		cmd.Stdout = command.Stdout
+	}
+	cmd.Stderr = &stderr
+
+	startedAt := time.Now()
+	err := cmd.Run()
+	duration := time.Since(startedAt)
+
+	if err != nil {
+		if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s: %w", timeout, err)
+		}
+
+		r.logger.Debug("command failed", "argv", commandLine(command.Args), "duration", duration, "error", err)
+		return stdout.Bytes(), &commandError{Args: command.Args, Err: err, Stderr: stderr.Bytes()}
+	}
+
+	r.logger.Debug("command finished", "argv", commandLine(command.Args), "duration", duration)
+
+	return stdout.Bytes(), nil
+}
+
+func commandLine(args []string) string {
+	// Get a command as it is logged, with secrets among its arguments redacted
+
+	return string(redactSecrets([]byte(strings.Join(args, " "))))
+}
+
+func runCommand(ctx context.Context, args ...string) ([]byte, error) {
+	// Run a short-lived command with the default timeout
+
+	return hostCommands.Run(ctx, hostCommand{Args: args})
+}
@@ -0,0 +1,122 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+const confidentialComputingSEVSNP = "sev-snp"
+const confidentialComputingTDX = "tdx"
+
+func (i *InstanceGroup) checkConfidentialComputing() error {
+	// Check the host is able to run the requested kind of confidential VMs
+
+	if i.VMConfidentialComputing != "" && runtime.GOARCH != archAMD64 {
+		return fmt.Errorf("vm_confidential_computing %s is only supported on %s hosts", i.VMConfidentialComputing, archAMD64)
+	}
+
+	switch i.VMConfidentialComputing {
+	case "":
+		return nil
+	case confidentialComputingSEVSNP:
+		enabled, err := readKernelModuleParameter("kvm_amd", "sev_snp")
+		if err != nil || !enabled {
+			return errors.New("vm_confidential_computing is set to sev-snp but SEV-SNP is not enabled in kvm_amd, please check the CPU, firmware and host kernel support it")
+		}
+
+		_, err = os.Stat("/dev/sev")
+		if err != nil {
+			return fmt.Errorf("vm_confidential_computing is set to sev-snp but the SEV device is not available: %w", err)
+		}
+	case confidentialComputingTDX:
+		enabled, err := readKernelModuleParameter("kvm_intel", "tdx")
+		if err != nil || !enabled {
+			return errors.New("vm_confidential_computing is set to tdx but TDX is not enabled in kvm_intel, please check the CPU, firmware and host kernel support it")
+		}
+	default:
+		return fmt.Errorf("unknown vm_confidential_computing mode '%s', must be one of: %s, %s", i.VMConfidentialComputing, confidentialComputingSEVSNP, confidentialComputingTDX)
+	}
+
+	// Confidential guests are started through firmware supplied by the operator (IGVM file for SEV-SNP, TDVF for TDX)
+	if i.VMConfidentialFirmware == "" {
+		return fmt.Errorf("vm_confidential_computing is set to %s but no vm_confidential_firmware was configured", i.VMConfidentialComputing)
+	}
+
+	_, err := os.Stat(i.VMConfidentialFirmware)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as vm_confidential_firmware but can not be accessed: %w", i.VMConfidentialFirmware, err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) platformHypervisorArgs(kernelFilePath string, pmemRoot bool, extraCmdline string) []string {
+	// Get the hypervisor arguments for booting the guest kernel on the configured platform, extraCmdline is appended to the kernel's command line
+
+	cmdline := i.kernelCmdline(pmemRoot)
+	if extraCmdline != "" {
+		cmdline += " " + extraCmdline
+	}
+
+	switch i.VMConfidentialComputing {
+	case confidentialComputingSEVSNP:
+		// The kernel is part of the IGVM image, the balloon can't be used as guest memory is encrypted
+		return []string{
+			"--igvm",
+			i.VMConfidentialFirmware,
+			"--cmdline",
+			cmdline,
+			"--platform",
+			"sev_snp=on",
+		}
+	case confidentialComputingTDX:
+		return []string{
+			"--firmware",
+			i.VMConfidentialFirmware,
+			"--kernel",
+			kernelFilePath,
+			"--cmdline",
+			cmdline,
+			"--platform",
+			"tdx=on",
+		}
+	}
+
+	// Images without a separate kernel are started through their own bootloader
+	if !i.bootsKernel() {
+		return []string{
+			"--firmware",
+			i.VMFirmware,
+			"--balloon",
+			"size=0,free_page_reporting=on",
+		}
+	}
+
+	return []string{
+		"--kernel",
+		kernelFilePath,
+		"--cmdline",
+		cmdline,
+		"--balloon",
+		"size=0,free_page_reporting=on",
+	}
+}
+
+func readKernelModuleParameter(module string, parameter string) (bool, error) {
+	// Read a boolean kernel module parameter (Y/N or 1/0)
+
+	value, err := os.ReadFile(fmt.Sprintf("/sys/module/%s/parameters/%s", module, parameter))
+	if err != nil {
+		return false, err
+	}
+
+	switch strings.TrimSpace(string(value)) {
+	case "Y", "y", "1":
+		return true, nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,91 @@
+package fleetingd
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+)
+
+// Filesystems of the config drive, some images' cloud-init builds only probe ISO9660 volumes for NoCloud
+const (
+	configDriveFormatFAT32   = "fat32"
+	configDriveFormatISO9660 = "iso9660"
+)
+
+// Blocks of an ISO9660 volume are 2 kB, which the guests' kernels read without a partition table
+const isoBlockSize = 2048
+
+func (i *InstanceGroup) checkConfigDriveFormat() error {
+	// Validate vm_config_drive_format, empty keeps the one of the image profile
+
+	switch i.VMConfigDriveFormat {
+	case "", configDriveFormatFAT32, configDriveFormatISO9660:
+		return nil
+	}
+
+	return fmt.Errorf("unknown vm_config_drive_format '%s', must be one of: %s, %s", i.VMConfigDriveFormat, configDriveFormatFAT32, configDriveFormatISO9660)
+}
+
+func (i *InstanceGroup) configDriveFormat() string {
+	// Get the filesystem of the config drives, vm_config_drive_format wins over the image profile
+
+	if i.VMConfigDriveFormat != "" {
+		return i.VMConfigDriveFormat
+	}
+
+	if i.imageProfile.ConfigDriveFormat != "" {
+		return i.imageProfile.ConfigDriveFormat
+	}
+
+	return configDriveFormatFAT32
+}
+
+func writeISOConfigDrive(drivePath string, volumeLabel string, files []renderedFile) error {
+	// Write rendered files to an ISO9660 volume with Rock Ridge names, the files are staged in a temporary directory until the volume is finalized
+
+	diskFile, err := file.CreateFromPath(drivePath, 10*1024*1024)
+	if err != nil {
+		return err
+	}
+	defer diskFile.Close()
+
+	// The drive carries the guest's SSH host key
+	err = os.Chmod(drivePath, 0600)
+	if err != nil {
+		return err
+	}
+
+	fs, err := iso9660.Create(diskFile, 0, 0, isoBlockSize, "")
+	if err != nil {
+		return err
+	}
+
+	directories := map[string]bool{"/": true}
+	for _, renderedFile := range files {
+		directory := path.Dir(renderedFile.Name)
+		if !directories[directory] {
+			err = fs.Mkdir(directory)
+			if err != nil {
+				return err
+			}
+			directories[directory] = true
+		}
+
+		driveFile, err := fs.OpenFile(renderedFile.Name, os.O_RDWR|os.O_CREATE)
+		if err != nil {
+			return err
+		}
+
+		_, err = driveFile.Write(renderedFile.Contents)
+		driveFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Without Rock Ridge the names would be cut down to upper case 8.3 ones cloud-init doesn't look for
+	return fs.Finalize(iso9660.FinalizeOptions{RockRidge: true, VolumeIdentifier: volumeLabel})
+}
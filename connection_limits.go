@@ -0,0 +1,170 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// Maps the instances' taps to their connection limit chains
+const firewallConnectionLimitMapName = "connlimits"
+
+func (i *InstanceGroup) checkConnectionLimits() error {
+	// Validate the per-instance connection limits, they need the host's conntrack to see the guests' traffic
+
+	if !i.connectionLimitsEnabled() {
+		return nil
+	}
+
+	// Bridged traffic bypasses the host's conntrack and passt has no nftables rules
+	if i.isBridged() || i.usesPasst() {
+		return errors.New("vm_net_max_connections and vm_net_new_connections_per_second can only be used with network_mode nat")
+	}
+
+	if i.VMNetMaxConnections > 1<<32-1 || i.VMNetNewConnectionsPerSecond > 1<<32-1 {
+		return errors.New("vm_net_max_connections and vm_net_new_connections_per_second must fit into 32 bits")
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) connectionLimitsEnabled() bool {
+	return i.VMNetMaxConnections > 0 || i.VMNetNewConnectionsPerSecond > 0
+}
+
+func firewallConnectionLimitMap() *nftables.Set {
+	return &nftables.Set{
+		Table:    firewallTable(),
+		Name:     firewallConnectionLimitMapName,
+		IsMap:    true,
+		KeyType:  nftables.TypeIFName,
+		DataType: nftables.TypeVerdict,
+	}
+}
+
+func connectionLimitChainName(instanceName string) string {
+	return "limits_" + instanceName
+}
+
+func matchNewConnection() []expr.Any {
+	// ct state new
+
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func (i *InstanceGroup) addConnectionLimitRules(connection nftablesBatch, table *nftables.Table) error {
+	// Queue the chain sending the guests' traffic to their limit chains, instances add their tap to the map
+
+	if !i.connectionLimitsEnabled() {
+		return nil
+	}
+
+	connectionLimitMap := firewallConnectionLimitMap()
+	err := connection.AddSet(connectionLimitMap, nil)
+	if err != nil {
+		return err
+	}
+
+	// Prerouting sees the connections to the host as well as the forwarded ones, conntrack already ran by then
+	chain := connection.AddChain(&nftables.Chain{
+		Name:     "guestlimits",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityFilter,
+	})
+
+	// ct state new iifname vmap @connlimits
+	addRule(connection, chain,
+		matchNewConnection(),
+		[]expr.Any{
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: connectionLimitMap.Name, SetID: connectionLimitMap.ID},
+		})
+
+	return nil
+}
+
+func (i *InstanceGroup) addInstanceConnectionLimits(connection nftablesBatch, instance *InstanceInfo) error {
+	// Queue the limit chain of an instance and map its tap to it, the counters in its rules only see the instance's connections
+
+	if !i.connectionLimitsEnabled() {
+		return nil
+	}
+
+	chain := connection.AddChain(&nftables.Chain{
+		Name:  connectionLimitChainName(instance.Name),
+		Table: firewallTable(),
+	})
+
+	// ct count over max drop
+	if i.VMNetMaxConnections > 0 {
+		addRule(connection, chain,
+			[]expr.Any{&expr.Connlimit{Count: uint32(i.VMNetMaxConnections), Flags: expr.NFT_CONNLIMIT_F_INV}},
+			drop())
+	}
+
+	// limit rate over rate/second burst rate packets drop
+	if i.VMNetNewConnectionsPerSecond > 0 {
+		addRule(connection, chain,
+			[]expr.Any{&expr.Limit{
+				Type:  expr.LimitTypePkts,
+				Rate:  i.VMNetNewConnectionsPerSecond,
+				Unit:  expr.LimitTimeSecond,
+				Burst: uint32(i.VMNetNewConnectionsPerSecond),
+				Over:  true,
+			}},
+			drop())
+	}
+
+	return connection.SetAddElements(firewallConnectionLimitMap(), []nftables.SetElement{{
+		Key:         interfaceName(instance.Name),
+		VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name},
+	}})
+}
+
+func (i *InstanceGroup) removeInstanceConnectionLimits(connection *nftables.Conn, instanceName string) error {
+	// Queue removing the limit chain of an instance, the map element referencing it goes first
+
+	if !i.connectionLimitsEnabled() {
+		return nil
+	}
+
+	connectionLimitMap := firewallConnectionLimitMap()
+	elements, err := connection.GetSetElements(connectionLimitMap)
+	if err != nil {
+		return fmt.Errorf("could not list nftables connection limit map: %w", err)
+	}
+
+	key := interfaceName(instanceName)
+	for _, element := range elements {
+		if string(element.Key) == string(key) {
+			err = connection.SetDeleteElements(connectionLimitMap, []nftables.SetElement{{Key: key}})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	chain, err := connection.ListChain(firewallTable(), connectionLimitChainName(instanceName))
+	if err == nil && chain != nil {
+		connection.FlushChain(chain)
+		connection.DelChain(chain)
+	}
+
+	return nil
+}
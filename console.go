@@ -0,0 +1,207 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloud-hypervisor writes an instance's virtio console here, the plugin moves it into the instance's console log
+const consoleRawFileName = "console.raw"
+
+const defaultConsoleLogMaxSizeKilobytes = 1024
+const defaultConsoleLogMaxFiles = 2
+
+// The end of an instance's console kept in memory, it is logged when the instance fails
+const consoleTailSize = 16 * 1024
+
+// How often the console is checked for new output
+const consoleCaptureInterval = 250 * time.Millisecond
+
+// Moves an instance's console output into its rotated console log while keeping the end of it in memory
+type consoleCapture struct {
+	rawPath string
+	log     rotatingFile
+	tail    outputTail
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (i *InstanceGroup) getConsoleRawPath(instanceName string) string {
+	return filepath.Join(i.getInstanceDir(instanceName), consoleRawFileName)
+}
+
+func isConsoleLogName(name string) bool {
+	// Tell console logs and their rotated copies, e.g. fleetingd3_console.1, apart from other instance files
+
+	return strings.HasSuffix(name, "_console") || strings.Contains(name, "_console.")
+}
+
+func removeRotatedFile(path string) error {
+	// Remove a log together with its rotated copies
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, file := range append([]string{path}, rotated...) {
+		err = os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (i *InstanceGroup) startConsoleCapture(instanceContext context.Context, instanceName string, fresh bool) *consoleCapture {
+	// Capture an instance's console until its context ends, a freshly booted instance replaces the log of the slot's previous one
+
+	logPath := i.getConsolePath(instanceName)
+	if fresh {
+		err := removeRotatedFile(logPath)
+		if err != nil {
+			i.logger.Error("could not remove console log of the slot's previous instance", "instance", instanceName, "error", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(instanceContext)
+
+	capture := &consoleCapture{
+		rawPath: i.getConsoleRawPath(instanceName),
+		log: rotatingFile{
+			path:     logPath,
+			maxSize:  int64(i.VMConsoleLogMaxSizeKilobytes) * 1024,
+			maxFiles: int(i.VMConsoleLogMaxFiles),
+		},
+		tail:   outputTail{size: consoleTailSize},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(capture.done)
+
+		err := capture.run(ctx)
+		if err != nil {
+			i.logger.Error("could not capture console", "instance", instanceName, "error", err)
+		}
+	}()
+
+	return capture
+}
+
+func (c *consoleCapture) stop() {
+	// Stop capturing once the output written so far was moved, adopted instances of earlier versions have no capture
+
+	if c == nil {
+		return
+	}
+
+	c.cancel()
+	<-c.done
+}
+
+func (c *consoleCapture) lastLines(count int) string {
+	// Get the last lines of the console kept in memory
+
+	if c == nil {
+		return ""
+	}
+
+	lines := strings.Split(c.tail.String(), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (c *consoleCapture) run(ctx context.Context) error {
+	// Follow the hypervisor's console file, the moved output is punched out of it so it doesn't take up space until the instance is gone
+
+	defer c.log.Close()
+
+	// The hypervisor creates the file once it is up
+	var raw *os.File
+	for raw == nil {
+		var err error
+		raw, err = os.OpenFile(c.rawPath, os.O_RDWR, 0)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(consoleCaptureInterval):
+				continue
+			}
+		}
+	}
+	defer raw.Close()
+
+	// An earlier plugin process punched out what it moved, an adopted instance's capture continues after it
+	offset, err := raw.Seek(0, unix.SEEK_DATA)
+	if err != nil {
+		offset, err = raw.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+	}
+
+	buffer := make([]byte, 64*1024)
+	stopping := false
+
+	for {
+		n, err := raw.Read(buffer)
+		if n > 0 {
+			c.tail.Write(buffer[:n])
+
+			_, err = c.log.Write(buffer[:n])
+			if err != nil {
+				return fmt.Errorf("could not write console log: %w", err)
+			}
+
+			offset += int64(n)
+
+			// The file keeps its size, so the hypervisor's offset stays valid, filesystems without hole punching keep the blocks
+			_ = unix.Fallocate(int(raw.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, offset)
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		// Whatever was written before the instance was stopped has been moved
+		if stopping {
+			return nil
+		}
+
+		// A restarted hypervisor starts the file over
+		info, err := raw.Stat()
+		if err == nil && info.Size() < offset {
+			offset, err = raw.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			stopping = true
+		case <-time.After(consoleCaptureInterval):
+		}
+	}
+}
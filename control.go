@@ -0,0 +1,241 @@
+package fleetingd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// Always created in vm_disk_directory, the list, status and debug-bundle commands ask the running plugin through it
+const controlSocketFileName = "control.sock"
+
+// An instance as the plugin sees it
+type controlInstance struct {
+	Name     string         `json:"name"`
+	State    provider.State `json:"state"`
+	Internal bool           `json:"internal"`
+	Paused   bool           `json:"paused"`
+
+	IP                 string `json:"ip"`
+	IP6                string `json:"ip6,omitempty"`
+	ExternalSSHAddress string `json:"external_ssh_address,omitempty"`
+	SSHHostKey         string `json:"ssh_host_key,omitempty"`
+
+	CreatedAt     time.Time `json:"created_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+
+	FailureReason string `json:"failure_reason,omitempty"`
+
+	// Last report of vm_guest_agent
+	Guest *guestStatus `json:"guest,omitempty"`
+}
+
+// What the plugin thinks exists right now, sorted by name
+type controlStatus struct {
+	Instances []controlInstance `json:"instances"`
+	SlotsUsed int               `json:"slots_used"`
+	Slots     int               `json:"slots"`
+}
+
+func (i *InstanceGroup) collectControlStatus() controlStatus {
+	// List the instances of the inventory and the used subnets
+
+	now := time.Now()
+
+	i.inventory.lock.RLock()
+	status := controlStatus{
+		Instances: []controlInstance{},
+		SlotsUsed: i.inventory.ipam.Count(),
+		Slots:     i.maxIPAMSlots(),
+	}
+	for _, instance := range i.inventory.instances {
+		status.Instances = append(status.Instances, controlInstance{
+			Name:               instance.Name,
+			State:              instance.State,
+			Internal:           instance.Internal,
+			Paused:             instance.Paused,
+			IP:                 instance.InstanceTapIP,
+			IP6:                instance.InstanceTapIP6,
+			ExternalSSHAddress: instance.ExternalSSHAddress,
+			SSHHostKey:         instance.SSHHostPublicKey,
+			CreatedAt:          instance.CreatedAt,
+			UptimeSeconds:      now.Sub(instance.CreatedAt).Seconds(),
+			FailureReason:      instance.FailureReason,
+			Guest:              instance.GuestStatus,
+		})
+	}
+	i.inventory.lock.RUnlock()
+
+	slices.SortFunc(status.Instances, func(a controlInstance, b controlInstance) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return status
+}
+
+func (i *InstanceGroup) serveControlStatus(w http.ResponseWriter, r *http.Request) {
+	// List the instances as JSON for the list and status commands
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(i.collectControlStatus())
+}
+
+func (i *InstanceGroup) serveControlSocket() error {
+	// Serve the plugin's view of its instances and debug bundles on a unix socket in vm_disk_directory
+
+	socketPath := filepath.Join(i.VMDiskDir, controlSocketFileName)
+
+	listener, err := listenUnixSocket(socketPath)
+	if err != nil {
+		return fmt.Errorf("could not listen on the control socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", i.serveControlStatus)
+	mux.HandleFunc("GET /debug-bundle", i.serveDebugBundle)
+
+	i.serveHTTP(listener, mux)
+
+	i.logger.Debug("serving control socket", "socket", socketPath)
+
+	return nil
+}
+
+func newControlClient(vmDiskDir string) *http.Client {
+	// Create a client for the control socket of the plugin using vmDiskDir, the host part of URLs is ignored by the socket dialer
+
+	socketPath := filepath.Join(vmDiskDir, controlSocketFileName)
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+func requestControlStatus(vmDiskDir string) (controlStatus, error) {
+	// Ask the plugin using vmDiskDir for its instances
+
+	response, err := newControlClient(vmDiskDir).Get("http://localhost/status")
+	if err != nil {
+		return controlStatus{}, fmt.Errorf("could not connect to the control socket in %s, is the plugin running?: %w", vmDiskDir, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return controlStatus{}, fmt.Errorf("plugin answered with status %s", response.Status)
+	}
+
+	var status controlStatus
+	err = json.NewDecoder(response.Body).Decode(&status)
+	if err != nil {
+		return controlStatus{}, fmt.Errorf("could not parse the plugin's answer: %w", err)
+	}
+
+	return status, nil
+}
+
+func PrintStatus(vmDiskDir string, summary bool, asJSON bool) error {
+	// Print the instances of the plugin using vmDiskDir as a table, summary adds the slot usage first
+
+	status, err := requestControlStatus(vmDiskDir)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+
+	if summary {
+		writeStatusSummary(os.Stdout, status)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tSTATE\tIP\tUPTIME\tNOTES")
+	for _, instance := range status.Instances {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", instance.Name, instance.State, instance.IP, formatUptime(instance.UptimeSeconds), instanceNotes(instance))
+	}
+
+	return writer.Flush()
+}
+
+func writeStatusSummary(w io.Writer, status controlStatus) {
+	// Count the instances by state, the plugin's own VMs separately
+
+	jobs := 0
+	internal := 0
+	states := map[provider.State]int{}
+	for _, instance := range status.Instances {
+		if instance.Internal {
+			internal++
+			continue
+		}
+		jobs++
+		states[instance.State]++
+	}
+
+	var counts []string
+	for _, state := range slices.Sorted(maps.Keys(states)) {
+		counts = append(counts, fmt.Sprintf("%d %s", states[state], state))
+	}
+
+	fmt.Fprintf(w, "Slots:     %d of %d used (%.0f%%)\n", status.SlotsUsed, status.Slots, 100*float64(status.SlotsUsed)/float64(status.Slots))
+	counted := ""
+	if len(counts) > 0 {
+		counted = fmt.Sprintf(" (%s)", strings.Join(counts, ", "))
+	}
+
+	fmt.Fprintf(w, "Instances: %d%s, %d internal\n\n", jobs, counted, internal)
+}
+
+func formatUptime(seconds float64) string {
+	// Print an uptime in whole seconds, e.g. 1h2m3s
+
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func instanceNotes(instance controlInstance) string {
+	// Mention what the state alone doesn't tell, e.g. that an instance is the prebuild VM or paused
+
+	var notes []string
+	if instance.Internal {
+		notes = append(notes, "internal")
+	}
+	if instance.Paused {
+		notes = append(notes, "paused")
+	}
+	if instance.ExternalSSHAddress != "" {
+		notes = append(notes, "ssh "+instance.ExternalSSHAddress)
+	}
+	if instance.Guest != nil {
+		notes = append(notes, fmt.Sprintf("cloud-init %s, load %.2f, %d MB available", instance.Guest.CloudInit, instance.Guest.Load1, instance.Guest.MemoryAvailableKB/1024))
+	}
+	if instance.FailureReason != "" {
+		notes = append(notes, instance.FailureReason)
+	}
+
+	return strings.Join(notes, ", ")
+}
@@ -0,0 +1,101 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Written next to the decompressed image, e.g. image_decompressed.img_conversion.json
+const conversionStampSuffix = "_conversion.json"
+
+// What a decompressed image was converted from and what it looked like afterwards, the prebuild boots it and so changes it
+type conversionStamp struct {
+	SourceChecksum string    `json:"source_checksum"`
+	DiskSizeGB     uint64    `json:"disk_size_gb"`
+	DiskFormat     string    `json:"disk_format"`
+	ImageConverter string    `json:"image_converter"`
+	Checksum       string    `json:"checksum"`
+	Size           int64     `json:"size"`
+	ModTime        time.Time `json:"mod_time"`
+}
+
+func (i *InstanceGroup) currentConversionStamp() conversionStamp {
+	// Get the stamp of a conversion of the current disk image, without the converted image's properties
+
+	return conversionStamp{
+		SourceChecksum: i.goldenImageInputs.DiskImageChecksum,
+		DiskSizeGB:     i.VMDiskSizeGB,
+		DiskFormat:     i.VMDiskFormat,
+		ImageConverter: i.VMImageConverter,
+	}
+}
+
+func (i *InstanceGroup) findConvertedImage(decompressedPath string) (imageIntegrity, bool, error) {
+	// Check if the decompressed image was converted from the current disk image and left untouched since
+
+	contents, err := os.ReadFile(decompressedPath + conversionStampSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return imageIntegrity{}, false, nil
+	}
+	if err != nil {
+		return imageIntegrity{}, false, err
+	}
+
+	var stamp conversionStamp
+	err = json.Unmarshal(contents, &stamp)
+	if err != nil {
+		i.logger.Warn("ignoring unreadable conversion stamp", "path", decompressedPath+conversionStampSuffix, "error", err)
+		return imageIntegrity{}, false, nil
+	}
+
+	current := i.currentConversionStamp()
+	if stamp.SourceChecksum != current.SourceChecksum || stamp.DiskSizeGB != current.DiskSizeGB || stamp.DiskFormat != current.DiskFormat || stamp.ImageConverter != current.ImageConverter {
+		return imageIntegrity{}, false, nil
+	}
+
+	// A prebuild which didn't finish leaves a booted image behind
+	integrity := imageIntegrity{Path: decompressedPath, Checksum: stamp.Checksum, Size: stamp.Size, ModTime: stamp.ModTime}
+	err = integrity.verify(i.VMImageVerifyFull)
+	if err != nil {
+		i.logger.Info("Decompressed image changed since it was converted, converting it again.", "path", decompressedPath)
+		return imageIntegrity{}, false, nil
+	}
+
+	return integrity, true, nil
+}
+
+func (i *InstanceGroup) writeConversionStamp(integrity imageIntegrity) error {
+	// Stamp a freshly converted and resized image, so a restart doesn't convert it again
+
+	stamp := i.currentConversionStamp()
+	stamp.Checksum = integrity.Checksum
+	stamp.Size = integrity.Size
+	stamp.ModTime = integrity.ModTime
+
+	contents, err := json.MarshalIndent(stamp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(integrity.Path+conversionStampSuffix, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write conversion stamp: %w", err)
+	}
+
+	return nil
+}
+
+func removeConversionStamp(decompressedPath string) error {
+	// Remove the stamp of an image which is about to be converted again or was turned into a golden image
+
+	err := os.Remove(decompressedPath + conversionStampSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,331 @@
+package fleetingd
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cosign stores the signatures and attestations of sha256:<digest> under the tags sha256-<digest>.sig and .att,
+// signatures of files are published next to them with the same suffixes
+const cosignSignatureSuffix = ".sig"
+const cosignAttestationSuffix = ".att"
+
+const cosignMediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+const cosignMediaTypeDSSE = "application/vnd.dsse.envelope.v1+json"
+const cosignAnnotationSignature = "dev.cosignproject.cosign/signature"
+
+const inTotoPayloadType = "application/vnd.in-toto+json"
+
+// Signatures, attestations and their payloads are small, anything larger is not one
+const cosignMaxSize = 4 * 1024 * 1024
+
+// Payload of an image signature, naming the manifest digest the signature is valid for
+type cosignSimpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// Signed envelope of an attestation, the signature covers its pre-authentication encoding
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		Sig string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// in-toto statement of an attestation, naming the digests of the artifacts it is about
+type inTotoStatement struct {
+	Subject []struct {
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+}
+
+func (i *InstanceGroup) checkCosignKey() error {
+	// Load the public key disk images have to be signed with
+
+	if i.VMImageCosignKey == "" {
+		if i.VMImageCosignAttestation {
+			return errors.New("vm_image_cosign_attestation requires vm_image_cosign_key")
+		}
+		return nil
+	}
+
+	keyData, err := os.ReadFile(i.VMImageCosignKey)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as vm_image_cosign_key but can not be accessed: %w", i.VMImageCosignKey, err)
+	}
+
+	i.cosignKey, err = parseCosignPublicKey(keyData)
+	if err != nil {
+		return fmt.Errorf("invalid vm_image_cosign_key '%s': %w", i.VMImageCosignKey, err)
+	}
+
+	return nil
+}
+
+func parseCosignPublicKey(keyData []byte) (crypto.PublicKey, error) {
+	// Parse a PEM encoded ECDSA or RSA public key as written by cosign generate-key-pair
+
+	block, _ := pem.Decode(keyData)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, supported are ECDSA and RSA keys", key)
+	}
+}
+
+func verifyCosignSignature(key crypto.PublicKey, digest []byte, signature []byte) error {
+	// Verify a signature over the SHA256 digest of a message
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature)
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+func verifyDSSEEnvelope(key crypto.PublicKey, envelopeData []byte, subjectDigest string) error {
+	// Verify an attestation's envelope and check its statement is about the artifact with the given SHA256 digest
+
+	var envelope dsseEnvelope
+	err := json.Unmarshal(envelopeData, &envelope)
+	if err != nil {
+		return fmt.Errorf("could not parse attestation: %w", err)
+	}
+
+	if envelope.PayloadType != inTotoPayloadType {
+		return fmt.Errorf("attestation has payload type '%s' instead of %s", envelope.PayloadType, inTotoPayloadType)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return fmt.Errorf("could not decode attestation payload: %w", err)
+	}
+
+	// DSSE signs "DSSEv1 <len(type)> <type> <len(payload)> <payload>" to bind the payload type
+	encoding := fmt.Appendf(nil, "DSSEv1 %d %s %d ", len(envelope.PayloadType), envelope.PayloadType, len(payload))
+	digest := sha256.Sum256(append(encoding, payload...))
+
+	verified := false
+	for _, signature := range envelope.Signatures {
+		signatureData, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err == nil && verifyCosignSignature(key, digest[:], signatureData) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("no signature of the attestation matches vm_image_cosign_key")
+	}
+
+	var statement inTotoStatement
+	err = json.Unmarshal(payload, &statement)
+	if err != nil {
+		return fmt.Errorf("could not parse attestation statement: %w", err)
+	}
+
+	for _, subject := range statement.Subject {
+		if strings.EqualFold(subject.Digest["sha256"], subjectDigest) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("attestation is not about sha256:%s", subjectDigest)
+}
+
+func (i *InstanceGroup) verifyRegistryImageCosign(ctx context.Context, reference ociReference, manifestDigest string, header http.Header) error {
+	// Verify the signature or attestation cosign stored next to the artifact in the registry
+
+	suffix := cosignSignatureSuffix
+	mediaType := cosignMediaTypeSimpleSigning
+	if i.VMImageCosignAttestation {
+		suffix = cosignAttestationSuffix
+		mediaType = cosignMediaTypeDSSE
+	}
+
+	tag := strings.Replace(manifestDigest, ":", "-", 1) + suffix
+
+	manifest, _, err := i.fetchOCIManifest(ctx, reference, tag, header)
+	if err != nil {
+		return fmt.Errorf("could not find a cosign %s of %s%s/%s@%s: %w", i.cosignKind(), ociScheme, reference.Registry, reference.Repository, manifestDigest, err)
+	}
+
+	// Signing again adds a layer, any of them has to be valid
+	var errs []error
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != mediaType {
+			continue
+		}
+
+		payload, err := i.fetchOCIBlob(ctx, reference, layer.Digest, header, cosignMaxSize)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if i.VMImageCosignAttestation {
+			err = verifyDSSEEnvelope(i.cosignKey, payload, strings.TrimPrefix(manifestDigest, "sha256:"))
+		} else {
+			err = verifySimpleSigning(i.cosignKey, payload, layer.Annotations[cosignAnnotationSignature], manifestDigest)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		i.logger.Info("Disk image "+i.cosignKind()+" verified.", "digest", manifestDigest)
+		return nil
+	}
+
+	if len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("%s has no %s layers", tag, mediaType))
+	}
+
+	return fmt.Errorf("cosign %s of %s%s/%s@%s could not be verified, refusing to use it: %w", i.cosignKind(), ociScheme, reference.Registry, reference.Repository, manifestDigest, errors.Join(errs...))
+}
+
+func verifySimpleSigning(key crypto.PublicKey, payload []byte, encodedSignature string, manifestDigest string) error {
+	// Verify an image signature's payload and check it names the signed manifest
+
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return fmt.Errorf("could not decode signature: %w", err)
+	}
+
+	digest := sha256.Sum256(payload)
+	err = verifyCosignSignature(key, digest[:], signature)
+	if err != nil {
+		return err
+	}
+
+	var simpleSigning cosignSimpleSigning
+	err = json.Unmarshal(payload, &simpleSigning)
+	if err != nil {
+		return fmt.Errorf("could not parse signature payload: %w", err)
+	}
+
+	if simpleSigning.Critical.Image.DockerManifestDigest != manifestDigest {
+		return fmt.Errorf("signature is for %s", simpleSigning.Critical.Image.DockerManifestDigest)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) verifyImageCosign(ctx context.Context, file resolvedImageFile, filePath string) error {
+	// Verify the signature or attestation published next to a downloaded or local disk image
+
+	checksum, err := i.cachedFileChecksum(filePath, "sha256")
+	if err != nil {
+		return err
+	}
+
+	suffix := cosignSignatureSuffix
+	if i.VMImageCosignAttestation {
+		suffix = cosignAttestationSuffix
+	}
+
+	verify := func(data []byte) error {
+		if i.VMImageCosignAttestation {
+			return verifyDSSEEnvelope(i.cosignKey, data, checksum)
+		}
+
+		// cosign sign-blob writes the base64 encoded signature over the file's SHA256
+		signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return fmt.Errorf("could not decode signature: %w", err)
+		}
+
+		digest, err := hex.DecodeString(checksum)
+		if err != nil {
+			return err
+		}
+
+		return verifyCosignSignature(i.cosignKey, digest, signature)
+	}
+
+	// Local images are signed in place
+	if file.Path != "" {
+		data, err := os.ReadFile(file.Path + suffix)
+		if err == nil {
+			err = verify(data)
+		}
+		if err != nil {
+			return fmt.Errorf("cosign %s of %s could not be verified, refusing to use it: %w", i.cosignKind(), file.Path, err)
+		}
+
+		i.logger.Info("Disk image "+i.cosignKind()+" verified.", "path", file.Path)
+		return nil
+	}
+
+	signaturePath := filepath.Join(i.VMDiskDir, filepath.Base(filePath)+suffix)
+
+	// The mirrors are where our own signatures are published, the canonical location comes last
+	for _, source := range i.imageSources(file.URL+suffix, false) {
+		err = i.downloadFile(ctx, source, signaturePath, nil)
+		if err == nil {
+			var data []byte
+			data, err = os.ReadFile(signaturePath)
+			if err == nil {
+				err = verify(data)
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+
+			i.logger.Warn("Could not verify the cosign "+i.cosignKind()+", trying the next source", "url", source, "error", err)
+			continue
+		}
+
+		i.logger.Info("Disk image "+i.cosignKind()+" verified.", "url", source)
+		return nil
+	}
+
+	return fmt.Errorf("could not verify a cosign %s of %s from any source, refusing to use it", i.cosignKind(), file.URL)
+}
+
+func (i *InstanceGroup) cosignKind() string {
+	// Name what is verified in messages
+
+	if i.VMImageCosignAttestation {
+		return "attestation"
+	}
+
+	return "signature"
+}
@@ -0,0 +1,97 @@
+package fleetingd
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Created in vm_disk_directory if debug_socket is set
+const debugSocketFileName = "debug.sock"
+
+// Sample one in this many contended mutexes and one blocking event per this many nanoseconds spent blocked
+const debugMutexProfileFraction = 10
+const debugBlockProfileRate = 10000
+
+func listenUnixSocket(path string) (net.Listener, error) {
+	// Listen on a unix socket only the plugin's user can connect to
+
+	// The socket of an earlier run is still around if it was killed
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not remove old socket %s: %w", path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (i *InstanceGroup) serveHTTP(listener net.Listener, handler http.Handler) {
+	// Serve HTTP on a listener until shutdown
+
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			i.logger.Error("http server stopped", "address", listener.Addr().String(), "error", err)
+		}
+	}()
+
+	go func() {
+		<-i.inventory.shutdownContext.Done()
+		server.Close()
+	}()
+}
+
+func (i *InstanceGroup) serveDebugSocket() error {
+	// Serve pprof profiles, expvar variables, the instances' resource usage and the recent lifecycle events on a unix socket in vm_disk_directory if debug_socket is set
+
+	if !i.DebugSocket {
+		return nil
+	}
+
+	socketPath := filepath.Join(i.VMDiskDir, debugSocketFileName)
+
+	listener, err := listenUnixSocket(socketPath)
+	if err != nil {
+		return fmt.Errorf("could not listen on the debug socket: %w", err)
+	}
+
+	// Lock contention only shows up in the profiles if it is sampled
+	runtime.SetMutexProfileFraction(debugMutexProfileFraction)
+	runtime.SetBlockProfileRate(debugBlockProfileRate)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/instances", i.serveVMStats)
+	mux.HandleFunc("/debug/events", i.serveRecentEvents)
+
+	i.serveHTTP(listener, mux)
+
+	i.logger.Info("Serving pprof, expvar, instance statistics and events on the debug socket.", "socket", socketPath)
+
+	return nil
+}
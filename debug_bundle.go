@@ -0,0 +1,249 @@
+package fleetingd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Replaces secrets in the bundle
+const redactedValue = "REDACTED"
+
+// Tokens and credentials which may show up in commands, consoles and logs, the first group is kept
+var secretRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`(gl[a-z]{2,4}-)[0-9A-Za-z_-]{8,}`),
+	regexp.MustCompile(`(?i)((?:password|passwd|token|secret|api[_-]?key)["']?\s*[=:]\s*)(?:"[^"]*"|'[^']*'|[^\s"',]+)`),
+	regexp.MustCompile(`(?i)(--(?:password|token)[= ])\S+`),
+	regexp.MustCompile(`(?i)(authorization:\s*\w+\s+)[^\s"']+`),
+	regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+(@)`),
+}
+
+func redactSecrets(text []byte) []byte {
+	// Replace what looks like a token or password, the part telling what it was is kept
+
+	for _, secretRegexp := range secretRegexps {
+		text = secretRegexp.ReplaceAllFunc(text, func(match []byte) []byte {
+			groups := secretRegexp.FindSubmatch(match)
+
+			redacted := slices.Clone(groups[1])
+			redacted = append(redacted, redactedValue...)
+			if len(groups) > 2 {
+				redacted = append(redacted, groups[2]...)
+			}
+			return redacted
+		})
+	}
+
+	return text
+}
+
+func redactURL(rawURL string) string {
+	// Remove the password of a URL, e.g. of a mirror requiring authentication
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || parsedURL.User == nil {
+		return rawURL
+	}
+
+	return parsedURL.Redacted()
+}
+
+func (i *InstanceGroup) redactedConfig() *InstanceGroup {
+	// Copy the configuration without its credentials
+
+	config := &InstanceGroup{}
+	contents, _ := json.Marshal(i)
+	json.Unmarshal(contents, config)
+
+	if config.VMImageRegistryPassword != "" {
+		config.VMImageRegistryPassword = redactedValue
+	}
+
+	config.VMDiskImage = redactURL(config.VMDiskImage)
+	config.VMKernel = redactURL(config.VMKernel)
+	config.TracingOTLPEndpoint = redactURL(config.TracingOTLPEndpoint)
+	config.VMHTTPProxy = redactURL(config.VMHTTPProxy)
+	config.VMHTTPSProxy = redactURL(config.VMHTTPSProxy)
+	for index, mirror := range config.VMImageMirrors {
+		config.VMImageMirrors[index] = redactURL(mirror)
+	}
+	for index, command := range config.VMPrebuildCloudinitExtraCmds {
+		config.VMPrebuildCloudinitExtraCmds[index] = string(redactSecrets([]byte(command)))
+	}
+	for index, command := range config.VMCloudinitExtraCmds {
+		config.VMCloudinitExtraCmds[index] = string(redactSecrets([]byte(command)))
+	}
+	for index, fragment := range config.VMCloudinitExtraUserdata {
+		config.VMCloudinitExtraUserdata[index] = string(redactSecrets([]byte(fragment)))
+	}
+
+	return config
+}
+
+// Writes the files of a debug bundle, the first error of every file is collected instead of aborting the bundle
+type debugBundleWriter struct {
+	tar        *tar.Writer
+	prefix     string
+	modifiedAt time.Time
+	errors     []string
+}
+
+func (b *debugBundleWriter) add(name string, contents []byte, err error) {
+	// Add a file, or the reason it is missing
+
+	if err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%s: %s", name, err))
+		return
+	}
+
+	err = b.tar.WriteHeader(&tar.Header{
+		Name:    b.prefix + name,
+		Mode:    0600,
+		Size:    int64(len(contents)),
+		ModTime: b.modifiedAt,
+	})
+	if err == nil {
+		_, err = b.tar.Write(contents)
+	}
+	if err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%s: %s", name, err))
+	}
+}
+
+func (b *debugBundleWriter) addJSON(name string, value any) {
+	contents, err := json.MarshalIndent(value, "", "  ")
+	b.add(name, contents, err)
+}
+
+func (i *InstanceGroup) instanceRecordsWithoutKeys() []instanceRecord {
+	// Get the records of the instance state, the instances' SSH keys left out
+
+	i.inventory.lock.RLock()
+	defer i.inventory.lock.RUnlock()
+
+	records := []instanceRecord{}
+	for _, instance := range i.inventory.instances {
+		record := newInstanceRecord(instance)
+		record.SSHPrivateKey = nil
+		record.SSHPrivateKeySealed = nil
+		records = append(records, record)
+	}
+
+	slices.SortFunc(records, func(a instanceRecord, b instanceRecord) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return records
+}
+
+func (i *InstanceGroup) writeDebugBundle(w io.Writer) error {
+	// Write what support requests need as a gzipped tar, secrets are redacted
+
+	now := time.Now().UTC()
+
+	gzipWriter := gzip.NewWriter(w)
+	bundle := &debugBundleWriter{
+		tar:        tar.NewWriter(gzipWriter),
+		prefix:     fmt.Sprintf("fleetingd-debug-%s/", now.Format("20060102T150405Z")),
+		modifiedAt: now,
+	}
+
+	bundle.addJSON("version.json", Version)
+	bundle.addJSON("config.json", i.redactedConfig())
+	bundle.addJSON("status.json", i.collectControlStatus())
+	bundle.addJSON("instances.json", i.instanceRecordsWithoutKeys())
+	bundle.addJSON("events.json", i.inventory.recentEvents.list(""))
+	bundle.addJSON("health.json", i.checkHealth())
+
+	// The rules are added through netlink, nft renders them as they are in the kernel
+	ruleset, err := runCommand(context.Background(), "nft", "list", "table", "inet", firewallTableName)
+	bundle.add("nftables.txt", ruleset, err)
+
+	templates, err := fs.Glob(userDataTemplates, "templates/*.tpl")
+	if err != nil {
+		bundle.add("templates", nil, err)
+	}
+	for _, template := range templates {
+		contents, err := fs.ReadFile(userDataTemplates, template)
+		bundle.add(template, contents, err)
+	}
+
+	// Consoles, the plugin's logs of the instances and panic markers, including those of stopped instances
+	workdir := filepath.Join(i.VMDiskDir, vmWorkdir)
+	entries, err := os.ReadDir(workdir)
+	if err != nil {
+		bundle.add("logs", nil, err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !(isInstanceLogName(entry.Name()) || strings.HasSuffix(entry.Name(), "_serial")) {
+			continue
+		}
+
+		contents, err := os.ReadFile(filepath.Join(workdir, entry.Name()))
+		bundle.add("logs/"+entry.Name(), redactSecrets(contents), err)
+	}
+
+	if len(bundle.errors) > 0 {
+		bundle.add("errors.txt", []byte(strings.Join(bundle.errors, "\n")+"\n"), nil)
+	}
+
+	err = bundle.tar.Close()
+	if err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+func (i *InstanceGroup) serveDebugBundle(w http.ResponseWriter, r *http.Request) {
+	// Stream the debug bundle, it is only known to be complete once the response ended
+
+	w.Header().Set("Content-Type", "application/gzip")
+
+	err := i.writeDebugBundle(w)
+	if err != nil {
+		i.logger.Error("could not write debug bundle", "error", err)
+	}
+}
+
+func WriteDebugBundle(vmDiskDir string, outputPath string) error {
+	// Ask the plugin using vmDiskDir for a debug bundle and write it to outputPath
+
+	client := newControlClient(vmDiskDir)
+	client.Timeout = 5 * time.Minute
+
+	response, err := client.Get("http://localhost/debug-bundle")
+	if err != nil {
+		return fmt.Errorf("could not connect to the control socket in %s, is the plugin running?: %w", vmDiskDir, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("plugin answered with status %s", response.Status)
+	}
+
+	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(output, response.Body)
+	if err != nil {
+		output.Close()
+		return fmt.Errorf("could not receive debug bundle: %w", err)
+	}
+
+	return output.Close()
+}
@@ -0,0 +1,67 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func DestroyAll(configPath string, force bool) error {
+	// Destroy every instance of the plugin_config in configPath, given as JSON, by its persisted records and what is found on the host, force also does so under a running plugin
+
+	instanceGroup, err := loadCleanupConfig(configPath, "destroy-all")
+	if err != nil {
+		return err
+	}
+
+	// A wedged plugin may still answer, it would try to manage instances which are gone
+	status, err := requestControlStatus(instanceGroup.VMDiskDir)
+	if err == nil {
+		if !force {
+			return fmt.Errorf("the plugin is running with vm_disk_directory %s, stop it first or destroy its instances anyway with -force", instanceGroup.VMDiskDir)
+		}
+		instanceGroup.logger.Warn("The plugin is still running, it will find its instances gone.", "instances", len(status.Instances))
+	}
+
+	statePath := filepath.Join(instanceGroup.VMDiskDir, instanceStateFileName)
+
+	// The records know the processes by their start time, so also those which no longer look like instances
+	records, err := readInstanceState(statePath)
+	if err != nil {
+		instanceGroup.logger.Warn("Could not read the instance state, only destroying what is found on the host.", "error", err)
+	}
+
+	for _, record := range records {
+		instanceGroup.inventory.reapInstance(instanceGroup, record)
+		instanceGroup.logger.Info("Destroyed instance.", "instance", record.Name)
+	}
+
+	found, tables, hasRoutes, err := instanceGroup.findLeftovers()
+	if err != nil {
+		return err
+	}
+
+	err = instanceGroup.removeLeftovers(found, tables, hasRoutes)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is left to adopt or keep addresses for
+	var errs []error
+	for _, name := range []string{instanceStateFileName, ipamStateFileName} {
+		err = os.Remove(filepath.Join(instanceGroup.VMDiskDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	err = errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+
+	instanceGroup.logger.Info("Destroyed all instances.", "instances", len(records), "slices", len(found.slices), "processes", len(found.processes), "taps", len(found.taps), "files", len(found.files), "tables", len(tables))
+
+	return nil
+}
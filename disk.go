@@ -0,0 +1,95 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func (i *InstanceGroup) getVhostUserBlockSocketPath(instanceName string) string {
+	// Get the path of the socket an instance's vhost-user-blk backend listens on
+
+	return filepath.Join(i.getInstanceDir(instanceName), "blk.sock")
+}
+
+func (i *InstanceGroup) diskQueueOptions() string {
+	// Queue tuning shared by virtio-blk and vhost-user-blk
+
+	options := strings.Builder{}
+
+	if i.VMDiskNumQueues > 0 {
+		fmt.Fprintf(&options, ",num_queues=%d", i.VMDiskNumQueues)
+	}
+
+	if i.VMDiskQueueSize > 0 {
+		fmt.Fprintf(&options, ",queue_size=%d", i.VMDiskQueueSize)
+	}
+
+	return options.String()
+}
+
+func (i *InstanceGroup) rootDiskArg(diskPath string, vhostUserSocketPath string) string {
+	// Get the --disk argument for an instance's root disk
+
+	if vhostUserSocketPath != "" {
+		return fmt.Sprintf("vhost_user=on,socket=%s%s", vhostUserSocketPath, i.diskQueueOptions())
+	}
+
+	diskArg := fmt.Sprintf("path=%s", diskPath)
+
+	if i.VMDiskDirectIO {
+		// Bypass the host page cache
+		diskArg += ",direct=on"
+	}
+
+	if i.VMDiskOverlay {
+		// cloud-hypervisor only opens backing files if asked to
+		diskArg += ",backing_files=on"
+	}
+
+	return diskArg + i.diskQueueOptions()
+}
+
+func (i *InstanceGroup) memoryArg() string {
+	// Get the --memory argument, vhost-user backends need access to guest memory and host_ksm merges it
+
+	memoryArg := fmt.Sprintf("size=%dM", i.VMMemoryMegabytes)
+
+	if i.VMDiskVhostUser || i.VMNetVhostUser {
+		memoryArg += ",shared=on"
+	}
+
+	if i.HostKSM {
+		memoryArg += ",mergeable=on"
+	}
+
+	return memoryArg
+}
+
+func (i *InstanceGroup) startVhostUserBlock(ctx context.Context, instanceName string, diskPath string, socketPath string) (*exec.Cmd, error) {
+	// Start a vhost-user-blk backend serving an instance's root disk, it stops when the context is cancelled
+
+	backendArgs := fmt.Sprintf("path=%s,socket=%s", diskPath, socketPath)
+
+	if i.VMDiskDirectIO {
+		backendArgs += ",direct=on"
+	}
+
+	backendArgs += i.diskQueueOptions()
+
+	backendCommand := i.instanceCommand(ctx, instanceName, nil, true, "vhost_user_block", "--block-backend", backendArgs)
+
+	err := backendCommand.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start vhost_user_block: %w", err)
+	}
+
+	err = waitForBackendSocket(ctx, backendCommand, socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("vhost_user_block did not become ready: %w", err)
+	}
+
+	return backendCommand, nil
+}
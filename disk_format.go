@@ -0,0 +1,163 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	diskFormatQcow2 = "qcow2"
+	diskFormatRaw   = "raw"
+)
+
+func (i *InstanceGroup) checkDiskFormat() error {
+	// Check the format of the base image, raw images need a filesystem with reflinks (e.g. btrfs or XFS)
+
+	switch i.VMDiskFormat {
+	case "":
+		i.VMDiskFormat = diskFormatQcow2
+	case diskFormatQcow2:
+	case diskFormatRaw:
+		err := checkReflinkSupport(i.VMDiskDir)
+		if err != nil {
+			i.logger.Warn("vm_disk_directory does not support reflinks, falling back to qcow2 disks", "error", err)
+			i.VMDiskFormat = diskFormatQcow2
+		}
+	default:
+		return fmt.Errorf("unknown vm_disk_format '%s', supported are %s and %s", i.VMDiskFormat, diskFormatQcow2, diskFormatRaw)
+	}
+
+	return i.checkDiskOverlay()
+}
+
+func (i *InstanceGroup) checkDiskOverlay() error {
+	// Validate the options of the instances' qcow2 overlays
+
+	if !i.VMDiskOverlay {
+		if i.VMDiskOverlayClusterKilobytes != 0 || i.VMDiskOverlayPreallocation != "" || i.VMDiskOverlayExtendedL2 || i.VMDiskOverlayCompat != "" || i.VMDiskOverlayPoolSize != 0 {
+			return errors.New("vm_disk_overlay_* settings require vm_disk_overlay")
+		}
+		return nil
+	}
+
+	if i.VMDiskFormat != diskFormatQcow2 {
+		return fmt.Errorf("vm_disk_overlay requires vm_disk_format %s", diskFormatQcow2)
+	}
+
+	if i.VMImageConverter != "" && i.VMImageConverter != imageConverterQemuImg {
+		return fmt.Errorf("vm_disk_overlay requires vm_image_converter %s", imageConverterQemuImg)
+	}
+
+	// vhost_user_block opens the disk without its backing file
+	if i.VMDiskVhostUser {
+		return errors.New("vm_disk_overlay can not be combined with vm_disk_vhost_user")
+	}
+
+	// qcow2 clusters are a power of two between 512 bytes and 2 MiB
+	if i.VMDiskOverlayClusterKilobytes != 0 && (i.VMDiskOverlayClusterKilobytes > 2048 || bits.OnesCount64(i.VMDiskOverlayClusterKilobytes) != 1) {
+		return fmt.Errorf("vm_disk_overlay_cluster_size_kb must be a power of two up to 2048 but is %d", i.VMDiskOverlayClusterKilobytes)
+	}
+
+	if i.VMDiskOverlayPreallocation != "" && !slices.Contains([]string{"off", "metadata", "falloc", "full"}, i.VMDiskOverlayPreallocation) {
+		return fmt.Errorf("unknown vm_disk_overlay_preallocation '%s', supported are off, metadata, falloc and full", i.VMDiskOverlayPreallocation)
+	}
+
+	if i.VMDiskOverlayCompat != "" && !slices.Contains([]string{"0.10", "1.1"}, i.VMDiskOverlayCompat) {
+		return fmt.Errorf("unknown vm_disk_overlay_compat '%s', supported are 0.10 and 1.1", i.VMDiskOverlayCompat)
+	}
+
+	// Subclusters are a qcow2 v3 feature
+	if i.VMDiskOverlayExtendedL2 && i.VMDiskOverlayCompat == "0.10" {
+		return errors.New("vm_disk_overlay_extended_l2 requires vm_disk_overlay_compat 1.1")
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) overlayOptions() string {
+	// Get the qemu-img -o options of the instances' overlays
+
+	var options []string
+
+	if i.VMDiskOverlayClusterKilobytes != 0 {
+		options = append(options, fmt.Sprintf("cluster_size=%dk", i.VMDiskOverlayClusterKilobytes))
+	}
+
+	if i.VMDiskOverlayPreallocation != "" {
+		options = append(options, "preallocation="+i.VMDiskOverlayPreallocation)
+	}
+
+	if i.VMDiskOverlayExtendedL2 {
+		options = append(options, "extended_l2=on")
+	}
+
+	if i.VMDiskOverlayCompat != "" {
+		options = append(options, "compat="+i.VMDiskOverlayCompat)
+	}
+
+	return strings.Join(options, ",")
+}
+
+func (i *InstanceGroup) createOverlay(ctx context.Context, basePath string, overlayPath string) error {
+	// Create a qcow2 overlay backed by the base image, the base image must not change while it is used
+
+	args := []string{"create", "-f", "qcow2", "-F", diskFormatQcow2, "-b", basePath}
+
+	options := i.overlayOptions()
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+
+	return runConverterCommand(ctx, append(append([]string{"qemu-img"}, args...), overlayPath))
+}
+
+func checkReflinkSupport(directory string) error {
+	// Try to reflink a file in a directory
+
+	source, err := os.CreateTemp(directory, ".reflink-check-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(source.Name())
+	defer source.Close()
+
+	_, err = source.WriteString("fleetingd")
+	if err != nil {
+		return err
+	}
+
+	targetPath := source.Name() + "-clone"
+	defer os.Remove(targetPath)
+
+	return reflinkFile(source.Name(), targetPath)
+}
+
+func reflinkFile(sourcePath string, targetPath string) error {
+	// Create a copy sharing the source's blocks with FICLONE, only changed blocks are written later on
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = unix.IoctlFileClone(int(target.Fd()), int(source.Fd()))
+	if err != nil {
+		target.Close()
+		return errors.Join(fmt.Errorf("could not reflink %s: %w", sourcePath, err), os.Remove(targetPath))
+	}
+
+	return target.Close()
+}
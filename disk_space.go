@@ -0,0 +1,156 @@
+package fleetingd
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"golang.org/x/sys/unix"
+)
+
+func getDiskSpace(directory string) (freeBytes uint64, totalBytes uint64, err error) {
+	// Get the space left to unprivileged users and the size of the filesystem a directory is on
+
+	var stat unix.Statfs_t
+	err = unix.Statfs(directory, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+func (i *InstanceGroup) runDiskSpaceMonitor(ctx context.Context) {
+	// Watch the free space in vm_disk_directory, the overlays grow with what the jobs write until it runs out for all of them
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	low := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			low = i.checkDiskSpace(low)
+		}
+	}
+}
+
+func (i *InstanceGroup) checkDiskSpace(wasLow bool) bool {
+	// Tell when the free space drops below host_min_free_disk_gb and recycle an idle instance if configured, the boots are refused by checkHostCapacity
+
+	freeBytes, _, err := getDiskSpace(i.VMDiskDir)
+	if err != nil {
+		i.logger.Error("could not determine free disk space", "directory", i.VMDiskDir, "error", err)
+		return wasLow
+	}
+
+	freeGigabytes := freeBytes / 1024 / 1024 / 1024
+	low := freeGigabytes < i.HostMinFreeDiskGigabytes
+
+	if low && !wasLow {
+		i.logger.Warn("Free space in vm_disk_directory dropped below host_min_free_disk_gb, no instances are booted until there is room again.", "free_gb", freeGigabytes, "directory", i.VMDiskDir)
+	} else if !low && wasLow {
+		i.logger.Info("Free space in vm_disk_directory recovered, booting instances again.", "free_gb", freeGigabytes, "directory", i.VMDiskDir)
+	}
+
+	if low && i.HostDiskRecycleIdle {
+		i.inventory.RecycleLargestIdleInstance(i)
+	}
+
+	return low
+}
+
+func instanceDiskUsage(directory string) uint64 {
+	// Sum up the blocks allocated by the files in an instance's directory, sparse disks only count what was written
+
+	var usage uint64
+	filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok {
+			usage += uint64(stat.Blocks) * 512
+		}
+
+		return nil
+	})
+
+	return usage
+}
+
+func (i *Inventory) RecycleLargestIdleInstance(instanceGroup *InstanceGroup) {
+	// Destroy the instance without SSH sessions whose disks take up the most space, jobs are never interrupted
+
+	sessions, err := instanceGroup.getSSHSessions()
+	if err != nil {
+		instanceGroup.logger.Error("could not determine active SSH sessions", "error", err)
+		return
+	}
+
+	idle := func(instance *InstanceInfo) bool {
+		if instance.Internal || instance.State != provider.StateRunning {
+			return false
+		}
+
+		// A job is connected to the instance
+		if sessions.active(instance) {
+			return false
+		}
+
+		// The runner just requested the instance, its job may not have connected yet
+		return time.Since(instance.LastActive) >= idleCheckInterval
+	}
+
+	i.lock.RLock()
+	var candidates []string
+	for name, instance := range i.instances {
+		if idle(instance) {
+			candidates = append(candidates, name)
+		}
+	}
+	i.lock.RUnlock()
+
+	// Walking the directories takes a while, the inventory isn't locked meanwhile
+	largest := ""
+	largestUsage := uint64(0)
+	for _, name := range candidates {
+		usage := instanceDiskUsage(instanceGroup.getInstanceDir(name))
+		if usage > largestUsage {
+			largest = name
+			largestUsage = usage
+		}
+	}
+
+	if largest == "" {
+		return
+	}
+
+	// Hold the lock while deciding so ConnectInfo can't hand out an instance that is about to be destroyed
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	instance, ok := i.instances[largest]
+	if !ok || !idle(instance) {
+		return
+	}
+
+	// Reported as deleting until the cleanup removed it, the runner then boots a replacement
+	instance.State = provider.StateDeleting
+	instance.InstanceContextCancelFunc()
+
+	i.metrics.diskSpaceRecycles.Add(1)
+
+	instance.logger.Warn("Recycling idle instance to free disk space.", "disk_usage_mb", largestUsage/1024/1024)
+}
@@ -0,0 +1,267 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The resolvers the guests use without the forwarder
+var defaultDNSUpstreams = []string{"1.1.1.3", "1.0.0.3"}
+
+const dnsCacheMaxEntries = 10000
+const dnsCacheMaxTTL = 5 * time.Minute
+const dnsUpstreamTimeout = 3 * time.Second
+
+type dnsCacheKey struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsCacheEntry struct {
+	response *dns.Msg
+	expires  time.Time
+}
+
+// Forwards the guests' queries to the upstream resolvers, the cache is shared by all instances
+type dnsForwarder struct {
+	upstreams []string
+
+	lock  sync.Mutex
+	cache map[dnsCacheKey]dnsCacheEntry
+}
+
+func (i *InstanceGroup) parseDNSForwarder() error {
+	// Set up the DNS forwarder if enabled
+
+	if !i.VMDNSCache {
+		return nil
+	}
+
+	// Bridged guests use the DHCP server's resolvers and passt has no host address in the guests' network
+	if i.isBridged() || i.usesPasst() {
+		return errors.New("vm_dns_cache can only be used with network_mode nat")
+	}
+
+	upstreams := i.VMDNSUpstreams
+	if len(upstreams) == 0 {
+		upstreams = defaultDNSUpstreams
+	}
+
+	forwarder := &dnsForwarder{cache: make(map[dnsCacheKey]dnsCacheEntry)}
+	for _, upstream := range upstreams {
+		// Port 53 unless specified
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		forwarder.upstreams = append(forwarder.upstreams, upstream)
+	}
+
+	i.dnsForwarder = forwarder
+
+	return nil
+}
+
+func (i *InstanceGroup) dnsServer(gateway string) string {
+	// Get the resolver advertised to an instance, empty for the default upstream resolvers
+
+	if i.dnsForwarder == nil {
+		return ""
+	}
+
+	return gateway
+}
+
+func (i *InstanceGroup) startDNSForwarder(ctx context.Context, hostTapIP string) error {
+	// Serve DNS on an instance's host tap address until the context is cancelled
+
+	if i.dnsForwarder == nil {
+		return nil
+	}
+
+	address := net.JoinHostPort(hostTapIP, "53")
+
+	packetConnection, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("could not start DNS forwarder on %s: %w", address, err)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		packetConnection.Close()
+		return fmt.Errorf("could not start DNS forwarder on %s: %w", address, err)
+	}
+
+	servers := []*dns.Server{
+		{PacketConn: packetConnection, Handler: i.dnsForwarder},
+		{Listener: listener, Handler: i.dnsForwarder},
+	}
+
+	for _, server := range servers {
+		go func() {
+			err := server.ActivateAndServe()
+			if err != nil && ctx.Err() == nil {
+				i.logger.Error("DNS forwarder stopped", "address", address, "error", err)
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	}()
+
+	return nil
+}
+
+func (f *dnsForwarder) ServeDNS(writer dns.ResponseWriter, request *dns.Msg) {
+	// Answer a query from the cache or the upstream resolvers
+
+	_, isTCP := writer.LocalAddr().(*net.TCPAddr)
+
+	var key dnsCacheKey
+	cacheable := len(request.Question) == 1
+	if cacheable {
+		question := request.Question[0]
+		key = dnsCacheKey{Name: strings.ToLower(question.Name), Type: question.Qtype, Class: question.Qclass}
+
+		response := f.lookup(key)
+		if response != nil {
+			response.Id = request.Id
+			f.write(writer, request, response, isTCP)
+			return
+		}
+	}
+
+	response, err := f.exchange(request, isTCP)
+	if err != nil {
+		failure := new(dns.Msg)
+		failure.SetRcode(request, dns.RcodeServerFailure)
+		writer.WriteMsg(failure)
+		return
+	}
+
+	if cacheable {
+		f.store(key, response)
+	}
+
+	f.write(writer, request, response, isTCP)
+}
+
+func (f *dnsForwarder) write(writer dns.ResponseWriter, request *dns.Msg, response *dns.Msg, isTCP bool) {
+	// Send a response, UDP responses are cut down to what the client can receive
+
+	if !isTCP {
+		size := dns.MinMsgSize
+		if options := request.IsEdns0(); options != nil {
+			size = int(options.UDPSize())
+		}
+		response.Truncate(size)
+	}
+
+	writer.WriteMsg(response)
+}
+
+func (f *dnsForwarder) exchange(request *dns.Msg, isTCP bool) (*dns.Msg, error) {
+	// Ask the upstream resolvers in order until one answers, truncated answers are retried over TCP
+
+	network := "udp"
+	if isTCP {
+		network = "tcp"
+	}
+
+	var lastErr error
+	for _, upstream := range f.upstreams {
+		client := &dns.Client{Net: network, Timeout: dnsUpstreamTimeout}
+		response, _, err := client.Exchange(request, upstream)
+		if err == nil && response.Truncated && !isTCP {
+			client.Net = "tcp"
+			response, _, err = client.Exchange(request, upstream)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return response, nil
+	}
+
+	return nil, lastErr
+}
+
+func (f *dnsForwarder) lookup(key dnsCacheKey) *dns.Msg {
+	// Get a copy of a cached response with the remaining TTLs, nil if there is none
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	entry, ok := f.cache[key]
+	if !ok {
+		return nil
+	}
+
+	remaining := time.Until(entry.expires)
+	if remaining <= 0 {
+		delete(f.cache, key)
+		return nil
+	}
+
+	response := entry.response.Copy()
+	for _, records := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, record := range records {
+			record.Header().Ttl = uint32(remaining.Seconds())
+		}
+	}
+
+	return response
+}
+
+func (f *dnsForwarder) store(key dnsCacheKey, response *dns.Msg) {
+	// Cache a response for the smallest TTL of its records
+
+	if response.Truncated || (response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	ttl := dnsCacheMaxTTL
+	records := append(append([]dns.RR{}, response.Answer...), response.Ns...)
+	if len(records) == 0 {
+		return
+	}
+	for _, record := range records {
+		recordTTL := time.Duration(record.Header().Ttl) * time.Second
+		if recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Make room by dropping expired entries, or everything if that is not enough
+	if len(f.cache) >= dnsCacheMaxEntries {
+		now := time.Now()
+		for cachedKey, entry := range f.cache {
+			if now.After(entry.expires) {
+				delete(f.cache, cachedKey)
+			}
+		}
+		if len(f.cache) >= dnsCacheMaxEntries {
+			clear(f.cache)
+		}
+	}
+
+	f.cache[key] = dnsCacheEntry{response: response.Copy(), expires: time.Now().Add(ttl)}
+}
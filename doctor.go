@@ -0,0 +1,375 @@
+package fleetingd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
+
+// Whether KVM lets guests run VMs of their own, the module of the host's CPU vendor is loaded
+var nestedVirtualizationPaths = []string{
+	"/sys/module/kvm_intel/parameters/nested",
+	"/sys/module/kvm_amd/parameters/nested",
+}
+
+// Flags printing the version of the tools doctor looks for, the first line of the output is reported
+var binaryVersionFlags = map[string][]string{
+	hypervisorBackend:  {"--version"},
+	"qemu-img":         {"--version"},
+	"passt":            {"--version"},
+	"tc":               {"-V"},
+	"ip":               {"-V"},
+	"vhost_user_block": {"--version"},
+	"vhost_user_net":   {"--version"},
+}
+
+// Result of one of doctor's checks
+type doctorResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+func Doctor(configPath string) (bool, error) {
+	// Check the host has everything Init needs for the plugin_config in configPath, or the defaults without one, and print a report
+
+	instanceGroup := &InstanceGroup{}
+
+	if configPath != "" {
+		contents, err := os.ReadFile(configPath)
+		if err != nil {
+			return false, err
+		}
+
+		err = json.Unmarshal(contents, instanceGroup)
+		if err != nil {
+			return false, fmt.Errorf("could not parse %s: %w", configPath, err)
+		}
+	}
+
+	instanceGroup.logger = hclog.NewNullLogger()
+
+	results := instanceGroup.runDoctorChecks()
+
+	passed := true
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		if result.Status == doctorFail {
+			passed = false
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", result.Status, result.Name, result.Detail)
+	}
+
+	return passed, writer.Flush()
+}
+
+func (i *InstanceGroup) runDoctorChecks() []doctorResult {
+	// Run the checks one after another, a failed one doesn't stop the others so the report lists every problem at once
+
+	results := []doctorResult{}
+	check := func(name string, err error, detail string) {
+		if err != nil {
+			results = append(results, doctorResult{Name: name, Status: doctorFail, Detail: err.Error()})
+			return
+		}
+		results = append(results, doctorResult{Name: name, Status: doctorPass, Detail: detail})
+	}
+	warn := func(name string, detail string) {
+		results = append(results, doctorResult{Name: name, Status: doctorWarn, Detail: detail})
+	}
+
+	check("architecture", checkHostArchitecture(), runtime.GOARCH)
+
+	// The settings decide which of the other checks apply
+	check("plugin_config", i.prepareRender(), "valid")
+
+	check(kvmDevicePath, unix.Access(kvmDevicePath, unix.R_OK|unix.W_OK), "readable and writable")
+
+	if i.VMHypervisorUser != "" {
+		check("vm_hypervisor_user", i.parseHypervisorUser(), i.VMHypervisorUser+" can use "+kvmDevicePath)
+	}
+
+	nested, err := nestedVirtualization()
+	if err != nil {
+		warn("nested virtualization", err.Error())
+	} else if !nested {
+		warn("nested virtualization", "disabled, jobs can't start VMs of their own")
+	} else {
+		check("nested virtualization", nil, "enabled")
+	}
+
+	// passt needs neither tap devices nor forwarding
+	if !i.usesPasst() {
+		_, err := os.Stat("/dev/net/tun")
+		if err != nil {
+			err = fmt.Errorf("not available, is the tun module loaded? %w", err)
+		}
+		check("/dev/net/tun", err, "available")
+	}
+
+	for _, binary := range i.doctorBinaries() {
+		version, err := binaryVersion(binary)
+		check("binary "+binary, err, version)
+	}
+
+	check("vm_image_converter", i.parseImageConverter(), "tools found")
+
+	// auto is resolved to the confinement found
+	if i.VMMACConfinement != "" && i.VMMACConfinement != macConfinementNone {
+		err := i.checkMACConfinement()
+		check("vm_mac_confinement", err, i.VMMACConfinement)
+	}
+
+	if i.VMSystemdScopes {
+		check("vm_systemd_scopes", i.checkSystemdScopes(), "systemd-run and systemctl found")
+	}
+
+	// Bridged and passt traffic is not routed by the host
+	if !i.isBridged() && !i.usesPasst() {
+		check("egress_interface", checkInterfaceUp(i.EgressInterface), i.EgressInterface+" is up")
+
+		results = append(results, i.doctorForwarding(ipv4ForwardingPath))
+		if i.ipv6Prefix.IsValid() {
+			results = append(results, i.doctorForwarding(ipv6ForwardingPath))
+		}
+	}
+
+	if i.isBridged() {
+		check("network_bridge", checkInterfaceUp(i.NetworkBridge), i.NetworkBridge+" is up")
+	}
+
+	results = append(results, i.doctorDiskSpace())
+	results = append(results, i.doctorMemory())
+	results = append(results, doctorHugepages())
+
+	return results
+}
+
+func (i *InstanceGroup) doctorBinaries() []string {
+	// Get the tools the configuration runs, those of the image converter, MAC confinement and systemd scopes are checked with their settings
+
+	binaries := []string{hypervisorBackend}
+
+	if i.isBridged() || i.ipv6Prefix.IsValid() {
+		binaries = append(binaries, "ip")
+	}
+	if i.trafficShapingEnabled() {
+		binaries = append(binaries, "tc")
+	}
+	if i.usesPasst() {
+		binaries = append(binaries, "passt")
+	}
+	if i.VMDiskVhostUser {
+		binaries = append(binaries, "vhost_user_block")
+	}
+	if i.VMNetVhostUser {
+		binaries = append(binaries, "vhost_user_net")
+	}
+
+	return binaries
+}
+
+func binaryVersion(binary string) (string, error) {
+	// Look a tool up on PATH and get the first line of its version, or where it was found if it has no version flag
+
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return "", fmt.Errorf("not found on PATH: %w", err)
+	}
+
+	flags, ok := binaryVersionFlags[binary]
+	if !ok {
+		return path, nil
+	}
+
+	output, err := runCommand(context.Background(), append([]string{path}, flags...)...)
+	if err != nil {
+		return "", err
+	}
+
+	version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return fmt.Sprintf("%s (%s)", version, path), nil
+}
+
+func nestedVirtualization() (bool, error) {
+	// Check the KVM module of the host's CPU allows nested virtualization
+
+	for _, path := range nestedVirtualizationPaths {
+		value, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		switch strings.TrimSpace(string(value)) {
+		case "1", "Y", "y":
+			return true, nil
+		}
+		return false, nil
+	}
+
+	return false, errors.New("could not be determined, neither kvm_intel nor kvm_amd is loaded")
+}
+
+func checkInterfaceUp(name string) error {
+	// Check an interface exists and is up
+
+	if name == "" {
+		return errors.New("not set")
+	}
+
+	networkInterface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("%s can not be found: %w", name, err)
+	}
+	if networkInterface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%s is down", name)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) doctorForwarding(sysctlPath string) doctorResult {
+	// Check forwarding is enabled without enabling it, Init does that with host_enable_ip_forwarding
+
+	sysctlName := strings.ReplaceAll(strings.TrimPrefix(sysctlPath, "/proc/sys/"), "/", ".")
+
+	value, err := os.ReadFile(sysctlPath)
+	if err != nil {
+		return doctorResult{Name: sysctlName, Status: doctorFail, Detail: err.Error()}
+	}
+
+	if strings.TrimSpace(string(value)) == "1" {
+		return doctorResult{Name: sysctlName, Status: doctorPass, Detail: "enabled"}
+	}
+
+	if i.HostEnableIPForwarding {
+		return doctorResult{Name: sysctlName, Status: doctorWarn, Detail: "disabled, the plugin enables it at startup with host_enable_ip_forwarding"}
+	}
+
+	return doctorResult{Name: sysctlName, Status: doctorFail, Detail: "disabled, enable it or set host_enable_ip_forwarding"}
+}
+
+func (i *InstanceGroup) doctorDiskSpace() doctorResult {
+	// Check vm_disk_directory is writable and has room, host_min_free_disk_gb or else one instance's disk
+
+	result := doctorResult{Name: "vm_disk_directory"}
+
+	if i.VMDiskDir == "" {
+		result.Status = doctorWarn
+		result.Detail = "not set"
+		return result
+	}
+
+	err := unix.Access(i.VMDiskDir, unix.W_OK)
+	if err != nil {
+		result.Status = doctorFail
+		result.Detail = fmt.Sprintf("%s is not writable: %s", i.VMDiskDir, err)
+		return result
+	}
+
+	var stat unix.Statfs_t
+	err = unix.Statfs(i.VMDiskDir, &stat)
+	if err != nil {
+		result.Status = doctorFail
+		result.Detail = fmt.Sprintf("could not determine free space in %s: %s", i.VMDiskDir, err)
+		return result
+	}
+
+	freeGigabytes := stat.Bavail * uint64(stat.Bsize) / 1024 / 1024 / 1024
+	result.Detail = fmt.Sprintf("%d GB free in %s", freeGigabytes, i.VMDiskDir)
+
+	switch {
+	case i.HostMinFreeDiskGigabytes > 0 && freeGigabytes < i.HostMinFreeDiskGigabytes:
+		result.Status = doctorFail
+		result.Detail += fmt.Sprintf(", host_min_free_disk_gb is %d GB", i.HostMinFreeDiskGigabytes)
+	case freeGigabytes < i.VMDiskSizeGB:
+		result.Status = doctorWarn
+		result.Detail += fmt.Sprintf(", an instance's disk can grow to %d GB", i.VMDiskSizeGB)
+	default:
+		result.Status = doctorPass
+	}
+
+	return result
+}
+
+func (i *InstanceGroup) doctorMemory() doctorResult {
+	// Check the host has the memory of at least one instance available
+
+	result := doctorResult{Name: "memory"}
+
+	availableMegabytes, err := getHostAvailableMemoryMegabytes()
+	if err != nil {
+		result.Status = doctorFail
+		result.Detail = fmt.Sprintf("could not determine available host memory: %s", err)
+		return result
+	}
+
+	result.Status = doctorPass
+	result.Detail = fmt.Sprintf("%d MB available", availableMegabytes)
+
+	if availableMegabytes < i.VMMemoryMegabytes+i.HostReservedMemoryMegabytes {
+		result.Status = doctorWarn
+		result.Detail += fmt.Sprintf(", an instance needs %d MB with host_reserved_memory_mb", i.VMMemoryMegabytes+i.HostReservedMemoryMegabytes)
+	}
+
+	return result
+}
+
+func doctorHugepages() doctorResult {
+	// Report memory reserved as hugepages, the VMs' memory doesn't use them so it is lost to the instances
+
+	result := doctorResult{Name: "hugepages"}
+
+	meminfo, err := os.Open("/proc/meminfo")
+	if err != nil {
+		result.Status = doctorWarn
+		result.Detail = err.Error()
+		return result
+	}
+	defer meminfo.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(meminfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = value
+	}
+
+	reservedMegabytes := values["HugePages_Total"] * values["Hugepagesize"] / 1024
+	if reservedMegabytes == 0 {
+		result.Status = doctorPass
+		result.Detail = "none reserved"
+		return result
+	}
+
+	result.Status = doctorWarn
+	result.Detail = fmt.Sprintf("%d MB reserved (%d of %d pages free), the VMs don't use hugepages", reservedMegabytes, values["HugePages_Free"], values["HugePages_Total"])
+
+	return result
+}
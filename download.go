@@ -0,0 +1,335 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// A download is aborted and retried if no data arrived for this long, large images may take hours in total
+const downloadInactivityTimeout = time.Minute
+
+const downloadAttempts = 5
+
+// Doubled after each failed attempt
+const downloadRetryDelay = 5 * time.Second
+
+// How often the progress of a running download is logged
+const downloadProgressInterval = 30 * time.Second
+
+// Downloads are written next to their target and only renamed once complete
+const downloadPartialSuffix = ".part"
+
+// The kernel and the disk image, each after its SUMS file
+const defaultParallelDownloads = 2
+
+// Identifies the version of a file a partial download belongs to
+type downloadValidator struct {
+	ETag         string
+	LastModified string
+}
+
+// Errors retrying won't fix, e.g. a 404
+type permanentDownloadError struct {
+	err error
+}
+
+func (e permanentDownloadError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentDownloadError) Unwrap() error {
+	return e.err
+}
+
+// Reads the body of a download, keeping it below the rate limit and periodically logging the progress
+type downloadReader struct {
+	ctx    context.Context
+	reader io.Reader
+	logger hclog.Logger
+	url    string
+
+	// Called after each read that returned data
+	onRead func()
+
+	// Zero is unlimited
+	bytesPerSecond uint64
+
+	// Bytes already downloaded by earlier attempts and the size of the file, -1 if unknown
+	offset int64
+	total  int64
+
+	read       int64
+	started    time.Time
+	lastReport time.Time
+}
+
+func (r *downloadReader) Read(buffer []byte) (int, error) {
+	n, err := r.reader.Read(buffer)
+	if n == 0 {
+		return n, err
+	}
+
+	r.read += int64(n)
+	r.onRead()
+
+	// Wait until the average rate of this attempt is back at the limit
+	if r.bytesPerSecond > 0 {
+		wait := time.Duration(float64(r.read)/float64(r.bytesPerSecond)*float64(time.Second)) - time.Since(r.started)
+		if wait > 0 {
+			select {
+			case <-r.ctx.Done():
+				return n, r.ctx.Err()
+			case <-time.After(wait):
+			}
+			r.onRead()
+		}
+	}
+
+	if time.Since(r.lastReport) >= downloadProgressInterval {
+		r.lastReport = time.Now()
+		r.report()
+	}
+
+	return n, err
+}
+
+func (r *downloadReader) report() {
+	// Log how far the download got, with percent and remaining time if the size is known
+
+	elapsed := time.Since(r.started).Seconds()
+	bytesPerSecond := float64(r.read) / elapsed
+	downloaded := r.offset + r.read
+
+	if r.total <= 0 || bytesPerSecond == 0 {
+		r.logger.Info("Downloading...", "url", r.url, "downloaded_mb", downloaded/1024/1024, "speed_mbit", int64(bytesPerSecond*8/1000/1000))
+		return
+	}
+
+	remaining := time.Duration(float64(r.total-downloaded)/bytesPerSecond) * time.Second
+
+	r.logger.Info("Downloading...",
+		"url", r.url,
+		"percent", downloaded*100/r.total,
+		"downloaded_mb", downloaded/1024/1024,
+		"total_mb", r.total/1024/1024,
+		"speed_mbit", int64(bytesPerSecond*8/1000/1000),
+		"eta", remaining.Round(time.Second))
+}
+
+func (i *InstanceGroup) downloadFile(ctx context.Context, url string, targetPath string, header http.Header) error {
+	// Download a file to the filesystem with optional extra headers, failed attempts are retried and resumed where the server supports ranges
+
+	partialPath := targetPath + downloadPartialSuffix
+
+	// A leftover partial download may belong to another version of the file
+	err := os.Remove(partialPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	validator := downloadValidator{}
+	delay := downloadRetryDelay
+
+	for attempt := 1; ; attempt++ {
+		err = i.downloadAttempt(ctx, url, partialPath, header, &validator)
+		if err == nil {
+			break
+		}
+
+		var permanentErr permanentDownloadError
+		if ctx.Err() != nil || errors.As(err, &permanentErr) || attempt == downloadAttempts {
+			removeErr := os.Remove(partialPath)
+			if removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+				i.logger.Error("could not remove partial download", "path", partialPath, "error", removeErr)
+			}
+
+			return fmt.Errorf("could not download %s: %w", url, err)
+		}
+
+		i.logger.Warn("Download failed, retrying", "url", url, "attempt", attempt, "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("could not download %s: %w", url, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+
+	return os.Rename(partialPath, targetPath)
+}
+
+func (i *InstanceGroup) downloadAttempt(ctx context.Context, url string, partialPath string, header http.Header, validator *downloadValidator) error {
+	// Download a file or the rest of it, the connection is torn down if it stalls
+
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	attemptContext, cancelAttempt := context.WithCancel(ctx)
+	defer cancelAttempt()
+
+	inactivityTimer := time.AfterFunc(downloadInactivityTimeout, cancelAttempt)
+	defer inactivityTimer.Stop()
+
+	request, err := http.NewRequestWithContext(attemptContext, http.MethodGet, url, nil)
+	if err != nil {
+		return permanentDownloadError{err: err}
+	}
+
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	// Only resume if the file is still the same, otherwise the server sends all of it
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator.ETag != "" {
+			request.Header.Set("If-Range", validator.ETag)
+		} else if validator.LastModified != "" {
+			request.Header.Set("If-Range", validator.LastModified)
+		}
+	}
+
+	response, err := i.imageHTTPClient(0).Do(request)
+	if err != nil {
+		return stalledDownloadError(ctx, attemptContext, err)
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+		// Start over, either no range was requested or the server ignored it
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		offset = 0
+
+		validator.ETag = response.Header.Get("ETag")
+		validator.LastModified = response.Header.Get("Last-Modified")
+	case response.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(response.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-") {
+			return fmt.Errorf("server answered with unexpected range '%s'", response.Header.Get("Content-Range"))
+		}
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Whatever was downloaded doesn't fit the file anymore, the next attempt starts over
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+		return errors.New("server could not resume the download")
+	case response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return fmt.Errorf("server answered %s", response.Status)
+	default:
+		return permanentDownloadError{err: fmt.Errorf("server answered %s", response.Status)}
+	}
+
+	// Partial responses only count the rest of the file
+	total := int64(-1)
+	if response.ContentLength >= 0 {
+		total = offset + response.ContentLength
+	}
+
+	body := &downloadReader{
+		ctx:    attemptContext,
+		reader: response.Body,
+		logger: i.logger,
+		url:    url,
+		onRead: func() {
+			inactivityTimer.Reset(downloadInactivityTimeout)
+		},
+		bytesPerSecond: i.downloadBytesPerSecond(),
+		offset:         offset,
+		total:          total,
+		started:        time.Now(),
+		lastReport:     time.Now(),
+	}
+
+	written, err := io.Copy(file, body)
+	i.inventory.metrics.downloadedBytes.Add(uint64(written))
+	if err != nil {
+		return stalledDownloadError(ctx, attemptContext, err)
+	}
+
+	return file.Sync()
+}
+
+func stalledDownloadError(ctx context.Context, attemptContext context.Context, err error) error {
+	// Tell a stalled connection apart from other errors of an attempt
+
+	if ctx.Err() == nil && attemptContext.Err() != nil {
+		return fmt.Errorf("no data received for %s", downloadInactivityTimeout)
+	}
+
+	return err
+}
+
+func (i *InstanceGroup) downloadBytesPerSecond() uint64 {
+	// Get the rate limit of a single download, parallel downloads share vm_image_download_rate_mbit
+
+	return i.VMImageDownloadRateMegabits * 1000 * 1000 / 8 / max(i.parallelDownloads, 1)
+}
+
+func runParallel(ctx context.Context, limit uint64, tasks []func(context.Context) error) error {
+	// Run tasks with at most limit of them at a time, the first error cancels the others and is returned
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	semaphore := make(chan struct{}, max(limit, 1))
+
+	var firstErr error
+	var once sync.Once
+	var waitGroup sync.WaitGroup
+
+	for _, task := range tasks {
+		waitGroup.Go(func() {
+			select {
+			case <-ctx.Done():
+				return
+			case semaphore <- struct{}{}:
+			}
+			defer func() { <-semaphore }()
+
+			err := task(ctx)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		})
+	}
+
+	waitGroup.Wait()
+
+	// The parent context may have been cancelled before any task ran
+	if firstErr == nil {
+		return ctx.Err()
+	}
+
+	return firstErr
+}
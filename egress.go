@@ -0,0 +1,211 @@
+package fleetingd
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const egressPolicyAllow = "allow"
+const egressPolicyDeny = "deny"
+
+// Neighbour discovery uses the ICMPv6 types from router solicitation to redirect
+const icmpv6RouterSolicitation = 133
+const icmpv6Redirect = 137
+
+type egressRule struct {
+	Prefix netip.Prefix
+
+	// Empty matches all protocols, ports are only matched for tcp and udp
+	Protocol  string
+	FirstPort uint16
+	LastPort  uint16
+}
+
+func parseEgressRule(rule string) (egressRule, error) {
+	// Parse an egress rule of the form "CIDR [tcp|udp[/PORT[-PORT]]]"
+
+	fields := strings.Fields(rule)
+	if len(fields) == 0 || len(fields) > 2 {
+		return egressRule{}, fmt.Errorf("invalid egress rule '%s', must be of the form 'CIDR [tcp|udp[/PORT[-PORT]]]'", rule)
+	}
+
+	prefix, err := netip.ParsePrefix(fields[0])
+	if err != nil {
+		// Allow single addresses without prefix length
+		address, addressErr := netip.ParseAddr(fields[0])
+		if addressErr != nil {
+			return egressRule{}, fmt.Errorf("invalid address in egress rule '%s': %w", rule, err)
+		}
+		prefix = netip.PrefixFrom(address, address.BitLen())
+	}
+
+	parsedRule := egressRule{Prefix: prefix.Masked()}
+
+	if len(fields) == 1 {
+		return parsedRule, nil
+	}
+
+	protocol, ports, hasPorts := strings.Cut(fields[1], "/")
+	if protocol != "tcp" && protocol != "udp" {
+		return egressRule{}, fmt.Errorf("invalid protocol '%s' in egress rule '%s', must be tcp or udp", protocol, rule)
+	}
+	parsedRule.Protocol = protocol
+
+	if !hasPorts {
+		return parsedRule, nil
+	}
+
+	firstPort, lastPort, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		lastPort = firstPort
+	}
+
+	first, err := strconv.ParseUint(firstPort, 10, 16)
+	if err != nil {
+		return egressRule{}, fmt.Errorf("invalid port in egress rule '%s': %w", rule, err)
+	}
+	last, err := strconv.ParseUint(lastPort, 10, 16)
+	if err != nil {
+		return egressRule{}, fmt.Errorf("invalid port in egress rule '%s': %w", rule, err)
+	}
+	if first == 0 || first > last {
+		return egressRule{}, fmt.Errorf("invalid port range in egress rule '%s'", rule)
+	}
+
+	parsedRule.FirstPort = uint16(first)
+	parsedRule.LastPort = uint16(last)
+
+	return parsedRule, nil
+}
+
+func (i *InstanceGroup) parseEgressPolicy() error {
+	// Validate the egress policy and parse its rules
+
+	switch i.EgressPolicy {
+	case "":
+		i.EgressPolicy = egressPolicyAllow
+	case egressPolicyAllow, egressPolicyDeny:
+	default:
+		return fmt.Errorf("unknown egress_policy '%s', must be one of: %s, %s", i.EgressPolicy, egressPolicyAllow, egressPolicyDeny)
+	}
+
+	i.egressAllowRules = []egressRule{}
+	for _, rule := range i.EgressAllow {
+		parsedRule, err := parseEgressRule(rule)
+		if err != nil {
+			return err
+		}
+		i.egressAllowRules = append(i.egressAllowRules, parsedRule)
+	}
+
+	i.egressDenyRules = []egressRule{}
+	for _, rule := range i.EgressDeny {
+		parsedRule, err := parseEgressRule(rule)
+		if err != nil {
+			return err
+		}
+		i.egressDenyRules = append(i.egressDenyRules, parsedRule)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) addEgressRules(connection nftablesBatch, chain *nftables.Chain) {
+	// Queue the egress policy rules of an instance's ingress chain, denies take precedence over allows
+
+	for _, rule := range i.egressDenyRules {
+		addRule(connection, chain, append(matchEgressRule(rule), drop())...)
+	}
+
+	if i.EgressPolicy == egressPolicyAllow {
+		return
+	}
+
+	for _, rule := range i.egressAllowRules {
+		addRule(connection, chain, append(matchEgressRule(rule), accept())...)
+	}
+
+	// Everything else that is IP is dropped, ARP and neighbour discovery are still needed to reach the gateway
+	addRule(connection, chain,
+		matchProtocol(unix.ETH_P_IP),
+		drop())
+	addRule(connection, chain,
+		matchProtocol(unix.ETH_P_IPV6),
+		matchL4Protocol(expr.CmpOpNeq, unix.IPPROTO_ICMPV6),
+		drop())
+	addRule(connection, chain,
+		matchProtocol(unix.ETH_P_IPV6),
+		matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_ICMPV6),
+		matchICMPv6Type(expr.CmpOpLt, icmpv6RouterSolicitation),
+		drop())
+	addRule(connection, chain,
+		matchProtocol(unix.ETH_P_IPV6),
+		matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_ICMPV6),
+		matchICMPv6Type(expr.CmpOpGt, icmpv6Redirect),
+		drop())
+}
+
+func matchEgressRule(rule egressRule) [][]expr.Any {
+	// Match the destination of an egress rule
+
+	matches := [][]expr.Any{}
+
+	if rule.Prefix.Addr().Is4() {
+		matches = append(matches,
+			matchProtocol(unix.ETH_P_IP),
+			matchPrefix(expr.PayloadBaseNetworkHeader, 16, expr.CmpOpEq, rule.Prefix))
+	} else {
+		matches = append(matches,
+			matchProtocol(unix.ETH_P_IPV6),
+			matchPrefix(expr.PayloadBaseNetworkHeader, 24, expr.CmpOpEq, rule.Prefix))
+	}
+
+	if rule.Protocol == "" {
+		return matches
+	}
+
+	protocol := byte(unix.IPPROTO_TCP)
+	if rule.Protocol == "udp" {
+		protocol = unix.IPPROTO_UDP
+	}
+
+	matches = append(matches, matchL4Protocol(expr.CmpOpEq, protocol))
+
+	if rule.FirstPort == 0 {
+		return matches
+	}
+
+	// Destination port
+	matches = append(matches, []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: binaryutil.BigEndian.PutUint16(rule.FirstPort)},
+		&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint16(rule.LastPort)},
+	})
+
+	return matches
+}
+
+func matchL4Protocol(op expr.CmpOp, protocol byte) []expr.Any {
+	// Compare the transport protocol
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: []byte{protocol}},
+	}
+}
+
+func matchICMPv6Type(op expr.CmpOp, icmpType byte) []expr.Any {
+	// Compare the ICMPv6 message type
+
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: []byte{icmpType}},
+	}
+}
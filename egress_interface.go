@@ -0,0 +1,157 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+)
+
+// Holds the egress interfaces so they can be swapped without touching the rules
+const firewallEgressSetName = "egress"
+
+func firewallEgressSet() *nftables.Set {
+	return &nftables.Set{Table: firewallTable(), Name: firewallEgressSetName, KeyType: nftables.TypeIFName}
+}
+
+func (i *InstanceGroup) checkEgressInterface() error {
+	// Use the interface of the default route if no egress interface was configured
+
+	// Only NATed guests are routed through the egress interface
+	if i.EgressInterface != "" || i.isBridged() || i.usesPasst() {
+		return nil
+	}
+
+	egressInterface, err := detectEgressInterface()
+	if err != nil {
+		return fmt.Errorf("no egress_interface was configured and it could not be detected: %w", err)
+	}
+
+	i.EgressInterface = egressInterface
+	i.egressInterfaceDetected = true
+
+	i.logger.Info("detected egress interface from the default route", "interface", egressInterface)
+
+	return nil
+}
+
+func detectEgressInterface() (string, error) {
+	// Get the interface of the IPv4 default route with the lowest metric
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+
+	var defaultRoute *netlink.Route
+	for index, route := range routes {
+		if route.Dst != nil {
+			ones, _ := route.Dst.Mask.Size()
+			if ones != 0 {
+				continue
+			}
+		}
+
+		if defaultRoute == nil || route.Priority < defaultRoute.Priority {
+			defaultRoute = &routes[index]
+		}
+	}
+
+	if defaultRoute == nil {
+		return "", errors.New("there is no IPv4 default route")
+	}
+
+	// Multipath routes carry the interface in their next hops
+	linkIndex := defaultRoute.LinkIndex
+	if linkIndex == 0 && len(defaultRoute.MultiPath) > 0 {
+		linkIndex = defaultRoute.MultiPath[0].LinkIndex
+	}
+
+	link, err := netlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return "", fmt.Errorf("could not look up the default route's interface: %w", err)
+	}
+
+	return link.Attrs().Name, nil
+}
+
+func (i *InstanceGroup) watchEgressInterface(ctx context.Context) {
+	// Follow the default route to another interface, e.g. after a NIC rename or failover
+
+	updates := make(chan netlink.RouteUpdate)
+	err := netlink.RouteSubscribeWithOptions(updates, ctx.Done(), netlink.RouteSubscribeOptions{
+		ErrorCallback: func(err error) {
+			// The subscription errors out when it is closed on shutdown
+			if ctx.Err() == nil {
+				i.logger.Error("error watching routes for egress interface changes", "error", err)
+			}
+		},
+	})
+	if err != nil {
+		i.logger.Error("could not watch routes for egress interface changes", "error", err)
+		return
+	}
+
+	currentInterface := i.EgressInterface
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-updates:
+			if !ok {
+				return
+			}
+
+			egressInterface, err := detectEgressInterface()
+			if err != nil {
+				// The default route may be gone for a moment while it is being replaced
+				i.logger.Debug("could not detect egress interface after route change", "error", err)
+				continue
+			}
+
+			if egressInterface == currentInterface {
+				continue
+			}
+
+			err = setFirewallEgressInterfaces(i.egressInterfaces(egressInterface))
+			if err != nil {
+				i.logger.Error("could not update egress interface", "interface", egressInterface, "error", err)
+				continue
+			}
+
+			i.logger.Info("egress interface changed", "previous", currentInterface, "interface", egressInterface)
+			currentInterface = egressInterface
+		}
+	}
+}
+
+func setFirewallEgressInterfaces(egressInterfaces []string) error {
+	// Replace the egress interfaces in the firewall set
+
+	connection, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	egressSet := firewallEgressSet()
+	connection.FlushSet(egressSet)
+
+	err = connection.SetAddElements(egressSet, egressSetElements(egressInterfaces))
+	if err != nil {
+		return err
+	}
+
+	return connection.Flush()
+}
+
+func egressSetElements(egressInterfaces []string) []nftables.SetElement {
+	elements := []nftables.SetElement{}
+	for _, egressInterface := range egressInterfaces {
+		elements = append(elements, nftables.SetElement{Key: interfaceName(egressInterface)})
+	}
+
+	return elements
+}
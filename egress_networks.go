@@ -0,0 +1,204 @@
+package fleetingd
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Names of egress_networks end up in the names of their sets
+var egressNetworkNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// A named group of networks the guests may or may not reach, e.g. an artifact cache VLAN or the IPMI network
+type egressNetwork struct {
+	CIDRs  []string `json:"cidrs"`
+	Policy string   `json:"policy"`
+}
+
+// An egress network as it is compiled into its sets, one per address family
+type parsedEgressNetwork struct {
+	Name     string
+	Policy   string
+	Prefixes []netip.Prefix
+}
+
+func (i *InstanceGroup) parseEgressNetworks() error {
+	// Validate egress_networks and parse their CIDRs, sorted by name so the rules come out the same every time
+
+	i.egressNetworks = []parsedEgressNetwork{}
+
+	if len(i.EgressNetworks) == 0 {
+		return nil
+	}
+
+	names := []string{}
+	for name := range i.EgressNetworks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		network := i.EgressNetworks[name]
+
+		if !egressNetworkNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid name '%s' in egress_networks, must be up to 32 lowercase letters, digits and underscores starting with a letter", name)
+		}
+
+		if network.Policy != egressPolicyAllow && network.Policy != egressPolicyDeny {
+			return fmt.Errorf("unknown policy '%s' of %s in egress_networks, must be one of: %s, %s", network.Policy, name, egressPolicyAllow, egressPolicyDeny)
+		}
+
+		if len(network.CIDRs) == 0 {
+			return fmt.Errorf("network %s in egress_networks has no cidrs", name)
+		}
+
+		parsedNetwork := parsedEgressNetwork{Name: name, Policy: network.Policy}
+		for _, cidr := range network.CIDRs {
+			// Only the destination of an egress rule is allowed here
+			rule, err := parseEgressRule(cidr)
+			if err != nil || rule.Protocol != "" {
+				return fmt.Errorf("invalid CIDR '%s' of %s in egress_networks", cidr, name)
+			}
+
+			parsedNetwork.Prefixes = append(parsedNetwork.Prefixes, rule.Prefix)
+		}
+
+		i.egressNetworks = append(i.egressNetworks, parsedNetwork)
+	}
+
+	return nil
+}
+
+func egressNetworkSet(name string, ipv6 bool) *nftables.Set {
+	// Get the set holding one family's addresses of an egress network
+
+	if ipv6 {
+		return &nftables.Set{Table: firewallTable(), Name: fmt.Sprintf("net_%s_v6", name), KeyType: nftables.TypeIP6Addr, Interval: true}
+	}
+
+	return &nftables.Set{Table: firewallTable(), Name: fmt.Sprintf("net_%s_v4", name), KeyType: nftables.TypeIPAddr, Interval: true}
+}
+
+func (i *InstanceGroup) addEgressNetworkSets(connection nftablesBatch) error {
+	// Queue the sets of the egress networks, families a network has no addresses of get no set
+
+	for _, network := range i.egressNetworks {
+		for _, ipv6 := range []bool{false, true} {
+			elements := egressNetworkSetElements(network.Prefixes, ipv6)
+			if len(elements) == 0 {
+				continue
+			}
+
+			err := connection.AddSet(egressNetworkSet(network.Name, ipv6), elements)
+			if err != nil {
+				return fmt.Errorf("could not add set of %s in egress_networks: %w", network.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func egressNetworkSetElements(prefixes []netip.Prefix, ipv6 bool) []nftables.SetElement {
+	// Get the elements of an interval set covering the prefixes of one family, the kernel refuses overlapping intervals so they are merged
+
+	type addressRange struct {
+		first netip.Addr
+		last  netip.Addr
+	}
+
+	ranges := []addressRange{}
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is6() != ipv6 {
+			continue
+		}
+		ranges = append(ranges, addressRange{first: prefix.Addr(), last: lastAddress(prefix)})
+	}
+
+	sort.Slice(ranges, func(a, b int) bool {
+		return ranges[a].first.Less(ranges[b].first)
+	})
+
+	merged := []addressRange{}
+	for _, current := range ranges {
+		if len(merged) > 0 {
+			previous := &merged[len(merged)-1]
+			next := previous.last.Next()
+			if !next.IsValid() || current.first.Compare(next) <= 0 {
+				if current.last.Compare(previous.last) > 0 {
+					previous.last = current.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, current)
+	}
+
+	// An interval ends at the address after its last one, the one reaching the end of the address space is left open
+	elements := []nftables.SetElement{}
+	for _, addresses := range merged {
+		elements = append(elements, nftables.SetElement{Key: addresses.first.AsSlice()})
+
+		end := addresses.last.Next()
+		if end.IsValid() {
+			elements = append(elements, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+		}
+	}
+
+	return elements
+}
+
+func lastAddress(prefix netip.Prefix) netip.Addr {
+	// Get the highest address of a prefix
+
+	address := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(address)*8; bit++ {
+		address[bit/8] |= 0x80 >> (bit % 8)
+	}
+
+	last, _ := netip.AddrFromSlice(address)
+	return last
+}
+
+func (i *InstanceGroup) addEgressNetworkRules(connection nftablesBatch, chain *nftables.Chain, policy string, verdict []expr.Any) {
+	// Queue the rules of an instance's ingress chain for the egress networks with the given policy
+
+	for _, network := range i.egressNetworks {
+		if network.Policy != policy {
+			continue
+		}
+
+		for _, ipv6 := range []bool{false, true} {
+			if len(egressNetworkSetElements(network.Prefixes, ipv6)) == 0 {
+				continue
+			}
+
+			// ip daddr @net_NAME_v4 drop, ip6 daddr @net_NAME_v6 accept
+			addRule(connection, chain, append(matchAddressSet(egressNetworkSet(network.Name, ipv6)), verdict)...)
+		}
+	}
+}
+
+func matchAddressSet(set *nftables.Set) [][]expr.Any {
+	// Look the destination address up in a set of the set's family
+
+	protocol := uint16(unix.ETH_P_IP)
+	offset, length := uint32(16), uint32(4)
+	if set.KeyType == nftables.TypeIP6Addr {
+		protocol = unix.ETH_P_IPV6
+		offset, length = 24, 16
+	}
+
+	return [][]expr.Any{
+		matchProtocol(protocol),
+		{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		},
+	}
+}
@@ -0,0 +1,194 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Routing table and rule priority for the guests' destination based routes, the rules go before the main table
+const defaultEgressRouteTable = 2810
+const egressRoutePriority = 1000
+
+type egressRoute struct {
+	Destination netip.Prefix
+	Interface   string
+
+	// Optional, directly connected destinations don't need one
+	Gateway netip.Addr
+}
+
+func parseEgressRoute(route string) (egressRoute, error) {
+	// Parse an egress route of the form "CIDR INTERFACE [via GATEWAY]"
+
+	fields := strings.Fields(route)
+	if (len(fields) != 2 && len(fields) != 4) || (len(fields) == 4 && fields[2] != "via") {
+		return egressRoute{}, fmt.Errorf("invalid egress route '%s', must be of the form 'CIDR INTERFACE [via GATEWAY]'", route)
+	}
+
+	destination, err := netip.ParsePrefix(fields[0])
+	if err != nil || !destination.Addr().Is4() {
+		return egressRoute{}, fmt.Errorf("invalid destination in egress route '%s', must be an IPv4 CIDR", route)
+	}
+
+	_, err = net.InterfaceByName(fields[1])
+	if err != nil {
+		return egressRoute{}, fmt.Errorf("interface of egress route '%s' can not be found: %w", route, err)
+	}
+
+	parsedRoute := egressRoute{Destination: destination.Masked(), Interface: fields[1]}
+
+	if len(fields) == 4 {
+		gateway, err := netip.ParseAddr(fields[3])
+		if err != nil || !gateway.Is4() {
+			return egressRoute{}, fmt.Errorf("invalid gateway in egress route '%s', must be an IPv4 address", route)
+		}
+		parsedRoute.Gateway = gateway
+	}
+
+	return parsedRoute, nil
+}
+
+func (i *InstanceGroup) parseEgressRoutes() error {
+	// Parse the routes sending guest traffic to other uplinks than the egress interface
+
+	i.egressRoutes = []egressRoute{}
+
+	// Also set without routes, so the ones of an earlier run get cleaned up
+	if i.EgressRouteTable == 0 {
+		i.EgressRouteTable = defaultEgressRouteTable
+	}
+
+	if len(i.EgressRoutes) == 0 {
+		return nil
+	}
+
+	// Bridged and passt guests are not routed by the host
+	if i.isBridged() || i.usesPasst() {
+		return errors.New("egress_routes can only be used with network_mode nat")
+	}
+
+	for _, route := range i.EgressRoutes {
+		parsedRoute, err := parseEgressRoute(route)
+		if err != nil {
+			return err
+		}
+		i.egressRoutes = append(i.egressRoutes, parsedRoute)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) egressInterfaces(egressInterface string) []string {
+	// Get all interfaces guest traffic may leave through, they are all forwarded and masqueraded
+
+	interfaces := []string{egressInterface}
+	for _, route := range i.egressRoutes {
+		if !slices.Contains(interfaces, route.Interface) {
+			interfaces = append(interfaces, route.Interface)
+		}
+	}
+
+	return interfaces
+}
+
+func (i *InstanceGroup) SetupEgressRoutes() error {
+	// Replace the guests' routing rules and the routes in the plugin's routing table
+
+	err := i.RemoveEgressRoutes()
+	if err != nil {
+		return err
+	}
+
+	if len(i.egressRoutes) == 0 {
+		return nil
+	}
+
+	vmSubnet, err := netip.ParsePrefix(i.VMSubnet + "0/24")
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as vm_subnet but is not a valid subnet: %w", i.VMSubnet, err)
+	}
+
+	for _, route := range i.egressRoutes {
+		link, err := netlink.LinkByName(route.Interface)
+		if err != nil {
+			return fmt.Errorf("could not find interface of egress route to %s: %w", route.Destination, err)
+		}
+
+		tableRoute := &netlink.Route{
+			Dst:       prefixToIPNet(route.Destination),
+			LinkIndex: link.Attrs().Index,
+			Table:     i.EgressRouteTable,
+		}
+		if route.Gateway.IsValid() {
+			tableRoute.Gw = route.Gateway.AsSlice()
+		}
+
+		err = netlink.RouteAdd(tableRoute)
+		if err != nil {
+			return fmt.Errorf("could not add egress route to %s: %w", route.Destination, err)
+		}
+
+		// from vm_subnet to destination lookup table
+		rule := netlink.NewRule()
+		rule.Family = unix.AF_INET
+		rule.Priority = egressRoutePriority
+		rule.Table = i.EgressRouteTable
+		rule.Src = prefixToIPNet(vmSubnet)
+		rule.Dst = prefixToIPNet(route.Destination)
+
+		err = netlink.RuleAdd(rule)
+		if err != nil {
+			return fmt.Errorf("could not add routing rule for egress route to %s: %w", route.Destination, err)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) RemoveEgressRoutes() error {
+	// Remove the guests' routing rules and flush the plugin's routing table
+
+	rules, err := netlink.RuleList(unix.AF_INET)
+	if err != nil {
+		return fmt.Errorf("could not list routing rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		if rule.Table != i.EgressRouteTable {
+			continue
+		}
+
+		err = netlink.RuleDel(&rule)
+		if err != nil {
+			return fmt.Errorf("could not remove routing rule: %w", err)
+		}
+	}
+
+	routes, err := netlink.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: i.EgressRouteTable}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("could not list egress routes: %w", err)
+	}
+
+	for _, route := range routes {
+		err = netlink.RouteDel(&route)
+		if err != nil {
+			return fmt.Errorf("could not remove egress route: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func prefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
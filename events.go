@@ -0,0 +1,127 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Steps of a boot, in the order they happen, and of the prebuild
+const (
+	eventSlotAllocated    = "slot_allocated"
+	eventUserdataWritten  = "userdata_written"
+	eventProcessStarted   = "process_started"
+	eventTapUp            = "tap_up"
+	eventFirewallApplied  = "nft_applied"
+	eventSSHReady         = "ssh_ready"
+	eventBootFailed       = "boot_failed"
+	eventGuestPanic       = "guest_panic"
+	eventPrebuildStarted  = "prebuild_started"
+	eventPrebuildFinished = "prebuild_finished"
+)
+
+// Every boot event gets its own histogram, a failed boot is timed until it gave up
+var bootEventNames = []string{eventSlotAllocated, eventUserdataWritten, eventProcessStarted, eventTapUp, eventFirewallApplied, eventSSHReady, eventBootFailed}
+
+// Enough for the boots of a few hundred instances
+const recentEventsSize = 2048
+
+// Something that happened to an instance, timed from the start of its boot or the prebuild
+type lifecycleEvent struct {
+	Time           time.Time `json:"time"`
+	Instance       string    `json:"instance"`
+	Event          string    `json:"event"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Hands the lifecycle events to everyone interested, subscribers are added before the first event is published
+type eventBus struct {
+	subscribers []func(lifecycleEvent)
+}
+
+// The latest events, the oldest one is dropped once it is full
+type recentEvents struct {
+	lock   sync.Mutex
+	events []lifecycleEvent
+	next   int
+	full   bool
+}
+
+func (b *eventBus) subscribe(subscriber func(lifecycleEvent)) {
+	b.subscribers = append(b.subscribers, subscriber)
+}
+
+func (b *eventBus) publish(event lifecycleEvent) {
+	// Subscribers are called in order and must not block
+
+	for _, subscriber := range b.subscribers {
+		subscriber(event)
+	}
+}
+
+func newRecentEvents(size int) *recentEvents {
+	return &recentEvents{events: make([]lifecycleEvent, size)}
+}
+
+func (r *recentEvents) record(event lifecycleEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *recentEvents) list(instanceName string) []lifecycleEvent {
+	// Get the recorded events oldest first, only the ones of an instance if instanceName is set
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ordered := r.events[:r.next]
+	if r.full {
+		ordered = slices.Concat(r.events[r.next:], r.events[:r.next])
+	}
+
+	result := []lifecycleEvent{}
+	for _, event := range ordered {
+		if instanceName == "" || event.Instance == instanceName {
+			result = append(result, event)
+		}
+	}
+
+	return result
+}
+
+func (i *Inventory) publishEvent(instanceName string, event string, started time.Time, err error) {
+	// Publish an event of an instance, started is when its boot or the prebuild started
+
+	now := time.Now()
+
+	lifecycleEvent := lifecycleEvent{
+		Time:           now,
+		Instance:       instanceName,
+		Event:          event,
+		ElapsedSeconds: now.Sub(started).Seconds(),
+	}
+	if err != nil {
+		lifecycleEvent.Error = err.Error()
+	}
+
+	i.events.publish(lifecycleEvent)
+}
+
+func (i *InstanceGroup) serveRecentEvents(w http.ResponseWriter, r *http.Request) {
+	// List the recent lifecycle events as JSON, ?instance=fleetingd3 limits them to one slot
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(i.inventory.recentEvents.list(r.URL.Query().Get("instance")))
+}
@@ -0,0 +1,253 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Maps the external ports to the per-instance DNAT chains
+const firewallExternalSSHMapName = "externalssh"
+
+const defaultExternalSSHPortBase = 22000
+
+// IPS_DST_NAT conntrack status bit
+const ctStatusDestinationNAT = 1 << 5
+
+// IP_CT_DIR_REPLY, packets going back to whoever opened the connection
+const ctDirectionReply = 1
+
+func (i *InstanceGroup) checkExternalAccess() error {
+	// Validate the address the instances' SSH ports are forwarded from
+
+	if i.ExternalAddress == "" {
+		return nil
+	}
+
+	address, err := netip.ParseAddr(i.ExternalAddress)
+	if err != nil || !address.Is4() {
+		return fmt.Errorf("'%s' was specified as external_address but is not an IPv4 address", i.ExternalAddress)
+	}
+
+	// Bridged guests are reachable without forwarding
+	if i.isBridged() {
+		return errors.New("external_address can not be combined with network_mode bridge")
+	}
+
+	if i.ExternalSSHPortBase == 0 {
+		i.ExternalSSHPortBase = defaultExternalSSHPortBase
+	}
+
+	if i.ExternalSSHPortBase+i.maxIPAMSlots() > 65535 {
+		return fmt.Errorf("external_ssh_port_base %d leaves no room for %d instances", i.ExternalSSHPortBase, i.maxIPAMSlots())
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) externalAccessEnabled() bool {
+	return i.ExternalAddress != ""
+}
+
+func (i *InstanceGroup) getExternalSSHPort(instanceIndex int) int {
+	// Each slot gets its own port
+
+	return i.ExternalSSHPortBase + instanceIndex
+}
+
+func firewallExternalSSHMap() *nftables.Set {
+	return &nftables.Set{
+		Table:    firewallTable(),
+		Name:     firewallExternalSSHMapName,
+		IsMap:    true,
+		KeyType:  nftables.TypeInetService,
+		DataType: nftables.TypeVerdict,
+	}
+}
+
+func externalSSHChainName(instanceName string) string {
+	return "ssh_" + instanceName
+}
+
+func (i *InstanceGroup) addExternalAccessRules(connection nftablesBatch, table *nftables.Table, forwardChain *nftables.Chain, tapSet *nftables.Set) error {
+	// Queue the chain DNATing the external SSH ports, instances add their port to the map
+
+	if !i.externalAccessEnabled() {
+		return nil
+	}
+
+	externalSSHMap := firewallExternalSSHMap()
+	err := connection.AddSet(externalSSHMap, nil)
+	if err != nil {
+		return err
+	}
+
+	chain := connection.AddChain(&nftables.Chain{
+		Name:     "externaltotap",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+
+	externalAddress := netip.MustParseAddr(i.ExternalAddress)
+
+	// ip daddr external tcp dport vmap @externalssh
+	addRule(connection, chain,
+		matchFamily(unix.NFPROTO_IPV4),
+		[]expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: externalAddress.AsSlice()},
+		},
+		matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_TCP),
+		[]expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: externalSSHMap.Name, SetID: externalSSHMap.ID},
+		})
+
+	// The external address may not be on the egress interface, so allow forwarded connections by their DNAT state
+	addRule(connection, forwardChain,
+		matchInterfaceSet(expr.MetaKeyOIFNAME, tapSet),
+		matchDestinationNAT(),
+		accept())
+
+	return nil
+}
+
+func (i *InstanceGroup) addExternalSSHReplyRules(connection nftablesBatch, forwardChain *nftables.Chain, tapSet *nftables.Set, egressSet *nftables.Set) {
+	// Queue the forward rules letting only the replies of forwarded SSH connections leave from port 22, the ingress chains let them skip the egress rules
+
+	if !i.externalAccessEnabled() {
+		return
+	}
+
+	matches := [][]expr.Any{
+		matchFamily(unix.NFPROTO_IPV4),
+		matchInterfaceSet(expr.MetaKeyIIFNAME, tapSet),
+		matchInterfaceSet(expr.MetaKeyOIFNAME, egressSet),
+		matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_TCP),
+		matchPayload(expr.PayloadBaseTransportHeader, 0, expr.CmpOpEq, binaryutil.BigEndian.PutUint16(22)),
+	}
+
+	// ct status dnat ct direction reply accept
+	addRule(connection, forwardChain, append(append(matches, matchDestinationNAT()),
+		[]expr.Any{
+			&expr.Ct{Key: expr.CtKeyDIRECTION, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{ctDirectionReply}},
+		},
+		accept())...)
+
+	// Anything else from port 22 is a connection the guest opened itself, which the egress rules didn't see
+	addRule(connection, forwardChain, append(matches, drop())...)
+}
+
+func matchDestinationNAT() []expr.Any {
+	// Match the packets of connections which were DNATed, in both directions
+
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATUS, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(ctStatusDestinationNAT),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func parseExternalSSHPort(externalSSHAddress string) ([]byte, error) {
+	// Get the map key of a forwarded address
+
+	_, port, err := net.SplitHostPort(externalSSHAddress)
+	if err != nil {
+		return nil, err
+	}
+	externalPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return binaryutil.BigEndian.PutUint16(uint16(externalPort)), nil
+}
+
+func (i *InstanceGroup) addInstanceExternalAccess(connection nftablesBatch, instance *InstanceInfo) error {
+	// Queue the DNAT chain of an instance and map its external port to it
+
+	if instance.ExternalSSHAddress == "" {
+		return nil
+	}
+
+	key, err := parseExternalSSHPort(instance.ExternalSSHAddress)
+	if err != nil {
+		return err
+	}
+
+	instanceTapIP, err := netip.ParseAddr(instance.InstanceTapIP)
+	if err != nil {
+		return err
+	}
+
+	chain := connection.AddChain(&nftables.Chain{
+		Name:  externalSSHChainName(instance.Name),
+		Table: firewallTable(),
+	})
+
+	// dnat ip to instance:22
+	addRule(connection, chain, []expr.Any{
+		&expr.Counter{},
+		&expr.Immediate{Register: 1, Data: instanceTapIP.AsSlice()},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(22)},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2, Specified: true},
+	})
+
+	return connection.SetAddElements(firewallExternalSSHMap(), []nftables.SetElement{{
+		Key:         key,
+		VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name},
+	}})
+}
+
+func (i *InstanceGroup) removeInstanceExternalAccess(connection *nftables.Conn, instanceName string, externalSSHAddress string) error {
+	// Queue removing the DNAT chain of an instance, the map element referencing it goes first
+
+	if externalSSHAddress == "" {
+		return nil
+	}
+
+	key, err := parseExternalSSHPort(externalSSHAddress)
+	if err != nil {
+		return err
+	}
+
+	externalSSHMap := firewallExternalSSHMap()
+	elements, err := connection.GetSetElements(externalSSHMap)
+	if err != nil {
+		return fmt.Errorf("could not list nftables external SSH map: %w", err)
+	}
+
+	for _, element := range elements {
+		if string(element.Key) == string(key) {
+			err = connection.SetDeleteElements(externalSSHMap, []nftables.SetElement{{Key: key}})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	chain, err := connection.ListChain(firewallTable(), externalSSHChainName(instanceName))
+	if err == nil && chain != nil {
+		connection.FlushChain(chain)
+		connection.DelChain(chain)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package fleetingd
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func (i *InstanceGroup) parseExtraAuthorizedKeys() error {
+	// Validate vm_extra_authorized_keys, lines in authorized_keys format of operators' keys which every job instance accepts next to the runner's
+
+	i.extraAuthorizedKeys = nil
+	i.extraAuthorizedKeyFingerprints = nil
+
+	for index, line := range i.VMExtraAuthorizedKeys {
+		line = strings.TrimSpace(line)
+
+		publicKey, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("invalid key %d in vm_extra_authorized_keys: %w", index+1, err)
+		}
+		if len(rest) > 0 || strings.Contains(line, "\n") {
+			return fmt.Errorf("key %d in vm_extra_authorized_keys has more than one line", index+1)
+		}
+
+		i.extraAuthorizedKeys = append(i.extraAuthorizedKeys, line)
+		i.extraAuthorizedKeyFingerprints = append(i.extraAuthorizedKeyFingerprints, ssh.FingerprintSHA256(publicKey))
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) authorizedKeys(instanceKey string) []string {
+	// Get the authorized_keys lines of a job instance, the runner's key first
+
+	return append([]string{instanceKey}, i.extraAuthorizedKeys...)
+}
@@ -0,0 +1,195 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Extra disks show up in the guest as /dev/disk/by-id/virtio-<serial>, virtio-blk serials are at most 20 bytes
+const extraDiskSerialPrefix = "fleetingd-extra"
+
+var extraDiskFilesystems = []string{"ext4", "xfs", "btrfs"}
+
+// An empty disk created for every instance, formatted and mounted on first boot
+type extraDisk struct {
+	SizeGB     uint64
+	Filesystem string
+	Mountpoint string
+}
+
+// How the guest's provisioning finds and mounts an extra disk
+type extraDiskMount struct {
+	Device     string
+	Filesystem string
+	Mountpoint string
+	Unit       string
+
+	// Only disks starting out empty are formatted unconditionally
+	Wipe bool
+}
+
+func parseExtraDisk(disk string) (extraDisk, error) {
+	// Parse an extra disk of the form "SIZE_GB FILESYSTEM MOUNTPOINT"
+
+	fields := strings.Fields(disk)
+	if len(fields) != 3 {
+		return extraDisk{}, fmt.Errorf("invalid extra disk '%s', must be of the form 'SIZE_GB FILESYSTEM MOUNTPOINT'", disk)
+	}
+
+	sizeGB, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil || sizeGB == 0 {
+		return extraDisk{}, fmt.Errorf("invalid size in extra disk '%s', must be a positive number of GB", disk)
+	}
+
+	if !slices.Contains(extraDiskFilesystems, fields[1]) {
+		return extraDisk{}, fmt.Errorf("unsupported filesystem in extra disk '%s', supported are %s", disk, strings.Join(extraDiskFilesystems, ", "))
+	}
+
+	if !path.IsAbs(fields[2]) || path.Clean(fields[2]) == "/" {
+		return extraDisk{}, fmt.Errorf("invalid mountpoint in extra disk '%s', must be an absolute path below /", disk)
+	}
+
+	return extraDisk{SizeGB: sizeGB, Filesystem: fields[1], Mountpoint: path.Clean(fields[2])}, nil
+}
+
+func (i *InstanceGroup) parseExtraDisks() error {
+	// Parse the scratch disks attached to every instance next to its root disk
+
+	if len(i.VMExtraDisks) == 0 {
+		return nil
+	}
+
+	// Restored VMs keep the disks of the template VM
+	if i.VMSnapshotBoot {
+		return errors.New("vm_extra_disks can not be combined with vm_snapshot_boot")
+	}
+
+	for _, disk := range i.VMExtraDisks {
+		parsedDisk, err := parseExtraDisk(disk)
+		if err != nil {
+			return err
+		}
+
+		for _, existingDisk := range i.extraDisks {
+			if existingDisk.Mountpoint == parsedDisk.Mountpoint {
+				return fmt.Errorf("extra disk '%s' uses mountpoint %s of another extra disk", disk, parsedDisk.Mountpoint)
+			}
+		}
+
+		i.extraDisks = append(i.extraDisks, parsedDisk)
+	}
+
+	return nil
+}
+
+func extraDiskSerial(index int) string {
+	return fmt.Sprintf("%s%d", extraDiskSerialPrefix, index)
+}
+
+func (i *InstanceGroup) getExtraDiskPath(instanceName string, index int) string {
+	// Get the path of an instance's extra disk in the working directory
+
+	return filepath.Join(i.getInstanceDir(instanceName), fmt.Sprintf("extra%d.img", index))
+}
+
+func (i *InstanceGroup) createExtraDisks(instanceName string) ([]string, error) {
+	// Create an instance's extra disks as sparse raw images, blocks are only allocated once the guest writes them
+
+	var paths []string
+
+	for index, disk := range i.extraDisks {
+		diskPath := i.getExtraDiskPath(instanceName, index)
+
+		diskFile, err := os.OpenFile(diskPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return paths, fmt.Errorf("could not create extra disk %s: %w", diskPath, err)
+		}
+		paths = append(paths, diskPath)
+
+		err = diskFile.Truncate(int64(disk.SizeGB) * 1024 * 1024 * 1024)
+		if err != nil {
+			diskFile.Close()
+			return paths, fmt.Errorf("could not create extra disk %s: %w", diskPath, err)
+		}
+
+		err = diskFile.Close()
+		if err != nil {
+			return paths, err
+		}
+	}
+
+	return paths, nil
+}
+
+func (i *InstanceGroup) extraDiskArgs(paths []string) []string {
+	// Get the --disk arguments of an instance's extra disks, the serial lets the guest find them regardless of their order
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	args := []string{"--disk"}
+	for index, diskPath := range paths {
+		diskArg := fmt.Sprintf("path=%s,serial=%s", diskPath, extraDiskSerial(index))
+
+		if i.VMDiskDirectIO {
+			// Bypass the host page cache
+			diskArg += ",direct=on"
+		}
+
+		args = append(args, diskArg+i.diskQueueOptions())
+	}
+
+	return args
+}
+
+func (i *InstanceGroup) extraDiskMounts() []extraDiskMount {
+	// Get the extra disks and the slot's cache disk as the guest sees them
+
+	var mounts []extraDiskMount
+	for index, disk := range i.extraDisks {
+		mounts = append(mounts, extraDiskMount{
+			Device:     "/dev/disk/by-id/virtio-" + extraDiskSerial(index),
+			Filesystem: disk.Filesystem,
+			Mountpoint: disk.Mountpoint,
+			Unit:       systemdMountUnitName(disk.Mountpoint),
+			Wipe:       true,
+		})
+	}
+
+	// The cache disk keeps the filesystem of the slot's previous instances
+	if i.slotCacheDisk != nil {
+		mounts = append(mounts, extraDiskMount{
+			Device:     "/dev/disk/by-id/virtio-" + slotCacheDiskSerial,
+			Filesystem: i.slotCacheDisk.Filesystem,
+			Mountpoint: i.slotCacheDisk.Mountpoint,
+			Unit:       systemdMountUnitName(i.slotCacheDisk.Mountpoint),
+		})
+	}
+
+	return mounts
+}
+
+func systemdMountUnitName(mountpoint string) string {
+	// Get the name of the mount unit of a path the way systemd-escape --path does, e.g. var-lib-docker.mount
+
+	var name strings.Builder
+	for index, char := range []byte(strings.Trim(mountpoint, "/")) {
+		switch {
+		case char == '/':
+			name.WriteByte('-')
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9', char == '_', char == '.' && index > 0:
+			name.WriteByte(char)
+		default:
+			fmt.Fprintf(&name, `\x%02x`, char)
+		}
+	}
+
+	return name.String() + ".mount"
+}
@@ -0,0 +1,574 @@
+package fleetingd
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// All rules live in this table, other tables are never touched
+const firewallTableName = "fleetingd"
+
+// Set of the instances' tap devices the shared forwarding and NAT rules match against
+const firewallTapSetName = "taps"
+
+// Where the rules are queued, a connection sends them to the kernel on Flush while render only prints them
+type nftablesBatch interface {
+	AddChain(chain *nftables.Chain) *nftables.Chain
+	AddRule(rule *nftables.Rule) *nftables.Rule
+	AddSet(set *nftables.Set, elements []nftables.SetElement) error
+	SetAddElements(set *nftables.Set, elements []nftables.SetElement) error
+}
+
+// Tables used by earlier versions, see removeLegacyFirewallTables
+var legacyFirewallTables = []nftables.Table{
+	{Family: nftables.TableFamilyIPv4, Name: "fleetingdforwarding"},
+	{Family: nftables.TableFamilyNetdev, Name: "fleetingdfilter"},
+	{Family: nftables.TableFamilyIPv4, Name: "fleetingdsnat"},
+	{Family: nftables.TableFamilyIPv6, Name: "fleetingdforwarding6"},
+	{Family: nftables.TableFamilyIPv6, Name: "fleetingdsnat6"},
+}
+
+// NF_INET_INGRESS, ChainHookIngress is the netdev family's hook number which is different
+var chainHookInetIngress = nftables.ChainHookRef(5)
+
+func firewallTable() *nftables.Table {
+	return &nftables.Table{Family: nftables.TableFamilyINet, Name: firewallTableName}
+}
+
+func firewallTapSet() *nftables.Set {
+	return &nftables.Set{Table: firewallTable(), Name: firewallTapSetName, KeyType: nftables.TypeIFName}
+}
+
+func (i *InstanceGroup) SetupFirewall() error {
+	// Replace the plugin's table with the shared chains, instances add and remove their own rules later
+
+	connection, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	// Adding the table first guarantees it exists, so the deletion can't fail the batch
+	table := firewallTable()
+	connection.AddTable(table)
+	connection.DelTable(table)
+	connection.AddTable(table)
+
+	err = i.addSharedChains(connection, table)
+	if err != nil {
+		return err
+	}
+
+	err = connection.Flush()
+	if err != nil {
+		return fmt.Errorf("could not set up nftables table: %w", err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) addSharedChains(connection nftablesBatch, table *nftables.Table) error {
+	// Queue the sets and chains all instances share
+
+	tapSet := firewallTapSet()
+	err := connection.AddSet(tapSet, nil)
+	if err != nil {
+		return err
+	}
+
+	err = i.addEgressNetworkSets(connection)
+	if err != nil {
+		return err
+	}
+
+	macSet := firewallMACSet()
+	if i.isBridged() {
+		err = connection.AddSet(macSet, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Bridged traffic is neither routed nor NATed by the host
+	if !i.isBridged() {
+		err = i.addForwardingRules(connection, table, tapSet)
+		if err != nil {
+			return err
+		}
+
+		err = i.addConnectionLimitRules(connection, table)
+		if err != nil {
+			return err
+		}
+	}
+
+	i.addHostProtectionChain(connection, table, tapSet, macSet)
+
+	return nil
+}
+
+func (i *InstanceGroup) addForwardingRules(connection nftablesBatch, table *nftables.Table, tapSet *nftables.Set) error {
+	// Only forward between the taps and the egress interface and masquerade on the way out
+
+	egressSet := firewallEgressSet()
+	err := connection.AddSet(egressSet, egressSetElements(i.egressInterfaces(i.EgressInterface)))
+	if err != nil {
+		return err
+	}
+
+	forwardChain := connection.AddChain(&nftables.Chain{
+		Name:     "dropnottap",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   policyRef(nftables.ChainPolicyDrop),
+	})
+
+	// Leave forwarding of IPv6 to the host's firewall if the guests don't use it
+	if !i.ipv6Prefix.IsValid() {
+		addRule(connection, forwardChain,
+			matchFamily(unix.NFPROTO_IPV6),
+			[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}})
+	}
+
+	// Ahead of the accepts, the ingress chains let everything through which may be a reply to a forwarded SSH connection
+	i.addExternalSSHReplyRules(connection, forwardChain, tapSet, egressSet)
+
+	addRule(connection, forwardChain,
+		matchInterfaceSet(expr.MetaKeyIIFNAME, egressSet),
+		matchInterfaceSet(expr.MetaKeyOIFNAME, tapSet),
+		accept())
+	addRule(connection, forwardChain,
+		matchInterfaceSet(expr.MetaKeyIIFNAME, tapSet),
+		matchInterfaceSet(expr.MetaKeyOIFNAME, egressSet),
+		accept())
+
+	// The instances' ingress chains only let traffic to other instances through if isolate_instances is disabled
+	if !i.isolateInstances() {
+		addRule(connection, forwardChain,
+			matchInterfaceSet(expr.MetaKeyIIFNAME, tapSet),
+			matchInterfaceSet(expr.MetaKeyOIFNAME, tapSet),
+			accept())
+	}
+
+	snatChain := connection.AddChain(&nftables.Chain{
+		Name:     "taptonet",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+
+	matches := [][]expr.Any{
+		matchInterfaceSet(expr.MetaKeyIIFNAME, tapSet),
+		matchInterfaceSet(expr.MetaKeyOIFNAME, egressSet),
+	}
+
+	// Routed IPv6 keeps the guest addresses
+	if i.ipv6Prefix.IsValid() && i.VMIPv6Mode != ipv6ModeNAT {
+		matches = append(matches, matchFamily(unix.NFPROTO_IPV4))
+	}
+
+	addRule(connection, snatChain, append(matches, []expr.Any{&expr.Counter{}, &expr.Masq{FullyRandom: true}})...)
+
+	return i.addExternalAccessRules(connection, table, forwardChain, tapSet)
+}
+
+func (i *Inventory) AddInstanceFirewall(instanceGroup *InstanceGroup, name string) error {
+	// Add the ingress filter chain of an instance and its tap to the forwarding set
+
+	// passt instances have no tap device to filter
+	if instanceGroup.usesPasst() {
+		return nil
+	}
+
+	// Hold the lock until the rules are in place, so the instance can't be cleaned up before they are added
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	instance, ok := i.instances[name]
+	if !ok {
+		return fmt.Errorf("instance %s not found", name)
+	}
+
+	connection, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	err = instanceGroup.addInstanceRules(connection, instance)
+	if err != nil {
+		return err
+	}
+
+	err = connection.Flush()
+	if err != nil {
+		return fmt.Errorf("could not add nftables rules for instance %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) addInstanceRules(connection nftablesBatch, instance *InstanceInfo) error {
+	// Queue the chains of an instance and add it to the shared sets
+
+	err := i.addInstanceChain(connection, instance)
+	if err != nil {
+		return err
+	}
+
+	err = connection.SetAddElements(firewallTapSet(), []nftables.SetElement{{Key: interfaceName(instance.Name)}})
+	if err != nil {
+		return err
+	}
+
+	err = i.addInstanceExternalAccess(connection, instance)
+	if err != nil {
+		return err
+	}
+
+	err = i.addInstanceConnectionLimits(connection, instance)
+	if err != nil {
+		return err
+	}
+
+	if i.isBridged() {
+		macAddress, err := net.ParseMAC(instance.InstanceTapMacAddress)
+		if err != nil {
+			return err
+		}
+
+		err = connection.SetAddElements(firewallMACSet(), []nftables.SetElement{{Key: macAddress}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) addInstanceChain(connection nftablesBatch, instance *InstanceInfo) error {
+	// Queue the ingress filter chain of an instance, it only allows the instance's own addresses
+
+	macAddress, err := net.ParseMAC(instance.InstanceTapMacAddress)
+	if err != nil {
+		return err
+	}
+
+	chain := connection.AddChain(&nftables.Chain{
+		Name:     instance.Name,
+		Table:    firewallTable(),
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  chainHookInetIngress,
+		Priority: nftables.ChainPriorityFilter,
+		Device:   instance.Name,
+		Policy:   policyRef(nftables.ChainPolicyAccept),
+	})
+
+	// ether saddr != mac drop
+	addRule(connection, chain,
+		matchPayload(expr.PayloadBaseLLHeader, 6, expr.CmpOpNeq, macAddress),
+		drop())
+
+	// Bridged guests are not bound to addresses
+	if i.isBridged() {
+		i.addInstanceIsolationRules(connection, chain, netip.Prefix{})
+		i.addDestinationProtectionRules(connection, chain)
+		i.addEgressRules(connection, chain)
+		return nil
+	}
+
+	// Guests may only talk to their gateway, not to other addresses in the VM subnet
+	vmSubnet, err := netip.ParsePrefix(i.VMSubnet + "0/24")
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as vm_subnet but is not a valid subnet: %w", i.VMSubnet, err)
+	}
+
+	instanceTapIP, err := netip.ParseAddr(instance.InstanceTapIP)
+	if err != nil {
+		return err
+	}
+	instanceGateway, err := netip.ParseAddr(instance.HostTapIP)
+	if err != nil {
+		return err
+	}
+
+	// ip saddr != instance drop
+	addRule(connection, chain,
+		matchProtocol(unix.ETH_P_IP),
+		matchPayload(expr.PayloadBaseNetworkHeader, 12, expr.CmpOpNeq, instanceTapIP.AsSlice()),
+		drop())
+
+	if instance.InstanceTapIP6 != "" {
+		instanceTapIP6, err := netip.ParseAddr(instance.InstanceTapIP6)
+		if err != nil {
+			return err
+		}
+
+		// ip6 saddr != { instance, fe80::/10 } drop
+		addRule(connection, chain,
+			matchProtocol(unix.ETH_P_IPV6),
+			matchPayload(expr.PayloadBaseNetworkHeader, 8, expr.CmpOpNeq, instanceTapIP6.AsSlice()),
+			matchPrefix(expr.PayloadBaseNetworkHeader, 8, expr.CmpOpNeq, netip.MustParsePrefix("fe80::/10")),
+			drop())
+
+		instanceGateway6, err := netip.ParseAddr(instance.HostTapIP6)
+		if err != nil {
+			return err
+		}
+
+		// ip6 daddr gateway accept
+		addRule(connection, chain,
+			matchProtocol(unix.ETH_P_IPV6),
+			matchPayload(expr.PayloadBaseNetworkHeader, 24, expr.CmpOpEq, instanceGateway6.AsSlice()),
+			accept())
+	}
+
+	// ip daddr gateway accept
+	addRule(connection, chain,
+		matchProtocol(unix.ETH_P_IP),
+		matchPayload(expr.PayloadBaseNetworkHeader, 16, expr.CmpOpEq, instanceGateway.AsSlice()),
+		accept())
+
+	i.addInstanceIsolationRules(connection, chain, vmSubnet)
+	i.addDestinationProtectionRules(connection, chain)
+
+	// The ingress hook runs before conntrack, so replies to forwarded SSH connections pass the egress rules by port and the forward hook drops what isn't one
+	if instance.ExternalSSHAddress != "" {
+		addRule(connection, chain,
+			matchProtocol(unix.ETH_P_IP),
+			matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_TCP),
+			matchPayload(expr.PayloadBaseTransportHeader, 0, expr.CmpOpEq, binaryutil.BigEndian.PutUint16(22)),
+			accept())
+	}
+
+	i.addEgressRules(connection, chain)
+
+	return nil
+}
+
+func (i *Inventory) RemoveInstanceFirewall(instanceGroup *InstanceGroup, name string, macAddress string, externalSSHAddress string) error {
+	// Remove the rules of an instance which has been removed from the inventory
+
+	if instanceGroup.usesPasst() {
+		return nil
+	}
+
+	connection, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	table := firewallTable()
+
+	// Nothing to do if the table is gone already, e.g. during shutdown
+	_, err = connection.ListTableOfFamily(firewallTableName, nftables.TableFamilyINet)
+	if err != nil {
+		return nil
+	}
+
+	// The kernel may already have dropped the chain together with the tap device, and the rules
+	// were never added if the instance failed early, so only delete what is still there
+	chain, err := connection.ListChain(table, name)
+	if err == nil && chain != nil {
+		connection.DelChain(chain)
+	}
+
+	err = instanceGroup.removeInstanceExternalAccess(connection, name, externalSSHAddress)
+	if err != nil {
+		return err
+	}
+
+	err = instanceGroup.removeInstanceConnectionLimits(connection, name)
+	if err != nil {
+		return err
+	}
+
+	tapSet := firewallTapSet()
+	elements, err := connection.GetSetElements(tapSet)
+	if err != nil {
+		return fmt.Errorf("could not list nftables tap set: %w", err)
+	}
+
+	key := interfaceName(name)
+	for _, element := range elements {
+		if string(element.Key) == string(key) {
+			err = connection.SetDeleteElements(tapSet, []nftables.SetElement{{Key: key}})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	if instanceGroup.isBridged() && macAddress != "" {
+		hardwareAddress, err := net.ParseMAC(macAddress)
+		if err != nil {
+			return err
+		}
+
+		macSet := firewallMACSet()
+		elements, err := connection.GetSetElements(macSet)
+		if err != nil {
+			return fmt.Errorf("could not list nftables MAC set: %w", err)
+		}
+
+		for _, element := range elements {
+			if string(element.Key) == string(hardwareAddress) {
+				err = connection.SetDeleteElements(macSet, []nftables.SetElement{{Key: hardwareAddress}})
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	err = connection.Flush()
+	if err != nil {
+		return fmt.Errorf("could not remove nftables rules for instance %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (i *Inventory) RemoveNftables() error {
+	// Delete the plugin's table, nothing else is touched
+
+	connection, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	table := firewallTable()
+	connection.AddTable(table)
+	connection.DelTable(table)
+
+	err = connection.Flush()
+	if err != nil {
+		return fmt.Errorf("could not remove nftables rules: %w", err)
+	}
+
+	return nil
+}
+
+func removeLegacyFirewallTables() error {
+	// Earlier versions spread the rules over several tables, their forward policy would drop all traffic if they were left behind
+
+	connection, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	for _, legacyTable := range legacyFirewallTables {
+		connection.AddTable(&legacyTable)
+		connection.DelTable(&legacyTable)
+	}
+
+	err = connection.Flush()
+	if err != nil {
+		return fmt.Errorf("could not remove legacy nftables tables: %w", err)
+	}
+
+	return nil
+}
+
+func addRule(connection nftablesBatch, chain *nftables.Chain, matches ...[]expr.Any) {
+	// Add a rule made up of a list of matches and a verdict
+
+	exprs := []expr.Any{}
+	for _, match := range matches {
+		exprs = append(exprs, match...)
+	}
+
+	connection.AddRule(&nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+}
+
+func interfaceName(name string) []byte {
+	// Interface names are compared as NUL padded buffers
+
+	paddedName := make([]byte, unix.IFNAMSIZ)
+	copy(paddedName, name)
+
+	return paddedName
+}
+
+func matchInterface(key expr.MetaKey, name string) []expr.Any {
+	// Match an interface name
+
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: interfaceName(name)},
+	}
+}
+
+func matchInterfaceSet(key expr.MetaKey, set *nftables.Set) []expr.Any {
+	// Match an interface name against a set of names
+
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+func matchFamily(family byte) []expr.Any {
+	// Match the layer 3 protocol family of an inet chain
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+	}
+}
+
+func matchProtocol(etherType uint16) []expr.Any {
+	// Match the ethertype, netdev chains see all protocols
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(etherType)},
+	}
+}
+
+func matchPayload(base expr.PayloadBase, offset uint32, op expr.CmpOp, data []byte) []expr.Any {
+	// Compare a header field against a value
+
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: base, Offset: offset, Len: uint32(len(data))},
+		&expr.Cmp{Op: op, Register: 1, Data: data},
+	}
+}
+
+func matchPrefix(base expr.PayloadBase, offset uint32, op expr.CmpOp, prefix netip.Prefix) []expr.Any {
+	// Compare an address header field against a prefix
+
+	length := uint32(prefix.Addr().BitLen() / 8)
+	mask := net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())
+
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: base, Offset: offset, Len: length},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: length, Mask: mask, Xor: make([]byte, length)},
+		&expr.Cmp{Op: op, Register: 1, Data: prefix.Masked().Addr().AsSlice()},
+	}
+}
+
+func accept() []expr.Any {
+	return []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictAccept}}
+}
+
+func drop() []expr.Any {
+	return []expr.Any{&expr.Counter{}, &expr.Verdict{Kind: expr.VerdictDrop}}
+}
+
+func policyRef(policy nftables.ChainPolicy) *nftables.ChainPolicy {
+	return &policy
+}
@@ -0,0 +1,453 @@
+package fleetingd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Collects the queued sets, chains and rules instead of sending them to the kernel and prints them close to the way nft lists them
+type firewallRenderer struct {
+	sets     []*nftables.Set
+	elements map[string][]nftables.SetElement
+	chains   []*nftables.Chain
+	rules    map[string][]*nftables.Rule
+}
+
+// What a register was loaded with, kind tells how the values it is compared with are printed
+type renderedOperand struct {
+	name string
+	kind string
+	mask []byte
+}
+
+var renderedHooks = map[nftables.ChainHook]string{
+	*nftables.ChainHookPrerouting:  "prerouting",
+	*nftables.ChainHookInput:       "input",
+	*nftables.ChainHookForward:     "forward",
+	*nftables.ChainHookOutput:      "output",
+	*nftables.ChainHookPostrouting: "postrouting",
+	*chainHookInetIngress:          "ingress",
+}
+
+var renderedMetaKeys = map[expr.MetaKey]renderedOperand{
+	expr.MetaKeyIIFNAME:  {name: "iifname", kind: "ifname"},
+	expr.MetaKeyOIFNAME:  {name: "oifname", kind: "ifname"},
+	expr.MetaKeyNFPROTO:  {name: "meta nfproto", kind: "nfproto"},
+	expr.MetaKeyL4PROTO:  {name: "meta l4proto", kind: "l4proto"},
+	expr.MetaKeyPROTOCOL: {name: "meta protocol", kind: "ethertype"},
+}
+
+var renderedProtocols = map[byte]string{
+	unix.IPPROTO_ICMP:   "icmp",
+	unix.IPPROTO_TCP:    "tcp",
+	unix.IPPROTO_UDP:    "udp",
+	unix.IPPROTO_ICMPV6: "icmpv6",
+}
+
+var renderedCtStates = []struct {
+	bit  uint32
+	name string
+}{
+	{expr.CtStateBitINVALID, "invalid"},
+	{expr.CtStateBitESTABLISHED, "established"},
+	{expr.CtStateBitRELATED, "related"},
+	{expr.CtStateBitNEW, "new"},
+	{expr.CtStateBitUNTRACKED, "untracked"},
+}
+
+func newFirewallRenderer() *firewallRenderer {
+	return &firewallRenderer{
+		elements: map[string][]nftables.SetElement{},
+		rules:    map[string][]*nftables.Rule{},
+	}
+}
+
+func (r *firewallRenderer) AddChain(chain *nftables.Chain) *nftables.Chain {
+	r.chains = append(r.chains, chain)
+	return chain
+}
+
+func (r *firewallRenderer) AddRule(rule *nftables.Rule) *nftables.Rule {
+	r.rules[rule.Chain.Name] = append(r.rules[rule.Chain.Name], rule)
+	return rule
+}
+
+func (r *firewallRenderer) AddSet(set *nftables.Set, elements []nftables.SetElement) error {
+	r.sets = append(r.sets, set)
+	r.elements[set.Name] = append(r.elements[set.Name], elements...)
+	return nil
+}
+
+func (r *firewallRenderer) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	r.elements[set.Name] = append(r.elements[set.Name], elements...)
+	return nil
+}
+
+func (r *firewallRenderer) write(w io.Writer) {
+	// Print the plugin's table, sets first and chains in the order they were added
+
+	fmt.Fprintf(w, "table inet %s {\n", firewallTableName)
+
+	for _, set := range r.sets {
+		kind := "set"
+		dataType := ""
+		if set.IsMap {
+			kind = "map"
+			dataType = " : " + set.DataType.Name
+		}
+
+		var elements []string
+		for index, element := range r.elements[set.Name] {
+			// Intervals are queued as their start and the address after their end
+			if set.Interval {
+				if element.IntervalEnd {
+					continue
+				}
+				elements = append(elements, renderInterval(r.elements[set.Name][index:]))
+				continue
+			}
+
+			rendered := renderValue(set.KeyType.Name, element.Key)
+			if element.VerdictData != nil {
+				rendered += " : " + renderVerdict(element.VerdictData)
+			}
+			elements = append(elements, rendered)
+		}
+
+		fmt.Fprintf(w, "\t%s %s {\n\t\ttype %s%s\n", kind, set.Name, set.KeyType.Name, dataType)
+		if set.Interval {
+			fmt.Fprintf(w, "\t\tflags interval\n")
+		}
+		if len(elements) > 0 {
+			fmt.Fprintf(w, "\t\telements = { %s }\n", strings.Join(elements, ", "))
+		}
+		fmt.Fprintf(w, "\t}\n\n")
+	}
+
+	for index, chain := range r.chains {
+		if index > 0 {
+			fmt.Fprintln(w)
+		}
+
+		fmt.Fprintf(w, "\tchain %s {\n", chain.Name)
+		if chain.Type != "" {
+			device := ""
+			if chain.Device != "" {
+				device = fmt.Sprintf(" device %q", chain.Device)
+			}
+
+			policy := "accept"
+			if chain.Policy != nil && *chain.Policy == nftables.ChainPolicyDrop {
+				policy = "drop"
+			}
+
+			fmt.Fprintf(w, "\t\ttype %s hook %s%s priority %d; policy %s;\n", chain.Type, renderedHooks[*chain.Hooknum], device, *chain.Priority, policy)
+		}
+
+		for _, rule := range r.rules[chain.Name] {
+			fmt.Fprintf(w, "\t\t%s\n", renderRule(rule.Exprs))
+		}
+		fmt.Fprintf(w, "\t}\n")
+	}
+
+	fmt.Fprintln(w, "}")
+}
+
+func renderRule(exprs []expr.Any) string {
+	// Print the expressions of a rule, loads into registers are printed where the register is compared
+
+	registers := map[uint32]renderedOperand{}
+	immediates := map[uint32][]byte{}
+
+	var parts []string
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			operand, ok := renderedMetaKeys[e.Key]
+			if !ok {
+				operand = renderedOperand{name: fmt.Sprintf("meta %d", e.Key), kind: "raw"}
+			}
+			registers[e.Register] = operand
+		case *expr.Payload:
+			registers[e.DestRegister] = renderPayload(e)
+		case *expr.Ct:
+			switch e.Key {
+			case expr.CtKeySTATE:
+				registers[e.Register] = renderedOperand{name: "ct state", kind: "ctstate"}
+			case expr.CtKeySTATUS:
+				registers[e.Register] = renderedOperand{name: "ct status", kind: "ctstatus"}
+			case expr.CtKeyDIRECTION:
+				registers[e.Register] = renderedOperand{name: "ct direction", kind: "ctdirection"}
+			default:
+				registers[e.Register] = renderedOperand{name: fmt.Sprintf("ct %d", e.Key), kind: "raw"}
+			}
+		case *expr.Bitwise:
+			operand := registers[e.SourceRegister]
+			operand.mask = e.Mask
+			registers[e.DestRegister] = operand
+		case *expr.Cmp:
+			parts = append(parts, renderComparison(registers[e.Register], e.Op, e.Data))
+		case *expr.Lookup:
+			operand := registers[e.SourceRegister]
+			if e.IsDestRegSet {
+				parts = append(parts, fmt.Sprintf("%s vmap @%s", operand.name, e.SetName))
+			} else if e.Invert {
+				parts = append(parts, fmt.Sprintf("%s != @%s", operand.name, e.SetName))
+			} else {
+				parts = append(parts, fmt.Sprintf("%s @%s", operand.name, e.SetName))
+			}
+		case *expr.Immediate:
+			immediates[e.Register] = e.Data
+		case *expr.NAT:
+			parts = append(parts, renderNAT(e, immediates))
+		case *expr.Masq:
+			if e.FullyRandom {
+				parts = append(parts, "masquerade fully-random")
+			} else {
+				parts = append(parts, "masquerade")
+			}
+		case *expr.Counter:
+			parts = append(parts, "counter")
+		case *expr.Verdict:
+			parts = append(parts, renderVerdict(e))
+		case *expr.Connlimit:
+			if e.Flags&expr.NFT_CONNLIMIT_F_INV != 0 {
+				parts = append(parts, fmt.Sprintf("ct count over %d", e.Count))
+			} else {
+				parts = append(parts, fmt.Sprintf("ct count %d", e.Count))
+			}
+		case *expr.Limit:
+			parts = append(parts, renderLimit(e))
+		default:
+			parts = append(parts, strings.TrimPrefix(fmt.Sprintf("%T", e), "*expr."))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func renderPayload(payload *expr.Payload) renderedOperand {
+	// Name the header fields the plugin matches, others by their offset and length in bits
+
+	type field struct {
+		base   expr.PayloadBase
+		offset uint32
+		length uint32
+	}
+
+	fields := map[field]renderedOperand{
+		{expr.PayloadBaseLLHeader, 0, 6}:        {name: "ether daddr", kind: "mac"},
+		{expr.PayloadBaseLLHeader, 6, 6}:        {name: "ether saddr", kind: "mac"},
+		{expr.PayloadBaseNetworkHeader, 12, 4}:  {name: "ip saddr", kind: "address"},
+		{expr.PayloadBaseNetworkHeader, 16, 4}:  {name: "ip daddr", kind: "address"},
+		{expr.PayloadBaseNetworkHeader, 8, 16}:  {name: "ip6 saddr", kind: "address"},
+		{expr.PayloadBaseNetworkHeader, 24, 16}: {name: "ip6 daddr", kind: "address"},
+		{expr.PayloadBaseTransportHeader, 0, 2}: {name: "th sport", kind: "port"},
+		{expr.PayloadBaseTransportHeader, 2, 2}: {name: "th dport", kind: "port"},
+		{expr.PayloadBaseTransportHeader, 0, 1}: {name: "icmpv6 type", kind: "raw"},
+	}
+
+	operand, ok := fields[field{payload.Base, payload.Offset, payload.Len}]
+	if ok {
+		return operand
+	}
+
+	bases := map[expr.PayloadBase]string{
+		expr.PayloadBaseLLHeader:        "ll",
+		expr.PayloadBaseNetworkHeader:   "nh",
+		expr.PayloadBaseTransportHeader: "th",
+	}
+
+	return renderedOperand{name: fmt.Sprintf("@%s,%d,%d", bases[payload.Base], payload.Offset*8, payload.Len*8), kind: "raw"}
+}
+
+func renderComparison(operand renderedOperand, op expr.CmpOp, data []byte) string {
+	// Print a comparison the way nft does, equality is implied
+
+	operators := map[expr.CmpOp]string{
+		expr.CmpOpEq:  "",
+		expr.CmpOpNeq: "!= ",
+		expr.CmpOpLt:  "< ",
+		expr.CmpOpLte: "<= ",
+		expr.CmpOpGt:  "> ",
+		expr.CmpOpGte: ">= ",
+	}
+
+	// Flags are tested by masking them and comparing with zero
+	if (operand.kind == "ctstate" || operand.kind == "ctstatus") && operand.mask != nil && op == expr.CmpOpNeq && binaryutil.NativeEndian.Uint32(data) == 0 {
+		return fmt.Sprintf("%s %s", operand.name, renderFlags(operand.kind, binaryutil.NativeEndian.Uint32(operand.mask)))
+	}
+
+	value := renderValue(operand.kind, data)
+	if operand.kind == "address" && operand.mask != nil {
+		ones := 0
+		for _, octet := range operand.mask {
+			ones += bits.OnesCount8(octet)
+		}
+		value = fmt.Sprintf("%s/%d", value, ones)
+	}
+
+	return fmt.Sprintf("%s %s%s", operand.name, operators[op], value)
+}
+
+func renderFlags(kind string, flags uint32) string {
+	// Name the connection tracking states or the DNAT status bit
+
+	var names []string
+	if kind == "ctstate" {
+		for _, state := range renderedCtStates {
+			if flags&state.bit != 0 {
+				names = append(names, state.name)
+				flags &^= state.bit
+			}
+		}
+	} else if flags&ctStatusDestinationNAT != 0 {
+		names = append(names, "dnat")
+		flags &^= ctStatusDestinationNAT
+	}
+
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("0x%x", flags))
+	}
+
+	return strings.Join(names, ",")
+}
+
+func renderValue(kind string, data []byte) string {
+	// Print a value compared with or stored in a set
+
+	switch kind {
+	case "ifname", nftables.TypeIFName.Name:
+		return fmt.Sprintf("%q", strings.TrimRight(string(data), "\x00"))
+	case "nfproto":
+		switch data[0] {
+		case unix.NFPROTO_IPV4:
+			return "ipv4"
+		case unix.NFPROTO_IPV6:
+			return "ipv6"
+		}
+	case "l4proto":
+		name, ok := renderedProtocols[data[0]]
+		if ok {
+			return name
+		}
+	case "ethertype":
+		switch binaryutil.BigEndian.Uint16(data) {
+		case unix.ETH_P_IP:
+			return "ip"
+		case unix.ETH_P_IPV6:
+			return "ip6"
+		case unix.ETH_P_ARP:
+			return "arp"
+		}
+	case "address", nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+		address, ok := netip.AddrFromSlice(data)
+		if ok {
+			return address.String()
+		}
+	case "ctdirection":
+		if data[0] == ctDirectionReply {
+			return "reply"
+		}
+		return "original"
+	case "mac", nftables.TypeEtherAddr.Name:
+		return net.HardwareAddr(data).String()
+	case "port", nftables.TypeInetService.Name:
+		if len(data) == 2 {
+			return fmt.Sprintf("%d", binaryutil.BigEndian.Uint16(data))
+		}
+	}
+
+	return "0x" + hex.EncodeToString(data)
+}
+
+func renderInterval(elements []nftables.SetElement) string {
+	// Print the interval starting with the first element as a prefix if it is one, otherwise as a range
+
+	first, _ := netip.AddrFromSlice(elements[0].Key)
+
+	// Without an end the interval reaches the end of the address space
+	last := lastAddress(netip.PrefixFrom(first, 0))
+	if len(elements) > 1 && elements[1].IntervalEnd {
+		end, _ := netip.AddrFromSlice(elements[1].Key)
+		last = end.Prev()
+	}
+
+	for bits := 0; bits <= first.BitLen(); bits++ {
+		prefix := netip.PrefixFrom(first, bits)
+		if prefix.Masked().Addr() == first && lastAddress(prefix) == last {
+			return prefix.String()
+		}
+	}
+
+	return fmt.Sprintf("%s-%s", first, last)
+}
+
+func renderVerdict(verdict *expr.Verdict) string {
+	switch verdict.Kind {
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictReturn:
+		return "return"
+	case expr.VerdictJump:
+		return "jump " + verdict.Chain
+	case expr.VerdictGoto:
+		return "goto " + verdict.Chain
+	}
+
+	return fmt.Sprintf("verdict %d", verdict.Kind)
+}
+
+func renderNAT(nat *expr.NAT, immediates map[uint32][]byte) string {
+	// Print a NAT statement with the address and port loaded before it
+
+	kind := "snat"
+	if nat.Type == expr.NATTypeDestNAT {
+		kind = "dnat"
+	}
+
+	target := renderValue("address", immediates[nat.RegAddrMin])
+	if port, ok := immediates[nat.RegProtoMin]; ok {
+		target += ":" + renderValue("port", port)
+	}
+
+	family := "ip"
+	if nat.Family == unix.NFPROTO_IPV6 {
+		family = "ip6"
+	}
+
+	return fmt.Sprintf("%s %s to %s", kind, family, target)
+}
+
+func renderLimit(limit *expr.Limit) string {
+	units := map[expr.LimitTime]string{
+		expr.LimitTimeSecond: "second",
+		expr.LimitTimeMinute: "minute",
+		expr.LimitTimeHour:   "hour",
+		expr.LimitTimeDay:    "day",
+	}
+
+	over := ""
+	if limit.Over {
+		over = "over "
+	}
+
+	burst := "packets"
+	if limit.Type == expr.LimitTypePktBytes {
+		burst = "bytes"
+	}
+
+	return fmt.Sprintf("limit rate %s%d/%s burst %d %s", over, limit.Rate, units[limit.Unit], limit.Burst, burst)
+}
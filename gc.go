@@ -0,0 +1,307 @@
+package fleetingd
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const gcInterval = time.Hour
+
+// Files of unknown instances are only removed once they are this old, a booting instance is not in the inventory yet
+const gcMinimumAge = 10 * time.Minute
+
+// Instance files in the working directory are prefixed with the instance's name, e.g. fleetingd3_userdata.img
+var instanceFileRegexp = regexp.MustCompile(`^(fleetingd[0-9]+)([._/]|$)`)
+
+type gcCandidate struct {
+	path    string
+	modTime time.Time
+}
+
+func (i *InstanceGroup) runGarbageCollector(ctx context.Context) {
+	// Remove outdated files from vm_disk_directory every gcInterval
+
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			i.collectGarbage()
+		}
+	}
+}
+
+func (i *InstanceGroup) collectGarbage() {
+	// Remove superseded images, files of instances which are gone and old console logs
+
+	i.imagesLock.Lock()
+	defer i.imagesLock.Unlock()
+
+	// Nothing is known to be superseded before the current images have been resolved
+	if i.diskImage.URL != "" || i.diskImage.Path != "" {
+		err := i.removeSupersededImages()
+		if err != nil {
+			i.logger.Error("could not remove superseded images", "error", err)
+		}
+	}
+
+	err := i.removeOrphanedInstanceFiles()
+	if err != nil {
+		i.logger.Error("could not remove orphaned instance files", "error", err)
+	}
+}
+
+func (i *InstanceGroup) currentImageFiles() map[string]struct{} {
+	// Get the names of the files in vm_disk_directory the current images consist of
+
+	decompressedName := filepath.Base(i.getDecompressedImagePath())
+	current := map[string]struct{}{
+		decompressedName:                         {},
+		decompressedName + conversionStampSuffix: {},
+	}
+
+	if i.goldenImageKey != "" {
+		goldenImagePath, goldenImageRecordPath := i.goldenImagePaths(i.goldenImageKey)
+		current[filepath.Base(goldenImagePath)] = struct{}{}
+		current[filepath.Base(goldenImageRecordPath)] = struct{}{}
+	}
+
+	diskImageFileName, err := i.diskImage.fileName()
+	if err == nil {
+		current[diskImageFileName] = struct{}{}
+		if compression := detectImageCompression(diskImageFileName); compression != nil {
+			current[compression.uncompressedName(diskImageFileName)] = struct{}{}
+		}
+		current[diskImageFileName+cosignSignatureSuffix] = struct{}{}
+		current[diskImageFileName+cosignAttestationSuffix] = struct{}{}
+	}
+
+	kernelFilePath, err := i.getKernelFilePath()
+	if err == nil && kernelFilePath != "" {
+		current[filepath.Base(kernelFilePath)] = struct{}{}
+		current[filepath.Base(kernelFilePath)+unpackedKernelSuffix] = struct{}{}
+	}
+
+	sumsFiles := []struct {
+		file   resolvedImageFile
+		suffix string
+	}{{i.diskImage, "_image"}, {i.kernel, "_kernel"}}
+
+	for _, sumsFile := range sumsFiles {
+		if sumsFile.file.SumsURL == "" {
+			continue
+		}
+
+		sumsFileName, err := getFilenameFromURL(sumsFile.file.SumsURL)
+		if err != nil {
+			continue
+		}
+		current[sumsFileName+sumsFile.suffix] = struct{}{}
+		current[sumsFileName+sumsFile.suffix+i.imageProfile.SumsSignatureSuffix] = struct{}{}
+	}
+
+	return current
+}
+
+func (i *InstanceGroup) removeSupersededImages() error {
+	// Remove all but the newest vm_disk_retention_count superseded disk images, their checksum files and partial downloads
+
+	entries, err := os.ReadDir(i.VMDiskDir)
+	if err != nil {
+		return err
+	}
+
+	current := i.currentImageFiles()
+
+	names := map[string]struct{}{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names[entry.Name()] = struct{}{}
+		}
+	}
+
+	// Every converted base image or golden image is one generation, the files it was made from belong to it
+	var generations []gcCandidate
+	superseded := map[string]struct{}{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := current[name]; ok || !entry.Type().IsRegular() {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(name, downloadPartialSuffix):
+			if _, ok := current[strings.TrimSuffix(name, downloadPartialSuffix)]; !ok {
+				superseded[name] = struct{}{}
+			}
+		case i.isChecksumFileName(name), strings.HasSuffix(name, cosignSignatureSuffix), strings.HasSuffix(name, cosignAttestationSuffix):
+			superseded[name] = struct{}{}
+		case strings.HasPrefix(name, goldenImagePrefix) && filepath.Ext(name) == ".json":
+			// Removed together with their golden image
+		case strings.HasPrefix(name, goldenImagePrefix) || strings.HasSuffix(strings.TrimSuffix(name, filepath.Ext(name)), decompressedSuffix):
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			generations = append(generations, gcCandidate{path: name, modTime: info.ModTime()})
+		}
+	}
+
+	slices.SortFunc(generations, func(a gcCandidate, b gcCandidate) int {
+		return b.modTime.Compare(a.modTime)
+	})
+
+	for index, generation := range generations {
+		if uint64(index) < i.VMDiskRetentionCount {
+			continue
+		}
+
+		superseded[generation.path] = struct{}{}
+
+		if strings.HasPrefix(generation.path, goldenImagePrefix) {
+			recordName := strings.TrimSuffix(generation.path, filepath.Ext(generation.path)) + ".json"
+			superseded[recordName] = struct{}{}
+
+			record, err := readGoldenImageRecord(filepath.Join(i.VMDiskDir, recordName))
+			if err != nil && !os.IsNotExist(err) {
+				i.logger.Warn("could not read golden image record", "error", err)
+			}
+			for _, name := range record.SourceFiles {
+				if _, ok := names[name]; ok {
+					superseded[name] = struct{}{}
+				}
+			}
+			continue
+		}
+
+		superseded[generation.path+conversionStampSuffix] = struct{}{}
+
+		// The downloaded image may be compressed as a whole, e.g. image.img.bz2 for image_decompressed.img
+		for _, name := range compressedImageNames(generation.path) {
+			if _, ok := names[name]; ok {
+				superseded[name] = struct{}{}
+			}
+		}
+	}
+
+	for name := range superseded {
+		if _, ok := current[name]; ok {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(i.VMDiskDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		i.logger.Info("removed superseded image file", "file", name)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) isChecksumFileName(name string) bool {
+	// Check if a file is a downloaded SUMS file or its signature
+
+	for _, sumsFileSuffix := range []string{"_image", "_kernel"} {
+		if strings.HasSuffix(name, sumsFileSuffix) {
+			return true
+		}
+
+		if i.imageProfile.SumsSignatureSuffix != "" && strings.HasSuffix(name, sumsFileSuffix+i.imageProfile.SumsSignatureSuffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (i *InstanceGroup) removeOrphanedInstanceFiles() error {
+	// Remove overlays, userdata, sockets and restore data of instances which are gone, keeping the newest console and instance logs
+
+	workdir := filepath.Join(i.VMDiskDir, vmWorkdir)
+
+	entries, err := os.ReadDir(workdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	i.inventory.lock.RLock()
+	running := map[string]struct{}{}
+	for name := range i.inventory.instances {
+		running[name] = struct{}{}
+	}
+	i.inventory.lock.RUnlock()
+
+	// The newest file of an instance's logs decides whether they are kept
+	logs := map[string]time.Time{}
+	for _, entry := range entries {
+		match := instanceFileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		if _, ok := running[match[1]]; ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if time.Since(info.ModTime()) < gcMinimumAge {
+			continue
+		}
+
+		path := filepath.Join(workdir, entry.Name())
+
+		// Console and instance logs outlive their instance for troubleshooting, they are kept or removed together
+		if isInstanceLogName(entry.Name()) {
+			if info.ModTime().After(logs[match[1]]) {
+				logs[match[1]] = info.ModTime()
+			}
+			continue
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+		i.logger.Info("removed orphaned instance file", "file", entry.Name())
+	}
+
+	instanceNames := slices.SortedFunc(maps.Keys(logs), func(a string, b string) int {
+		return logs[b].Compare(logs[a])
+	})
+
+	for index, instanceName := range instanceNames {
+		if uint64(index) < i.VMDiskRetentionCount {
+			continue
+		}
+
+		for _, path := range []string{i.getConsolePath(instanceName), i.getInstanceLogPath(instanceName), i.getPanicPath(instanceName)} {
+			err = removeRotatedFile(path)
+			if err != nil {
+				return err
+			}
+		}
+		i.logger.Info("removed old logs of instance", "instance", instanceName)
+	}
+
+	return nil
+}
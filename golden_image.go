@@ -0,0 +1,332 @@
+package fleetingd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Golden images are named after the hash of their inputs, e.g. golden-0123456789abcdef.img
+const goldenImagePrefix = "golden-"
+
+// Everything the prebuilt image depends on, a golden image built from different inputs is not reused
+type goldenImageInputs struct {
+	Distro            string   `json:"distro"`
+	DiskImageChecksum string   `json:"disk_image_checksum"`
+	KernelChecksum    string   `json:"kernel_checksum,omitempty"`
+	DiskSizeGB        uint64   `json:"disk_size_gb"`
+	DiskFormat        string   `json:"disk_format"`
+	ImageConverter    string   `json:"image_converter"`
+	PrebuildProfile   string   `json:"prebuild_profile,omitempty"`
+	PrebuildCommands  []string `json:"prebuild_commands"`
+	CACertificates    []string `json:"ca_certificates,omitempty"`
+	GuestProxy        string   `json:"guest_proxy,omitempty"`
+	GuestAgent        bool     `json:"guest_agent,omitempty"`
+	TemplatesChecksum string   `json:"templates_checksum"`
+	PluginRevision    string   `json:"plugin_revision"`
+}
+
+func (g goldenImageInputs) fields() map[string]string {
+	// Get the inputs by their JSON names for comparing them
+
+	contents, _ := json.Marshal(g)
+
+	var values map[string]any
+	_ = json.Unmarshal(contents, &values)
+
+	fields := map[string]string{}
+	for name, value := range values {
+		fields[name] = fmt.Sprint(value)
+	}
+
+	return fields
+}
+
+type goldenImageRecord struct {
+	Key       string            `json:"key"`
+	Inputs    goldenImageInputs `json:"inputs"`
+	Size      int64             `json:"size"`
+	CreatedAt time.Time         `json:"created_at"`
+
+	// Of the finished image, checked before it is reused and booted from
+	Checksum string    `json:"checksum,omitempty"`
+	ModTime  time.Time `json:"mod_time"`
+
+	// Downloaded files in vm_disk_directory the image was made from, removed together with it
+	SourceFiles []string `json:"source_files"`
+}
+
+func (i *InstanceGroup) imageChecksumAlgorithm(file resolvedImageFile) string {
+	// Get the algorithm a file is verified with, which is the one its checksum is cached for
+
+	if file.Path != "" {
+		return localImageChecksumAlgorithm
+	}
+
+	if file.ChecksumAlgorithm != "" {
+		return file.ChecksumAlgorithm
+	}
+
+	return i.imageProfile.ChecksumAlgorithm
+}
+
+func (i *InstanceGroup) computeGoldenImageKey(diskImageFilePath string) (goldenImageInputs, string, error) {
+	// Hash the inputs of the prebuild, the disk image and kernel have been verified already so their checksums are cached
+
+	diskImageChecksum, err := i.cachedFileChecksum(diskImageFilePath, i.imageChecksumAlgorithm(i.diskImage))
+	if err != nil {
+		return goldenImageInputs{}, "", err
+	}
+
+	templatesHasher := sha256.New()
+	err = fs.WalkDir(userDataTemplates, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		contents, err := userDataTemplates.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(templatesHasher, "%s %d\n", path, len(contents))
+		templatesHasher.Write(contents)
+
+		return nil
+	})
+	if err != nil {
+		return goldenImageInputs{}, "", err
+	}
+
+	inputs := goldenImageInputs{
+		Distro:            i.Distro,
+		DiskImageChecksum: i.imageChecksumAlgorithm(i.diskImage) + ":" + diskImageChecksum,
+		DiskSizeGB:        i.VMDiskSizeGB,
+		DiskFormat:        i.VMDiskFormat,
+		ImageConverter:    i.VMImageConverter,
+		PrebuildProfile:   i.prebuildProfileVersion(),
+		PrebuildCommands:  i.VMPrebuildCloudinitExtraCmds,
+		CACertificates:    i.caCertificates,
+		GuestProxy:        i.guestProxyChecksum(),
+		GuestAgent:        i.VMGuestAgent,
+		TemplatesChecksum: hex.EncodeToString(templatesHasher.Sum(nil)),
+		PluginRevision:    Version.Revision,
+	}
+
+	// The kernel is baked into the prebuild by its modules
+	if i.bootsKernel() {
+		kernelFilePath, err := i.getKernelFilePath()
+		if err != nil {
+			return goldenImageInputs{}, "", err
+		}
+
+		kernelChecksum, err := i.cachedFileChecksum(kernelFilePath, i.imageChecksumAlgorithm(i.kernel))
+		if err != nil {
+			return goldenImageInputs{}, "", err
+		}
+		inputs.KernelChecksum = i.imageChecksumAlgorithm(i.kernel) + ":" + kernelChecksum
+	}
+
+	contents, err := json.Marshal(inputs)
+	if err != nil {
+		return goldenImageInputs{}, "", err
+	}
+
+	key := sha256.Sum256(contents)
+
+	return inputs, hex.EncodeToString(key[:8]), nil
+}
+
+func (i *InstanceGroup) goldenImagePaths(key string) (string, string) {
+	// Get the paths of a golden image and its record
+
+	imagePath := filepath.Join(i.VMDiskDir, goldenImagePrefix+key+filepath.Ext(i.getDecompressedImagePath()))
+
+	return imagePath, strings.TrimSuffix(imagePath, filepath.Ext(imagePath)) + ".json"
+}
+
+func (i *InstanceGroup) findGoldenImage() (bool, error) {
+	// Check for a golden image built from the current inputs, a record is only written once the prebuild succeeded
+
+	imagePath, recordPath := i.goldenImagePaths(i.goldenImageKey)
+
+	record, err := readGoldenImageRecord(recordPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		i.logChangedPrebuildInputs()
+		return false, nil
+	}
+	if err != nil {
+		i.logger.Warn("ignoring unreadable golden image record", "path", recordPath, "error", err)
+		return false, nil
+	}
+
+	info, err := os.Stat(imagePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// A golden image which was written to after the prebuild is not trusted anymore
+	if record.Key != i.goldenImageKey || record.Size != info.Size() {
+		i.logger.Warn("ignoring golden image which does not match its record", "path", imagePath)
+		return false, nil
+	}
+
+	// Records of earlier versions have no checksum, the image is trusted as it is once
+	if record.Checksum == "" {
+		i.logger.Info("Recording the checksum of the golden image.", "path", imagePath)
+
+		err = i.writeGoldenImageRecord(&record, imagePath, recordPath)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	integrity := imageIntegrity{Path: imagePath, Checksum: record.Checksum, Size: record.Size, ModTime: record.ModTime}
+	err = integrity.verify(i.VMImageVerifyFull)
+	if err != nil {
+		i.logger.Warn("ignoring golden image which does not match its record", "path", imagePath, "error", err)
+		return false, nil
+	}
+
+	i.baseImageIntegrity = integrity
+
+	return true, nil
+}
+
+func (i *InstanceGroup) logChangedPrebuildInputs() {
+	// Tell why the prebuild has to run again by comparing the inputs with the ones of the newest golden image
+
+	recordPaths, err := filepath.Glob(filepath.Join(i.VMDiskDir, goldenImagePrefix+"*.json"))
+	if err != nil || len(recordPaths) == 0 {
+		i.logger.Info("No golden image found, running the prebuild.", "key", i.goldenImageKey)
+		return
+	}
+
+	var newest goldenImageRecord
+	for _, recordPath := range recordPaths {
+		record, err := readGoldenImageRecord(recordPath)
+		if err == nil && record.CreatedAt.After(newest.CreatedAt) {
+			newest = record
+		}
+	}
+
+	previousInputs := newest.Inputs.fields()
+	currentInputs := i.goldenImageInputs.fields()
+
+	var changed []string
+	for name := range currentInputs {
+		if previousInputs[name] != currentInputs[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previousInputs {
+		if _, ok := currentInputs[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+
+	i.logger.Info("Prebuild inputs changed, running the prebuild.", "key", i.goldenImageKey, "previous_key", newest.Key, "changed", strings.Join(changed, ","))
+}
+
+func readGoldenImageRecord(recordPath string) (goldenImageRecord, error) {
+	// Read the record of a golden image
+
+	var record goldenImageRecord
+
+	contents, err := os.ReadFile(recordPath)
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal(contents, &record)
+	if err != nil {
+		return record, fmt.Errorf("could not parse golden image record %s: %w", recordPath, err)
+	}
+
+	return record, nil
+}
+
+func (i *InstanceGroup) commitGoldenImage() error {
+	// Turn the prebuilt base image into the golden image of its inputs
+
+	i.imagesLock.Lock()
+	defer i.imagesLock.Unlock()
+
+	imagePath, recordPath := i.goldenImagePaths(i.goldenImageKey)
+
+	err := os.Rename(i.getDecompressedImagePath(), imagePath)
+	if err != nil {
+		return fmt.Errorf("could not create golden image: %w", err)
+	}
+
+	// The stamp described the image before the prebuild
+	err = removeConversionStamp(i.getDecompressedImagePath())
+	if err != nil {
+		i.logger.Warn("could not remove conversion stamp", "error", err)
+	}
+
+	record := goldenImageRecord{
+		Key:       i.goldenImageKey,
+		Inputs:    i.goldenImageInputs,
+		CreatedAt: time.Now(),
+	}
+
+	// Local images are not ours to remove
+	diskImageFileName, err := i.diskImage.fileName()
+	if err == nil && i.diskImage.Path == "" {
+		record.SourceFiles = append(record.SourceFiles, diskImageFileName)
+		compression := i.diskCompression()
+		if compression != nil {
+			record.SourceFiles = append(record.SourceFiles, compression.uncompressedName(diskImageFileName))
+		}
+	}
+
+	err = i.writeGoldenImageRecord(&record, imagePath, recordPath)
+	if err != nil {
+		return err
+	}
+
+	i.goldenImagePath = imagePath
+	i.logger.Info("Golden image created.", "path", imagePath)
+
+	return nil
+}
+
+func (i *InstanceGroup) writeGoldenImageRecord(record *goldenImageRecord, imagePath string, recordPath string) error {
+	// Hash the golden image and write its record, instances boot from it as long as it matches
+
+	integrity, err := recordImageIntegrity(imagePath)
+	if err != nil {
+		return err
+	}
+
+	record.Size = integrity.Size
+	record.ModTime = integrity.ModTime
+	record.Checksum = integrity.Checksum
+
+	contents, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(recordPath, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write golden image record: %w", err)
+	}
+
+	i.baseImageIntegrity = integrity
+
+	return nil
+}
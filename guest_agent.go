@@ -0,0 +1,130 @@
+package fleetingd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// Port the status agent of vm_guest_agent listens on, see templates/guest-agent.tpl
+const guestStatusAgentVsockPort = 1025
+
+// The agent answers from memory and /proc, a slow answer means a guest too busy to be asked
+const guestStatusAgentTimeout = 3 * time.Second
+
+// How long a guest may take to power off after its agent was asked to, it is stopped the hard way afterwards
+const guestShutdownTimeout = 20 * time.Second
+
+// What the status agent reports about a guest
+type guestStatus struct {
+	CloudInit         string  `json:"cloud_init"`
+	Load1             float64 `json:"load1"`
+	MemoryTotalKB     uint64  `json:"memory_total_kb"`
+	MemoryAvailableKB uint64  `json:"memory_available_kb"`
+	UptimeSeconds     float64 `json:"uptime_seconds"`
+}
+
+func (i *InstanceGroup) checkGuestAgent() error {
+	// Validate vm_guest_agent, the agent is a Python script run by systemd and installed by the prebuild
+
+	if !i.VMGuestAgent {
+		return nil
+	}
+
+	if i.usesIgnition() || i.imageProfile.Family == "alpine" {
+		return fmt.Errorf("vm_guest_agent can not be used with distro %s", i.Distro)
+	}
+
+	// The hypervisor gets no vsock device for confidential guests
+	if i.VMConfidentialComputing != "" {
+		return errors.New("vm_guest_agent can not be combined with vm_confidential_computing")
+	}
+
+	return nil
+}
+
+func requestGuestAgent(ctx context.Context, socketPath string, request string, response any) error {
+	// Send one request to an instance's status agent and decode its one line answer
+
+	ctx, cancel := context.WithTimeout(ctx, guestStatusAgentTimeout)
+	defer cancel()
+
+	connection, err := dialGuestVsock(ctx, socketPath, guestStatusAgentVsockPort)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	_, err = fmt.Fprintf(connection, "%s\n", request)
+	if err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(connection).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("guest agent did not answer %s: %w", request, err)
+	}
+
+	return json.Unmarshal(line, response)
+}
+
+func (i *InstanceGroup) checkGuestStatus(ctx context.Context, instance string) error {
+	// Ask an instance's agent how the guest is doing, it is only ready once cloud-init finished
+
+	var status guestStatus
+	err := requestGuestAgent(ctx, i.getVsockSocketPath(instance), "status", &status)
+	if err != nil {
+		return err
+	}
+
+	i.inventory.recordGuestStatus(instance, status)
+
+	switch status.CloudInit {
+	case "done", "disabled":
+		return nil
+	case "error":
+		return fmt.Errorf("%w: cloud-init failed", provider.ErrInstanceUnhealthy)
+	}
+
+	return fmt.Errorf("cloud-init has not finished yet: %s", status.CloudInit)
+}
+
+func (i *Inventory) recordGuestStatus(name string, status guestStatus) {
+	// Keep the latest status an instance's agent reported for the status command
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	instance, ok := i.instances[name]
+	if ok {
+		instance.GuestStatus = &status
+	}
+}
+
+func (i *Inventory) shutdownGuest(ctx context.Context, instance *InstanceInfo, socketPath string) {
+	// Ask an instance's agent to power the guest off and wait for it to be gone, a guest which doesn't is stopped by the caller
+
+	var response struct {
+		Shutdown bool `json:"shutdown"`
+	}
+	err := requestGuestAgent(ctx, socketPath, "shutdown", &response)
+	if err != nil || !response.Shutdown {
+		instance.logger.Warn("could not shut down the guest through its agent, stopping it", "error", err)
+		return
+	}
+
+	timeout := time.NewTimer(guestShutdownTimeout)
+	defer timeout.Stop()
+
+	select {
+	case <-instance.Removed:
+	case <-ctx.Done():
+	case <-timeout.C:
+		instance.logger.Warn("guest did not power off in time, stopping it", "timeout", guestShutdownTimeout)
+	}
+}
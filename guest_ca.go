@@ -0,0 +1,63 @@
+package fleetingd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func (i *InstanceGroup) parseCACertificates() error {
+	// Read vm_ca_certificates, each either PEM encoded certificates or the path of a file with them, into single PEM blocks for cloud-init
+
+	i.caCertificates = nil
+
+	if len(i.VMCACertificates) == 0 {
+		return nil
+	}
+
+	if i.usesIgnition() {
+		return fmt.Errorf("vm_ca_certificates can not be used with distro %s which is provisioned through Ignition", i.Distro)
+	}
+
+	for index, entry := range i.VMCACertificates {
+		contents := []byte(entry)
+		source := fmt.Sprintf("entry %d", index+1)
+
+		if !strings.Contains(entry, "-----BEGIN") {
+			var err error
+			contents, err = os.ReadFile(entry)
+			if err != nil {
+				return fmt.Errorf("could not read vm_ca_certificates: %w", err)
+			}
+			source = entry
+		}
+
+		found := 0
+		for {
+			var block *pem.Block
+			block, contents = pem.Decode(contents)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			_, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("invalid certificate in %s of vm_ca_certificates: %w", source, err)
+			}
+
+			i.caCertificates = append(i.caCertificates, string(pem.EncodeToMemory(block)))
+			found++
+		}
+
+		if found == 0 {
+			return fmt.Errorf("no PEM encoded certificates found in %s of vm_ca_certificates", source)
+		}
+	}
+
+	return nil
+}
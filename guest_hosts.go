@@ -0,0 +1,52 @@
+package fleetingd
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const guestHostsPath = "/etc/hosts"
+
+var hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?$`)
+
+func (i *InstanceGroup) parseHostEntries() error {
+	// Validate vm_host_entries, addresses by host name
+
+	for hostname, address := range i.VMHostEntries {
+		if len(hostname) > 253 || !hostnameRegexp.MatchString(hostname) {
+			return fmt.Errorf("invalid host name '%s' in vm_host_entries", hostname)
+		}
+
+		_, err := netip.ParseAddr(address)
+		if err != nil {
+			return fmt.Errorf("invalid address '%s' of %s in vm_host_entries: %w", address, hostname, err)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) guestHostsFiles() []guestFile {
+	// Get the lines of vm_host_entries appended to the guests' /etc/hosts, sorted by host name
+
+	if len(i.VMHostEntries) == 0 {
+		return nil
+	}
+
+	hostnames := []string{}
+	for hostname := range i.VMHostEntries {
+		hostnames = append(hostnames, hostname)
+	}
+	slices.Sort(hostnames)
+
+	var contents strings.Builder
+	contents.WriteString("# vm_host_entries\n")
+	for _, hostname := range hostnames {
+		fmt.Fprintf(&contents, "%s %s\n", i.VMHostEntries[hostname], hostname)
+	}
+
+	return []guestFile{{Path: guestHostsPath, Contents: contents.String(), Append: true}}
+}
@@ -0,0 +1,136 @@
+package fleetingd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Read by pam_env for logins and by the jobs' shells
+const guestEnvironmentPath = "/etc/environment"
+
+// Default environment of every unit systemd starts in the guest
+const guestSystemdProxyPath = "/etc/systemd/system.conf.d/fleetingd-proxy.conf"
+
+// docker pulls through the daemon, which doesn't read the login environment
+const guestDockerProxyPath = "/etc/systemd/system/docker.service.d/fleetingd-proxy.conf"
+
+// A proxy setting by the name of its environment variable, tools disagree on the case so both are set
+type proxyVariable struct {
+	Name  string
+	Value string
+}
+
+func (i *InstanceGroup) parseGuestProxy() error {
+	// Validate vm_http_proxy and vm_https_proxy, vm_no_proxy is passed on as it is
+
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"vm_http_proxy", i.VMHTTPProxy},
+		{"vm_https_proxy", i.VMHTTPSProxy},
+	} {
+		if setting.value == "" {
+			continue
+		}
+
+		// The URLs are quoted in shell commands and unit files
+		if strings.ContainsAny(setting.value, " \t\n\"'`$\\") {
+			return fmt.Errorf("invalid %s '%s', whitespace, quotes, backslashes and $ must be percent-encoded", setting.name, setting.value)
+		}
+
+		proxyURL, err := url.Parse(setting.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", setting.name, err)
+		}
+
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("invalid %s '%s', must be a URL with scheme http, https, socks5 or socks5h", setting.name, setting.value)
+		}
+
+		if proxyURL.Host == "" {
+			return fmt.Errorf("invalid %s '%s', the host is missing", setting.name, setting.value)
+		}
+	}
+
+	for _, host := range i.VMNoProxy {
+		if host == "" || strings.ContainsAny(host, ", \t\n\"") {
+			return fmt.Errorf("invalid host '%s' in vm_no_proxy", host)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) guestProxyVariables() []proxyVariable {
+	// Get the proxy environment variables of the guests, none without vm_http_proxy and vm_https_proxy
+
+	if i.VMHTTPProxy == "" && i.VMHTTPSProxy == "" {
+		return nil
+	}
+
+	var variables []proxyVariable
+	for _, setting := range []struct {
+		name  string
+		value string
+	}{
+		{"http_proxy", i.VMHTTPProxy},
+		{"https_proxy", i.VMHTTPSProxy},
+		{"no_proxy", strings.Join(i.VMNoProxy, ",")},
+	} {
+		if setting.value == "" {
+			continue
+		}
+
+		variables = append(variables,
+			proxyVariable{Name: setting.name, Value: setting.value},
+			proxyVariable{Name: strings.ToUpper(setting.name), Value: setting.value},
+		)
+	}
+
+	return variables
+}
+
+func (i *InstanceGroup) guestProxyFiles() []guestFile {
+	// Get the files making logins, systemd's units and docker in a guest use the proxy, /etc/environment is appended to
+
+	variables := i.guestProxyVariables()
+	if len(variables) == 0 {
+		return nil
+	}
+
+	var environment, defaultEnvironment, serviceEnvironment strings.Builder
+	for _, variable := range variables {
+		fmt.Fprintf(&environment, "%s=%s\n", variable.Name, variable.Value)
+		fmt.Fprintf(&defaultEnvironment, "DefaultEnvironment=\"%s=%s\"\n", variable.Name, variable.Value)
+		// Units expand specifiers, e.g. in percent-encoded credentials
+		fmt.Fprintf(&serviceEnvironment, "Environment=\"%s=%s\"\n", variable.Name, strings.ReplaceAll(variable.Value, "%", "%%"))
+	}
+
+	return []guestFile{
+		{Path: guestEnvironmentPath, Contents: environment.String(), Append: true},
+		{Path: guestSystemdProxyPath, Contents: "[Manager]\n" + defaultEnvironment.String()},
+		{Path: guestDockerProxyPath, Contents: "[Service]\n" + serviceEnvironment.String()},
+	}
+}
+
+func (i *InstanceGroup) guestProxyChecksum() string {
+	// Hash the proxy files baked into the golden image, the URLs may carry credentials which must not end up in its record
+
+	files := i.guestProxyFiles()
+	if len(files) == 0 {
+		return ""
+	}
+
+	hasher := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(hasher, "%s %d\n%s", file.Path, len(file.Contents), file.Contents)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,66 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	guestSwapFile = "file"
+	guestSwapZram = "zram"
+)
+
+// Created by cloud-init's mounts module on the root disk
+const guestSwapFilePath = "/swap.img"
+
+// What the guest template renders, a zero size means no swap
+type guestSwap struct {
+	Mode       string
+	SizeMB     uint64
+	Path       string
+	Swappiness *uint64
+}
+
+func (i *InstanceGroup) checkGuestSwap() error {
+	// Validate vm_swap, vm_swap_size_mb and vm_swappiness
+
+	if i.VMSwap == "" {
+		if i.VMSwapSizeMegabytes > 0 {
+			return errors.New("vm_swap_size_mb requires vm_swap")
+		}
+	} else {
+		if i.VMSwap != guestSwapFile && i.VMSwap != guestSwapZram {
+			return fmt.Errorf("unknown vm_swap '%s', must be one of: %s, %s", i.VMSwap, guestSwapFile, guestSwapZram)
+		}
+
+		if i.VMSwapSizeMegabytes == 0 {
+			return fmt.Errorf("vm_swap %s requires vm_swap_size_mb", i.VMSwap)
+		}
+
+		// A swap file larger than the root disk can't be created and would leave the job nothing
+		if i.VMSwap == guestSwapFile && i.VMDiskSizeGB > 0 && i.VMSwapSizeMegabytes >= i.VMDiskSizeGB*1024 {
+			return fmt.Errorf("vm_swap_size_mb %d does not fit onto the root disk of vm_disk_size_gb %d", i.VMSwapSizeMegabytes, i.VMDiskSizeGB)
+		}
+	}
+
+	if i.VMSwappiness != nil && *i.VMSwappiness > 200 {
+		return fmt.Errorf("vm_swappiness %d is out of range, must be between 0 and 200", *i.VMSwappiness)
+	}
+
+	if (i.VMSwap != "" || i.VMSwappiness != nil) && i.usesIgnition() {
+		return fmt.Errorf("vm_swap and vm_swappiness can not be used with distro %s which is provisioned through Ignition", i.Distro)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) guestSwap() guestSwap {
+	// Get the swap of the job instances
+
+	return guestSwap{
+		Mode:       i.VMSwap,
+		SizeMB:     i.VMSwapSizeMegabytes,
+		Path:       guestSwapFilePath,
+		Swappiness: i.VMSwappiness,
+	}
+}
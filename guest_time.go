@@ -0,0 +1,64 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Written by cloud-init's ntp module on the distros vm_snapshot_boot supports, rewritten when a restored instance moves to its gateway
+const guestTimesyncdConfigPath = "/etc/systemd/timesyncd.conf.d/cloud-init.conf"
+
+func (i *InstanceGroup) parseGuestTime() error {
+	// Validate vm_ntp_servers, vm_ntp_relay and vm_timezone
+
+	if len(i.VMNTPServers) == 0 && !i.VMNTPRelay && i.VMTimezone == "" {
+		return nil
+	}
+
+	if i.usesIgnition() {
+		return fmt.Errorf("vm_ntp_servers, vm_ntp_relay and vm_timezone can not be used with distro %s which is provisioned through Ignition", i.Distro)
+	}
+
+	// Like the DNS forwarder, the relay is reached on the instances' host tap address
+	if i.VMNTPRelay && (i.isBridged() || i.usesPasst()) {
+		return errors.New("vm_ntp_relay can only be used with network_mode nat")
+	}
+
+	for _, server := range i.VMNTPServers {
+		if server == "" || strings.ContainsAny(server, " \t\n\"'`$\\") {
+			return fmt.Errorf("invalid server '%s' in vm_ntp_servers", server)
+		}
+	}
+
+	if i.VMTimezone != "" {
+		// Local would be whatever the host uses
+		_, err := time.LoadLocation(i.VMTimezone)
+		if err != nil || i.VMTimezone == "Local" {
+			return fmt.Errorf("unknown vm_timezone '%s', must be a name of the tz database like Europe/Berlin", i.VMTimezone)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) ntpServers(gateway string) []string {
+	// Get the NTP servers of an instance, empty for the image's defaults
+
+	if len(i.VMNTPServers) > 0 {
+		return i.VMNTPServers
+	}
+
+	if i.VMNTPRelay {
+		return []string{gateway}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) ntpFollowsGateway() bool {
+	// Whether the instances' NTP server is their gateway, which restored instances have to be moved to
+
+	return i.VMNTPRelay && len(i.VMNTPServers) == 0
+}
@@ -0,0 +1,82 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// Replaces the schedule of the distributions' weekly fstrim.timer
+const guestFstrimTimerDropInPath = "/etc/systemd/system/fstrim.timer.d/90-fleetingd.conf"
+
+// The overlays are measured this often to count what the trims gave back
+const diskReclaimCheckInterval = time.Minute
+
+func (i *InstanceGroup) checkGuestTrim() error {
+	// Validate vm_fstrim_interval_minutes, the timer is set up by cloud-init
+
+	if i.VMFstrimIntervalMinutes > 0 && i.usesIgnition() {
+		return fmt.Errorf("vm_fstrim_interval_minutes can not be used with distro %s which is provisioned through Ignition", i.Distro)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) guestTrimFiles() []guestFile {
+	// Get the drop-in running fstrim every vm_fstrim_interval_minutes, it trims all mounted filesystems which support it
+
+	if i.VMFstrimIntervalMinutes == 0 {
+		return nil
+	}
+
+	// The empty OnCalendar clears the distribution's weekly schedule
+	contents := fmt.Sprintf("[Timer]\nOnCalendar=\nOnBootSec=%dmin\nOnUnitActiveSec=%dmin\nAccuracySec=1min\nRandomizedDelaySec=0\nPersistent=false\n", i.VMFstrimIntervalMinutes, i.VMFstrimIntervalMinutes)
+
+	return []guestFile{{Path: guestFstrimTimerDropInPath, Contents: contents}}
+}
+
+func (i *InstanceGroup) runDiskReclaimMonitor(ctx context.Context) {
+	// Measure the job instances' directories and count the space they shrank by, which is what the trims gave back to vm_disk_directory
+
+	ticker := time.NewTicker(diskReclaimCheckInterval)
+	defer ticker.Stop()
+
+	usages := map[string]uint64{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			usages = i.measureDiskReclaim(usages)
+		}
+	}
+}
+
+func (i *InstanceGroup) measureDiskReclaim(previousUsages map[string]uint64) map[string]uint64 {
+	// Compare the instances' disk usage with the last measurement, instances which are gone are forgotten
+
+	i.inventory.lock.RLock()
+	var names []string
+	for name, instance := range i.inventory.instances {
+		if !instance.Internal && instance.State == provider.StateRunning {
+			names = append(names, name)
+		}
+	}
+	i.inventory.lock.RUnlock()
+
+	// Walking the directories takes a while, the inventory isn't locked meanwhile
+	usages := map[string]uint64{}
+	for _, name := range names {
+		usage := instanceDiskUsage(i.getInstanceDir(name))
+		usages[name] = usage
+
+		previousUsage, ok := previousUsages[name]
+		if ok && usage < previousUsage {
+			i.inventory.metrics.diskReclaimedBytes.Add(previousUsage - usage)
+		}
+	}
+
+	return usages
+}
@@ -0,0 +1,103 @@
+package fleetingd
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Sorts after the distributions' drop-ins, the last value read for a setting wins
+const guestSysctlConfigPath = "/etc/sysctl.d/90-fleetingd.conf"
+const guestLimitsConfigPath = "/etc/security/limits.d/90-fleetingd.conf"
+
+var sysctlNameRegexp = regexp.MustCompile(`^[a-z0-9_\-]+(\.[a-zA-Z0-9_\-*]+)+$`)
+var ulimitValueRegexp = regexp.MustCompile(`^([0-9]+|unlimited|-1)$`)
+
+// The items limits.conf knows
+var ulimitItems = []string{"as", "core", "cpu", "data", "fsize", "locks", "maxlogins", "maxsyslogins", "memlock", "msgqueue", "nice", "nofile", "nproc", "priority", "rss", "rtprio", "sigpending", "stack"}
+
+// A kernel parameter set with vm_sysctls
+type guestSysctl struct {
+	Name  string
+	Value string
+}
+
+func (i *InstanceGroup) checkGuestTuning() error {
+	// Validate vm_sysctls and vm_ulimits, a limit is either one value for soft and hard or "SOFT:HARD"
+
+	for name, value := range i.VMSysctls {
+		if !sysctlNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid kernel parameter '%s' in vm_sysctls", name)
+		}
+		if value == "" || strings.ContainsAny(value, "\n\"\\") {
+			return fmt.Errorf("invalid value '%s' for %s in vm_sysctls", value, name)
+		}
+	}
+
+	for item, value := range i.VMUlimits {
+		if !slices.Contains(ulimitItems, item) {
+			return fmt.Errorf("unknown limit '%s' in vm_ulimits, must be one of: %s", item, strings.Join(ulimitItems, ", "))
+		}
+
+		soft, hard, ok := strings.Cut(value, ":")
+		if !ok {
+			hard = soft
+		}
+		if !ulimitValueRegexp.MatchString(soft) || !ulimitValueRegexp.MatchString(hard) {
+			return fmt.Errorf("invalid value '%s' for %s in vm_ulimits, must be a number, unlimited or SOFT:HARD", value, item)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) guestSysctls() []guestSysctl {
+	// Get vm_sysctls sorted by name
+
+	var sysctls []guestSysctl
+	for name, value := range i.VMSysctls {
+		sysctls = append(sysctls, guestSysctl{Name: name, Value: value})
+	}
+
+	slices.SortFunc(sysctls, func(a guestSysctl, b guestSysctl) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return sysctls
+}
+
+func (i *InstanceGroup) guestTuningFiles() []guestFile {
+	// Get the drop-ins of vm_sysctls and vm_ulimits, the limits apply to every login including the runner's
+
+	var files []guestFile
+
+	sysctls := i.guestSysctls()
+	if len(sysctls) > 0 {
+		var contents strings.Builder
+		for _, sysctl := range sysctls {
+			fmt.Fprintf(&contents, "%s = %s\n", sysctl.Name, sysctl.Value)
+		}
+		files = append(files, guestFile{Path: guestSysctlConfigPath, Contents: contents.String()})
+	}
+
+	if len(i.VMUlimits) > 0 {
+		items := []string{}
+		for item := range i.VMUlimits {
+			items = append(items, item)
+		}
+		slices.Sort(items)
+
+		var contents strings.Builder
+		for _, item := range items {
+			soft, hard, ok := strings.Cut(i.VMUlimits[item], ":")
+			if !ok {
+				hard = soft
+			}
+			fmt.Fprintf(&contents, "* soft %s %s\n* hard %s %s\n", item, soft, item, hard)
+		}
+		files = append(files, guestFile{Path: guestLimitsConfigPath, Contents: contents.String()})
+	}
+
+	return files
+}
@@ -0,0 +1,62 @@
+package fleetingd
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Sorts before the distributions' and cloud-init's drop-ins, sshd uses the first value it reads for a setting
+const guestHardeningSSHDConfigPath = "/etc/ssh/sshd_config.d/10-fleetingd-hardening.conf"
+
+// Update services of the Ignition distributions, masked with vm_hardening so a job's VM doesn't change or reboot under it
+var ignitionUpdateUnits = map[string][]string{
+	"flatcar": {"update-engine.service", "locksmithd.service"},
+	"coreos":  {"zincati.service"},
+}
+
+func (i *InstanceGroup) guestHardeningFiles() []guestFile {
+	// Get the sshd settings of vm_hardening, public keys of the image's user only and no forwarding the runner doesn't need
+
+	if !i.VMHardening {
+		return nil
+	}
+
+	// The runner reaches the Docker socket through a Unix socket forward, so that one stays allowed
+	return []guestFile{{
+		Path: guestHardeningSSHDConfigPath,
+		Contents: fmt.Sprintf(`PermitRootLogin no
+PasswordAuthentication no
+KbdInteractiveAuthentication no
+PermitEmptyPasswords no
+AuthenticationMethods publickey
+AllowUsers %s
+MaxAuthTries 3
+LoginGraceTime 30
+X11Forwarding no
+PermitTunnel no
+PermitUserEnvironment no
+AllowStreamLocalForwarding local
+`, i.imageProfile.Username),
+	}}
+}
+
+func (i *InstanceGroup) guestFiles(instanceName string) []guestFile {
+	// Get the files written into the job VM with the given name on its first boot besides its network config and SSH keys
+
+	return slices.Concat(i.guestHardeningFiles(), i.guestSSHCAFiles(), i.guestTuningFiles(), i.guestTrimFiles(), i.guestHostsFiles(), i.instanceMetadataFiles(instanceName))
+}
+
+func (i *InstanceGroup) ignitionHardeningUnits() []ignitionUnit {
+	// Get the units masked with vm_hardening on Ignition distributions
+
+	if !i.VMHardening {
+		return nil
+	}
+
+	var units []ignitionUnit
+	for _, name := range ignitionUpdateUnits[i.imageProfile.Family] {
+		units = append(units, ignitionUnit{Name: name, Mask: true})
+	}
+
+	return units
+}
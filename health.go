@@ -0,0 +1,189 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Created in vm_disk_directory if health_socket is set
+const healthSocketFileName = "health.sock"
+
+// The reconciler is considered stuck after missing this many runs
+const reconcileStaleRuns = 3
+
+const (
+	prebuildStatePending   = "pending"
+	prebuildStateRunning   = "running"
+	prebuildStateSucceeded = "succeeded"
+	prebuildStateFailed    = "failed"
+)
+
+// What node monitoring needs to tell whether jobs can run, Problems explains an unhealthy or unready plugin
+type healthReport struct {
+	Healthy  bool     `json:"healthy"`
+	Ready    bool     `json:"ready"`
+	Problems []string `json:"problems,omitempty"`
+
+	// The prebuild only starts with the first requested instance
+	Prebuild      string `json:"prebuild"`
+	PrebuildError string `json:"prebuild_error,omitempty"`
+
+	// The images instances boot from, only known once the prebuild succeeded
+	ImagesPresent bool   `json:"images_present"`
+	ImagesCurrent bool   `json:"images_current"`
+	BaseImage     string `json:"base_image,omitempty"`
+
+	SlotsUsed   int     `json:"slots_used"`
+	Slots       int     `json:"slots"`
+	Utilization float64 `json:"utilization"`
+
+	LastReconcile *time.Time `json:"last_reconcile,omitempty"`
+}
+
+func (i *InstanceGroup) checkHealth() healthReport {
+	// Check the prebuild, the images, the address space and the reconciler, unhealthy means jobs are failing or about to
+
+	report := healthReport{Healthy: true, Prebuild: prebuildStatePending}
+
+	select {
+	case <-i.inventory.prebuildDone:
+		report.Prebuild = prebuildStateSucceeded
+		if i.inventory.prebuildErr != nil {
+			report.Prebuild = prebuildStateFailed
+			report.PrebuildError = i.inventory.prebuildErr.Error()
+		}
+	default:
+		if i.inventory.prebuildStarted.Load() {
+			report.Prebuild = prebuildStateRunning
+		}
+	}
+
+	if report.Prebuild == prebuildStateFailed {
+		report.Healthy = false
+		report.Problems = append(report.Problems, "prebuild failed")
+	}
+
+	// The images don't change anymore once the prebuild is done
+	if report.Prebuild == prebuildStateSucceeded {
+		report.BaseImage = i.getBaseImagePath()
+		report.ImagesPresent = i.imagesPresent()
+
+		goldenImagePath, _ := i.goldenImagePaths(i.goldenImageKey)
+		report.ImagesCurrent = i.goldenImagePath == goldenImagePath
+
+		if !report.ImagesPresent {
+			report.Healthy = false
+			report.Problems = append(report.Problems, "images instances boot from are missing")
+		}
+		i.imagesLock.Lock()
+		baseImageProblem := i.baseImageProblem
+		i.imagesLock.Unlock()
+
+		if baseImageProblem != nil {
+			report.Healthy = false
+			report.Problems = append(report.Problems, "base image failed its integrity check")
+		}
+		if !report.ImagesCurrent {
+			report.Problems = append(report.Problems, "instances boot from an image of outdated inputs")
+		}
+	}
+
+	i.inventory.lock.RLock()
+	report.SlotsUsed = i.inventory.ipam.Count()
+	i.inventory.lock.RUnlock()
+
+	report.Slots = i.maxIPAMSlots()
+	report.Utilization = float64(report.SlotsUsed) / float64(report.Slots)
+
+	if report.SlotsUsed >= report.Slots {
+		report.Problems = append(report.Problems, "address space exhausted")
+	}
+
+	// Until the first run the reconciler's age counts from the start of the plugin
+	lastReconcile := i.startedAt
+	if reconciled := i.inventory.lastReconcile.Load(); reconciled != nil {
+		lastReconcile = *reconciled
+		report.LastReconcile = reconciled
+	}
+
+	if time.Since(lastReconcile) > reconcileStaleRuns*reconcileInterval {
+		report.Healthy = false
+		report.Problems = append(report.Problems, fmt.Sprintf("reconciler did not run since %s", lastReconcile.Format(time.RFC3339)))
+	}
+
+	report.Ready = report.Healthy && report.Prebuild == prebuildStateSucceeded && report.ImagesCurrent && report.SlotsUsed < report.Slots
+
+	return report
+}
+
+func (i *InstanceGroup) imagesPresent() bool {
+	// Check the base image and the kernel instances boot from are still there
+
+	paths := []string{i.getBaseImagePath()}
+
+	kernelFilePath, err := i.getBootKernelPath()
+	if err != nil {
+		return false
+	}
+	if kernelFilePath != "" {
+		paths = append(paths, kernelFilePath)
+	}
+
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (i *InstanceGroup) serveHealth(ready bool) http.HandlerFunc {
+	// Report the health as JSON, the status code tells an unhealthy or, for ready, an unready plugin apart
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := i.checkHealth()
+
+		status := http.StatusOK
+		if !report.Healthy || (ready && !report.Ready) {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+}
+
+func (i *InstanceGroup) serveHealthSocket() error {
+	// Serve /health and /ready on a unix socket in vm_disk_directory if health_socket is set
+
+	if !i.HealthSocket {
+		return nil
+	}
+
+	socketPath := filepath.Join(i.VMDiskDir, healthSocketFileName)
+
+	listener, err := listenUnixSocket(socketPath)
+	if err != nil {
+		return fmt.Errorf("could not listen on the health socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", i.serveHealth(false))
+	mux.HandleFunc("GET /ready", i.serveHealth(true))
+
+	i.serveHTTP(listener, mux)
+
+	i.logger.Info("Serving health checks on the health socket.", "socket", socketPath)
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshd answers right away, a slow one is still busy with cloud-init
+const sshHandshakeTimeout = 5 * time.Second
+
+// A heartbeat result is reused for this long
+const heartbeatCacheTTL = 5 * time.Second
+
+// Probes of Update start spread over this interval
+const heartbeatJitter = 500 * time.Millisecond
+
+// At most this many probes of Update run at a time, every one is an SSH handshake
+const heartbeatParallelism = 16
+
+type heartbeatResult struct {
+	checkedAt time.Time
+	err       error
+}
+
+func (i *InstanceGroup) cachedHeartbeat(instance string) (heartbeatResult, bool) {
+	// Get the result of a recent heartbeat of an instance
+
+	i.heartbeatLock.Lock()
+	defer i.heartbeatLock.Unlock()
+
+	result, ok := i.heartbeatResults[instance]
+	if !ok || time.Since(result.checkedAt) > heartbeatCacheTTL {
+		return heartbeatResult{}, false
+	}
+
+	return result, true
+}
+
+func (i *InstanceGroup) cacheHeartbeat(instance string, err error) {
+	// Remember a heartbeat result, dropping the outdated ones of instances which may be gone
+
+	i.heartbeatLock.Lock()
+	defer i.heartbeatLock.Unlock()
+
+	if i.heartbeatResults == nil {
+		i.heartbeatResults = map[string]heartbeatResult{}
+	}
+
+	for name, result := range i.heartbeatResults {
+		if time.Since(result.checkedAt) > heartbeatCacheTTL {
+			delete(i.heartbeatResults, name)
+		}
+	}
+
+	i.heartbeatResults[instance] = heartbeatResult{checkedAt: time.Now(), err: err}
+}
+
+func (i *InstanceGroup) heartbeatAll(ctx context.Context, instances []string) map[string]error {
+	// Heartbeat instances concurrently, each after a random delay so the probes don't all hit the host at once
+
+	results := map[string]error{}
+	var lock sync.Mutex
+	var waitGroup sync.WaitGroup
+
+	semaphore := make(chan struct{}, heartbeatParallelism)
+
+	for _, instance := range instances {
+		waitGroup.Go(func() {
+			timer := time.NewTimer(rand.N(heartbeatJitter))
+			defer timer.Stop()
+
+			var err error
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-timer.C:
+				err = i.boundedHeartbeat(ctx, semaphore, instance)
+			}
+
+			lock.Lock()
+			results[instance] = err
+			lock.Unlock()
+		})
+	}
+
+	waitGroup.Wait()
+
+	return results
+}
+
+func (i *InstanceGroup) boundedHeartbeat(ctx context.Context, semaphore chan struct{}, instance string) error {
+	// Heartbeat an instance once one of the slots is free, the results are only reported when all probes finished
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case semaphore <- struct{}{}:
+	}
+	defer func() { <-semaphore }()
+
+	return i.Heartbeat(ctx, instance)
+}
+
+func (i *InstanceGroup) checkSSHLogin(ctx context.Context, hostPort string, info *provider.ConnectInfo, hostPublicKey string) error {
+	// Log in the way the runner does, a listening port alone may be passt or a guest whose user isn't set up yet
+
+	signer, err := ssh.ParsePrivateKey(info.Key)
+	if err != nil {
+		return err
+	}
+
+	// With vm_ssh_ca the certificate is offered first, guests booted before it was enabled only know the key
+	signers := []ssh.Signer{signer}
+	if i.sshCA != nil {
+		certSigner, err := i.issueSSHCertificate(signer, info.Username, info.ID)
+		if err != nil {
+			return err
+		}
+		signers = []ssh.Signer{certSigner, signer}
+	}
+
+	config := &ssh.ClientConfig{
+		User:    info.Username,
+		Auth:    []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		Timeout: sshHandshakeTimeout,
+	}
+
+	// Anything else answering on the instance's address, e.g. on the host between tap and runner, is rejected
+	err = pinSSHHostKey(config, hostPublicKey)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: time.Second}
+	connection, err := dialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	connection.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+
+	clientConnection, channels, requests, err := ssh.NewClientConn(connection, hostPort, config)
+	if err != nil {
+		return fmt.Errorf("could not log in to %s: %w", hostPort, err)
+	}
+
+	client := ssh.NewClient(clientConnection, channels, requests)
+	defer client.Close()
+
+	// The status agent of vm_guest_agent already reported cloud-init's status
+	if !i.VMHeartbeatCloudinitCheck || i.VMGuestAgent {
+		return nil
+	}
+
+	return checkCloudinitStatus(client)
+}
+
+func checkCloudinitStatus(client *ssh.Client) error {
+	// Check cloud-init finished in the guest, a guest where it failed never becomes healthy
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput("cloud-init status")
+	status := strings.TrimSpace(string(output))
+
+	// Exit code 2 means cloud-init finished with warnings only
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.ExitStatus() == 2 {
+			return nil
+		}
+		return fmt.Errorf("%w: cloud-init failed: %s", provider.ErrInstanceUnhealthy, status)
+	}
+	if err != nil {
+		return fmt.Errorf("could not check cloud-init status: %w", err)
+	}
+
+	if !strings.Contains(status, "status: done") {
+		return fmt.Errorf("cloud-init has not finished yet: %s", status)
+	}
+
+	return nil
+}
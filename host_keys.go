@@ -0,0 +1,59 @@
+package fleetingd
+
+import (
+	"crypto/ed25519"
+	"encoding/pem"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The host key the plugin generates for a job VM and injects through its userdata, heartbeats only accept this one
+type sshHostKey struct {
+	PrivateKey string
+	PublicKey  string
+}
+
+func generateSSHHostKey() (sshHostKey, error) {
+	// Generate an instance's ed25519 host key, the private key in the OpenSSH format sshd reads and the public key as in known_hosts
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return sshHostKey{}, err
+	}
+
+	marshalledKey, err := ssh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		return sshHostKey{}, err
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return sshHostKey{}, err
+	}
+
+	return sshHostKey{
+		PrivateKey: string(pem.EncodeToMemory(marshalledKey)),
+		PublicKey:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))),
+	}, nil
+}
+
+func pinSSHHostKey(config *ssh.ClientConfig, publicKey string) error {
+	// Only accept the instance's own host key, instances adopted from a record of an older plugin have none and are accepted as before
+
+	if publicKey == "" {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return nil
+	}
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return err
+	}
+
+	// Otherwise sshd may present one of the other host keys it generated
+	config.HostKeyAlgorithms = []string{hostKey.Type()}
+	config.HostKeyCallback = ssh.FixedHostKey(hostKey)
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Set of the bridged instances' MAC addresses, on a bridge the input interface is the bridge itself
+const firewallMACSetName = "macs"
+
+// Cloud metadata endpoints live in here
+var linkLocalPrefix = netip.MustParsePrefix("169.254.0.0/16")
+
+var privateNetworkPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+func (i *InstanceGroup) checkHostProtection() error {
+	// Validate the host protection settings
+
+	// The DHCP server and gateway of a bridged network usually are private addresses
+	if i.EgressBlockPrivateNetworks && i.isBridged() {
+		return errors.New("egress_block_private_networks can not be combined with network_mode bridge")
+	}
+
+	if len(i.EgressHostAllow) == 0 {
+		return nil
+	}
+
+	if i.EgressDisableHostProtection {
+		return errors.New("egress_host_allow can not be combined with egress_disable_host_protection, which allows everything")
+	}
+
+	// passt's guests reach the host through passt's own sockets, which the firewall can't tell apart from the host's
+	if i.usesPasst() {
+		return errors.New("egress_host_allow can not be combined with network_mode passt")
+	}
+
+	i.hostAllowRules = []egressRule{}
+	for _, rule := range i.EgressHostAllow {
+		parsedRule, err := parseEgressRule(rule)
+		if err != nil {
+			return fmt.Errorf("invalid rule in egress_host_allow: %w", err)
+		}
+		i.hostAllowRules = append(i.hostAllowRules, parsedRule)
+	}
+
+	return nil
+}
+
+func firewallMACSet() *nftables.Set {
+	return &nftables.Set{Table: firewallTable(), Name: firewallMACSetName, KeyType: nftables.TypeEtherAddr}
+}
+
+func (i *InstanceGroup) addHostProtectionChain(connection nftablesBatch, table *nftables.Table, tapSet *nftables.Set, macSet *nftables.Set) {
+	// Guests may only answer connections opened by the host, e.g. the runner's SSH sessions
+
+	if i.EgressDisableHostProtection {
+		return
+	}
+
+	chain := connection.AddChain(&nftables.Chain{
+		Name:     "guesttohost",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   policyRef(nftables.ChainPolicyAccept),
+	})
+
+	matchGuest := matchInterfaceSet(expr.MetaKeyIIFNAME, tapSet)
+	if i.isBridged() {
+		matchGuest = append(matchInterface(expr.MetaKeyIIFNAME, i.bridgeDevice),
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+			&expr.Lookup{SourceRegister: 1, SetName: macSet.Name, SetID: macSet.ID})
+	}
+
+	// ct state established,related accept
+	addRule(connection, chain,
+		matchGuest,
+		[]expr.Any{
+			&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		},
+		accept())
+
+	// Ping and neighbour discovery
+	addRule(connection, chain,
+		matchGuest,
+		matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_ICMP),
+		accept())
+	addRule(connection, chain,
+		matchGuest,
+		matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_ICMPV6),
+		accept())
+
+	// Host services the guests are explicitly allowed to use, e.g. an NTP server or a proxy on the host
+	for _, rule := range i.hostAllowRules {
+		addRule(connection, chain, append(append([][]expr.Any{matchGuest}, matchEgressRule(rule)...), accept())...)
+	}
+
+	// The DNS forwarder listens on the host tap addresses
+	if i.dnsForwarder != nil {
+		for _, protocol := range []byte{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+			addRule(connection, chain,
+				matchGuest,
+				matchL4Protocol(expr.CmpOpEq, protocol),
+				[]expr.Any{
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(53)},
+				},
+				accept())
+		}
+	}
+
+	// The host's NTP server with vm_ntp_relay
+	if i.VMNTPRelay {
+		addRule(connection, chain,
+			matchGuest,
+			matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_UDP),
+			[]expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(123)},
+			},
+			accept())
+	}
+
+	// The seeds of vm_seed_mode http, each only answers its own instance
+	if i.usesHTTPSeed() {
+		addRule(connection, chain,
+			matchGuest,
+			matchL4Protocol(expr.CmpOpEq, unix.IPPROTO_TCP),
+			[]expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(seedServerPort)},
+			},
+			accept())
+	}
+
+	addRule(connection, chain,
+		matchGuest,
+		drop())
+}
+
+func (i *InstanceGroup) addDestinationProtectionRules(connection nftablesBatch, chain *nftables.Chain) {
+	// Queue the rules keeping an instance away from link-local and optionally private networks, egress_networks are decided in between
+
+	if !i.EgressDisableHostProtection {
+		addRule(connection, chain,
+			matchProtocol(unix.ETH_P_IP),
+			matchPrefix(expr.PayloadBaseNetworkHeader, 16, expr.CmpOpEq, linkLocalPrefix),
+			drop())
+	}
+
+	// Denied networks win over allowed ones, an allowed one then bypasses egress_block_private_networks and the egress rules
+	i.addEgressNetworkRules(connection, chain, egressPolicyDeny, drop())
+	i.addEgressNetworkRules(connection, chain, egressPolicyAllow, accept())
+
+	if !i.EgressBlockPrivateNetworks {
+		return
+	}
+
+	for _, prefix := range privateNetworkPrefixes {
+		addRule(connection, chain, append(matchEgressRule(egressRule{Prefix: prefix}), drop())...)
+	}
+}
@@ -0,0 +1,149 @@
+package fleetingd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+type hypervisorAPIClient struct {
+	client *http.Client
+}
+
+func newHypervisorAPIClient(socketPath string) *hypervisorAPIClient {
+	// Create a client for the cloud-hypervisor REST API listening on a unix socket
+
+	return &hypervisorAPIClient{
+		client: &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+func (i *InstanceGroup) getAPISocketPath(instanceName string) string {
+	// Get the path of an instance's hypervisor API socket
+
+	return filepath.Join(i.getInstanceDir(instanceName), "api.sock")
+}
+
+func (c *hypervisorAPIClient) request(method string, endpoint string, body any, response any) error {
+	// Send a request to the hypervisor API, the host part of the URL is ignored by the socket dialer
+
+	var requestBody io.Reader
+	if body != nil {
+		marshalledBody, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(marshalledBody)
+	}
+
+	request, err := http.NewRequest(method, "http://localhost/api/v1/"+endpoint, requestBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResponse, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(httpResponse.Body, 4096))
+		return fmt.Errorf("hypervisor API call %s failed with status %s: %s", endpoint, httpResponse.Status, bytes.TrimSpace(message))
+	}
+
+	if response != nil {
+		return json.NewDecoder(httpResponse.Body).Decode(response)
+	}
+
+	return nil
+}
+
+func (c *hypervisorAPIClient) Ping() error {
+	return c.request(http.MethodGet, "vmm.ping", nil, nil)
+}
+
+func (c *hypervisorAPIClient) Pause() error {
+	return c.request(http.MethodPut, "vm.pause", nil, nil)
+}
+
+func (c *hypervisorAPIClient) Resume() error {
+	return c.request(http.MethodPut, "vm.resume", nil, nil)
+}
+
+func (c *hypervisorAPIClient) Snapshot(destinationDir string) error {
+	type snapshotRequest struct {
+		DestinationURL string `json:"destination_url"`
+	}
+
+	return c.request(http.MethodPut, "vm.snapshot", snapshotRequest{DestinationURL: "file://" + destinationDir}, nil)
+}
+
+func (c *hypervisorAPIClient) ResizeBalloon(sizeBytes uint64) error {
+	type resizeRequest struct {
+		DesiredBalloon uint64 `json:"desired_balloon"`
+	}
+
+	return c.request(http.MethodPut, "vm.resize", resizeRequest{DesiredBalloon: sizeBytes}, nil)
+}
+
+func (c *hypervisorAPIClient) Counters() (map[string]map[string]uint64, error) {
+	// Get the counters of the VM's devices by device id, e.g. read_bytes of _disk0 or rx_bytes of _net1
+
+	counters := map[string]map[string]uint64{}
+	err := c.request(http.MethodGet, "vm.counters", nil, &counters)
+
+	return counters, err
+}
+
+type hypervisorVMInfo struct {
+	Config struct {
+		Memory struct {
+			Size uint64 `json:"size"`
+		} `json:"memory"`
+	} `json:"config"`
+	// Guest memory minus what the balloon reclaimed
+	MemoryActualSize uint64 `json:"memory_actual_size"`
+}
+
+func (c *hypervisorAPIClient) Info() (hypervisorVMInfo, error) {
+	var info hypervisorVMInfo
+	err := c.request(http.MethodGet, "vm.info", nil, &info)
+
+	return info, err
+}
+
+func (c *hypervisorAPIClient) waitReady(timeout time.Duration) error {
+	// Wait for the API socket to accept requests after the process was started
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := c.Ping()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for hypervisor API: %w", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
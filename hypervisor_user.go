@@ -0,0 +1,234 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cloud-hypervisor needs read and write access to it to run VMs
+const kvmDevicePath = "/dev/kvm"
+
+func lookupUser(name string) (*user.User, error) {
+	// Find a user by name or uid
+
+	found, err := user.Lookup(name)
+	if err != nil {
+		found, err = user.LookupId(name)
+	}
+
+	return found, err
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	// Find a group by name or gid
+
+	found, err := user.LookupGroup(name)
+	if err != nil {
+		found, err = user.LookupGroupId(name)
+	}
+
+	return found, err
+}
+
+func (i *InstanceGroup) parseHypervisorUser() error {
+	// Resolve the user the job VMs' processes are run as, they run with the plugin's privileges by default
+
+	if i.VMHypervisorUser == "" {
+		if i.VMHypervisorGroup != "" {
+			return errors.New("vm_hypervisor_group requires vm_hypervisor_user")
+		}
+		return nil
+	}
+
+	// Handing files and taps to another user takes root
+	if os.Geteuid() != 0 {
+		return errors.New("vm_hypervisor_user requires the plugin to run as root")
+	}
+
+	// These open devices or create taps, which takes the privileges the user doesn't have
+	unsupported := map[string]bool{
+		"vm_passthrough_devices":    len(i.VMPassthroughDevices) > 0,
+		"vm_net_sriov_devices":      len(i.VMNetSRIOVDevices) > 0,
+		"vm_net_vhost_user":         i.VMNetVhostUser,
+		"vm_snapshot_boot":          i.VMSnapshotBoot,
+		"vm_confidential_computing": i.VMConfidentialComputing != "",
+	}
+	for _, setting := range slices.Sorted(maps.Keys(unsupported)) {
+		if unsupported[setting] {
+			return fmt.Errorf("vm_hypervisor_user can not be combined with %s", setting)
+		}
+	}
+
+	hypervisorUser, err := lookupUser(i.VMHypervisorUser)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as vm_hypervisor_user but is not a known user: %w", i.VMHypervisorUser, err)
+	}
+
+	uid, err := strconv.ParseUint(hypervisorUser.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return fmt.Errorf("vm_hypervisor_user '%s' is root", i.VMHypervisorUser)
+	}
+
+	gid, err := strconv.ParseUint(hypervisorUser.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if i.VMHypervisorGroup != "" {
+		group, err := lookupGroup(i.VMHypervisorGroup)
+		if err != nil {
+			return fmt.Errorf("'%s' was specified as vm_hypervisor_group but is not a known group: %w", i.VMHypervisorGroup, err)
+		}
+
+		gid, err = strconv.ParseUint(group.Gid, 10, 32)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The supplementary groups give access to /dev/kvm, usually through the kvm group
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	groupIDs, err := hypervisorUser.GroupIds()
+	if err != nil {
+		return fmt.Errorf("could not get the groups of vm_hypervisor_user '%s': %w", i.VMHypervisorUser, err)
+	}
+	for _, groupID := range groupIDs {
+		groupGID, err := strconv.ParseUint(groupID, 10, 32)
+		if err != nil {
+			return err
+		}
+		credential.Groups = append(credential.Groups, uint32(groupGID))
+	}
+
+	err = checkDeviceAccess(kvmDevicePath, credential)
+	if err != nil {
+		return fmt.Errorf("vm_hypervisor_user '%s' can not use %s, add it to the group owning it: %w", i.VMHypervisorUser, kvmDevicePath, err)
+	}
+
+	i.hypervisorCredential = credential
+
+	return nil
+}
+
+func checkDeviceAccess(path string, credential *syscall.Credential) error {
+	// Check the mode of a device lets the user of the credential read and write it, ACLs are not considered
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("could not get the owner of %s", path)
+	}
+
+	mode := info.Mode().Perm()
+	switch {
+	case stat.Uid == credential.Uid && mode&0600 == 0600:
+		return nil
+	case (stat.Gid == credential.Gid || slices.Contains(credential.Groups, stat.Gid)) && mode&0060 == 0060:
+		return nil
+	case mode&0006 == 0006:
+		return nil
+	}
+
+	return fmt.Errorf("%s is owned by %d:%d with mode %s", path, stat.Uid, stat.Gid, mode)
+}
+
+func (i *InstanceGroup) handToHypervisorUser(instanceName string, paths ...string) error {
+	// Give the user running an instance's processes its directory and the given files, and read access to the images it boots from, empty paths are skipped
+
+	if i.hypervisorCredential == nil {
+		return nil
+	}
+
+	uid := int(i.hypervisorCredential.Uid)
+	gid := int(i.hypervisorCredential.Gid)
+
+	// Created by the plugin, the instance's processes add their sockets, console and events
+	err := filepath.WalkDir(i.getInstanceDir(instanceName), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return fmt.Errorf("could not hand the directory of %s to vm_hypervisor_user: %w", instanceName, err)
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		err = os.Chown(path, uid, gid)
+		if err != nil {
+			return fmt.Errorf("could not hand %s to vm_hypervisor_user: %w", path, err)
+		}
+	}
+
+	// Overlays are backed by the base image, the kernel is booted directly, both are shared by all instances
+	workdir := filepath.Join(i.VMDiskDir, vmWorkdir)
+	shared := map[string]fs.FileMode{
+		i.VMDiskDir: 0010,
+		workdir:     0010,
+	}
+
+	kernelFilePath, err := i.getBootKernelPath()
+	if err != nil {
+		return err
+	}
+	if kernelFilePath != "" {
+		shared[kernelFilePath] = 0040
+	}
+	if i.VMDiskOverlay {
+		shared[i.getBaseImagePath()] = 0040
+	}
+
+	for path, mode := range shared {
+		// Files from elsewhere, e.g. local images, have to be readable already
+		if path != i.VMDiskDir && !strings.HasPrefix(path, i.VMDiskDir+string(filepath.Separator)) {
+			continue
+		}
+
+		err = shareWithGroup(path, gid, mode)
+		if err != nil {
+			return fmt.Errorf("could not share %s with vm_hypervisor_user: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+func shareWithGroup(path string, gid int, mode fs.FileMode) error {
+	// Let a group access a file or directory the plugin keeps owning
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chown(path, -1, gid)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Perm()&mode == mode {
+		return nil
+	}
+
+	return os.Chmod(path, info.Mode().Perm()|mode)
+}
@@ -0,0 +1,365 @@
+package fleetingd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"golang.org/x/sys/unix"
+)
+
+const idleCheckInterval = 30 * time.Second
+
+// The port of the guests' sshd ConnectInfo hands out together with their tap addresses
+const guestSSHPort = 22
+
+// Destinations of the established TCP connections on the host, an instance is busy while one of its SSH addresses is among them
+type sshSessions map[netip.AddrPort]struct{}
+
+// Guests reporting a higher load through vm_guest_agent are busy even without SSH sessions, e.g. with a job's background process
+const idleGuestLoad = 0.5
+
+func (i *InstanceGroup) runIdlePolicy(ctx context.Context) {
+	// Inflate the balloons of instances which have not been used for vm_idle_balloon_minutes and pause those idle for vm_idle_pause_minutes
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if i.VMIdleBalloonMinutes > 0 {
+				i.inventory.BalloonIdleInstances(i)
+			}
+			if i.VMIdlePauseMinutes > 0 {
+				i.inventory.PauseIdleInstances(i)
+			}
+		}
+	}
+}
+
+func (i *Inventory) BalloonIdleInstances(instanceGroup *InstanceGroup) {
+	// Reclaim the memory of running instances idle for vm_idle_balloon_minutes down to vm_memory_floor_mb, busy ones get it back
+
+	sessions, err := instanceGroup.getSSHSessions()
+	if err != nil {
+		instanceGroup.logger.Error("could not determine active SSH sessions", "error", err)
+		return
+	}
+
+	// The balloons are resized without the lock like the memory manager's
+	var resizes []balloonResize
+
+	i.lock.Lock()
+	for _, instance := range i.instances {
+		if instance.Internal || instance.Paused || instance.State != provider.StateRunning {
+			continue
+		}
+
+		active := sessions.active(instance)
+		if instance.GuestStatus != nil && instance.GuestStatus.Load1 >= idleGuestLoad {
+			active = true
+		}
+		if active {
+			instance.LastActive = time.Now()
+		}
+
+		targetMegabytes := instanceGroup.idleBalloonMegabytes(instance, active)
+
+		// A balloon inflated under host memory pressure is left to the memory manager
+		if targetMegabytes == instance.BalloonMegabytes || (!active && targetMegabytes < instance.BalloonMegabytes) {
+			continue
+		}
+
+		resizes = append(resizes, balloonResize{instance: instance, fromMegabytes: instance.BalloonMegabytes, toMegabytes: targetMegabytes})
+	}
+	i.lock.Unlock()
+
+	for _, resize := range resizes {
+		resized, err := i.resizeBalloon(instanceGroup, resize)
+		if err != nil {
+			resize.instance.logger.Error("could not resize memory balloon of idle instance", "error", err)
+			continue
+		}
+
+		if resized {
+			resize.instance.logger.Info("resized memory balloon of idle instance", "balloon_mb", resize.toMegabytes)
+		}
+	}
+}
+
+func (i *InstanceGroup) idleBalloonMegabytes(instance *InstanceInfo, active bool) uint64 {
+	// Get the balloon the idle policy gives an instance, none while it is used or before vm_idle_balloon_minutes passed
+
+	idleTimeout := time.Duration(i.VMIdleBalloonMinutes) * time.Minute
+	if active || i.VMIdleBalloonMinutes == 0 || time.Since(instance.LastActive) < idleTimeout {
+		return 0
+	}
+
+	return i.maxBalloonMegabytes()
+}
+
+func (i *Inventory) PauseIdleInstances(instanceGroup *InstanceGroup) {
+	// Pause running instances without SSH sessions once they have been idle long enough
+
+	idleTimeout := time.Duration(instanceGroup.VMIdlePauseMinutes) * time.Minute
+
+	sessions, err := instanceGroup.getSSHSessions()
+	if err != nil {
+		instanceGroup.logger.Error("could not determine active SSH sessions", "error", err)
+		return
+	}
+
+	// The instances are paused without the lock, a hanging hypervisor would block the whole inventory otherwise
+	var idleInstances []*InstanceInfo
+
+	i.lock.Lock()
+	for _, instance := range i.instances {
+		// Booting instances are still being logged in to and deleted ones are on their way out
+		if instance.Internal || instance.Paused || instance.State != provider.StateRunning {
+			continue
+		}
+
+		// A job is connected to the instance
+		if sessions.active(instance) {
+			instance.LastActive = time.Now()
+			continue
+		}
+
+		if time.Since(instance.LastActive) < idleTimeout {
+			continue
+		}
+
+		idleInstances = append(idleInstances, instance)
+	}
+	i.lock.Unlock()
+
+	for _, instance := range idleInstances {
+		paused, err := i.pauseIdleInstance(instanceGroup, instance, idleTimeout)
+		if err != nil {
+			instance.logger.Error("could not pause idle instance", "error", err)
+			continue
+		}
+
+		if paused {
+			instance.logger.Info("paused idle instance")
+		}
+	}
+}
+
+func (i *Inventory) pauseIdleInstance(instanceGroup *InstanceGroup, instance *InstanceInfo, idleTimeout time.Duration) (bool, error) {
+	// Pause an instance picked as idle unless it was woken, paused or removed since
+
+	// ConnectInfo marks the instance as active before it waits for the lock, so it resumes an instance paused here
+	instance.apiLock.Lock()
+	defer instance.apiLock.Unlock()
+
+	i.lock.RLock()
+	idle := i.instances[instance.Name] == instance && instance.State == provider.StateRunning && !instance.Paused && time.Since(instance.LastActive) >= idleTimeout
+	i.lock.RUnlock()
+
+	if !idle {
+		return false, nil
+	}
+
+	err := newHypervisorAPIClient(instanceGroup.getAPISocketPath(instance.Name)).Pause()
+	if err != nil {
+		return false, err
+	}
+
+	i.lock.Lock()
+	instance.Paused = true
+	i.lock.Unlock()
+
+	return true, nil
+}
+
+func (i *Inventory) WakeInstance(instanceGroup *InstanceGroup, name string) error {
+	// Resume an instance if it was paused, give it back its memory and mark it as active
+
+	i.lock.Lock()
+	instance, ok := i.instances[name]
+	if ok {
+		instance.LastActive = time.Now()
+	}
+	i.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	// A pause or balloon resize of the instance which is already under way finishes first
+	instance.apiLock.Lock()
+	defer instance.apiLock.Unlock()
+
+	// Both only change while the API lock is held
+	i.lock.RLock()
+	paused := instance.Paused
+	ballooned := instance.BalloonMegabytes > 0
+	i.lock.RUnlock()
+
+	apiClient := newHypervisorAPIClient(instanceGroup.getAPISocketPath(name))
+
+	if paused {
+		err := apiClient.Resume()
+		if err != nil {
+			return err
+		}
+
+		i.lock.Lock()
+		instance.Paused = false
+		i.lock.Unlock()
+		instance.logger.Info("resumed instance")
+	}
+
+	if ballooned {
+		err := apiClient.ResizeBalloon(0)
+		if err != nil {
+			return err
+		}
+
+		i.lock.Lock()
+		instance.BalloonMegabytes = 0
+		i.lock.Unlock()
+		instance.logger.Info("deflated instance memory balloon")
+	}
+
+	return nil
+}
+
+func (i *Inventory) IsInstancePaused(name string) bool {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	instance, ok := i.instances[name]
+
+	return ok && instance.Paused
+}
+
+func (i *InstanceGroup) getSSHSessions() (sshSessions, error) {
+	// Collect the destinations of the established TCP connections over IPv4 and IPv6, with external access also those forwarded to the guests
+
+	sessions := sshSessions{}
+
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		err := sessions.readTCPTable(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Connections DNATed from the external address end in the guest, the host's sockets don't see them
+	if i.externalAccessEnabled() {
+		for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+			flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, family)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, flow := range flows {
+				tcp, ok := flow.ProtoInfo.(*netlink.ProtoInfoTCP)
+				if !ok || tcp.State != nl.TCP_CONNTRACK_ESTABLISHED {
+					continue
+				}
+
+				// The client connected to the forward destination, the reply comes from the guest
+				sessions.add(flow.Forward.DstIP, flow.Forward.DstPort)
+				sessions.add(flow.Reverse.SrcIP, flow.Reverse.SrcPort)
+			}
+		}
+	}
+
+	return sessions, nil
+}
+
+func (s sshSessions) readTCPTable(path string) error {
+	// Add the remote addresses of the established connections in /proc/net/tcp or /proc/net/tcp6
+
+	tcpTable, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer tcpTable.Close()
+
+	scanner := bufio.NewScanner(tcpTable)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// Columns: sl local_address rem_address st ..., state 01 is ESTABLISHED
+		if len(fields) < 4 || fields[3] != "01" {
+			continue
+		}
+
+		address, port, found := strings.Cut(fields[2], ":")
+		if !found {
+			continue
+		}
+
+		portNumber, err := strconv.ParseUint(port, 16, 16)
+		if err != nil {
+			continue
+		}
+
+		// Addresses are printed as 32 bit words of the in-memory network order bytes interpreted as host order numbers
+		addressBytes, err := hex.DecodeString(address)
+		if err != nil || (len(addressBytes) != 4 && len(addressBytes) != 16) {
+			continue
+		}
+
+		ip := make(net.IP, len(addressBytes))
+		for offset := 0; offset < len(addressBytes); offset += 4 {
+			binary.NativeEndian.PutUint32(ip[offset:], binary.BigEndian.Uint32(addressBytes[offset:]))
+		}
+
+		s.add(ip, uint16(portNumber))
+	}
+
+	return scanner.Err()
+}
+
+func (s sshSessions) add(ip net.IP, port uint16) {
+	// Record a connection's destination, IPv4 addresses mapped into IPv6 are recorded as IPv4
+
+	address, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return
+	}
+
+	s[netip.AddrPortFrom(address.Unmap(), port)] = struct{}{}
+}
+
+func (s sshSessions) active(instance *InstanceInfo) bool {
+	// Tell if a connection to any of the addresses ConnectInfo hands out for the instance is established
+
+	addresses := []string{instance.PasstSSHAddress, instance.ExternalSSHAddress}
+	for _, ip := range []string{instance.InstanceTapIP, instance.InstanceTapIP6} {
+		if ip != "" {
+			addresses = append(addresses, net.JoinHostPort(ip, strconv.Itoa(guestSSHPort)))
+		}
+	}
+
+	for _, address := range addresses {
+		addressPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := s[netip.AddrPortFrom(addressPort.Addr().Unmap(), addressPort.Port())]; ok {
+			return true
+		}
+	}
+
+	return false
+}
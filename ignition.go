@@ -0,0 +1,174 @@
+package fleetingd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"text/template"
+)
+
+// Understood by the Ignition releases of current Flatcar and Fedora CoreOS
+const ignitionSpecVersion = "3.3.0"
+
+// Where Ignition's OpenStack provider looks for the config on a config drive
+const ignitionConfigDriveLabel = "CONFIG-2"
+const ignitionConfigDriveDirectory = "/openstack/latest"
+
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd struct {
+		Users []ignitionUser `json:"users"`
+	} `json:"passwd"`
+	Storage struct {
+		Files       []ignitionFile       `json:"files"`
+		Filesystems []ignitionFilesystem `json:"filesystems,omitempty"`
+	} `json:"storage"`
+	Systemd struct {
+		Units []ignitionUnit `json:"units,omitempty"`
+	} `json:"systemd"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+type ignitionFile struct {
+	Path      string             `json:"path"`
+	Mode      int                `json:"mode"`
+	Overwrite bool               `json:"overwrite"`
+	Contents  *ignitionResource  `json:"contents,omitempty"`
+	Append    []ignitionResource `json:"append,omitempty"`
+}
+
+type ignitionResource struct {
+	Source string `json:"source"`
+}
+
+type ignitionFilesystem struct {
+	Device         string `json:"device"`
+	Format         string `json:"format"`
+	WipeFilesystem bool   `json:"wipeFilesystem"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Mask     bool   `json:"mask,omitempty"`
+	Contents string `json:"contents,omitempty"`
+}
+
+func newIgnitionFile(path string, mode int, contents []byte) ignitionFile {
+	// Create a file entry carrying its contents as a data URL
+
+	return ignitionFile{
+		Path:      path,
+		Mode:      mode,
+		Overwrite: true,
+		Contents:  &ignitionResource{Source: dataURL(contents)},
+	}
+}
+
+func newIgnitionAppend(path string, mode int, contents []byte) ignitionFile {
+	// Create a file entry adding its contents to the end of the file the image has
+
+	return ignitionFile{
+		Path:   path,
+		Mode:   mode,
+		Append: []ignitionResource{{Source: dataURL(contents)}},
+	}
+}
+
+func dataURL(contents []byte) string {
+	// Carry contents inline in the config
+
+	return "data:;base64," + base64.StdEncoding.EncodeToString(contents)
+}
+
+func (i *InstanceGroup) renderIgnitionConfig(templates *template.Template, instanceName string, sshAuthorizedPublicKey string, hostKey sshHostKey, dhcp bool, templateInput any) ([]byte, error) {
+	// Render the Ignition config setting up the SSH keys, hostname and network of an instance
+
+	config := ignitionConfig{}
+	config.Ignition.Version = ignitionSpecVersion
+
+	config.Passwd.Users = []ignitionUser{
+		{
+			Name:              i.imageProfile.Username,
+			SSHAuthorizedKeys: i.authorizedKeys(sshAuthorizedPublicKey),
+		},
+	}
+
+	networkConfig := bytes.Buffer{}
+	err := templates.ExecuteTemplate(&networkConfig, i.imageProfile.IgnitionNetworkTemplate, templateInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// NetworkManager ignores keyfiles readable by others while systemd-networkd runs unprivileged
+	networkConfigMode := 0644
+	if strings.HasSuffix(i.imageProfile.IgnitionNetworkFile, ".nmconnection") {
+		networkConfigMode = 0600
+	}
+
+	config.Storage.Files = []ignitionFile{
+		newIgnitionFile("/etc/hostname", 0644, []byte(instanceName+"\n")),
+		newIgnitionFile(i.imageProfile.IgnitionNetworkFile, networkConfigMode, networkConfig.Bytes()),
+
+		// sshd only generates the host keys which are missing
+		newIgnitionFile("/etc/ssh/ssh_host_ed25519_key", 0600, []byte(hostKey.PrivateKey)),
+		newIgnitionFile("/etc/ssh/ssh_host_ed25519_key.pub", 0644, []byte(hostKey.PublicKey+"\n")),
+	}
+
+	// Without a prebuild the proxy is set up on every instance, Ignition writes the files before systemd loads any unit
+	for _, file := range append(i.guestFiles(instanceName), i.guestProxyFiles()...) {
+		if file.Append {
+			config.Storage.Files = append(config.Storage.Files, newIgnitionAppend(file.Path, 0644, []byte(file.Contents)))
+			continue
+		}
+		config.Storage.Files = append(config.Storage.Files, newIgnitionFile(file.Path, 0644, []byte(file.Contents)))
+	}
+
+	if dhcp {
+		announceUnit := bytes.Buffer{}
+		err = templates.ExecuteTemplate(&announceUnit, "ignition-announce.tpl", templateInput)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Systemd.Units = []ignitionUnit{
+			{
+				Name:     "fleetingd-announce.service",
+				Enabled:  true,
+				Contents: announceUnit.String(),
+			},
+		}
+	}
+
+	config.Systemd.Units = append(config.Systemd.Units, i.ignitionHardeningUnits()...)
+
+	// Ignition formats the extra disks and a new cache disk, a mount unit each mounts them on every boot
+	for _, mount := range i.extraDiskMounts() {
+		config.Storage.Filesystems = append(config.Storage.Filesystems, ignitionFilesystem{
+			Device:         mount.Device,
+			Format:         mount.Filesystem,
+			WipeFilesystem: mount.Wipe,
+		})
+
+		mountUnit := bytes.Buffer{}
+		err = templates.ExecuteTemplate(&mountUnit, "ignition-mount.tpl", mount)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Systemd.Units = append(config.Systemd.Units, ignitionUnit{
+			Name:     mount.Unit,
+			Enabled:  true,
+			Contents: mountUnit.String(),
+		})
+	}
+
+	return json.Marshal(config)
+}
@@ -0,0 +1,342 @@
+package fleetingd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Checksums are shortened in the listing like image IDs, enough to tell images apart
+const imageCacheChecksumLength = 16
+
+// A file in vm_disk_directory belonging to the images
+type cachedImage struct {
+	Name     string
+	Kind     string
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+
+	// Removed together with the file, e.g. the record of a golden image
+	Companions []string
+}
+
+func Images(ctx context.Context, configPath string, offline bool, remove []string) error {
+	// List the images cached in the vm_disk_directory of the plugin_config in configPath, given as JSON, and whether upstream has newer ones, or remove the named ones
+
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	instanceGroup := &InstanceGroup{}
+	err = json.Unmarshal(contents, instanceGroup)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", configPath, err)
+	}
+
+	if instanceGroup.VMDiskDir == "" {
+		return fmt.Errorf("no vm_disk_directory in %s", configPath)
+	}
+
+	instanceGroup.logger = hclog.New(&hclog.LoggerOptions{Name: "images", Output: os.Stderr})
+
+	// Only what finding the upstream images needs
+	checks := []func() error{
+		instanceGroup.parseImageProfile,
+		instanceGroup.parseLocalImages,
+		instanceGroup.parseImageMirrors,
+		instanceGroup.checkImageTLS,
+		instanceGroup.checkImageSignatures,
+		instanceGroup.checkCosignKey,
+	}
+
+	for _, check := range checks {
+		err = check()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(remove) > 0 {
+		return instanceGroup.removeCachedImages(remove)
+	}
+
+	// Marks the current files as such, they are only known once the upstream images are resolved
+	resolved := false
+	if !offline {
+		err = instanceGroup.resolveImages(ctx)
+		if err != nil {
+			return err
+		}
+		resolved = true
+	}
+
+	images, err := instanceGroup.listCachedImages(resolved)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "KIND\tNAME\tSIZE\tMODIFIED\tCHECKSUM")
+	for _, image := range images {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", image.Kind, image.Name, formatImageSize(image.Size), image.ModTime.Format(time.DateTime), image.Checksum)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if !resolved {
+		return nil
+	}
+
+	fmt.Println()
+	fmt.Println("Disk image: " + instanceGroup.imageUpdateStatus(ctx, instanceGroup.diskImage, "_image"))
+	if instanceGroup.bootsKernel() {
+		fmt.Println("Kernel:     " + instanceGroup.imageUpdateStatus(ctx, instanceGroup.kernel, "_kernel"))
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) listCachedImages(resolved bool) ([]cachedImage, error) {
+	// Find the image files in vm_disk_directory, sorted by name, resolved also finds the current downloads which no image was made from yet
+
+	entries, err := os.ReadDir(i.VMDiskDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]struct{}{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names[entry.Name()] = struct{}{}
+		}
+	}
+
+	// Downloads are only told apart from the plugin's other files by what was made from them
+	downloads := map[string]struct{}{}
+	if resolved {
+		for name := range i.currentImageFiles() {
+			downloads[name] = struct{}{}
+		}
+	}
+
+	images := []cachedImage{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		image := cachedImage{Name: name}
+
+		switch {
+		case strings.HasSuffix(name, downloadPartialSuffix):
+			image.Kind = "partial"
+		case i.isChecksumFileName(name):
+			image.Kind = "checksums"
+		case strings.HasSuffix(name, cosignSignatureSuffix), strings.HasSuffix(name, cosignAttestationSuffix):
+			image.Kind = "signature"
+		case strings.HasPrefix(name, goldenImagePrefix) && filepath.Ext(name) == ".json":
+			// Listed with its golden image
+			continue
+		case strings.HasPrefix(name, goldenImagePrefix):
+			image.Kind = "golden"
+
+			recordName := strings.TrimSuffix(name, filepath.Ext(name)) + ".json"
+			image.Companions = []string{recordName}
+
+			record, err := readGoldenImageRecord(filepath.Join(i.VMDiskDir, recordName))
+			if err != nil && !os.IsNotExist(err) {
+				i.logger.Warn("could not read golden image record", "error", err)
+			}
+			if record.Checksum != "" {
+				image.Checksum = baseImageChecksumAlgorithm + ":" + record.Checksum
+			}
+			for _, sourceName := range record.SourceFiles {
+				downloads[sourceName] = struct{}{}
+			}
+		case strings.HasSuffix(strings.TrimSuffix(name, filepath.Ext(name)), decompressedSuffix):
+			image.Kind = "base"
+
+			// The downloaded image may be compressed as a whole, e.g. image.img.bz2 for image_decompressed.img
+			for _, name := range compressedImageNames(name) {
+				downloads[name] = struct{}{}
+			}
+		case strings.HasSuffix(name, unpackedKernelSuffix):
+			image.Kind = "kernel"
+			downloads[strings.TrimSuffix(name, unpackedKernelSuffix)] = struct{}{}
+		default:
+			// Downloads are decided once every file was seen
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		image.Size = info.Size()
+		image.ModTime = info.ModTime()
+
+		images = append(images, image)
+	}
+
+	checksums := i.loadChecksumCache()
+
+	listed := []cachedImage{}
+	for _, image := range images {
+		if image.Kind == "" {
+			if _, ok := downloads[image.Name]; !ok {
+				continue
+			}
+			image.Kind = "download"
+
+			// Kernels are unpacked next to the download
+			if _, ok := names[image.Name+unpackedKernelSuffix]; ok {
+				image.Kind = "kernel"
+			}
+		}
+
+		if image.Checksum == "" {
+			image.Checksum = cachedChecksumOf(checksums, filepath.Join(i.VMDiskDir, image.Name), image.Size, image.ModTime)
+		}
+		image.Checksum = shortChecksum(image.Checksum)
+
+		listed = append(listed, image)
+	}
+
+	slices.SortFunc(listed, func(a cachedImage, b cachedImage) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return listed, nil
+}
+
+func cachedChecksumOf(checksums map[string]checksumCacheEntry, path string, size int64, modTime time.Time) string {
+	// Get a file's checksum from the checksum cache without hashing it, empty if it was never hashed or changed since
+
+	for _, entry := range checksums {
+		if entry.Path == path && entry.Size == size && entry.ModTime.Equal(modTime) {
+			return entry.Algorithm + ":" + entry.Checksum
+		}
+	}
+
+	return ""
+}
+
+func (i *InstanceGroup) imageUpdateStatus(ctx context.Context, file resolvedImageFile, sumsFileSuffix string) string {
+	// Describe whether the local copy of a resolved image matches the published one
+
+	if file.Path != "" {
+		return "local file " + file.Path + ", not checked"
+	}
+
+	fileName, err := file.fileName()
+	if err != nil {
+		return err.Error()
+	}
+
+	filePath := filepath.Join(i.VMDiskDir, fileName)
+
+	fileExists, err := checkFileExists(filePath)
+	if err != nil {
+		return err.Error()
+	}
+	if !fileExists {
+		return "not downloaded yet, " + file.URL
+	}
+
+	onlineChecksum, err := i.getOnlineChecksum(ctx, file, sumsFileSuffix)
+	if err != nil {
+		return "could not check for updates: " + err.Error()
+	}
+
+	localChecksum, err := i.cachedFileChecksum(filePath, i.imageChecksumAlgorithm(file))
+	if err != nil {
+		return "could not check for updates: " + err.Error()
+	}
+
+	if localChecksum != onlineChecksum {
+		return "update available, " + file.URL
+	}
+
+	return "up to date, " + fileName
+}
+
+func (i *InstanceGroup) removeCachedImages(names []string) error {
+	// Remove the named image files and what belongs to them, refusing names which aren't in the listing
+
+	// The plugin boots from the images and would find them gone
+	_, err := requestControlStatus(i.VMDiskDir)
+	if err == nil {
+		return fmt.Errorf("the plugin is running with vm_disk_directory %s, stop it before removing images", i.VMDiskDir)
+	}
+
+	images, err := i.listCachedImages(false)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, name := range names {
+		index := slices.IndexFunc(images, func(image cachedImage) bool {
+			return image.Name == name
+		})
+		if index == -1 {
+			errs = append(errs, fmt.Errorf("%s is not an image in %s", name, i.VMDiskDir))
+			continue
+		}
+
+		for _, fileName := range append([]string{name}, images[index].Companions...) {
+			err = os.Remove(filepath.Join(i.VMDiskDir, fileName))
+			if err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+
+		i.logger.Info("Removed image.", "file", name)
+	}
+
+	return errors.Join(errs...)
+}
+
+func shortChecksum(checksum string) string {
+	// Shorten an algorithm:checksum pair for the listing, hashing multi-GB images is left to the plugin so unknown ones are a dash
+
+	algorithm, value, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return "-"
+	}
+
+	return algorithm + ":" + value[:min(len(value), imageCacheChecksumLength)]
+}
+
+func formatImageSize(size int64) string {
+	// Format a size in the largest unit it has at least one of
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
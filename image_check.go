@@ -0,0 +1,145 @@
+package fleetingd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Lives next to the images it describes
+const imageCheckFileName = "image_check.json"
+
+// The images the last successful update check found, with their checksums so they can be used without asking upstream again
+type imageCheckRecord struct {
+	Key       string            `json:"key"`
+	CheckedAt time.Time         `json:"checked_at"`
+	DiskImage resolvedImageFile `json:"disk_image"`
+	Kernel    resolvedImageFile `json:"kernel"`
+}
+
+func (i *InstanceGroup) imageCheckKey() string {
+	// Get what decides which images are current, a record of other settings is ignored
+
+	return strings.Join([]string{i.Distro, runtime.GOARCH, i.VMImageChannel, i.VMImageSerial, i.VMDiskImage, i.VMKernel}, " ")
+}
+
+func (i *InstanceGroup) checkImageUpdates(ctx context.Context) (string, error) {
+	// Resolve and fetch the current images unless the last check is recent, falling back to its images if upstream can't be reached
+
+	record, recorded := i.readImageCheck()
+
+	interval := time.Duration(i.VMImageCheckIntervalMinutes) * time.Minute
+	if recorded && time.Since(record.CheckedAt) < interval {
+		i.logger.Info("Skipping the image update check, the last one is recent.", "checked_at", record.CheckedAt.Format(time.RFC3339))
+		return i.fetchRecordedImages(ctx, record)
+	}
+
+	err := i.resolveImages(ctx)
+	diskImageFilePath := ""
+	if err == nil {
+		diskImageFilePath, err = i.fetchImages(ctx)
+	}
+
+	if err == nil {
+		// Losing the record only costs another check
+		err = i.writeImageCheck(diskImageFilePath)
+		if err != nil {
+			i.logger.Warn("could not record the image update check", "error", err)
+		}
+		return diskImageFilePath, nil
+	}
+
+	if ctx.Err() != nil || !recorded {
+		return "", err
+	}
+
+	i.logger.Warn("Could not check for image updates, using the images of the last successful check.", "checked_at", record.CheckedAt.Format(time.RFC3339), "error", err)
+
+	return i.fetchRecordedImages(ctx, record)
+}
+
+func (i *InstanceGroup) fetchRecordedImages(ctx context.Context, record imageCheckRecord) (string, error) {
+	// Use the images of the last check, their recorded checksums stand in for the SUMS files
+
+	i.diskImage = record.DiskImage
+	i.kernel = record.Kernel
+
+	diskImageFilePath, err := i.fetchImages(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not use the images of the last update check: %w", err)
+	}
+
+	return diskImageFilePath, nil
+}
+
+func (i *InstanceGroup) readImageCheck() (imageCheckRecord, bool) {
+	// Read the record of the last successful check, registry images are resolved by their registry every time
+
+	var record imageCheckRecord
+
+	if i.registryImage != nil {
+		return record, false
+	}
+
+	contents, err := os.ReadFile(filepath.Join(i.VMDiskDir, imageCheckFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return record, false
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, &record)
+	}
+	if err != nil {
+		i.logger.Warn("ignoring unreadable image check record", "error", err)
+		return record, false
+	}
+
+	return record, record.Key == i.imageCheckKey()
+}
+
+func (i *InstanceGroup) writeImageCheck(diskImageFilePath string) error {
+	// Record the images a successful check found together with the checksums they were verified against
+
+	if i.registryImage != nil {
+		return nil
+	}
+
+	record := imageCheckRecord{
+		Key:       i.imageCheckKey(),
+		CheckedAt: time.Now(),
+		DiskImage: i.diskImage,
+		Kernel:    i.kernel,
+	}
+
+	// The files were verified just now, so their checksums are cached
+	var err error
+	record.DiskImage.Checksum, err = i.cachedFileChecksum(diskImageFilePath, i.imageChecksumAlgorithm(i.diskImage))
+	if err != nil {
+		return err
+	}
+
+	if i.bootsKernel() {
+		kernelFilePath, err := i.getKernelFilePath()
+		if err != nil {
+			return err
+		}
+
+		record.Kernel.Checksum, err = i.cachedFileChecksum(kernelFilePath, i.imageChecksumAlgorithm(i.kernel))
+		if err != nil {
+			return err
+		}
+	}
+
+	contents, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(i.VMDiskDir, imageCheckFileName), contents, 0600)
+}
@@ -0,0 +1,167 @@
+package fleetingd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	compressionBzip2 = "bz2"
+	compressionXz    = "xz"
+	compressionZstd  = "zstd"
+)
+
+// How a disk image compressed as a whole is recognized by its name, tarballs hold the image as their only file
+type imageCompression struct {
+	Suffix      string
+	Compression string
+	Tarball     bool
+}
+
+// Tarballs come first, image.tar.xz is not an xz compressed image.tar
+var imageCompressions = []imageCompression{
+	{Suffix: ".tar.zst", Compression: compressionZstd, Tarball: true},
+	{Suffix: ".tar.xz", Compression: compressionXz, Tarball: true},
+	{Suffix: ".tar", Tarball: true},
+	{Suffix: ".zst", Compression: compressionZstd},
+	{Suffix: ".xz", Compression: compressionXz},
+	{Suffix: ".bz2", Compression: compressionBzip2},
+}
+
+// Reading the compressed file in larger chunks keeps the decompressors busy
+const uncompressBufferSize = 1024 * 1024
+
+func detectImageCompression(fileName string) *imageCompression {
+	// Get the compression of a disk image from its name, nil if it isn't compressed as a whole
+
+	for _, compression := range imageCompressions {
+		if strings.HasSuffix(fileName, compression.Suffix) {
+			return &compression
+		}
+	}
+
+	return nil
+}
+
+func compressedImageNames(decompressedName string) []string {
+	// Get the names the image a decompressed base image was converted from may have, e.g. image.img and image.img.bz2 for image_decompressed.img
+
+	sourceName := strings.Replace(decompressedName, decompressedSuffix+filepath.Ext(decompressedName), filepath.Ext(decompressedName), 1)
+
+	names := []string{sourceName}
+	for _, compression := range imageCompressions {
+		names = append(names, sourceName+compression.Suffix)
+	}
+
+	return names
+}
+
+func (c *imageCompression) uncompressedName(fileName string) string {
+	// Get the name the uncompressed image is stored under, e.g. image.img for image.img.zst and image for image.tar.xz
+
+	return strings.TrimSuffix(fileName, c.Suffix)
+}
+
+func (c *imageCompression) String() string {
+	// Describe the compression for the logs
+
+	return strings.TrimPrefix(c.Suffix, ".")
+}
+
+func (c *imageCompression) uncompress(sourcePath string, targetPath string) error {
+	// Uncompress a disk image in one stream from the compressed file to targetPath, keeping the compressed file for the next update check
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	var reader io.Reader = bufio.NewReaderSize(source, uncompressBufferSize)
+
+	switch c.Compression {
+	case compressionBzip2:
+		reader = bzip2.NewReader(reader)
+	case compressionXz:
+		reader, err = xz.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("could not uncompress %s: %w", sourcePath, err)
+		}
+	case compressionZstd:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("could not uncompress %s: %w", sourcePath, err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+
+	target, err := os.Create(targetPath)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if c.Tarball {
+		err = copyTarballImage(target, reader)
+	} else {
+		_, err = io.Copy(target, reader)
+	}
+	if err == nil {
+		err = target.Close()
+	}
+	if err != nil {
+		os.Remove(targetPath)
+		return fmt.Errorf("could not uncompress %s: %w", sourcePath, err)
+	}
+
+	return nil
+}
+
+func copyTarballImage(target io.Writer, reader io.Reader) error {
+	// Copy the only file of a tarball, directories and links in it are skipped
+
+	archive := tar.NewReader(reader)
+
+	found := ""
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Which of several files is the disk image can't be told
+		if found != "" {
+			return fmt.Errorf("tarball holds more than one file: %s and %s", found, header.Name)
+		}
+		found = header.Name
+
+		_, err = io.Copy(target, archive)
+		if err != nil {
+			return err
+		}
+	}
+
+	if found == "" {
+		return errors.New("tarball holds no file")
+	}
+
+	return nil
+}
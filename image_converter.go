@@ -0,0 +1,136 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	imageConverterQemuImg = "qemu-img"
+	imageConverterCommand = "command"
+)
+
+// The steps turning a downloaded disk image into the instances' disks
+type imageConverter interface {
+	// Write an uncompressed image of the given format (qcow2 or raw) cloud-hypervisor can boot from
+	Convert(ctx context.Context, sourcePath string, targetPath string, format string) error
+	// Grow an image's virtual size
+	Resize(ctx context.Context, path string, format string, sizeGB uint64) error
+	// Create the disk of an instance from a base image
+	Copy(ctx context.Context, sourcePath string, targetPath string) error
+}
+
+type qemuImgConverter struct{}
+
+func (qemuImgConverter) Convert(ctx context.Context, sourcePath string, targetPath string, format string) error {
+	// cloud-hypervisor can't read compressed QCOW2 images, so rewrite the image uncompressed
+
+	return runConverterCommand(ctx, []string{"qemu-img", "convert", "-f", "qcow2", "-O", format, sourcePath, targetPath})
+}
+
+func (qemuImgConverter) Resize(ctx context.Context, path string, format string, sizeGB uint64) error {
+	// Expand the virtual size, both qcow2 and raw images stay sparse
+
+	return runConverterCommand(ctx, []string{"qemu-img", "resize", "-f", format, path, fmt.Sprintf("%dG", sizeGB)})
+}
+
+func (qemuImgConverter) Copy(ctx context.Context, sourcePath string, targetPath string) error {
+	// Copy the base image
+
+	return runConverterCommand(ctx, []string{"cp", "-f", sourcePath, targetPath})
+}
+
+// Runs configured tools, arguments may contain the {source}, {target}, {format} and {size_gb} placeholders
+type commandConverter struct {
+	convertCommand []string
+	resizeCommand  []string
+	copyCommand    []string
+}
+
+func (c commandConverter) Convert(ctx context.Context, sourcePath string, targetPath string, format string) error {
+	// Run the configured convert command
+
+	return runConverterCommand(ctx, c.command(c.convertCommand, sourcePath, targetPath, format, 0))
+}
+
+func (c commandConverter) Resize(ctx context.Context, path string, format string, sizeGB uint64) error {
+	// Run the configured resize command on the image, which is both source and target
+
+	return runConverterCommand(ctx, c.command(c.resizeCommand, path, path, format, sizeGB))
+}
+
+func (c commandConverter) Copy(ctx context.Context, sourcePath string, targetPath string) error {
+	// Run the configured copy command, a plain copy is enough for most formats
+
+	if len(c.copyCommand) == 0 {
+		return qemuImgConverter{}.Copy(ctx, sourcePath, targetPath)
+	}
+
+	return runConverterCommand(ctx, c.command(c.copyCommand, sourcePath, targetPath, "", 0))
+}
+
+func (c commandConverter) command(template []string, sourcePath string, targetPath string, format string, sizeGB uint64) []string {
+	// Fill in the placeholders of a configured command
+
+	replacer := strings.NewReplacer("{source}", sourcePath, "{target}", targetPath, "{format}", format, "{size_gb}", strconv.FormatUint(sizeGB, 10))
+
+	args := make([]string, len(template))
+	for index, arg := range template {
+		args[index] = replacer.Replace(arg)
+	}
+
+	return args
+}
+
+func runConverterCommand(ctx context.Context, args []string) error {
+	// Run a conversion tool, large images take as long as they take
+
+	_, err := hostCommands.Run(ctx, hostCommand{Args: args, Timeout: noCommandTimeout})
+
+	return err
+}
+
+func (i *InstanceGroup) parseImageConverter() error {
+	// Select the image conversion backend and check its tools are installed
+
+	if i.VMImageConverter == "" {
+		i.VMImageConverter = imageConverterQemuImg
+	}
+
+	var requiredBinaries []string
+
+	switch i.VMImageConverter {
+	case imageConverterQemuImg:
+		i.imageConverter = qemuImgConverter{}
+		requiredBinaries = []string{"qemu-img"}
+	case imageConverterCommand:
+		if len(i.VMImageConvertCommand) == 0 || len(i.VMImageResizeCommand) == 0 {
+			return errors.New("vm_image_converter command requires vm_image_convert_command and vm_image_resize_command")
+		}
+
+		i.imageConverter = commandConverter{
+			convertCommand: i.VMImageConvertCommand,
+			resizeCommand:  i.VMImageResizeCommand,
+			copyCommand:    i.VMImageCopyCommand,
+		}
+		requiredBinaries = []string{i.VMImageConvertCommand[0], i.VMImageResizeCommand[0]}
+		if len(i.VMImageCopyCommand) > 0 {
+			requiredBinaries = append(requiredBinaries, i.VMImageCopyCommand[0])
+		}
+	default:
+		return fmt.Errorf("unknown vm_image_converter '%s', supported are %s and %s", i.VMImageConverter, imageConverterQemuImg, imageConverterCommand)
+	}
+
+	for _, binary := range requiredBinaries {
+		_, err := exec.LookPath(binary)
+		if err != nil {
+			return fmt.Errorf("could not find %s of vm_image_converter %s on PATH: %w", binary, i.VMImageConverter, err)
+		}
+	}
+
+	return nil
+}
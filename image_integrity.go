@@ -0,0 +1,115 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Base images are hashed with SHA-256 like the golden images' inputs
+const baseImageChecksumAlgorithm = "sha256"
+
+// What the image instances are copied from or backed by looked like once it was finished, overlays depend on it never changing
+type imageIntegrity struct {
+	Path     string
+	Checksum string
+	Size     int64
+	ModTime  time.Time
+}
+
+func recordImageIntegrity(path string) (imageIntegrity, error) {
+	// Hash a finished image and remember its size and modification time
+
+	checksum, err := computeFileChecksum(path, baseImageChecksumAlgorithm)
+	if err != nil {
+		return imageIntegrity{}, fmt.Errorf("could not hash %s: %w", path, err)
+	}
+
+	// Stat after hashing, a change while hashing then doesn't match
+	info, err := os.Stat(path)
+	if err != nil {
+		return imageIntegrity{}, err
+	}
+
+	return imageIntegrity{Path: path, Checksum: checksum, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (r imageIntegrity) verify(full bool) error {
+	// Check an image still has its recorded size and modification time, full also hashes it again
+
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != r.Size || !info.ModTime().Equal(r.ModTime) {
+		return fmt.Errorf("image %s changed after it was verified, size %d and modification time %s instead of %d and %s", r.Path, info.Size(), info.ModTime().Format(time.RFC3339Nano), r.Size, r.ModTime.Format(time.RFC3339Nano))
+	}
+
+	if !full {
+		return nil
+	}
+
+	checksum, err := computeFileChecksum(r.Path, baseImageChecksumAlgorithm)
+	if err != nil {
+		return fmt.Errorf("could not hash %s: %w", r.Path, err)
+	}
+
+	if checksum != r.Checksum {
+		return fmt.Errorf("image %s changed after it was verified, checksum %s instead of %s", r.Path, checksum, r.Checksum)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) verifyBaseImage(full bool) error {
+	// Check the base image before something boots from it, a failed check is kept so no instance boots from it anymore
+
+	i.imagesLock.Lock()
+	record := i.baseImageIntegrity
+	problem := i.baseImageProblem
+	i.imagesLock.Unlock()
+
+	if problem != nil {
+		return problem
+	}
+
+	// Nothing recorded yet, e.g. the images are still being prepared
+	if record.Path == "" {
+		return nil
+	}
+
+	err := record.verify(full)
+	if err != nil {
+		i.imagesLock.Lock()
+		if i.baseImageIntegrity.Path == record.Path {
+			i.baseImageProblem = err
+		}
+		i.imagesLock.Unlock()
+
+		i.logger.Error("Base image failed its integrity check, not booting from it until the plugin is restarted.", "path", record.Path, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) runImageVerifier(ctx context.Context) {
+	// Hash the base image again every vm_image_verify_interval_minutes, catching changes which kept its size and modification time
+
+	ticker := time.NewTicker(time.Duration(i.VMImageVerifyIntervalMinutes) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := i.verifyBaseImage(true)
+			if err == nil {
+				i.logger.Debug("base image verified", "path", i.getBaseImagePath())
+			}
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package fleetingd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+const defaultDistro = "ubuntu"
+
+const firewallUFW = "ufw"
+const firewallFirewalld = "firewalld"
+
+const provisioningCloudInit = "cloud-init"
+const provisioningIgnition = "ignition"
+
+const imageChannelDaily = "daily"
+const imageChannelRelease = "release"
+const imageSerialCurrent = "current"
+
+// Serials are dates, optionally followed by a build number like Debian's 20240901-1856
+var imageSerialRegexp = regexp.MustCompile(`^[0-9]+([.-][0-9]+)*$`)
+
+// Links in a directory index
+var directoryIndexLinkRegexp = regexp.MustCompile(`href="([^"?#/]+)"`)
+
+type imageFile struct {
+	// Either the file itself or, with Pattern, the directory whose index is searched for the newest matching file
+	URL     string
+	Pattern string
+
+	// Where the file's checksum is listed: a SUMS file, a SUMS file matching SumsPattern next to the file or the file's URL with SumsSuffix appended
+	SumsURL     string
+	SumsPattern string
+	SumsSuffix  string
+
+	// Alternatively a CoreOS stream metadata document listing the file's location and checksum
+	StreamURL          string
+	StreamArchitecture string
+	StreamArtifact     string
+	StreamFormat       string
+}
+
+// Location of a file found through an imageFile
+type resolvedImageFile struct {
+	URL     string
+	SumsURL string
+
+	// Published checksum of files that are not listed in a SUMS file
+	Checksum string
+
+	// Local files are used without downloading them, SumsPath is a local SUMS file
+	Path     string
+	SumsPath string
+
+	// Registry blobs are stored under a name of their own, verified by their digest and only downloaded with the registry's authorization
+	FileName          string
+	ChecksumAlgorithm string
+	Header            http.Header
+
+	// Files configured by URL are only fetched from there, their SUMS files are not signed by the distribution
+	Configured bool
+}
+
+func (f resolvedImageFile) fileName() (string, error) {
+	// Get the name the file is stored under in vm_disk_directory
+
+	if f.FileName != "" {
+		return f.FileName, nil
+	}
+
+	return getFilenameFromURL(f.URL)
+}
+
+type imageProfile struct {
+	Name string
+
+	DiskImage imageFile
+
+	// Whether vm_image_channel and vm_image_serial select the images
+	Pinnable bool
+
+	// Booted directly with RootDevice if set, otherwise the disk's own bootloader is started through vm_firmware
+	Kernel     *imageFile
+	RootDevice string
+
+	// Algorithm of the checksums in the SUMS files, sha256 or sha512
+	ChecksumAlgorithm string
+
+	// Detached signatures of the SUMS files are found by appending SumsSignatureSuffix, made by the key with SigningKeyFingerprint
+	SumsSignatureSuffix   string
+	SigningKeyFingerprint string
+	SigningKeyring        string
+
+	// Default user of the image, the runner connects as this user
+	Username string
+
+	// How instances are configured on first boot, cloud-init from a CIDATA drive or Ignition from an OpenStack config drive
+	Provisioning string
+
+	// Filesystem of that drive, fat32 if empty
+	ConfigDriveFormat string
+
+	// Systemd-networkd or NetworkManager keyfile written by Ignition, guest path and template
+	IgnitionNetworkFile     string
+	IgnitionNetworkTemplate string
+
+	// Selects the init system and package handling in the cloud-init templates: debian, fedora, suse or alpine
+	Family         string
+	Firewall       string
+	InstallCommand string
+
+	// packages.gitlab.com repository gitlab-runner is installed from, the distribution's own package if empty
+	RunnerRepositoryScript string
+	RunnerRepositoryOS     string
+	RunnerRepositoryDist   string
+}
+
+func linuxArch(goarch string) string {
+	// Get the architecture name most distributions use in their file names
+
+	switch goarch {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+
+	return goarch
+}
+
+func ubuntuImageDirectory(channel string, serial string) string {
+	// Get the directory of an Ubuntu release, daily builds are the default
+
+	if channel == imageChannelRelease {
+		if serial == imageSerialCurrent {
+			return "https://cloud-images.ubuntu.com/releases/resolute/release/"
+		}
+		return "https://cloud-images.ubuntu.com/releases/resolute/release-" + serial + "/"
+	}
+
+	return "https://cloud-images.ubuntu.com/daily/server/resolute/" + serial + "/"
+}
+
+func debianImageDirectory(channel string, serial string) string {
+	// Get the directory of a Debian release, point releases are the default
+
+	if serial == imageSerialCurrent {
+		serial = "latest"
+	}
+
+	if channel == imageChannelDaily {
+		return "https://cloud.debian.org/images/cloud/trixie/daily/" + serial + "/"
+	}
+
+	return "https://cloud.debian.org/images/cloud/trixie/" + serial + "/"
+}
+
+func opensuseDownloadDirectory(goarch string) string {
+	// Get the download directory of an architecture, anything but x86_64 is published as a port
+
+	if goarch == archAMD64 {
+		return "https://download.opensuse.org/"
+	}
+
+	return "https://download.opensuse.org/ports/" + linuxArch(goarch) + "/"
+}
+
+func imageProfiles(goarch string, channel string, serial string) map[string]imageProfile {
+	// Get the built-in image profiles for an architecture, pinnable ones use the given channel and serial
+
+	arch := linuxArch(goarch)
+
+	if serial == "" {
+		serial = imageSerialCurrent
+	}
+
+	ubuntuDirectory := ubuntuImageDirectory(channel, serial)
+	debianDirectory := debianImageDirectory(channel, serial)
+
+	return map[string]imageProfile{
+		"ubuntu": {
+			Name:     "ubuntu",
+			Pinnable: true,
+			DiskImage: imageFile{
+				URL:     fmt.Sprintf("%sresolute-server-cloudimg-%s.img", ubuntuDirectory, goarch),
+				SumsURL: ubuntuDirectory + "SHA256SUMS",
+			},
+			Kernel: &imageFile{
+				URL:     fmt.Sprintf("%sunpacked/resolute-server-cloudimg-%s-vmlinuz-generic", ubuntuDirectory, goarch),
+				SumsURL: ubuntuDirectory + "unpacked/SHA256SUMS",
+			},
+			RootDevice:             "/dev/vda1",
+			ChecksumAlgorithm:      "sha256",
+			SumsSignatureSuffix:    ".gpg",
+			SigningKeyFingerprint:  ubuntuCloudImageKeyFingerprint,
+			SigningKeyring:         ubuntuCloudImageKeyring,
+			Provisioning:           provisioningCloudInit,
+			Username:               "ubuntu",
+			Family:                 "debian",
+			Firewall:               firewallUFW,
+			InstallCommand:         "apt install -y",
+			RunnerRepositoryScript: "script.deb.sh",
+			RunnerRepositoryOS:     "ubuntu",
+			RunnerRepositoryDist:   "noble",
+		},
+		"debian": {
+			Name:     "debian",
+			Pinnable: true,
+			DiskImage: imageFile{
+				URL:     fmt.Sprintf("%sdebian-13-genericcloud-%s.qcow2", debianDirectory, goarch),
+				SumsURL: debianDirectory + "SHA512SUMS",
+			},
+			ChecksumAlgorithm:      "sha512",
+			Provisioning:           provisioningCloudInit,
+			Username:               "debian",
+			Family:                 "debian",
+			Firewall:               firewallUFW,
+			InstallCommand:         "apt install -y",
+			RunnerRepositoryScript: "script.deb.sh",
+			RunnerRepositoryOS:     "debian",
+			RunnerRepositoryDist:   "trixie",
+		},
+		"fedora": {
+			Name: "fedora",
+			DiskImage: imageFile{
+				URL:         fmt.Sprintf("https://download.fedoraproject.org/pub/fedora/linux/releases/44/Cloud/%s/images/", arch),
+				Pattern:     fmt.Sprintf(`Fedora-Cloud-Base-Generic-[0-9.-]+\.%s\.qcow2`, arch),
+				SumsPattern: fmt.Sprintf(`Fedora-Cloud-[0-9.-]+-%s-CHECKSUM`, arch),
+			},
+			ChecksumAlgorithm:      "sha256",
+			Provisioning:           provisioningCloudInit,
+			Username:               "fedora",
+			Family:                 "fedora",
+			Firewall:               firewallUFW,
+			InstallCommand:         "dnf install -y",
+			RunnerRepositoryScript: "script.rpm.sh",
+			RunnerRepositoryOS:     "fedora",
+			RunnerRepositoryDist:   "44",
+		},
+		"alpine": {
+			Name: "alpine",
+			DiskImage: imageFile{
+				URL:        "https://dl-cdn.alpinelinux.org/alpine/latest-stable/releases/cloud/",
+				Pattern:    fmt.Sprintf(`generic_alpine-[0-9.]+-%s-uefi-cloudinit-r[0-9]+\.qcow2`, arch),
+				SumsSuffix: ".sha512",
+			},
+			ChecksumAlgorithm: "sha512",
+			Provisioning:      provisioningCloudInit,
+			Username:          "alpine",
+			Family:            "alpine",
+			Firewall:          firewallUFW,
+			InstallCommand:    "apk add",
+		},
+		"opensuse": {
+			Name: "opensuse",
+			DiskImage: imageFile{
+				URL:        fmt.Sprintf("%stumbleweed/appliances/openSUSE-Tumbleweed-Minimal-VM.%s-Cloud.qcow2", opensuseDownloadDirectory(goarch), arch),
+				SumsSuffix: ".sha256",
+			},
+			ChecksumAlgorithm:      "sha256",
+			Provisioning:           provisioningCloudInit,
+			Username:               "opensuse",
+			Family:                 "suse",
+			Firewall:               firewallFirewalld,
+			InstallCommand:         "zypper --non-interactive install",
+			RunnerRepositoryScript: "script.rpm.sh",
+			RunnerRepositoryOS:     "opensuse",
+			RunnerRepositoryDist:   "15.6",
+		},
+		// Container-optimized, Docker is part of the image and nothing gets installed
+		"flatcar": {
+			Name: "flatcar",
+			DiskImage: imageFile{
+				URL:        fmt.Sprintf("https://stable.release.flatcar-linux.net/%s-usr/current/flatcar_production_openstack_image.img.bz2", goarch),
+				SumsSuffix: ".DIGESTS",
+			},
+			ChecksumAlgorithm:       "sha512",
+			Provisioning:            provisioningIgnition,
+			IgnitionNetworkFile:     "/etc/systemd/network/00-veth0.network",
+			IgnitionNetworkTemplate: "ignition-networkd.tpl",
+			Username:                "core",
+			Family:                  "flatcar",
+		},
+		"fedora-coreos": {
+			Name: "fedora-coreos",
+			DiskImage: imageFile{
+				StreamURL:          "https://builds.coreos.fedoraproject.org/streams/stable.json",
+				StreamArchitecture: arch,
+				StreamArtifact:     "openstack",
+				StreamFormat:       "qcow2.xz",
+			},
+			ChecksumAlgorithm:       "sha256",
+			Provisioning:            provisioningIgnition,
+			IgnitionNetworkFile:     "/etc/NetworkManager/system-connections/veth0.nmconnection",
+			IgnitionNetworkTemplate: "ignition-networkmanager.tpl",
+			Username:                "core",
+			Family:                  "coreos",
+		},
+	}
+}
+
+func (i *InstanceGroup) parseImageProfile() error {
+	// Select the image profile of the configured distribution
+
+	if i.Distro == "" {
+		i.Distro = defaultDistro
+	}
+
+	switch i.VMImageChannel {
+	case "", imageChannelDaily, imageChannelRelease:
+	default:
+		return fmt.Errorf("unknown vm_image_channel '%s', must be one of: %s, %s", i.VMImageChannel, imageChannelDaily, imageChannelRelease)
+	}
+
+	if i.VMImageSerial != "" && i.VMImageSerial != imageSerialCurrent && !imageSerialRegexp.MatchString(i.VMImageSerial) {
+		return fmt.Errorf("invalid vm_image_serial '%s', must be %s or a build serial like 20240901", i.VMImageSerial, imageSerialCurrent)
+	}
+
+	profiles := imageProfiles(runtime.GOARCH, i.VMImageChannel, i.VMImageSerial)
+
+	profile, ok := profiles[i.Distro]
+	if !ok {
+		names := []string{}
+		for name := range profiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		return fmt.Errorf("unknown distro '%s', must be one of: %s", i.Distro, strings.Join(names, ", "))
+	}
+
+	// The other distributions publish a single current build
+	if !profile.Pinnable && (i.VMImageChannel != "" || (i.VMImageSerial != "" && i.VMImageSerial != imageSerialCurrent)) {
+		return fmt.Errorf("vm_image_channel and vm_image_serial are only supported with distro ubuntu and debian")
+	}
+
+	// Images without a published kernel boot through UEFI firmware, e.g. CLOUDHV.fd from edk2
+	if profile.Kernel == nil {
+		if i.VMFirmware == "" {
+			return fmt.Errorf("distro %s has no separate kernel and is booted through firmware, please configure vm_firmware (e.g. edk2's %s)", i.Distro, firmwareFileName())
+		}
+
+		_, err := os.Stat(i.VMFirmware)
+		if err != nil {
+			return fmt.Errorf("'%s' was specified as vm_firmware but can not be accessed: %w", i.VMFirmware, err)
+		}
+
+		if i.VMConfidentialComputing != "" {
+			return fmt.Errorf("vm_confidential_computing needs a separate kernel which distro %s does not have", i.Distro)
+		}
+	}
+
+	// Ignition only runs on the first boot of a pristine image, so there is no prebuild to run commands in
+	if profile.Provisioning == provisioningIgnition && len(i.VMPrebuildCloudinitExtraCmds) > 0 {
+		return fmt.Errorf("vm_prebuild_cloudinit_extra_cmds can not be used with distro %s which is provisioned through Ignition", i.Distro)
+	}
+
+	// The snapshot fixup script uses systemd and ufw
+	if i.VMSnapshotBoot && (profile.Family != "debian" || profile.Firewall != firewallUFW) {
+		return fmt.Errorf("vm_snapshot_boot is not supported with distro %s", i.Distro)
+	}
+
+	i.imageProfile = profile
+
+	return nil
+}
+
+func (i *InstanceGroup) bootsKernel() bool {
+	return i.imageProfile.Kernel != nil
+}
+
+func (i *InstanceGroup) usesIgnition() bool {
+	return i.imageProfile.Provisioning == provisioningIgnition
+}
+
+func (f imageFile) resolve(ctx context.Context, client *http.Client) (resolvedImageFile, error) {
+	// Get the URLs of a file and its SUMS file, searching the directory index or stream metadata if needed
+
+	if f.StreamURL != "" {
+		return f.resolveStream(ctx, client)
+	}
+
+	fileURL := f.URL
+	if f.Pattern != "" {
+		name, err := findNewestLink(ctx, client, f.URL, f.Pattern)
+		if err != nil {
+			return resolvedImageFile{}, err
+		}
+		fileURL, err = url.JoinPath(f.URL, name)
+		if err != nil {
+			return resolvedImageFile{}, err
+		}
+	}
+
+	switch {
+	case f.SumsURL != "":
+		return resolvedImageFile{URL: fileURL, SumsURL: f.SumsURL}, nil
+	case f.SumsSuffix != "":
+		return resolvedImageFile{URL: fileURL, SumsURL: fileURL + f.SumsSuffix}, nil
+	case f.SumsPattern != "":
+		directoryURL := fileURL[:strings.LastIndex(fileURL, "/")+1]
+		name, err := findNewestLink(ctx, client, directoryURL, f.SumsPattern)
+		if err != nil {
+			return resolvedImageFile{}, err
+		}
+		sumsURL, err := url.JoinPath(directoryURL, name)
+		if err != nil {
+			return resolvedImageFile{}, err
+		}
+		return resolvedImageFile{URL: fileURL, SumsURL: sumsURL}, nil
+	}
+
+	return resolvedImageFile{}, fmt.Errorf("no checksums configured for %s", fileURL)
+}
+
+func (f imageFile) resolveStream(ctx context.Context, client *http.Client) (resolvedImageFile, error) {
+	// Look up the current release of an artifact in a CoreOS stream metadata document
+
+	type streamDisk struct {
+		Location string `json:"location"`
+		SHA256   string `json:"sha256"`
+	}
+
+	type stream struct {
+		Architectures map[string]struct {
+			Artifacts map[string]struct {
+				Release string `json:"release"`
+				Formats map[string]struct {
+					Disk *streamDisk `json:"disk"`
+				} `json:"formats"`
+			} `json:"artifacts"`
+		} `json:"architectures"`
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, f.StreamURL, nil)
+	if err != nil {
+		return resolvedImageFile{}, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return resolvedImageFile{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return resolvedImageFile{}, fmt.Errorf("could not fetch %s: %s", f.StreamURL, response.Status)
+	}
+
+	metadata := stream{}
+	err = json.NewDecoder(io.LimitReader(response.Body, 16*1024*1024)).Decode(&metadata)
+	if err != nil {
+		return resolvedImageFile{}, fmt.Errorf("could not parse stream metadata %s: %w", f.StreamURL, err)
+	}
+
+	artifact, ok := metadata.Architectures[f.StreamArchitecture].Artifacts[f.StreamArtifact]
+	if !ok {
+		return resolvedImageFile{}, fmt.Errorf("stream metadata %s has no %s artifact for %s", f.StreamURL, f.StreamArtifact, f.StreamArchitecture)
+	}
+
+	disk := artifact.Formats[f.StreamFormat].Disk
+	if disk == nil || disk.Location == "" || disk.SHA256 == "" {
+		return resolvedImageFile{}, fmt.Errorf("release %s in stream metadata %s has no %s disk", artifact.Release, f.StreamURL, f.StreamFormat)
+	}
+
+	return resolvedImageFile{URL: disk.Location, Checksum: strings.ToLower(disk.SHA256)}, nil
+}
+
+func findNewestLink(ctx context.Context, client *http.Client, directoryURL string, pattern string) (string, error) {
+	// Find the newest file in a directory index whose name matches a pattern, versions are compared numerically
+
+	matcher, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, directoryURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not list %s: %s", directoryURL, response.Status)
+	}
+
+	index, err := io.ReadAll(io.LimitReader(response.Body, 16*1024*1024))
+	if err != nil {
+		return "", err
+	}
+
+	newest := ""
+	for _, link := range directoryIndexLinkRegexp.FindAllStringSubmatch(string(index), -1) {
+		name, err := url.PathUnescape(link[1])
+		if err != nil || !matcher.MatchString(name) {
+			continue
+		}
+
+		if newest == "" || compareVersions(name, newest) > 0 {
+			newest = name
+		}
+	}
+
+	if newest == "" {
+		return "", errors.New("no file matching " + pattern + " found in " + directoryURL)
+	}
+
+	return newest, nil
+}
+
+func compareVersions(a string, b string) int {
+	// Compare two strings, runs of digits are compared by their value so 3.22.10 sorts after 3.22.9
+
+	for a != "" && b != "" {
+		aDigits := len(a) - len(strings.TrimLeft(a, "0123456789"))
+		bDigits := len(b) - len(strings.TrimLeft(b, "0123456789"))
+
+		if aDigits > 0 && bDigits > 0 {
+			aNumber := strings.TrimLeft(a[:aDigits], "0")
+			bNumber := strings.TrimLeft(b[:bDigits], "0")
+			if len(aNumber) != len(bNumber) {
+				return len(aNumber) - len(bNumber)
+			}
+			if aNumber != bNumber {
+				return strings.Compare(aNumber, bNumber)
+			}
+
+			a = a[aDigits:]
+			b = b[bDigits:]
+			continue
+		}
+
+		if a[0] != b[0] {
+			return int(a[0]) - int(b[0])
+		}
+
+		a = a[1:]
+		b = b[1:]
+	}
+
+	return len(a) - len(b)
+}
@@ -0,0 +1,126 @@
+package fleetingd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (i *InstanceGroup) checkImageTLS() error {
+	// Build the TLS settings images, their checksums and metadata are fetched with, the system's trust store is used without any
+
+	if len(i.VMImageCACertificates) == 0 && len(i.VMImageSPKIPins) == 0 {
+		return nil
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		i.logger.Warn("Could not load the system's trust store, only vm_image_ca_certificates are trusted.", "err", err)
+		roots = x509.NewCertPool()
+	}
+
+	for _, path := range i.VMImageCACertificates {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read vm_image_ca_certificates: %w", err)
+		}
+
+		if !roots.AppendCertsFromPEM(contents) {
+			return fmt.Errorf("no PEM encoded certificates found in %s of vm_image_ca_certificates", path)
+		}
+	}
+
+	// Hosts sorted so the first invalid pin reported stays the same
+	hosts := []string{}
+	for host := range i.VMImageSPKIPins {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	transports := map[string]*http.Transport{}
+	for _, host := range hosts {
+		if len(i.VMImageSPKIPins[host]) == 0 {
+			return fmt.Errorf("host %s in vm_image_spki_pins has no pins", host)
+		}
+
+		for _, pin := range i.VMImageSPKIPins[host] {
+			digest, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(digest) != sha256.Size {
+				return fmt.Errorf("invalid pin '%s' for %s in vm_image_spki_pins, must be a base64 encoded SHA-256 digest", pin, host)
+			}
+		}
+
+		transports[strings.ToLower(host)] = newImageTransport(roots, i.VMImageSPKIPins[host])
+	}
+
+	i.imageTransport = &pinningTransport{
+		unpinned: newImageTransport(roots, nil),
+		pinned:   transports,
+	}
+
+	return nil
+}
+
+// Sends requests to pinned hosts through transports of their own, a connection is only pinned to the host it was dialed for
+type pinningTransport struct {
+	unpinned *http.Transport
+	pinned   map[string]*http.Transport
+}
+
+func (t *pinningTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Redirects are sent through here again, so they are checked against the pins of their own host
+
+	transport, ok := t.pinned[strings.ToLower(request.URL.Hostname())]
+	if !ok {
+		transport = t.unpinned
+	}
+
+	return transport.RoundTrip(request)
+}
+
+func newImageTransport(roots *x509.CertPool, pins []string) *http.Transport {
+	// Get a transport trusting roots, with pins a certificate of the verified chain also has to have one of the public keys
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(pins) == 0 {
+		return transport
+	}
+
+	transport.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, certificate := range chain {
+				digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+				if slices.Contains(pins, base64.StdEncoding.EncodeToString(digest[:])) {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("certificate matches none of vm_image_spki_pins")
+	}
+
+	return transport
+}
+
+func (i *InstanceGroup) imageHTTPClient(timeout time.Duration) *http.Client {
+	// Get a client for image downloads and metadata, a timeout of 0 never gives up
+
+	return &http.Client{
+		Transport: i.imageTransport,
+		Timeout:   timeout,
+	}
+}
@@ -2,33 +2,305 @@ package fleetingd
 
 import (
 	"context"
+	"crypto"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"os/exec"
+	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/sys/unix"
 )
 
-// Currently the number of VM slots is limited by the number of /30s, this is fairly arbitrary but should be plenty for now
+// Part of the runner's shutdown deadline reserved for killing instances which did not stop
+const shutdownForceMargin = 3 * time.Second
+
+// Currently the number of VM slots is limited by the number of instance subnets in a /24, see vm_subnet_prefix_length
 const VMPrefix = "172.16.120."
-const MaxIPAMSlots = 255 / 4
 
 type InstanceGroup struct {
-	EgressInterface              string   `json:"egress_interface"`
-	VMDiskDir                    string   `json:"vm_disk_directory"`
-	VMSubnet                     string   `json:"vm_subnet"`
-	VMNumCPUCores                uint64   `json:"vm_num_cpu_cores"`
-	VMMemoryMegabytes            uint64   `json:"vm_memory_mb"`
-	VMDiskSizeGB                 uint64   `json:"vm_disk_size_gb"`
-	VMPrebuildCloudinitExtraCmds []string `json:"vm_prebuild_cloudinit_extra_cmds"`
-	VMEnableVirtioConsole        bool     `json:"vm_enable_virtio_console"`
+	EgressInterface                 string   `json:"egress_interface"`
+	EgressPolicy                    string   `json:"egress_policy"`
+	EgressAllow                     []string `json:"egress_allow"`
+	EgressDeny                      []string `json:"egress_deny"`
+	EgressDisableHostProtection     bool     `json:"egress_disable_host_protection"`
+	EgressHostAllow                 []string `json:"egress_host_allow"`
+	EgressBlockPrivateNetworks      bool     `json:"egress_block_private_networks"`
+	EgressRoutes                    []string `json:"egress_routes"`
+	EgressRouteTable                int      `json:"egress_route_table"`
+	NetworkMode                     string   `json:"network_mode"`
+	NetworkBridge                   string   `json:"network_bridge"`
+	VMVLANID                        int      `json:"vm_vlan_id"`
+	NetworkPasstSSHPortBase         int      `json:"network_passt_ssh_port_base"`
+	NetworkTapOwner                 string   `json:"network_tap_owner"`
+	ExternalAddress                 string   `json:"external_address"`
+	ExternalSSHPortBase             int      `json:"external_ssh_port_base"`
+	IsolateInstances                *bool    `json:"isolate_instances"`
+	HypervisorBackend               string   `json:"hypervisor_backend"`
+	Distro                          string   `json:"distro"`
+	VMFirmware                      string   `json:"vm_firmware"`
+	VMDiskImage                     string   `json:"vm_disk_image"`
+	VMDiskImageSHA256               string   `json:"vm_disk_image_sha256"`
+	VMDiskImageSums                 string   `json:"vm_disk_image_sums"`
+	VMImageRegistryUsername         string   `json:"vm_image_registry_username"`
+	VMImageRegistryPassword         string   `json:"vm_image_registry_password"`
+	VMKernel                        string   `json:"vm_kernel"`
+	VMKernelSHA256                  string   `json:"vm_kernel_sha256"`
+	VMKernelSums                    string   `json:"vm_kernel_sums"`
+	VMImageChannel                  string   `json:"vm_image_channel"`
+	VMImageSerial                   string   `json:"vm_image_serial"`
+	VMImageMirrors                  []string `json:"vm_image_mirrors"`
+	VMImageCACertificates           []string `json:"vm_image_ca_certificates"`
+	VMImageDownloadRateMegabits     uint64   `json:"vm_image_download_rate_mbit"`
+	VMImageParallelDownloads        uint64   `json:"vm_image_parallel_downloads"`
+	VMImageCheckIntervalMinutes     uint64   `json:"vm_image_check_interval_minutes"`
+	VMImageSigningKey               string   `json:"vm_image_signing_key"`
+	VMImageSkipSignatureCheck       bool     `json:"vm_image_skip_signature_check"`
+	VMImageCosignKey                string   `json:"vm_image_cosign_key"`
+	VMImageCosignAttestation        bool     `json:"vm_image_cosign_attestation"`
+	VMImageConverter                string   `json:"vm_image_converter"`
+	VMImageConvertCommand           []string `json:"vm_image_convert_command"`
+	VMImageResizeCommand            []string `json:"vm_image_resize_command"`
+	VMImageCopyCommand              []string `json:"vm_image_copy_command"`
+	VMDiskDir                       string   `json:"vm_disk_directory"`
+	VMDiskRetentionCount            uint64   `json:"vm_disk_retention_count"`
+	VMSubnet                        string   `json:"vm_subnet"`
+	VMSubnetPrefixLength            int      `json:"vm_subnet_prefix_length"`
+	VMIPAMBackend                   string   `json:"vm_ipam_backend"`
+	VMNumCPUCores                   uint64   `json:"vm_num_cpu_cores"`
+	VMMemoryMegabytes               uint64   `json:"vm_memory_mb"`
+	VMDiskSizeGB                    uint64   `json:"vm_disk_size_gb"`
+	VMDiskFormat                    string   `json:"vm_disk_format"`
+	VMDiskOverlay                   bool     `json:"vm_disk_overlay"`
+	VMDiskOverlayClusterKilobytes   uint64   `json:"vm_disk_overlay_cluster_size_kb"`
+	VMDiskOverlayPreallocation      string   `json:"vm_disk_overlay_preallocation"`
+	VMDiskOverlayExtendedL2         bool     `json:"vm_disk_overlay_extended_l2"`
+	VMDiskOverlayCompat             string   `json:"vm_disk_overlay_compat"`
+	VMDiskOverlayPoolSize           uint64   `json:"vm_disk_overlay_pool_size"`
+	VMExtraDisks                    []string `json:"vm_extra_disks"`
+	VMSlotCacheDisk                 string   `json:"vm_slot_cache_disk"`
+	VMSwap                          string   `json:"vm_swap"`
+	VMSwapSizeMegabytes             uint64   `json:"vm_swap_size_mb"`
+	VMSwappiness                    *uint64  `json:"vm_swappiness"`
+	VMFstrimIntervalMinutes         uint64   `json:"vm_fstrim_interval_minutes"`
+	PrebuildProfile                 string   `json:"prebuild_profile"`
+	VMPrebuildCloudinitExtraCmds    []string `json:"vm_prebuild_cloudinit_extra_cmds"`
+	VMCloudinitExtraCmds            []string `json:"vm_cloudinit_extra_cmds"`
+	VMCloudinitExtraUserdata        []string `json:"vm_cloudinit_extra_userdata"`
+	VMCACertificates                []string `json:"vm_ca_certificates"`
+	VMHTTPProxy                     string   `json:"vm_http_proxy"`
+	VMHTTPSProxy                    string   `json:"vm_https_proxy"`
+	VMNoProxy                       []string `json:"vm_no_proxy"`
+	VMPrebuildTimeoutMinutes        uint64   `json:"vm_prebuild_timeout_minutes"`
+	VMImageVerifyFull               bool     `json:"vm_image_verify_full"`
+	VMImageVerifyIntervalMinutes    uint64   `json:"vm_image_verify_interval_minutes"`
+	VMBootTimeoutMinutes            uint64   `json:"vm_boot_timeout_minutes"`
+	VMParallelBoots                 uint64   `json:"vm_parallel_boots"`
+	VMBootRatePerMinute             uint64   `json:"vm_boot_rate_per_minute"`
+	VMBootJitterSeconds             uint64   `json:"vm_boot_jitter_seconds"`
+	VMEnableVirtioConsole           bool     `json:"vm_enable_virtio_console"`
+	VMConsoleLogMaxSizeKilobytes    uint64   `json:"vm_console_log_max_size_kb"`
+	VMConsoleLogMaxFiles            uint64   `json:"vm_console_log_max_files"`
+	VMPanicConsoleLines             uint64   `json:"vm_panic_console_lines"`
+	VMHeartbeatCloudinitCheck       bool     `json:"vm_heartbeat_cloudinit_check"`
+	VMGuestAgent                    bool     `json:"vm_guest_agent"`
+	VMSeedMode                      string   `json:"vm_seed_mode"`
+	VMConfigDriveFormat             string   `json:"vm_config_drive_format"`
+	VMMaxRestarts                   uint64   `json:"vm_max_restarts"`
+	VMSystemdScopes                 bool     `json:"vm_systemd_scopes"`
+	VMSystemdScopeProperties        []string `json:"vm_systemd_scope_properties"`
+	VMCgroupLimits                  bool     `json:"vm_cgroup_limits"`
+	VMCgroupMemoryOverheadMegabytes uint64   `json:"vm_cgroup_memory_overhead_mb"`
+	VMCgroupCPUOverheadPercent      uint64   `json:"vm_cgroup_cpu_overhead_percent"`
+	VMHypervisorUser                string   `json:"vm_hypervisor_user"`
+	VMHypervisorGroup               string   `json:"vm_hypervisor_group"`
+	VMSeccomp                       string   `json:"vm_seccomp"`
+	VMLandlock                      *bool    `json:"vm_landlock"`
+	VMSMTIsolation                  bool     `json:"vm_smt_isolation"`
+	VMMACConfinement                string   `json:"vm_mac_confinement"`
+	VMAppArmorProfile               string   `json:"vm_apparmor_profile"`
+	VMSELinuxContext                string   `json:"vm_selinux_context"`
+	VMHardening                     bool     `json:"vm_hardening"`
+	VMSSHCA                         bool     `json:"vm_ssh_ca"`
+	VMSSHCAKeyFile                  string   `json:"vm_ssh_ca_key_file"`
+	VMExtraAuthorizedKeys           []string `json:"vm_extra_authorized_keys"`
+	VMSSHCertificateLifetimeMinutes uint64   `json:"vm_ssh_certificate_lifetime_minutes"`
+	StateEncryptionKeyFile          string   `json:"state_encryption_key_file"`
+	VMAuditLog                      bool     `json:"vm_audit_log"`
+	VMAuditLogMaxSizeMegabytes      uint64   `json:"vm_audit_log_max_size_mb"`
+	VMAuditLogMaxFiles              uint64   `json:"vm_audit_log_max_files"`
+	MetricsListenAddress            string   `json:"metrics_listen_address"`
+	TracingOTLPEndpoint             string   `json:"tracing_otlp_endpoint"`
+	DebugSocket                     bool     `json:"debug_socket"`
+	HealthSocket                    bool     `json:"health_socket"`
+	LogLevel                        string   `json:"log_level"`
+	LogFormat                       string   `json:"log_format"`
+	VMPassthroughDevices            []string `json:"vm_passthrough_devices"`
+	VMNetSRIOVDevices               []string `json:"vm_net_sriov_devices"`
+	VMConfidentialComputing         string   `json:"vm_confidential_computing"`
+	VMConfidentialFirmware          string   `json:"vm_confidential_firmware"`
+	VMSnapshotBoot                  bool     `json:"vm_snapshot_boot"`
+	VMIdlePauseMinutes              uint64   `json:"vm_idle_pause_minutes"`
+	VMIdleBalloonMinutes            uint64   `json:"vm_idle_balloon_minutes"`
+	VMMaxLifetimeMinutes            uint64   `json:"vm_max_lifetime_minutes"`
+	VMMemoryFloorMegabytes          uint64   `json:"vm_memory_floor_mb"`
+	HostMinAvailableMemoryMegabytes uint64   `json:"host_min_available_memory_mb"`
+	HostEnableIPForwarding          bool     `json:"host_enable_ip_forwarding"`
+	HostKSM                         bool     `json:"host_ksm"`
+	HostKSMPagesToScan              uint64   `json:"host_ksm_pages_to_scan"`
+	HostReservedMemoryMegabytes     uint64   `json:"host_reserved_memory_mb"`
+	HostMinFreeDiskGigabytes        uint64   `json:"host_min_free_disk_gb"`
+	HostDiskRecycleIdle             bool     `json:"host_disk_recycle_idle"`
+	HostMaxLoadPerCPU               float64  `json:"host_max_load_per_cpu"`
+	HostDropCapabilities            bool     `json:"host_drop_capabilities"`
+	HostRetainedCapabilities        []string `json:"host_retained_capabilities"`
+	VMDiskDirectIO                  bool     `json:"vm_disk_direct_io"`
+	VMDiskNumQueues                 uint64   `json:"vm_disk_num_queues"`
+	VMDiskQueueSize                 uint64   `json:"vm_disk_queue_size"`
+	VMDiskVhostUser                 bool     `json:"vm_disk_vhost_user"`
+	VMRootPmem                      bool     `json:"vm_root_pmem"`
+	VMNetNumQueues                  uint64   `json:"vm_net_num_queues"`
+	VMNetQueueSize                  uint64   `json:"vm_net_queue_size"`
+	VMNetVhostUser                  bool     `json:"vm_net_vhost_user"`
+	VMNetDownloadRateMegabits       uint64   `json:"vm_net_download_rate_mbit"`
+	VMNetUploadRateMegabits         uint64   `json:"vm_net_upload_rate_mbit"`
+	VMNetBurstKilobytes             uint64   `json:"vm_net_burst_kb"`
+	VMNetMaxConnections             uint64   `json:"vm_net_max_connections"`
+	VMNetNewConnectionsPerSecond    uint64   `json:"vm_net_new_connections_per_second"`
+	VMIPv6Prefix                    string   `json:"vm_ipv6_prefix"`
+	VMIPv6InstancePrefixLength      int      `json:"vm_ipv6_instance_prefix_length"`
+	VMIPv6Mode                      string   `json:"vm_ipv6_mode"`
+	VMIPv6Preferred                 bool     `json:"vm_ipv6_preferred"`
+	VMMACPrefix                     string   `json:"vm_mac_prefix"`
+	VMMACDeterministic              bool     `json:"vm_mac_deterministic"`
+	VMDNSCache                      bool     `json:"vm_dns_cache"`
+	VMDNSUpstreams                  []string `json:"vm_dns_upstreams"`
+	VMNTPServers                    []string `json:"vm_ntp_servers"`
+	VMNTPRelay                      bool     `json:"vm_ntp_relay"`
+	VMTimezone                      string   `json:"vm_timezone"`
+
+	// Attached to every instance next to the labels the plugin sets at boot, included in logs and audit events
+	VMLabels map[string]string `json:"vm_labels"`
+
+	// Kernel parameters and login limits of the job instances, by name
+	VMSysctls map[string]string `json:"vm_sysctls"`
+	VMUlimits map[string]string `json:"vm_ulimits"`
+
+	// Addresses of internal services by host name, appended to the guests' /etc/hosts
+	VMHostEntries map[string]string `json:"vm_host_entries"`
+
+	// Public keys the image servers' certificates are pinned to, by host name
+	VMImageSPKIPins map[string][]string `json:"vm_image_spki_pins"`
+
+	// Named networks the guests may or may not reach, decided before the egress policy
+	EgressNetworks map[string]egressNetwork `json:"egress_networks"`
 
 	logger    hclog.Logger
 	inventory *Inventory
+
+	ipv6Prefix       netip.Prefix
+	bridgeAddress    string
+	bridgeDevice     string
+	egressAllowRules []egressRule
+	egressDenyRules  []egressRule
+	hostAllowRules   []egressRule
+	egressNetworks   []parsedEgressNetwork
+	egressRoutes     []egressRoute
+	extraDisks       []extraDisk
+	slotCacheDisk    *extraDisk
+	macPrefix        []byte
+	tapOwnerUID      uint32
+	tapOwnerGID      uint32
+
+	// Run the job VMs' processes as vm_hypervisor_user, nil runs them with the plugin's privileges
+	hypervisorCredential *syscall.Credential
+
+	// Fetches images with vm_image_ca_certificates and vm_image_spki_pins, nil uses Go's default transport
+	imageTransport http.RoundTripper
+
+	// Single PEM blocks of vm_ca_certificates, added to the guests' trust store
+	caCertificates []string
+
+	// Operators' keys of vm_extra_authorized_keys and their fingerprints for the audit log
+	extraAuthorizedKeys            []string
+	extraAuthorizedKeyFingerprints []string
+
+	// Signs the plugin's own logins to the guests with vm_ssh_ca, nil without
+	sshCA ssh.Signer
+
+	dnsForwarder   *dnsForwarder
+	sriovFunctions map[string]sriovFunction
+
+	egressInterfaceDetected bool
+
+	// The embedded templates, parsed once at Init
+	templates *template.Template
+
+	// Image profile of the distro and where its files were last found
+	imageProfile imageProfile
+	diskImage    resolvedImageFile
+	kernel       resolvedImageFile
+	imagesLock   sync.Mutex
+
+	// The base image as it was finished, a failed check stops boots from it until a restart
+	baseImageIntegrity imageIntegrity
+	baseImageProblem   error
+
+	// Prebuilt image reused across restarts as long as its inputs stay the same
+	goldenImageKey    string
+	goldenImageInputs goldenImageInputs
+	goldenImagePath   string
+
+	// Backend turning the downloaded disk image into the instances' disks
+	imageConverter imageConverter
+
+	// Overlays created ahead of the boots
+	overlayPool overlayPool
+
+	// Paces the boots of Increase
+	bootLimiter bootLimiter
+
+	// Downloads running at the same time, they share the download rate limit
+	parallelDownloads uint64
+
+	// Held while the checksum cache is read and written
+	checksumCacheLock sync.Mutex
+
+	// Configured local files, kernel URL or registry artifact replacing the ones of the image profile
+	localDiskImage resolvedImageFile
+	localKernel    resolvedImageFile
+	registryImage  *ociReference
+
+	// Public key the disk image's cosign signature or attestation is verified with
+	cosignKey crypto.PublicKey
+
+	// Recent heartbeat results by instance name
+	heartbeatResults map[string]heartbeatResult
+	heartbeatLock    sync.Mutex
+
+	// When Init ran, the health check counts the reconciler's age from here until its first run
+	startedAt time.Time
+
+	// Simulates the instances with hypervisor_backend mock, nil when VMs are booted
+	mock *mockHypervisor
+
+	// Traces the instances' lifecycles, the provider is nil if tracing_otlp_endpoint is not set
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
 }
 
 func (i *InstanceGroup) Init(ctx context.Context, logger hclog.Logger, settings provider.Settings) (provider.ProviderInfo, error) {
@@ -36,15 +308,50 @@ func (i *InstanceGroup) Init(ctx context.Context, logger hclog.Logger, settings
 	// Preflight checks
 	//
 
-	i.logger = logger.Named("fleetingd")
+	i.logger = newFieldLogger(logger.Named("fleetingd"))
+	i.startedAt = time.Now()
+
+	// Applies to everything logged from here on
+	err := i.checkLogLevel()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	err = i.checkLogFormat()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Log the host tools run from here on
+	hostCommands = &execRunner{logger: i.logger.Named("exec")}
 
 	i.inventory = NewInventory()
 
+	err = i.checkHypervisorBackend()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Simulated instances need neither KVM nor any of the host setup below
+	if i.HypervisorBackend == hypervisorBackendMock {
+		return i.initMock()
+	}
+
+	// The image profiles and hypervisor arguments exist for x86_64 and aarch64 only
+	err = checkHostArchitecture()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Parse the templates of the guests' config and the AppArmor profiles
+	err = i.parseTemplates()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
 	// Check all supporting tools are installed
 	requiredBinaries := []string{
 		"cloud-hypervisor",
-		"nft",
-		"qemu-img",
 	}
 
 	for _, binary := range requiredBinaries {
@@ -54,105 +361,827 @@ func (i *InstanceGroup) Init(ctx context.Context, logger hclog.Logger, settings
 		}
 	}
 
+	// Support requests need to know which build runs on which hypervisor
+	i.logger.Info("Starting fleetingd.", "version", Version.Version, "revision", Version.Revision, "built_at", Version.BuiltAt, "go", runtime.Version(), "hypervisor", hypervisorVersion())
+
+	// Confine the hypervisors, a compromised one can then only use the files and system calls its VM needs
+	err = i.checkHypervisorSandbox()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// The vhost-user-blk backend ships with cloud-hypervisor but is packaged separately on some distributions
+	if i.VMDiskVhostUser {
+		_, err := exec.LookPath("vhost_user_block")
+		if err != nil {
+			return provider.ProviderInfo{}, fmt.Errorf("vm_disk_vhost_user is enabled but vhost_user_block could not be found on PATH: %w", err)
+		}
+
+		if i.VMSnapshotBoot {
+			return provider.ProviderInfo{}, errors.New("vm_disk_vhost_user can not be combined with vm_snapshot_boot")
+		}
+	}
+
+	// Encrypted guest memory can't be ballooned
+	if i.VMIdleBalloonMinutes > 0 && i.VMConfidentialComputing != "" {
+		return provider.ProviderInfo{}, errors.New("vm_idle_balloon_minutes can not be combined with vm_confidential_computing")
+	}
+
+	// The memory manager balloons the guests as well
+	if i.HostMinAvailableMemoryMegabytes > 0 && i.VMConfidentialComputing != "" {
+		return provider.ProviderInfo{}, errors.New("host_min_available_memory_mb can not be combined with vm_confidential_computing")
+	}
+
+	// Idle instances are only recycled while the free space is below the threshold
+	if i.HostDiskRecycleIdle && i.HostMinFreeDiskGigabytes == 0 {
+		return provider.ProviderInfo{}, errors.New("host_disk_recycle_idle requires host_min_free_disk_gb")
+	}
+
+	// Check the size of the per-instance subnets
+	err = i.checkSubnetPrefixLength()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Parse the optional IPv6 prefix for dual-stack guests
+	err = i.parseIPv6Prefix()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the bridge exists if VMs are attached to one
+	err = i.checkNetworkMode()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Fall back to the interface of the default route
+	err = i.checkEgressInterface()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the prefix of the instances' MAC addresses
+	err = i.parseMACPrefix()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Resolve the user running the job VMs, it owns their taps by default
+	err = i.parseHypervisorUser()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Resolve who the tap devices belong to
+	err = i.parseTapOwner()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the address the guests' SSH ports are forwarded from
+	err = i.checkExternalAccess()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Parse the rules restricting where the guests can connect to
+	err = i.parseEgressPolicy()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Parse the named networks the guests may or may not reach
+	err = i.parseEgressNetworks()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Parse the routes to other uplinks
+	err = i.parseEgressRoutes()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Keep the guests apart unless configured otherwise
+	i.checkInstanceIsolation()
+
+	// Set up the DNS forwarder for the guests
+	err = i.parseDNSForwarder()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the egress interface, forwarding and the tun device
+	err = i.checkNetworkPrerequisites()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Ignition distributions don't run cloud-init
+	if i.VMHeartbeatCloudinitCheck && i.usesIgnition() {
+		return provider.ProviderInfo{}, errors.New("vm_heartbeat_cloudinit_check can not be used with distributions provisioned by Ignition")
+	}
+
+	err = i.checkLabels()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the instances' processes can be put into systemd scopes
+	err = i.checkSystemdScopes()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Keep the hypervisors within their guests' size plus overhead
+	err = i.checkCgroupLimits()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Keep the job VMs off each other's hyperthreads if configured
+	err = i.checkSMTIsolation()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Confine the hypervisors with AppArmor or SELinux if configured
+	err = i.checkMACConfinement()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the capabilities kept once Init is done
+	err = i.checkCapabilities()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the guests can be kept away from the host's and private networks
+	err = i.checkHostProtection()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the per-instance connection limits can be enforced
+	err = i.checkConnectionLimits()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Traffic shaping is done with tc from iproute2
+	if i.trafficShapingEnabled() {
+		_, err := exec.LookPath("tc")
+		if err != nil {
+			return provider.ProviderInfo{}, fmt.Errorf("vm_net_download_rate_mbit or vm_net_upload_rate_mbit is set but tc could not be found on PATH: %w", err)
+		}
+	}
+
+	// Queues come in RX/TX pairs
+	if i.VMNetNumQueues%2 != 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("vm_net_num_queues must be an even number (RX/TX pairs) but is %d", i.VMNetNumQueues)
+	}
+
+	// cloud-hypervisor does not use the kernel's vhost-net, the offloaded data path is provided by vhost_user_net
+	if i.VMNetVhostUser {
+		_, err := exec.LookPath("vhost_user_net")
+		if err != nil {
+			return provider.ProviderInfo{}, fmt.Errorf("vm_net_vhost_user is enabled but vhost_user_net could not be found on PATH: %w", err)
+		}
+
+		if i.VMSnapshotBoot {
+			return provider.ProviderInfo{}, errors.New("vm_net_vhost_user can not be combined with vm_snapshot_boot")
+		}
+	}
+
 	// Check disk dir is writable
-	err := unix.Access(i.VMDiskDir, unix.W_OK)
+	err = unix.Access(i.VMDiskDir, unix.W_OK)
 	if err != nil {
 		return provider.ProviderInfo{}, fmt.Errorf("'%s' was specified as vm_disk_directory in the settings but is not writable: %w", i.VMDiskDir, err)
 	}
 
+	// Raw disks need reflinks in vm_disk_directory, overlays need qemu-img
+	err = i.checkDiskFormat()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the root disks can be mapped as pmem
+	err = i.checkRootPmem()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the overlays can be created ahead of the boots
+	err = i.checkOverlayPool()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Parse the scratch disks created for every instance
+	err = i.parseExtraDisks()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Parse the disk kept per slot across instances
+	err = i.parseSlotCacheDisk()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the platform supports confidential VMs if requested
+	err = i.checkConfidentialComputing()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Select the images of the configured distribution
+	err = i.parseImageProfile()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check what is merged into the job instances' cloud-init
+	err = i.checkCloudinitExtraUserdata()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the maintained prebuild steps
+	err = i.checkPrebuildProfile()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Read the certificates the guests trust
+	err = i.parseCACertificates()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the proxy the guests use
+	err = i.parseGuestProxy()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the guests' time settings
+	err = i.parseGuestTime()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the swap of the job instances
+	err = i.checkGuestSwap()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the periodic trim of the job instances
+	err = i.checkGuestTrim()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the kernel parameters and limits of the job instances
+	err = i.checkGuestTuning()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the host names the guests resolve locally
+	err = i.parseHostEntries()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the guests can run the status agent, destroying an instance asks it to power off first
+	err = i.checkGuestAgent()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+	if i.VMGuestAgent {
+		i.inventory.guestAgentSocketPath = i.getVsockSocketPath
+	}
+
+	// Check how the job instances get their cloud-init seed
+	err = i.checkSeedMode()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the filesystem of the config drives
+	err = i.checkConfigDriveFormat()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the local images used instead of downloaded ones
+	err = i.parseLocalImages()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the tools converting the disk image are installed
+	err = i.parseImageConverter()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// A hung prebuild would keep every instance from booting
+	if i.VMPrebuildTimeoutMinutes == 0 {
+		i.VMPrebuildTimeoutMinutes = defaultPrebuildTimeoutMinutes
+	}
+
+	// A VM wedged in cloud-init would otherwise stay creating forever
+	if i.VMBootTimeoutMinutes == 0 {
+		i.VMBootTimeoutMinutes = defaultBootTimeoutMinutes
+	}
+
+	// Console logs are rotated instead of growing with chatty guests
+	if i.VMConsoleLogMaxSizeKilobytes == 0 {
+		i.VMConsoleLogMaxSizeKilobytes = defaultConsoleLogMaxSizeKilobytes
+	}
+	if i.VMConsoleLogMaxFiles == 0 {
+		i.VMConsoleLogMaxFiles = defaultConsoleLogMaxFiles
+	}
+
+	// Saved next to the console log when an instance panics
+	if i.VMPanicConsoleLines == 0 {
+		i.VMPanicConsoleLines = defaultPanicConsoleLines
+	}
+
+	// The console used to be written only on request
+	if i.VMEnableVirtioConsole {
+		i.logger.Warn("vm_enable_virtio_console is no longer needed, the consoles of all instances are captured.")
+	}
+
+	// Instances requested together are booted side by side unless configured otherwise
+	if i.VMParallelBoots == 0 {
+		i.VMParallelBoots = defaultParallelBoots
+	}
+
+	// The kernel and the disk image are downloaded side by side unless configured otherwise
+	if i.VMImageParallelDownloads == 0 {
+		i.VMImageParallelDownloads = defaultParallelDownloads
+	}
+
+	// Check the mirrors images are downloaded from
+	err = i.parseImageMirrors()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Trust the private CAs and pinned keys of image servers
+	err = i.checkImageTLS()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the key the image checksums are verified with
+	err = i.checkImageSignatures()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Load the key disk images have to be signed with by cosign
+	err = i.checkCosignKey()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Check the passthrough devices and virtual functions are listed only once
+	err = i.checkPassthroughDevices()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Restored VMs can't carry host devices or confidential state over from the template
+	if i.VMSnapshotBoot && (len(i.VMPassthroughDevices) > 0 || len(i.VMNetSRIOVDevices) > 0 || i.VMConfidentialComputing != "") {
+		return provider.ProviderInfo{}, errors.New("vm_snapshot_boot can not be combined with vm_passthrough_devices, vm_net_sriov_devices or vm_confidential_computing")
+	}
+
+	// Read the operators' keys the instances accept, before the audit log records them
+	err = i.parseExtraAuthorizedKeys()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+	if len(i.extraAuthorizedKeyFingerprints) > 0 {
+		i.logger.Warn("Job instances accept the keys of vm_extra_authorized_keys besides the runner's.", "fingerprints", i.extraAuthorizedKeyFingerprints)
+	}
+
+	// Nothing on the host is changed before this point, a rejected configuration leaves it as it was
+
+	// Set up address allocation, persisted allocations of still running instances are kept
+	i.inventory.ipam, err = i.newIPAM()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Clean up the firewall tables of earlier versions and set up the plugin's table, passt needs neither root nor nftables
+	if !i.usesPasst() {
+		err = removeLegacyFirewallTables()
+		if err != nil {
+			return provider.ProviderInfo{}, err
+		}
+
+		err = i.SetupFirewall()
+		if err != nil {
+			return provider.ProviderInfo{}, err
+		}
+	}
+
+	// Route the guests' traffic to the configured uplinks
+	err = i.SetupEgressRoutes()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Deduplicate the job VMs' memory if configured, only once all settings are validated
+	err = i.setupKSM()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Find the physical functions of the SR-IOV virtual functions
+	err = i.prepareSRIOVDevices()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Bind passthrough devices and virtual functions, each instance needs one of each
+	err = i.preparePassthroughDevices()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Record which instances existed when, from the instances adopted below on
+	i.inventory.auditLog, err = i.openAuditLog()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// The guests booted from here on trust the CA, it is kept in the vm_disk_directory for those adopted below
+	err = i.loadSSHCA()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// The SSH keys in the instance state are encrypted if a key is configured, without one they aren't persisted
+	i.inventory.stateCipher, err = i.loadStateEncryptionKey()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+	if i.inventory.stateCipher == nil {
+		i.logger.Info("state_encryption_key_file is not set, instances are reaped instead of adopted after a restart.")
+	}
+
+	// Take over the instances an earlier plugin process left running
+	err = i.inventory.AdoptInstances(ctx, i)
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	// Clean up taps, files and processes of the instances which were not adopted
+	i.inventory.RemoveOrphans(i)
+
+	// Bind the sockets and exporters before the background loops start, a failure closes those already listening
+	services := []func() error{
+		// Expose counters and histograms for Prometheus
+		i.serveMetrics,
+		// Trace the lifecycle operations if a collector is configured
+		i.setupTracing,
+		// Let goroutine leaks and lock contention be inspected
+		i.serveDebugSocket,
+		// Let node monitoring alert before jobs start failing
+		i.serveHealthSocket,
+		// Let the list and status commands ask what exists right now
+		i.serveControlSocket,
+		// Everything needing more privileges than the instances' lifecycle is set up by now
+		i.dropCapabilities,
+	}
+
+	for _, service := range services {
+		err = service()
+		if err != nil {
+			i.inventory.shutdownCancelFunc()
+			return provider.ProviderInfo{}, err
+		}
+	}
+
+	// Nothing can fail from here on, so the loops never run against a group whose Init failed
+
+	// A detected egress interface follows the default route
+	if i.egressInterfaceDetected {
+		go i.watchEgressInterface(i.inventory.shutdownContext)
+	}
+
+	// Remove outdated images and instance files in the background
+	go i.runGarbageCollector(i.inventory.shutdownContext)
+
+	// Catch changes of the base image which kept its size and modification time
+	if i.VMImageVerifyIntervalMinutes > 0 {
+		go i.runImageVerifier(i.inventory.shutdownContext)
+	}
+
+	// Repair taps, rules and instances which got out of sync with the inventory
+	go i.runReconciler(i.inventory.shutdownContext)
+
+	// Pause instances which are not used or take back their memory
+	if i.VMIdlePauseMinutes > 0 || i.VMIdleBalloonMinutes > 0 {
+		go i.runIdlePolicy(i.inventory.shutdownContext)
+	}
+
+	// Watch the space the overlays grow into
+	if i.HostMinFreeDiskGigabytes > 0 {
+		go i.runDiskSpaceMonitor(i.inventory.shutdownContext)
+	}
+	if i.VMFstrimIntervalMinutes > 0 {
+		go i.runDiskReclaimMonitor(i.inventory.shutdownContext)
+	}
+
+	// Replace instances which have been around too long by fresh ones
+	if i.VMMaxLifetimeMinutes > 0 {
+		go i.runLifetimePolicy(i.inventory.shutdownContext)
+	}
+
+	// Reclaim memory from idle guests under host memory pressure
+	if i.HostMinAvailableMemoryMegabytes > 0 {
+		go i.runMemoryManager(i.inventory.shutdownContext)
+	}
+
+	maxSize := i.maxIPAMSlots()
+	if len(i.VMPassthroughDevices) > 0 {
+		maxSize = min(maxSize, len(i.VMPassthroughDevices))
+	}
+
+	// Every job VM gets a virtual function of its own, so there are never more of them than are listed
+	if len(i.VMNetSRIOVDevices) > 0 {
+		maxSize = min(maxSize, len(i.VMNetSRIOVDevices))
+	}
+
 	return provider.ProviderInfo{
 		ID:        "fleetingd",
-		MaxSize:   MaxIPAMSlots,
+		MaxSize:   maxSize,
 		Version:   Version.Version,
-		BuildInfo: "TBD",
+		BuildInfo: BuildInfo(),
 	}, nil
 }
 
 func (i *InstanceGroup) Update(ctx context.Context, updateFunc func(instance string, state provider.State)) error {
 	// Query status from inventory
-	instances := i.inventory.GetAllInstances()
+	if i.mock != nil {
+		i.mock.Update(updateFunc)
+		return nil
+	}
 
-	for _, instance := range instances {
-		err := i.Heartbeat(ctx, instance)
-		if err != nil {
-			i.logger.Info("creating...", "instance", instance)
-			updateFunc(instance, provider.StateCreating)
-			continue
+	states := i.inventory.GetInstanceStates()
+
+	// Instances are creating until they could be logged in to once, they are all probed at the same time
+	var creating []string
+	for instance, status := range states {
+		if status.State == provider.StateCreating {
+			creating = append(creating, instance)
 		}
+	}
+	heartbeats := i.heartbeatAll(ctx, creating)
+
+	for instance, status := range states {
+		state := status.State
 
-		updateFunc(instance, provider.StateRunning)
+		if state == provider.StateCreating {
+			if heartbeats[instance] != nil {
+				i.inventory.instanceLogger(i, instance).Info("creating...")
+			} else {
+				state = i.inventory.MarkInstanceRunning(instance)
+			}
+		}
+
+		if status.Reason != "" {
+			i.inventory.instanceLogger(i, instance).Warn("reporting failed instance", "state", state, "reason", status.Reason)
+		}
+
+		updateFunc(instance, state)
 	}
 
 	return nil
 }
 
 func (i *InstanceGroup) Increase(ctx context.Context, n int) (succeeded int, err error) {
-	// Try to boot more instances
+	// Try to boot more instances, vm_parallel_boots at a time and at most vm_boot_rate_per_minute
 
-	for counter := 0; counter < n; counter++ {
-		err := i.inventory.BootInstance(i)
-		if err != nil {
-			i.logger.Error("instance boot error", "error", err)
-			return counter, err
+	if i.mock != nil {
+		return i.mock.Increase(n)
+	}
+
+	ctx, span := i.tracer.Start(ctx, "Increase", trace.WithAttributes(attribute.Int("count", n)))
+	defer func() {
+		span.SetAttributes(attribute.Int("succeeded", succeeded))
+		endSpan(span, err)
+	}()
+
+	var booted atomic.Int64
+
+	tasks := make([]func(context.Context) error, n)
+	for index := range tasks {
+		// Boots which already started are not cancelled by the failure of another one
+		tasks[index] = func(context.Context) error {
+			_, waitSpan := i.tracer.Start(ctx, "wait for boot slot")
+			err := i.waitForBootSlot(ctx)
+			endSpan(waitSpan, err)
+			if err != nil {
+				return err
+			}
+
+			err = i.inventory.BootInstance(ctx, i)
+			if err != nil {
+				i.logger.Error("instance boot error", "error", err)
+				return err
+			}
+
+			booted.Add(1)
+			return nil
 		}
 	}
 
-	return n, nil
+	// A failed boot keeps the remaining ones from starting, the ones already booting finish
+	err = runParallel(ctx, i.VMParallelBoots, tasks)
+
+	return int(booted.Load()), err
 }
 
 func (i *InstanceGroup) Decrease(ctx context.Context, instances []string) ([]string, error) {
-	// Try to remove instances
+	// Try to remove instances, all of them at the same time
+	if i.mock != nil {
+		return i.mock.Decrease(instances)
+	}
+
 	removedInstances := []string{}
 
+	var lock sync.Mutex
+	var errs []error
+	var waitGroup sync.WaitGroup
+
 	for _, instanceToRemove := range instances {
-		i.logger.Info("stopping instance", "instance", instanceToRemove)
+		waitGroup.Go(func() {
+			logger := i.inventory.instanceLogger(i, instanceToRemove)
+			logger.Info("stopping instance")
 
-		err := i.inventory.DestroyInstance(instanceToRemove)
-		if err != nil {
-			i.logger.Error("error stopping instance: %w", err)
-			continue
-		}
+			err := i.inventory.DestroyInstance(ctx, instanceToRemove)
+
+			lock.Lock()
+			defer lock.Unlock()
 
-		i.logger.Info("stopped instance", "instance", instanceToRemove)
+			if err != nil {
+				logger.Error("error stopping instance", "error", err)
+				errs = append(errs, err)
+				return
+			}
 
-		removedInstances = append(removedInstances, instanceToRemove)
+			logger.Info("stopped instance")
+
+			removedInstances = append(removedInstances, instanceToRemove)
+		})
 	}
 
-	return removedInstances, nil
+	waitGroup.Wait()
+
+	return removedInstances, errors.Join(errs...)
 }
 
 func (i *InstanceGroup) ConnectInfo(ctx context.Context, instance string) (provider.ConnectInfo, error) {
 	// Return connection information from the inventory
 
-	info, err := i.inventory.GetConnectInfo(instance)
+	if i.mock != nil {
+		return i.mock.ConnectInfo(instance)
+	}
+
+	// The runner is about to use the instance, so wake it up if it was paused or ballooned
+	err := i.inventory.WakeInstance(i, instance)
+	if err != nil {
+		return provider.ConnectInfo{}, err
+	}
+
+	err = i.inventory.LearnInstanceAddress(i, instance)
+	if err != nil {
+		return provider.ConnectInfo{}, err
+	}
+
+	info, err := i.inventory.GetConnectInfo(i, instance, i.VMIPv6Preferred)
 	if err != nil {
 		return provider.ConnectInfo{}, err
 	}
 
+	// Heartbeats get the connect info as well, only what the runner was given is audited
+	i.inventory.recordAuditEvent(auditEventConnectInfo, instance)
+
 	return *info, err
 }
 
 func (i *InstanceGroup) Heartbeat(ctx context.Context, instance string) error {
+	if i.mock != nil {
+		return i.mock.Heartbeat(instance)
+	}
+
+	// Paused instances can't answer but are healthy
+	if i.inventory.IsInstancePaused(instance) {
+		return nil
+	}
+
+	// Update and the runner may probe the same instance right after another
+	result, ok := i.cachedHeartbeat(instance)
+	if ok {
+		return result.err
+	}
+
+	err := i.probeInstance(ctx, instance)
+
+	// A cancelled probe says nothing about the instance
+	if ctx.Err() == nil {
+		i.cacheHeartbeat(instance, err)
+
+		if err != nil {
+			i.inventory.metrics.heartbeatFailures.Add(1)
+		}
+	}
+
+	return err
+}
+
+func (i *InstanceGroup) probeInstance(ctx context.Context, instance string) error {
+	// Log in to an instance to check it is healthy
+
+	err := i.inventory.LearnInstanceAddress(i, instance)
+	if err != nil {
+		return err
+	}
+
 	// Check SSH connection
-	info, err := i.inventory.GetConnectInfo(instance)
+	info, err := i.inventory.GetConnectInfo(i, instance, i.VMIPv6Preferred)
 	if err != nil {
 		return err
 	}
 
-	// Check SSH port is reachable
-	hostPort := net.JoinHostPort(info.InternalAddr, strconv.Itoa(info.ProtocolPort))
-	connection, err := net.DialTimeout("tcp", hostPort, time.Second)
+	hostPublicKey, err := i.inventory.GetSSHHostPublicKey(instance)
 	if err != nil {
 		return err
 	}
-	connection.Close()
 
-	return nil
+	// Check SSH port is reachable, passt instances' addresses carry their forwarded port
+	hostPort := info.InternalAddr
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(info.InternalAddr, strconv.Itoa(info.ProtocolPort))
+	}
+
+	// The runner still logs in over SSH, the agent only tells when the guest is ready for it
+	if i.VMGuestAgent {
+		err = i.checkGuestStatus(ctx, instance)
+		if err != nil {
+			return err
+		}
+	}
+
+	return i.checkSSHLogin(ctx, hostPort, info, hostPublicKey)
 }
 
 func (i *InstanceGroup) Shutdown(ctx context.Context) error {
-	// Destroy all instances
-	return i.inventory.DestroyAllInstances()
+	// Destroy all instances, forcing their removal if they don't stop before the runner's deadline
+
+	if i.mock != nil {
+		return i.mock.Shutdown()
+	}
+
+	// Leave time for the forced cleanup before the runner gives up on the plugin
+	destroyContext := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		destroyContext, cancel = context.WithDeadline(ctx, deadline.Add(-shutdownForceMargin))
+		defer cancel()
+	}
+
+	var errs []error
+
+	err := i.inventory.DestroyAllInstances(destroyContext)
+	if err != nil {
+		i.logger.Warn("Not all instances stopped in time, killing them.", "error", err)
+		i.inventory.ForceRemoveInstances(i)
+		errs = append(errs, err)
+	}
+
+	// The host's network is cleaned up even if instances had to be killed
+	errs = append(errs, i.RemoveEgressRoutes())
+
+	// Remove the firewall rules, instances remove themselves but the last one might still be cleaning up
+	if !i.usesPasst() {
+		errs = append(errs, i.inventory.RemoveNftables())
+	}
+
+	// Spans of the last instances are still queued
+	errs = append(errs, i.shutdownTracing(ctx))
+
+	return errors.Join(errs...)
 }
 
 func (i *InstanceGroup) MakeAddress(index int) string {
@@ -0,0 +1,160 @@
+package fleetingd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// The plugin's log lines about an instance are also written to its own log, which outlives it like its console log
+const instanceLogMaxSize = 1024 * 1024
+const instanceLogMaxFiles = 1
+
+// Phase of the prebuild VM, job instances are in the phase of the state reported to the runner
+const instancePhasePrebuild = "prebuild"
+
+// Logs about an instance go to the plugin log and the instance's own log, every line carries its name and lifecycle phase
+type instanceLogger struct {
+	lock sync.Mutex
+
+	logger     hclog.Logger
+	fileLogger hclog.Logger
+	file       *rotatingFile
+
+	phase string
+}
+
+func (i *InstanceGroup) checkLogLevel() error {
+	// Apply log_level to the plugin's log and the instances' logs, the runner still drops lines below its own level
+
+	if i.LogLevel == "" {
+		return nil
+	}
+
+	level := hclog.LevelFromString(i.LogLevel)
+	if level == hclog.NoLevel || level == hclog.Off {
+		return fmt.Errorf("invalid log_level '%s', must be one of trace, debug, info, warn or error", i.LogLevel)
+	}
+
+	i.logger.SetLevel(level)
+
+	return nil
+}
+
+func (i *InstanceGroup) getInstanceLogPath(instanceName string) string {
+	// Get the path of an instance's log, it is kept next to its console log
+
+	return filepath.Join(i.VMDiskDir, vmWorkdir, fmt.Sprintf("%s.log", instanceName))
+}
+
+func isInstanceLogName(name string) bool {
+	// Tell the logs and panic markers of instances and their rotated copies, e.g. fleetingd3.log.1, apart from other instance files
+
+	return isConsoleLogName(name) || strings.HasSuffix(name, ".log") || strings.Contains(name, ".log.") || strings.HasSuffix(name, "_panic")
+}
+
+func (i *InstanceGroup) newInstanceLogger(instanceName string, phase string, fresh bool) *instanceLogger {
+	// Start logging about an instance, a freshly booted instance replaces the log of the slot's previous one
+
+	path := i.getInstanceLogPath(instanceName)
+	if fresh {
+		err := removeRotatedFile(path)
+		if err != nil {
+			i.logger.Error("could not remove log of the slot's previous instance", "instance", instanceName, "error", err)
+		}
+	}
+
+	file := &rotatingFile{
+		path:     path,
+		maxSize:  instanceLogMaxSize,
+		maxFiles: instanceLogMaxFiles,
+	}
+
+	return &instanceLogger{
+		logger: i.logger.With("instance", instanceName),
+		fileLogger: newFieldLogger(hclog.New(&hclog.LoggerOptions{
+			Name:       i.logger.Name(),
+			Level:      i.logger.GetLevel(),
+			Output:     file,
+			JSONFormat: i.LogFormat == logFormatJSON,
+		})).With("instance", instanceName),
+		file:  file,
+		phase: phase,
+	}
+}
+
+func (l *instanceLogger) setPhase(phase string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.phase = phase
+}
+
+func (l *instanceLogger) setState(state provider.State) {
+	l.setPhase(string(state))
+}
+
+func (l *instanceLogger) log(level hclog.Level, message string, args []any) {
+	// Write a line to both logs, once the instance is gone it only goes to the plugin log
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	args = append([]any{"phase", l.phase}, args...)
+
+	l.logger.Log(level, message, args...)
+	if l.file != nil {
+		l.fileLogger.Log(level, message, args...)
+	}
+}
+
+func (l *instanceLogger) Debug(message string, args ...any) {
+	l.log(hclog.Debug, message, args)
+}
+
+func (l *instanceLogger) Info(message string, args ...any) {
+	l.log(hclog.Info, message, args)
+}
+
+func (l *instanceLogger) Warn(message string, args ...any) {
+	l.log(hclog.Warn, message, args)
+}
+
+func (l *instanceLogger) Error(message string, args ...any) {
+	l.log(hclog.Error, message, args)
+}
+
+func (l *instanceLogger) close() {
+	// Close the instance's log, later lines about the instance only go to the plugin log
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	l.file.Close()
+	l.file = nil
+}
+
+func (i *Inventory) instanceLogger(instanceGroup *InstanceGroup, name string) *instanceLogger {
+	// Get the logger of an instance, lines about an instance which is gone only go to the plugin log
+
+	i.lock.RLock()
+	instance, ok := i.instances[name]
+	i.lock.RUnlock()
+
+	if ok && instance.logger != nil {
+		return instance.logger
+	}
+
+	return &instanceLogger{
+		logger: instanceGroup.logger.With("instance", name),
+		phase:  string(provider.StateDeleted),
+	}
+}
@@ -0,0 +1,42 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Where jobs find out which instance and host they run on
+const guestInstanceMetadataPath = "/etc/fleetingd/instance.json"
+
+// What an instance is told about itself, e.g. for cache keys and debugging
+type instanceMetadata struct {
+	Instance    string            `json:"instance"`
+	Slot        int               `json:"slot"`
+	Host        string            `json:"host"`
+	ImageSerial string            `json:"image_serial"`
+	Labels      map[string]string `json:"labels"`
+}
+
+func (i *InstanceGroup) instanceMetadataFiles(instanceName string) []guestFile {
+	// Get the metadata file of the instance with the given name, written like the other files on every boot
+
+	labels := i.instanceLabels()
+
+	// Instances are named after their slot
+	slot, _ := strconv.Atoi(strings.TrimPrefix(instanceName, "fleetingd"))
+
+	// A host without a name is left out rather than failing the boot
+	host, _ := os.Hostname()
+
+	contents, _ := json.MarshalIndent(instanceMetadata{
+		Instance:    instanceName,
+		Slot:        slot,
+		Host:        host,
+		ImageSerial: labels[labelImageSerial],
+		Labels:      labels,
+	}, "", "  ")
+
+	return []guestFile{{Path: guestInstanceMetadataPath, Contents: string(contents) + "\n"}}
+}
@@ -0,0 +1,526 @@
+package fleetingd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"golang.org/x/sys/unix"
+)
+
+// Lives outside of the working directory, which is cleared on startup
+const instanceStateFileName = "instances.json"
+
+// How long a reaped hypervisor gets to exit after being killed
+const reapTimeout = 10 * time.Second
+
+// A process is identified by its PID and start time, so a PID reused after a reboot or crash is never mistaken for it
+type processRecord struct {
+	PID       int    `json:"pid"`
+	StartTime uint64 `json:"start_time"`
+}
+
+// Everything needed to manage an instance again after the plugin was restarted, the hypervisor comes first in Processes
+type instanceRecord struct {
+	Name       string `json:"name"`
+	SubnetBase int    `json:"subnet_base"`
+	Internal   bool   `json:"internal"`
+
+	CreatedAt time.Time         `json:"created_at"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	HostTapIP             string `json:"host_tap_ip"`
+	InstanceTapIP         string `json:"instance_tap_ip"`
+	InstanceTapMacAddress string `json:"instance_tap_mac_address"`
+	HostTapIP6            string `json:"host_tap_ip6"`
+	InstanceTapIP6        string `json:"instance_tap_ip6"`
+	ExternalSSHAddress    string `json:"external_ssh_address"`
+	PasstSSHAddress       string `json:"passt_ssh_address"`
+	PassthroughDevice     string `json:"passthrough_device"`
+	SRIOVDevice           string `json:"sriov_device"`
+
+	// The sealed key is encrypted with state_encryption_key_file, the plain one is only read from records of earlier versions
+	SSHPrivateKey       []byte `json:"ssh_private_key,omitempty"`
+	SSHPrivateKeySealed []byte `json:"ssh_private_key_sealed,omitempty"`
+	SSHHostPublicKey    string `json:"ssh_host_public_key,omitempty"`
+
+	Processes []processRecord `json:"processes"`
+	Files     []string        `json:"files"`
+}
+
+func newInstanceRecord(instance *InstanceInfo) instanceRecord {
+	return instanceRecord{
+		Name:       instance.Name,
+		SubnetBase: instance.SubnetBase,
+		Internal:   instance.Internal,
+
+		CreatedAt: instance.CreatedAt,
+		Labels:    instance.Labels,
+
+		HostTapIP:             instance.HostTapIP,
+		InstanceTapIP:         instance.InstanceTapIP,
+		InstanceTapMacAddress: instance.InstanceTapMacAddress,
+		HostTapIP6:            instance.HostTapIP6,
+		InstanceTapIP6:        instance.InstanceTapIP6,
+		ExternalSSHAddress:    instance.ExternalSSHAddress,
+		PasstSSHAddress:       instance.PasstSSHAddress,
+		PassthroughDevice:     instance.PassthroughDevice,
+		SRIOVDevice:           instance.SRIOVDevice,
+
+		SSHPrivateKey:    instance.SSHPrivateKey.Bytes(),
+		SSHHostPublicKey: instance.SSHHostPublicKey,
+
+		Processes: instance.Processes,
+		Files:     instance.Files,
+	}
+}
+
+func readProcessStat(pid int) ([]string, error) {
+	// Read the fields of /proc/<pid>/stat after the command name, the third field is the first one returned
+
+	contents, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name may contain spaces and parentheses, the fields after it don't
+	end := strings.LastIndexByte(string(contents), ')')
+	if end == -1 {
+		return nil, fmt.Errorf("could not parse /proc/%d/stat", pid)
+	}
+
+	fields := strings.Fields(string(contents[end+1:]))
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("could not parse /proc/%d/stat", pid)
+	}
+
+	return fields, nil
+}
+
+func processStartTime(pid int) (uint64, error) {
+	// Read when a process was started, in clock ticks since boot
+
+	fields, err := readProcessStat(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	// The start time is the 22nd field
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+func newProcessRecord(pid int) processRecord {
+	// Record a process started by the plugin, an unknown start time never matches so the process is not adopted
+
+	startTime, _ := processStartTime(pid)
+
+	return processRecord{PID: pid, StartTime: startTime}
+}
+
+func (p processRecord) open() (int, error) {
+	// Get a pidfd of the recorded process, it keeps referring to the process even once the PID is reused
+
+	if p.PID <= 0 || p.StartTime == 0 {
+		return -1, errors.New("process was not recorded")
+	}
+
+	pidfd, err := unix.PidfdOpen(p.PID, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	// Between reading the start time and opening the pidfd the process could have been replaced
+	startTime, err := processStartTime(p.PID)
+	if err != nil || startTime != p.StartTime {
+		unix.Close(pidfd)
+		return -1, fmt.Errorf("process %d is gone", p.PID)
+	}
+
+	return pidfd, nil
+}
+
+func waitProcessExit(pidfd int, timeout time.Duration) bool {
+	// Wait until the process of a pidfd exited, a negative timeout waits forever
+
+	timeoutMilliseconds := -1
+	if timeout >= 0 {
+		timeoutMilliseconds = int(timeout.Milliseconds())
+	}
+
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	for {
+		count, err := unix.Poll(fds, timeoutMilliseconds)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+
+		return err == nil && count > 0
+	}
+}
+
+func killProcesses(pidfds []int) {
+	// Kill processes of an adopted instance and close their pidfds once they exited
+
+	for _, pidfd := range pidfds {
+		unix.PidfdSendSignal(pidfd, unix.SIGKILL, nil, 0)
+	}
+
+	for _, pidfd := range pidfds {
+		waitProcessExit(pidfd, reapTimeout)
+		unix.Close(pidfd)
+	}
+}
+
+func (i *Inventory) saveInstanceState() error {
+	// Write the records of all instances, the inventory lock has to be held
+
+	if i.statePath == "" {
+		return nil
+	}
+
+	records := []instanceRecord{}
+	for _, instance := range i.instances {
+		record := newInstanceRecord(instance)
+
+		// Without state_encryption_key_file the key isn't persisted at all, a restarted plugin reaps the instance instead
+		if i.stateCipher != nil && record.SSHPrivateKey != nil {
+			sealed, err := sealSecret(i.stateCipher, record.SSHPrivateKey, record.Name)
+			if err != nil {
+				return fmt.Errorf("could not encrypt SSH key of %s: %w", record.Name, err)
+			}
+			record.SSHPrivateKeySealed = sealed
+		}
+		record.SSHPrivateKey = nil
+
+		records = append(records, record)
+	}
+
+	contents, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	// The records contain the instances' addresses and processes, the SSH keys only encrypted
+	temporaryPath := i.statePath + ".tmp"
+	err = os.WriteFile(temporaryPath, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write instance state: %w", err)
+	}
+
+	err = os.Rename(temporaryPath, i.statePath)
+	if err != nil {
+		return fmt.Errorf("could not write instance state: %w", err)
+	}
+
+	return nil
+}
+
+func (i *Inventory) AdoptInstances(ctx context.Context, instanceGroup *InstanceGroup) error {
+	// Take over the instances an earlier plugin process left running and reap the ones which can't be taken over
+
+	i.statePath = filepath.Join(instanceGroup.VMDiskDir, instanceStateFileName)
+
+	records, err := readInstanceState(i.statePath)
+	if err != nil {
+		return err
+	}
+
+	var adopted []string
+	for _, record := range records {
+		err = i.adoptInstance(instanceGroup, record)
+		if err != nil {
+			instanceGroup.logger.Warn("Reaping instance left behind by an earlier run.", "instance", record.Name, "reason", err)
+			i.reapInstance(instanceGroup, record)
+			continue
+		}
+
+		i.instanceLogger(instanceGroup, record.Name).Info("Adopted instance still running from an earlier run.", "labels", record.Labels)
+		adopted = append(adopted, record.Name)
+	}
+
+	i.lock.Lock()
+	err = i.saveInstanceState()
+	i.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The firewall table was set up from scratch, the adopted instances need their rules again
+	for _, name := range adopted {
+		err = i.AddInstanceFirewall(instanceGroup, name)
+		if err != nil {
+			i.instanceLogger(instanceGroup, name).Error("could not add firewall rules of adopted instance, destroying it", "error", err)
+			i.DestroyInstance(ctx, name)
+		}
+	}
+
+	return nil
+}
+
+func readInstanceState(statePath string) ([]instanceRecord, error) {
+	// Read the records of the instances an earlier plugin process left, none if it never saved any
+
+	contents, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read instance state: %w", err)
+	}
+
+	var records []instanceRecord
+	err = json.Unmarshal(contents, &records)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse instance state %s: %w", statePath, err)
+	}
+
+	return records, nil
+}
+
+func (i *Inventory) adoptInstance(instanceGroup *InstanceGroup, record instanceRecord) error {
+	// Re-attach to the hypervisor of a record, its slot and devices are taken again
+
+	// Template VMs belong to the boot snapshot of the earlier run
+	if record.Internal {
+		return errors.New("internal instance")
+	}
+
+	stepSize := instanceGroup.ipamStepSize()
+	hostTapIP, _ := instanceGroup.makeTapAddresses(record.SubnetBase)
+	if record.SubnetBase%stepSize != 0 || record.Name != "fleetingd"+strconv.Itoa(record.SubnetBase/stepSize) || record.HostTapIP != hostTapIP {
+		return errors.New("address configuration changed")
+	}
+
+	// Records of earlier versions carry the key in plain text, saving them again encrypts or drops it
+	privateKey := record.SSHPrivateKey
+	if len(privateKey) == 0 && len(record.SSHPrivateKeySealed) == 0 {
+		return errors.New("SSH key was not recorded, state_encryption_key_file is not set")
+	}
+	if len(record.SSHPrivateKeySealed) > 0 {
+		if i.stateCipher == nil {
+			return errors.New("SSH key is encrypted but state_encryption_key_file is not set")
+		}
+
+		var openErr error
+		privateKey, openErr = openSecret(i.stateCipher, record.SSHPrivateKeySealed, record.Name)
+		if openErr != nil {
+			return fmt.Errorf("could not decrypt SSH key: %w", openErr)
+		}
+	}
+
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return errors.New("invalid SSH key")
+	}
+
+	sshPrivateKey, lockErr := newLockedSecret(privateKey)
+	if lockErr != nil {
+		return lockErr
+	}
+
+	// Only an adopted instance keeps its key
+	adopted := false
+	defer func() {
+		if !adopted {
+			sshPrivateKey.Destroy()
+		}
+	}()
+
+	if len(record.Processes) == 0 {
+		return errors.New("no hypervisor recorded")
+	}
+
+	var pidfds []int
+	for index, process := range record.Processes {
+		pidfd, err := process.open()
+		if err != nil {
+			killProcesses(pidfds)
+			return fmt.Errorf("process %d is not running anymore: %w", process.PID, err)
+		}
+		pidfds = append(pidfds, pidfd)
+
+		// Helper processes are only looked up once the hypervisor is known to be alive
+		if index == 0 {
+			err = newHypervisorAPIClient(instanceGroup.getAPISocketPath(record.Name)).Ping()
+			if err != nil {
+				killProcesses(pidfds)
+				return fmt.Errorf("hypervisor does not respond: %w", err)
+			}
+		}
+	}
+
+	instanceContext, instanceCancelFunc := context.WithCancel(context.Background())
+
+	// The DNS forwarder ran in the earlier plugin process
+	err := instanceGroup.startDNSForwarder(instanceContext, record.HostTapIP)
+	if err != nil {
+		instanceCancelFunc()
+		killProcesses(pidfds)
+		return err
+	}
+
+	// The idle policy may have paused the VM, resuming a running VM fails harmlessly
+	newHypervisorAPIClient(instanceGroup.getAPISocketPath(record.Name)).Resume()
+
+	// Records written before the creation time was tracked start their lifetime now
+	createdAt := record.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	instance := &InstanceInfo{
+		Name:                      record.Name,
+		InstanceContextCancelFunc: instanceCancelFunc,
+		State:                     provider.StateCreating,
+
+		HostTapIP:     record.HostTapIP,
+		InstanceTapIP: record.InstanceTapIP,
+
+		HostTapIP6:     record.HostTapIP6,
+		InstanceTapIP6: record.InstanceTapIP6,
+
+		InstanceTapMacAddress: record.InstanceTapMacAddress,
+		ExternalSSHAddress:    record.ExternalSSHAddress,
+		PasstSSHAddress:       record.PasstSSHAddress,
+
+		PassthroughDevice: record.PassthroughDevice,
+		SRIOVDevice:       record.SRIOVDevice,
+
+		LastActive: time.Now(),
+		CreatedAt:  createdAt,
+		Labels:     record.Labels,
+
+		SSHPublicKey:     ed25519.PrivateKey(sshPrivateKey.Bytes()).Public().(ed25519.PublicKey),
+		SSHPrivateKey:    sshPrivateKey,
+		SSHHostPublicKey: record.SSHHostPublicKey,
+
+		SubnetBase: record.SubnetBase,
+		Processes:  record.Processes,
+		Files:      record.Files,
+
+		Removed: make(chan struct{}),
+
+		console: instanceGroup.startConsoleCapture(instanceContext, record.Name, false),
+		logger:  instanceGroup.newInstanceLogger(record.Name, string(provider.StateCreating), false),
+	}
+
+	i.lock.Lock()
+
+	err = i.ipam.Reserve(record.SubnetBase)
+	if err != nil {
+		i.lock.Unlock()
+		instanceCancelFunc()
+		killProcesses(pidfds)
+		return err
+	}
+
+	if record.PassthroughDevice != "" {
+		i.passthroughSlots[record.PassthroughDevice] = struct{}{}
+	}
+	if record.SRIOVDevice != "" {
+		i.sriovSlots[record.SRIOVDevice] = struct{}{}
+	}
+
+	i.instances[record.Name] = instance
+	adopted = true
+
+	i.auditLog.record(auditEventAdopt, instance, "")
+
+	i.lock.Unlock()
+
+	// An adopted instance which never became ready is recycled like a newly booted one
+	go i.enforceBootDeadline(instanceGroup, instance)
+	go i.watchGuestPanics(instanceGroup, instance, instanceContext)
+
+	go func() {
+		//
+		// Adopted VM cleanup - the hypervisor is not our child, its pidfd tells when it exited
+		//
+
+		exited := make(chan struct{})
+		go func() {
+			waitProcessExit(pidfds[0], -1)
+			close(exited)
+		}()
+
+		// The exit status of a process which is not our child is not known
+		exitReason := ""
+		select {
+		case <-instanceContext.Done():
+		case <-exited:
+			exitReason = "hypervisor exited"
+			instanceGroup.logInstanceFailure(instance, "instance exited unexpectedly", exitReason)
+		}
+
+		// Helper processes stop with the hypervisor, like the ones bound to an instance context
+		killProcesses(pidfds)
+
+		instance.logger.Info("instance process finished. cleaning up.")
+
+		i.cleanupInstance(instanceGroup, instance, exitReason)
+	}()
+
+	return nil
+}
+
+func (i *Inventory) reapInstance(instanceGroup *InstanceGroup, record instanceRecord) {
+	// Stop the processes of an instance which is not adopted and remove what it left behind
+
+	var pidfds []int
+	for _, process := range record.Processes {
+		pidfd, err := process.open()
+		if err == nil {
+			pidfds = append(pidfds, pidfd)
+		}
+	}
+	killProcesses(pidfds)
+
+	removeInstanceFiles(instanceGroup, record.Name, record.Files)
+
+	// The firewall table was set up from scratch, the tap's traffic shaping goes with it
+	err := deleteTap(record.Name)
+	if err != nil {
+		instanceGroup.logger.Error("error deleting tap of reaped instance", "instance", record.Name, "error", err)
+	}
+
+	// Without an IPAM, e.g. for the destroy-all command, the allocations are dropped with the IPAM state
+	if i.ipam == nil {
+		return
+	}
+
+	// The address was kept for the instance while it looked like it was still running
+	i.lock.Lock()
+	err = i.ipam.Release(record.SubnetBase)
+	i.lock.Unlock()
+	if err != nil {
+		instanceGroup.logger.Error("error releasing address of reaped instance", "instance", record.Name, "error", err)
+	}
+}
+
+func removeInstanceFiles(instanceGroup *InstanceGroup, instanceName string, files []string) {
+	// Delete an instance's directory, records of earlier versions list its overlay, userdata, restore data, extra disks and sockets instead
+
+	for _, file := range files {
+		// Instance directories are moved out of the way first, so the next instance of the slot never finds half of one
+		info, err := os.Lstat(file)
+		if err == nil && info.IsDir() {
+			removingPath := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".removing")
+			if os.Rename(file, removingPath) == nil {
+				file = removingPath
+			}
+		}
+
+		err = os.RemoveAll(file)
+		if err != nil {
+			instanceGroup.logger.Error("error deleting instance file after instance has been stopped", "instance", instanceName, "file", file, "error", err)
+		}
+	}
+}
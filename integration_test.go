@@ -0,0 +1,47 @@
+//go:build integration
+
+package fleetingd_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/integration"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// Plugin config in JSON to run the suite against real VMs, e.g. a copy of the [runners.autoscaler.plugin_config] of a KVM host
+const integrationConfigEnv = "FLEETINGD_INTEGRATION_CONFIG"
+
+func TestIntegration(t *testing.T) {
+	// Run the fleeting provider contract against the mock hypervisor, or the VMs of the config in FLEETINGD_INTEGRATION_CONFIG
+
+	pluginConfig := map[string]any{
+		"hypervisor_backend": "mock",
+	}
+
+	configPath := os.Getenv(integrationConfigEnv)
+	if configPath != "" {
+		contents, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Fatalf("could not read %s: %v", integrationConfigEnv, err)
+		}
+
+		pluginConfig = map[string]any{}
+		err = json.Unmarshal(contents, &pluginConfig)
+		if err != nil {
+			t.Fatalf("could not parse %s: %v", integrationConfigEnv, err)
+		}
+	}
+
+	binaryName := integration.BuildPluginBinary(t, "./cmd/fleeting-plugin-fleetingd", "fleeting-plugin-fleetingd")
+
+	// The key and user name come from ConnectInfo, the runner's connector config only sets the OS
+	integration.TestProvisioning(t, binaryName, integration.Config{
+		PluginConfig:    pluginConfig,
+		ConnectorConfig: provider.ConnectorConfig{OS: "linux"},
+		MaxInstances:    3,
+		UseExternalAddr: false,
+	})
+}
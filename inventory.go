@@ -1,10 +1,10 @@
 package fleetingd
 
 import (
+	"cmp"
 	"context"
+	"crypto/cipher"
 	"crypto/ed25519"
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -15,49 +15,195 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
-	"text/template"
+	"sync/atomic"
 	"time"
 
 	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
+// How long destroying an instance waits for its cleanup
+const instanceRemovalTimeout = 10 * time.Second
+
+// Instances still not answering SSH after this long are recycled
+const defaultBootTimeoutMinutes = 15
+
+// Instances of one Increase booted at the same time, preparing their disks is mostly waiting for I/O
+const defaultParallelBoots = 4
+
 type InstanceInfo struct {
 	Name                      string
 	InstanceContextCancelFunc context.CancelFunc
 
+	// Lifecycle state reported to the runner
+	State provider.State
+	// Why the plugin gave up on the instance, reported once it is removed
+	FailureReason string
+
 	HostTapIP             string
 	InstanceTapIP         string
 	InstanceTapMacAddress string
 
+	// Empty if IPv6 is disabled
+	HostTapIP6     string
+	InstanceTapIP6 string
+
+	// Host address forwarded to the instance's SSH port, empty if external access is disabled
+	ExternalSSHAddress string
+
+	// Loopback address passt forwards to the instance's SSH port, empty if passt is not used
+	PasstSSHAddress string
+
+	// PCI address of the device passed through to this instance, if any
+	PassthroughDevice string
+
+	// PCI address of the SR-IOV virtual function passed through to this instance, if any
+	SRIOVDevice string
+
+	// Prebuild and snapshot template VMs are managed by the plugin itself
+	Internal bool
+
+	// Idle tracking, paused instances are resumed when they are requested again
+	Paused     bool
+	LastActive time.Time
+
+	// Instances are recycled once they are older than vm_max_lifetime_minutes
+	CreatedAt time.Time
+
+	// Configured and boot-time labels, e.g. the image the instance was booted from
+	Labels map[string]string
+
+	// Latest report of the guest's status agent, nil without vm_guest_agent or before it answered
+	GuestStatus *guestStatus
+
+	// Guest memory currently reclaimed through the balloon device
+	BalloonMegabytes uint64
+
+	// The private key is an ed25519.PrivateKey in locked memory, destroyed once the instance is gone
 	SSHPublicKey  ed25519.PublicKey
-	SSHPrivateKey ed25519.PrivateKey
+	SSHPrivateKey *lockedSecret
+
+	// The guest's pinned host key as in known_hosts, empty for instances adopted from a record of an older plugin
+	SSHHostPublicKey string
+
+	// Offset of the instance's subnet in vm_subnet
+	SubnetBase int
+
+	// Hypervisor and helper processes, persisted so a restarted plugin can find them again
+	Processes []processRecord
+
+	// Overlay, userdata, restore data, extra disks and sockets, removed once the instance is gone
+	Files []string
+
+	// Closed by the cleanup once the instance was removed from the inventory
+	Removed chan struct{}
+
+	// Span of the wait for the instance to answer over SSH, ended once it did or it is gone
+	readySpan trace.Span
+
+	// Moves the console into the instance's console log
+	console *consoleCapture
+
+	// Writes the lines about the instance to the plugin log and its own log
+	logger *instanceLogger
+
+	// Serializes the balloon, pause and resume calls to the hypervisor, they are made without holding the inventory lock
+	apiLock sync.Mutex
+}
+
+// State of an instance as reported to the runner, Reason tells why an instance which exited on its own is gone
+type instanceStatus struct {
+	State  provider.State
+	Reason string
 }
 
 type Inventory struct {
 	lock     *sync.RWMutex
 	prebuild *sync.Once
+	// Closed once the prebuild finished, successfully or not
+	prebuildDone chan struct{}
+	// Set once the first boot started the prebuild
+	prebuildStarted atomic.Bool
+
+	// Cancelled on shutdown so a running prebuild gets aborted and background tasks stop
+	shutdownContext    context.Context
+	shutdownCancelFunc context.CancelFunc
+	// Result of the prebuild, shared by all boots
+	prebuildErr error
+	// Snapshot instances are restored from, nil if they are booted regularly
+	bootSnapshot *bootSnapshot
 
 	// Stop accepting requests when this is true
 	shuttingDown bool
 
-	// IPAM "tickets" / subnet tracking
-	ipamSlots map[string]struct{}
+	// IPAM "tickets" / subnet tracking, set up at Init
+	ipam IPAM
+	// Passthrough devices currently attached to an instance
+	passthroughSlots map[string]struct{}
+	// SR-IOV virtual functions currently attached to an instance
+	sriovSlots map[string]struct{}
 	// Inventory
 	instances map[string]*InstanceInfo
+	// Instances removed since the last Update, reported once more so the runner learns they are gone
+	removedInstances map[string]instanceStatus
+	// Where the instances are persisted for adoption after a restart, set up at Init
+	statePath string
+	// Encrypts the SSH keys in the persisted records with state_encryption_key_file, nil leaves them out
+	stateCipher cipher.AEAD
+
+	// Names of the instances which are being prepared and not in the inventory yet
+	booting map[string]struct{}
+
+	// When the reconciler last compared the inventory with the host, nil until its first run
+	lastReconcile atomic.Pointer[time.Time]
+
+	// Counters and histograms exposed on metrics_listen_address
+	metrics *metrics
+
+	// Lifecycle events of the instances, they feed the metrics and the recent events listed on the debug socket
+	events       *eventBus
+	recentEvents *recentEvents
+
+	// Where the instances' lifecycle events are recorded, nil unless vm_audit_log is set
+	auditLog *auditLog
+
+	// Where the guests' status agents are reached, nil unless vm_guest_agent is set
+	guestAgentSocketPath func(instanceName string) string
 }
 
 func NewInventory() *Inventory {
+	shutdownContext, shutdownCancelFunc := context.WithCancel(context.Background())
+
+	metrics := newMetrics()
+	recentEvents := newRecentEvents(recentEventsSize)
+
+	events := &eventBus{}
+	events.subscribe(metrics.observeEvent)
+	events.subscribe(recentEvents.record)
+
 	return &Inventory{
 		lock:     &sync.RWMutex{},
 		prebuild: &sync.Once{},
 
-		ipamSlots: make(map[string]struct{}),
-		instances: make(map[string]*InstanceInfo),
+		prebuildDone: make(chan struct{}),
+
+		shutdownContext:    shutdownContext,
+		shutdownCancelFunc: shutdownCancelFunc,
+
+		passthroughSlots: make(map[string]struct{}),
+		sriovSlots:       make(map[string]struct{}),
+		instances:        make(map[string]*InstanceInfo),
+		removedInstances: make(map[string]instanceStatus),
+		booting:          make(map[string]struct{}),
+		metrics:          metrics,
+		events:           events,
+		recentEvents:     recentEvents,
 	}
 }
 
-func (i *Inventory) RunPrebuild(instanceGroup *InstanceGroup) error {
+func (i *Inventory) RunPrebuild(ctx context.Context, instanceGroup *InstanceGroup) error {
 	//
 	// Disk image preparation
 	//
@@ -71,156 +217,933 @@ func (i *Inventory) RunPrebuild(instanceGroup *InstanceGroup) error {
 	}
 
 	// Ensure disk images are present
-	err = instanceGroup.ensureImages()
+	err = instanceGroup.ensureImages(ctx)
+	if err != nil {
+		return newBootError(ErrImageUnavailable, err)
+	}
+
+	// Remove the images the current ones superseded
+	instanceGroup.collectGarbage()
+
+	// Do not start the prebuild VM if shutdown was requested in the meantime
+	if ctx.Err() != nil {
+		return fmt.Errorf("prebuild cancelled: %w", ctx.Err())
+	}
+
+	// Ignition only runs on the first boot, instances have to start from the pristine image
+	if instanceGroup.usesIgnition() {
+		instanceGroup.logger.Info("Skipping prebuild, the image is provisioned through Ignition.")
+
+		if instanceGroup.goldenImagePath != "" {
+			return nil
+		}
+		return instanceGroup.commitGoldenImage()
+	}
+
+	// Run prebuild unless the golden image of an earlier run is reused
+	if instanceGroup.goldenImagePath != "" {
+		instanceGroup.logger.Info("Skipping prebuild, the golden image is up-to-date.")
+	} else {
+		// The prebuild's changes end up in every instance, so it only runs on the image which was just converted
+		err = instanceGroup.verifyBaseImage(instanceGroup.VMImageVerifyFull)
+		if err != nil {
+			return err
+		}
+
+		instanceGroup.logger.Info("Triggering prebuild...")
+		err = instanceGroup.inventory.PrebuildInstance(ctx, instanceGroup)
+		if err != nil {
+			return err
+		}
+		instanceGroup.logger.Info("Prebuild finished.")
+
+		err = instanceGroup.commitGoldenImage()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Snapshot a booted VM so instances can be restored instead of booted
+	if instanceGroup.VMSnapshotBoot {
+		err = i.CreateBootSnapshot(ctx, instanceGroup)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *Inventory) BootInstance(ctx context.Context, instanceGroup *InstanceGroup) (err error) {
+	// Run prebuild once, later boots share its result, so only a shutdown aborts it
+
+	ctx, span := instanceGroup.tracer.Start(ctx, "boot")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	// A cancelled boot just stops waiting, the prebuild carries on for the next one
+	_, waitSpan := instanceGroup.tracer.Start(ctx, "wait for prebuild")
+	err = i.waitForPrebuild(ctx, instanceGroup)
 	if err != nil {
+		endSpan(waitSpan, err)
 		return err
 	}
+	endSpan(waitSpan, i.prebuildErr)
 
-	// Run prebuild
-	instanceGroup.logger.Info("Triggering prebuild...")
-	err = instanceGroup.inventory.PrebuildInstance(instanceGroup)
+	if i.prebuildErr != nil {
+		instanceGroup.logger.Error("Prebuild failed", "error", i.prebuildErr)
+		err = prebuildBootError(i.prebuildErr)
+		i.metrics.countBootFailure(err)
+		return err
+	}
+
+	// Overcommitting the host would slow down or kill the running instances as well
+	err = i.checkHostCapacity(instanceGroup)
 	if err != nil {
+		err = newBootError(ErrCapacityExhausted, err)
+		i.metrics.countBootFailure(err)
 		return err
 	}
-	instanceGroup.logger.Info("Prebuild finished.")
 
-	return nil
+	name, err := i.bootInstance(ctx, instanceGroup, false)
+	if name != "" {
+		span.SetAttributes(attribute.String("instance", name))
+	}
+	if err != nil {
+		i.metrics.countBootFailure(err)
+	}
+
+	return err
 }
 
-func (i *Inventory) BootInstance(instanceGroup *InstanceGroup) error {
-	var err error
+func (i *Inventory) waitForPrebuild(ctx context.Context, instanceGroup *InstanceGroup) error {
+	// Start the prebuild on the first call and wait until it is done, its result is in prebuildErr
 
 	i.prebuild.Do(func() {
-		err = i.RunPrebuild(instanceGroup)
+		i.prebuildStarted.Store(true)
+		go func() {
+			i.prebuildErr = i.RunPrebuild(i.shutdownContext, instanceGroup)
+			close(i.prebuildDone)
+
+			// The overlays are backed by the golden image, which only exists once the prebuild is done
+			if i.prebuildErr == nil && instanceGroup.VMDiskOverlayPoolSize > 0 {
+				instanceGroup.runOverlayPool(i.shutdownContext)
+			}
+		}()
 	})
-	if err != nil {
-		instanceGroup.logger.Error("Prebuild failed", err)
-		return err
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("boot cancelled while waiting for the prebuild: %w", ctx.Err())
+	case <-i.prebuildDone:
+		return nil
 	}
+}
+
+func (i *Inventory) bootInstance(ctx context.Context, instanceGroup *InstanceGroup, snapshotTemplate bool) (name string, err error) {
+	// Boot a job instance, or the VM the boot snapshot is taken from if snapshotTemplate is set
+
+	started := time.Now()
+
+	// Each phase gets a span below the boot's
+	phases := instanceGroup.startBootPhases(ctx)
+	defer func() {
+		// Errors which weren't classified where they happened get the kind of the phase they happened in
+		err = classifyBootPhaseError(phases.name, err)
+		phases.end(err)
+	}()
+	phases.start("allocate")
 
 	i.lock.RLock()
-	takenSlots := len(i.ipamSlots)
+	takenSlots := i.ipam.Count()
 	i.lock.RUnlock()
 
 	// Short-circuit function instead of walking address space
-	if takenSlots >= MaxIPAMSlots {
-		return errors.New("available VM address space exhausted")
+	if takenSlots >= instanceGroup.maxIPAMSlots() {
+		return "", newBootError(ErrCapacityExhausted, errors.New("available VM address space exhausted"))
 	}
 
 	i.lock.Lock()
 
 	if i.shuttingDown {
 		i.lock.Unlock()
-		return errors.New("system is shutting down")
+		return "", errShuttingDown
 	}
 
-	// Behold, the ultimate IPv4 subnet allocation algorithm
-	subnetBase := 0
-	stepSize := 4
+	// Template VMs are never handed out, so they get neither a passthrough device nor the fast network path
+	passthroughDevice, sriovDevice := "", ""
+	if !snapshotTemplate {
+		// A device is only ever given to one VM at a time
+		passthroughDevice, err = i.allocatePassthroughDevice(instanceGroup)
+		if err != nil {
+			i.lock.Unlock()
+			return "", newBootError(ErrCapacityExhausted, err)
+		}
 
-	// Walk subnets until a free slot is found and allocate it
-	for {
-		if subnetBase >= 255-stepSize {
+		sriovDevice, err = i.allocateSRIOVDevice(instanceGroup)
+		if err != nil {
+			if passthroughDevice != "" {
+				delete(i.passthroughSlots, passthroughDevice)
+			}
 			i.lock.Unlock()
-			return errors.New("available VM address space exhausted")
+			return "", newBootError(ErrCapacityExhausted, err)
 		}
+	}
 
-		if _, ok := i.ipamSlots[instanceGroup.MakeAddress(subnetBase)+"/30"]; !ok {
-			break
+	subnetBase, err := i.ipam.Allocate()
+	if err != nil {
+		if passthroughDevice != "" {
+			delete(i.passthroughSlots, passthroughDevice)
 		}
+		if sriovDevice != "" {
+			delete(i.sriovSlots, sriovDevice)
+		}
+		i.lock.Unlock()
+		return "", newBootError(ErrCapacityExhausted, err)
+	}
+	stepSize := instanceGroup.ipamStepSize()
+
+	// VMs restored from the boot snapshot keep the MAC address of the template VM
+	restoring := i.bootSnapshot != nil && !snapshotTemplate
+
+	instanceIndex := subnetBase / stepSize
+	instanceName := "fleetingd" + strconv.Itoa(instanceIndex)
 
-		subnetBase += 4
+	// The reconciler leaves the tap and rules of an instance alone while it is prepared
+	i.booting[instanceName] = struct{}{}
+
+	// Everything else is prepared without the lock, so instances boot in parallel
+	i.lock.Unlock()
+
+	// Everything logged about the instance also goes into its own log
+	logger := instanceGroup.newInstanceLogger(instanceName, string(provider.StateCreating), true)
+
+	i.publishEvent(instanceName, eventSlotAllocated, started, nil)
+
+	// A panic marker of the slot's previous instance would be taken for one of this instance
+	markerErr := os.Remove(instanceGroup.getPanicPath(instanceName))
+	if markerErr != nil && !os.IsNotExist(markerErr) {
+		logger.Error("could not remove panic marker of the slot's previous instance", "error", markerErr)
 	}
 
-	i.ipamSlots[instanceGroup.MakeAddress(subnetBase)+"/30"] = struct{}{}
+	apiSocketPath := instanceGroup.getAPISocketPath(instanceName)
+	vsockSocketPath := instanceGroup.getVsockSocketPath(instanceName)
+
+	var overlayPath, userdataPath, restorePath, kernelFilePath string
+	var extraDiskPaths []string
+	var slotCacheDiskPath string
+	var vhostUserSocketPath, vhostUserNetSocketPath string
+
+	// Served over HTTP instead of the config drive with vm_seed_mode http
+	var seedFiles []renderedFile
+	var seedKernelCmdline string
+
+	var instanceCancelFunc context.CancelFunc
+	var sshPrivateKey *lockedSecret
+
+	// Helper processes serving the instance's disk and network, they stop with the instance context
+	var vhostUserBlockCommand, vhostUserNetCommand, passtCommand *exec.Cmd
+
+	// Set once the instance is in the inventory, from then on its cleanup undoes the boot
+	inserted := false
+
+	defer func() {
+		// Undo the preparation and hand the slot and devices back if any step of the boot failed
+
+		if err == nil {
+			return
+		}
+
+		logger.Error("instance failed to boot", "error", err)
+		i.publishEvent(instanceName, eventBootFailed, started, err)
+
+		if inserted {
+			instanceCancelFunc()
+			return
+		}
+
+		if instanceCancelFunc != nil {
+			instanceCancelFunc()
+		}
 
-	// Generate SSH key
+		// Cancelling the context kills the helpers, they are waited for so they don't stay around as zombies
+		for _, command := range []*exec.Cmd{vhostUserBlockCommand, vhostUserNetCommand, passtCommand} {
+			if command != nil {
+				command.Wait()
+			}
+		}
+
+		sshPrivateKey.Destroy()
+
+		removeInstanceFiles(instanceGroup, instanceName, []string{instanceGroup.getInstanceDir(instanceName)})
+
+		confinementErr := instanceGroup.releaseConfinement(instanceName)
+		if confinementErr != nil {
+			logger.Error("error unloading AppArmor profile of instance which failed to boot", "error", confinementErr)
+		}
+
+		tapErr := deleteTap(instanceName)
+		if tapErr != nil {
+			logger.Error("error deleting tap of instance which failed to boot", "error", tapErr)
+		}
+
+		i.lock.Lock()
+		delete(i.booting, instanceName)
+		releaseErr := i.releaseSlot(subnetBase, passthroughDevice, sriovDevice)
+		i.lock.Unlock()
+		if releaseErr != nil {
+			logger.Error("error releasing address of instance which failed to boot", "error", releaseErr)
+		}
+
+		logger.close()
+	}()
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("instance", instanceName))
+
+	// Everything the instance leaves behind goes into its own directory
+	err = instanceGroup.createInstanceDir(instanceName)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate SSH key, the private key is only kept in locked memory
 	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", err
+	}
+
+	sshPrivateKey, err = newLockedSecret(privKey)
+	if err != nil {
+		return "", err
+	}
+
+	// The guest gets its host key from the plugin, so heartbeats can tell it from anything else answering on its address
+	hostKey, err := generateSSHHostKey()
+	if err != nil {
+		return "", err
+	}
+
+	// Generate the mac address
+	instanceMac, err := instanceGroup.makeMACAddress(instanceIndex)
+	if err != nil {
+		return "", err
+	}
+
+	// The virtual function gets its own address, the guest tells its interfaces apart by it
+	sriovMac := ""
+	if sriovDevice != "" {
+		sriovMac, err = instanceGroup.makeSRIOVMACAddress(instanceIndex)
+		if err != nil {
+			return "", err
+		}
+
+		err = instanceGroup.configureSRIOVDevice(sriovDevice, sriovMac)
+		if err != nil {
+			return "", newBootError(ErrNetworkSetup, err)
+		}
+	}
+
+	hostTapIP, instanceTapIP := instanceGroup.makeTapAddresses(subnetBase)
+
+	hostTapIP6, instanceTapIP6 := instanceGroup.MakeAddresses6(subnetBase / stepSize)
+
+	// Template VMs are never handed out, so they don't get a forwarded port
+	externalSSHAddress := ""
+	if instanceGroup.externalAccessEnabled() && !snapshotTemplate {
+		externalSSHAddress = net.JoinHostPort(instanceGroup.ExternalAddress, strconv.Itoa(instanceGroup.getExternalSSHPort(instanceIndex)))
+	}
+
+	// Guests behind passt are only reachable through the port it forwards
+	passtSSHAddress := ""
+	if instanceGroup.usesPasst() {
+		passtSSHAddress = instanceGroup.getPasstSSHAddress(instanceIndex)
+	}
+
+	if restoring {
+		instanceMac = i.bootSnapshot.MACAddress
+	}
+
+	if restoring {
+		phases.start("disk")
+
+		// Create copy of the snapshotted disk
+		overlayPath, err = instanceGroup.copyImage(ctx, i.bootSnapshot.DiskPath, instanceName)
+		if err != nil {
+			return "", err
+		}
+
+		restorePath, err = instanceGroup.prepareSnapshotRestore(i.bootSnapshot, instanceName, overlayPath, hostTapIP)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		// Generate userdata image, the template VM additionally runs the agent used for re-identifying restored VMs
+		userDataTemplate := "user-data.tpl"
+		if snapshotTemplate {
+			userDataTemplate = "user-data-template.tpl"
+		}
+
+		phases.start("userdata")
+		if instanceGroup.usesHTTPSeed() {
+			seedFiles, err = instanceGroup.renderUserdata(userDataTemplate,
+				instanceName,
+				instanceMac,
+				instanceTapIP,
+				hostTapIP,
+				instanceGroup.subnetNetmask(),
+				instanceTapIP6,
+				hostTapIP6,
+				sriovMac,
+				pubKey,
+				hostKey)
+			if err != nil {
+				return "", err
+			}
+
+			seedKernelCmdline, err = seedCmdline(seedFiles, hostTapIP)
+		} else {
+			userdataPath, err = instanceGroup.createUserdata(userDataTemplate,
+				instanceName,
+				instanceMac,
+				instanceTapIP,
+				hostTapIP,
+				instanceGroup.subnetNetmask(),
+				instanceTapIP6,
+				hostTapIP6,
+				sriovMac,
+				pubKey,
+				hostKey)
+		}
+		if err != nil {
+			return "", err
+		}
+		i.publishEvent(instanceName, eventUserdataWritten, started, nil)
+
+		phases.start("disk")
+
+		// Every overlay depends on the base image, a tampered or corrupted one must not be booted
+		err = instanceGroup.verifyBaseImage(false)
+		if err != nil {
+			return "", err
+		}
+
+		// Create copy of qcow image
+		overlayPath, err = instanceGroup.copyImage(ctx, instanceGroup.getBaseImagePath(), instanceName)
+		if err != nil {
+			return "", err
+		}
+
+		kernelFilePath, err = instanceGroup.getBootKernelPath()
+		if err != nil {
+			return "", err
+		}
+
+		// Scratch disks start out empty for every instance
+		extraDiskPaths, err = instanceGroup.createExtraDisks(instanceName)
+		if err != nil {
+			return "", err
+		}
+
+		// The slot's cache disk is only ever attached to the one instance in the slot
+		if instanceGroup.slotCacheDisk != nil {
+			slotCacheDiskPath, err = instanceGroup.ensureSlotCacheDisk(instanceIndex)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// Everything the job VM's processes open was created by the plugin
+	err = instanceGroup.handToHypervisorUser(instanceName, append(extraDiskPaths, slotCacheDiskPath)...)
+	if err != nil {
+		return "", newBootError(ErrHypervisorFailure, err)
+	}
+
+	err = instanceGroup.confineInstance(instanceName, append(extraDiskPaths, slotCacheDiskPath)...)
+	if err != nil {
+		return "", newBootError(ErrHypervisorFailure, err)
+	}
+
+	phases.start("network")
+
+	// Create the tap device up front, passt doesn't use one
+	if !instanceGroup.usesPasst() {
+		err = instanceGroup.createTap(instanceName, hostTapIP)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Start instance
+	instanceContext, cancelFunc := context.WithCancel(context.Background())
+	instanceCancelFunc = cancelFunc
+
+	// Answer the guest's DNS queries on its gateway address
+	err = instanceGroup.startDNSForwarder(instanceContext, hostTapIP)
+	if err != nil {
+		return "", err
+	}
+
+	// cloud-init fetches the seed from the gateway address as well
+	if seedFiles != nil {
+		err = instanceGroup.startSeedServer(instanceContext, seedFiles, hostTapIP, instanceTapIP)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	phases.start("start hypervisor")
+
+	// Serve the root disk from a separate vhost-user-blk process if configured
+	if instanceGroup.VMDiskVhostUser && !restoring {
+		vhostUserSocketPath = instanceGroup.getVhostUserBlockSocketPath(instanceName)
+
+		vhostUserBlockCommand, err = instanceGroup.startVhostUserBlock(instanceContext, instanceName, overlayPath, vhostUserSocketPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Move the network data path into a separate vhost-user-net process if configured
+	if instanceGroup.VMNetVhostUser && !restoring {
+		vhostUserNetSocketPath = instanceGroup.getVhostUserNetSocketPath(instanceName)
+
+		vhostUserNetCommand, err = instanceGroup.startVhostUserNet(instanceContext, instanceName, hostTapIP, vhostUserNetSocketPath)
+		if err != nil {
+			return "", newBootError(ErrNetworkSetup, err)
+		}
+	}
+
+	// passt replaces the tap device with user-mode networking
+	if instanceGroup.usesPasst() {
+		vhostUserNetSocketPath = instanceGroup.getVhostUserNetSocketPath(instanceName)
+
+		passtCommand, err = instanceGroup.startPasst(instanceContext, instanceName, instanceIndex, instanceTapIP, hostTapIP, vhostUserNetSocketPath, true)
+		if err != nil {
+			return "", newBootError(ErrNetworkSetup, err)
+		}
+	}
+
+	var hypervisorCommand *exec.Cmd
+
+	if restoring {
+		// The VM configuration is part of the snapshot
+		hypervisorCommand = instanceGroup.hypervisorCommand(instanceContext, instanceName, true,
+			"--api-socket",
+			fmt.Sprintf("path=%s", apiSocketPath),
+			"--restore",
+			fmt.Sprintf("source_url=file://%s", restorePath),
+		)
+
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.hypervisorSandboxArgs(true)...)
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.eventMonitorArgs(instanceName)...)
+	} else {
+		hypervisorCommand = instanceGroup.hypervisorCommand(instanceContext, instanceName, true,
+			"--cpus",
+			fmt.Sprintf("boot=%d", instanceGroup.VMNumCPUCores),
+			"--memory",
+			instanceGroup.memoryArg(),
+			"--net",
+			instanceGroup.netArg(instanceName, instanceMac, vhostUserNetSocketPath),
+			"--api-socket",
+			fmt.Sprintf("path=%s", apiSocketPath),
+		)
+
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.rootDiskArgs(overlayPath, vhostUserSocketPath)...)
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.hypervisorSandboxArgs(false)...)
+
+		// Without a config drive the kernel command line tells cloud-init where its seed is
+		if userdataPath != "" {
+			hypervisorCommand.Args = append(hypervisorCommand.Args, "--disk",
+				fmt.Sprintf("path=%s,readonly=on", userdataPath))
+		}
+
+		// Kernel, firmware and platform depend on whether this is a confidential VM
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.platformHypervisorArgs(kernelFilePath, instanceGroup.VMRootPmem, seedKernelCmdline)...)
+
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.extraDiskArgs(extraDiskPaths)...)
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.slotCacheDiskArgs(slotCacheDiskPath)...)
+
+		// The console is always captured, the plugin moves it into the rotated console log
+		hypervisorCommand.Args = append(hypervisorCommand.Args, "--console",
+			fmt.Sprintf("file=%s", instanceGroup.getConsoleRawPath(instanceName)))
+
+		// The serial port can be attached to with the console command
+		hypervisorCommand.Args = append(hypervisorCommand.Args, "--serial",
+			fmt.Sprintf("socket=%s", instanceGroup.getSerialSocketPath(instanceName)))
+
+		// A panicking guest kernel tells the hypervisor through the pvpanic device, which reports it as an event
+		hypervisorCommand.Args = append(hypervisorCommand.Args, "--pvpanic")
+		hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.eventMonitorArgs(instanceName)...)
+
+		if snapshotTemplate || instanceGroup.VMGuestAgent {
+			// The host talks to the template's agent and the status agent of vm_guest_agent through vsock
+			hypervisorCommand.Args = append(hypervisorCommand.Args, "--vsock",
+				fmt.Sprintf("cid=3,socket=%s", vsockSocketPath))
+		}
+
+		if passthroughDevice != "" {
+			// Pass the reserved PCI device through to the VM
+			hypervisorCommand.Args = append(hypervisorCommand.Args, "--device",
+				fmt.Sprintf("path=%s/", filepath.Join(pciDevicesPath, passthroughDevice)))
+		}
+
+		if sriovDevice != "" {
+			// Pass the reserved virtual function through to the VM
+			hypervisorCommand.Args = append(hypervisorCommand.Args, "--device",
+				fmt.Sprintf("path=%s/", filepath.Join(pciDevicesPath, sriovDevice)))
+		}
+	}
+
+	// Give up before the VM is started if the boot was cancelled while the instance was prepared
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("boot cancelled: %w", ctx.Err())
+	}
+
+	i.lock.Lock()
+
+	// A shutdown started while the instance was prepared would not destroy it anymore
+	if i.shuttingDown {
+		i.lock.Unlock()
+		return "", errShuttingDown
+	}
+
+	// Kept for the reason of a crash, cloud-hypervisor explains why it exits on stderr
+	hypervisorStderr := &outputTail{size: hypervisorStderrSize}
+	hypervisorCommand.Stderr = hypervisorStderr
+
+	labels := instanceGroup.instanceLabels()
+
+	logger.Info("starting instance VM", "labels", labels)
+	err = hypervisorCommand.Start()
+	if err != nil {
+		i.lock.Unlock()
+		return "", fmt.Errorf("could not start cloud-hypervisor: %w", err)
+	}
+
+	// Before the guest gets far, a failure kills and waits for the hypervisor again, the rollback reaps its helpers
+	err = instanceGroup.isolateSMT(hypervisorCommand)
+	if err != nil {
+		i.lock.Unlock()
+		return "", err
+	}
+	i.publishEvent(instanceName, eventProcessStarted, started, nil)
+
+	// The hypervisor comes first, a restarted plugin only adopts the instance while it is running
+	var processes []processRecord
+	for _, command := range []*exec.Cmd{hypervisorCommand, vhostUserBlockCommand, vhostUserNetCommand, passtCommand} {
+		if command != nil && command.Process != nil {
+			processes = append(processes, newProcessRecord(command.Process.Pid))
+		}
+	}
+
+	// Helpers don't survive the hypervisor they served and restored VMs can't go back to their snapshot
+	restartable := len(processes) == 1 && !restoring && !snapshotTemplate
+
+	instance := &InstanceInfo{
+		Name:                      instanceName,
+		InstanceContextCancelFunc: instanceCancelFunc,
+		State:                     provider.StateCreating,
+
+		HostTapIP:     hostTapIP,
+		InstanceTapIP: instanceTapIP,
+
+		HostTapIP6:     hostTapIP6,
+		InstanceTapIP6: instanceTapIP6,
+
+		InstanceTapMacAddress: instanceMac,
+		ExternalSSHAddress:    externalSSHAddress,
+		PasstSSHAddress:       passtSSHAddress,
+
+		PassthroughDevice: passthroughDevice,
+		SRIOVDevice:       sriovDevice,
+
+		Internal:   snapshotTemplate,
+		LastActive: time.Now(),
+		CreatedAt:  started,
+		Labels:     labels,
+
+		SSHPublicKey:     pubKey,
+		SSHPrivateKey:    sshPrivateKey,
+		SSHHostPublicKey: hostKey.PublicKey,
+
+		SubnetBase: subnetBase,
+		Processes:  processes,
+		Files:      []string{instanceGroup.getInstanceDir(instanceName)},
+
+		Removed: make(chan struct{}),
+
+		console: instanceGroup.startConsoleCapture(instanceContext, instanceName, true),
+		logger:  logger,
+	}
+
+	go func() {
+		//
+		// VM cleanup - cancel VM context to trigger stopping the VM process and then calling this function
+		//
+
+		// Wait for VM to terminate (when context gets cancelled), restarting it after crashes if configured
+		exitReason := i.superviseHypervisor(instanceGroup, instance, instanceContext, hypervisorCommand, hypervisorStderr, restartable)
+
+		logger.Info("instance process finished. cleaning up.")
+
+		i.cleanupInstance(instanceGroup, instance, exitReason)
+	}()
+
+	// Update inventory, a new instance in the slot supersedes the removed one
+	i.instances[instanceName] = instance
+	delete(i.removedInstances, instanceName)
+	delete(i.booting, instanceName)
+	inserted = true
+
+	i.auditLog.record(auditEventCreate, instance, "")
+
+	// The template VM is waited for by the snapshot itself
+	if !snapshotTemplate {
+		go i.enforceBootDeadline(instanceGroup, instance)
+		go i.watchGuestPanics(instanceGroup, instance, instanceContext)
+
+		// Ends once the instance could be logged in to, after the boot returned
+		_, instance.readySpan = instanceGroup.tracer.Start(ctx, "wait for ssh")
+	}
+
+	// A restarted plugin finds the instance here
+	err = i.saveInstanceState()
+	if err != nil {
+		logger.Error("could not save instance state", "error", err)
+	}
+
+	// Release lock for nftables
+	i.lock.Unlock()
+
+	phases.start("firewall")
+
+	err = instanceGroup.attachTapToBridge(instanceName)
+	if err != nil {
+		return instanceName, err
+	}
+
+	err = instanceGroup.applyTrafficShaping(instanceName)
+	if err != nil {
+		return instanceName, err
+	}
+
+	err = configureTapIPv6(instanceName, hostTapIP6, instanceGroup.VMIPv6InstancePrefixLength)
+	if err != nil {
+		return instanceName, err
+	}
+
+	if !instanceGroup.usesPasst() {
+		i.publishEvent(instanceName, eventTapUp, started, nil)
+	}
+
+	// Add the instance's firewall rules
+	err = i.AddInstanceFirewall(instanceGroup, instanceName)
+	if err != nil {
+		return instanceName, err
+	}
+	i.publishEvent(instanceName, eventFirewallApplied, started, nil)
+
+	if restoring {
+		phases.start("restore")
+
+		// Restored VMs start out paused and with the template's identity
+		sshKey, err := ssh.NewPublicKey(pubKey)
+		if err != nil {
+			return instanceName, err
+		}
+
+		err = instanceGroup.finishSnapshotRestore(ctx, i.bootSnapshot, instanceName, instanceTapIP, hostTapIP, instanceGroup.subnetNetmask(), instanceTapIP6, hostTapIP6, sshKey, hostKey)
+		if err != nil {
+			return instanceName, err
+		}
+	}
+
+	return instanceName, nil
+}
+
+func (i *Inventory) PrebuildInstance(ctx context.Context, instanceGroup *InstanceGroup) error {
+	// Boot the prebuild VM and wait for it to power off, it is killed if it takes longer than vm_prebuild_timeout_minutes
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(instanceGroup.VMPrebuildTimeoutMinutes)*time.Minute)
+	defer cancel()
+
+	i.lock.RLock()
+	takenSlots := i.ipam.Count()
+	i.lock.RUnlock()
+
+	// Short-circuit function instead of walking adddress space
+	if takenSlots >= instanceGroup.maxIPAMSlots() {
+		return errors.New("available VM address space exhausted")
+	}
+
+	i.lock.Lock()
+
+	if i.shuttingDown {
+		i.lock.Unlock()
+		return errors.New("system is shutting down")
+	}
+
+	subnetBase, err := i.ipam.Allocate()
 	if err != nil {
 		i.lock.Unlock()
 		return err
 	}
+	stepSize := instanceGroup.ipamStepSize()
 
 	instanceIndex := subnetBase / stepSize
 	instanceName := "fleetingd" + strconv.Itoa(instanceIndex)
 
-	// Generate random mac address
-	randomBytes := make([]byte, 4)
-	_, err = rand.Read(randomBytes)
+	// Everything logged about the prebuild VM also goes into its own log
+	logger := instanceGroup.newInstanceLogger(instanceName, instancePhasePrebuild, true)
+
+	// Stops the DNS forwarder and passt, set once they were started
+	var instanceCancelFunc context.CancelFunc
+
+	// Set once the prebuild VM is in the inventory, from then on its cleanup goroutine undoes the boot
+	registered := false
+
+	defer func() {
+		// Remove what was prepared and hand the slot back if the prebuild VM could not be started
+
+		if registered {
+			return
+		}
+
+		if instanceCancelFunc != nil {
+			instanceCancelFunc()
+		}
+
+		removeInstanceFiles(instanceGroup, instanceName, []string{instanceGroup.getInstanceDir(instanceName)})
+
+		tapErr := deleteTap(instanceName)
+		if tapErr != nil {
+			logger.Error("error deleting tap of prebuild VM which failed to start", "error", tapErr)
+		}
+
+		i.lock.Lock()
+		releaseErr := i.ipam.Release(subnetBase)
+		i.lock.Unlock()
+		if releaseErr != nil {
+			logger.Error("error releasing address of prebuild VM which failed to start", "error", releaseErr)
+		}
+
+		logger.close()
+	}()
+
+	// Generate the mac address
+	instanceMac, err := instanceGroup.makeMACAddress(instanceIndex)
 	if err != nil {
 		i.lock.Unlock()
 		return err
 	}
-	randomPart := hex.EncodeToString(randomBytes)
 
-	// slicing like this is okay since it is an ASCII string
-	instanceMac := fmt.Sprintf(
-		"de:51:%s:%s:%s:%s",
-		randomPart[0:2],
-		randomPart[2:4],
-		randomPart[4:6],
-		randomPart[6:])
+	hostTapIP, instanceTapIP := instanceGroup.makeTapAddresses(subnetBase)
+
+	hostTapIP6, instanceTapIP6 := instanceGroup.MakeAddresses6(subnetBase / stepSize)
+
+	started := time.Now()
+	i.publishEvent(instanceName, eventPrebuildStarted, started, nil)
 
-	hostTapIP := instanceGroup.MakeAddress(subnetBase + 1)
-	instanceTapIP := instanceGroup.MakeAddress(subnetBase + 2)
+	// The prebuild VM's userdata and sockets go into its own directory
+	err = instanceGroup.createInstanceDir(instanceName)
+	if err != nil {
+		i.lock.Unlock()
+		return err
+	}
 
 	// Generate userdata image
-	userdataPath, err := instanceGroup.createUserdata(instanceName,
+	userdataPath, err := instanceGroup.createUserdataPrebuild(instanceName,
 		instanceMac,
 		instanceTapIP,
 		hostTapIP,
-		"/30",
-		pubKey)
+		instanceGroup.subnetNetmask(),
+		instanceTapIP6,
+		hostTapIP6)
 	if err != nil {
 		i.lock.Unlock()
 		return err
 	}
 
-	// Create copy of qcow image
-	overlayPath, err := instanceGroup.copyImage(instanceName)
+	decompressedPath := instanceGroup.getBaseImagePath()
+
+	kernelFilePath, err := instanceGroup.getBootKernelPath()
 	if err != nil {
 		i.lock.Unlock()
 		return err
 	}
 
-	kernelFilePath, err := instanceGroup.getKernelFilePath()
+	// Create the tap device up front, passt doesn't use one
+	if !instanceGroup.usesPasst() {
+		err = instanceGroup.createTap(instanceName, hostTapIP)
+		if err != nil {
+			i.lock.Unlock()
+			return err
+		}
+	}
+
+	// Start instance, cancelling the prebuild context stops the VM
+	instanceContext, cancelFunc := context.WithCancel(ctx)
+	instanceCancelFunc = cancelFunc
+
+	// Answer the guest's DNS queries on its gateway address
+	err = instanceGroup.startDNSForwarder(instanceContext, hostTapIP)
 	if err != nil {
 		i.lock.Unlock()
 		return err
 	}
 
-	// Start instance
-	instanceContext, instanceCancelFunc := context.WithCancel(context.Background())
+	// passt replaces the tap device with user-mode networking
+	passtSocketPath := ""
+	if instanceGroup.usesPasst() {
+		passtSocketPath = instanceGroup.getVhostUserNetSocketPath(instanceName)
+
+		_, err = instanceGroup.startPasst(instanceContext, instanceName, instanceIndex, instanceTapIP, hostTapIP, passtSocketPath, false)
+		if err != nil {
+			i.lock.Unlock()
+			return err
+		}
+	}
 
-	hypervisorCommand := exec.CommandContext(instanceContext, "cloud-hypervisor",
-		"--kernel",
-		kernelFilePath,
+	// The prebuild VM writes the base image, which every job VM boots from, so it keeps the plugin's privileges
+	hypervisorCommand := instanceGroup.hypervisorCommand(instanceContext, instanceName, false,
 		"--disk",
-		fmt.Sprintf("path=%s", overlayPath),
+		instanceGroup.rootDiskArg(decompressedPath, ""),
 		fmt.Sprintf("path=%s,readonly=on", userdataPath),
 		"--cpus",
 		fmt.Sprintf("boot=%d", instanceGroup.VMNumCPUCores),
 		"--memory",
-		fmt.Sprintf("size=%dM", instanceGroup.VMMemoryMegabytes),
+		instanceGroup.memoryArg(),
 		"--net",
-		fmt.Sprintf("tap=%s,mac=%s,ip=%s,mask=255.255.255.252", instanceName, instanceMac, hostTapIP),
-		"--balloon",
-		"size=0,free_page_reporting=on",
-		"--cmdline",
-		"console=hvc0 root=/dev/vda1 rw",
-		"--landlock",
-	)
-
-	if instanceGroup.VMEnableVirtioConsole {
-		// Enable console
-		consolePath := filepath.Join(instanceGroup.VMDiskDir, vmWorkdir, fmt.Sprintf("%s_console", instanceName))
+		instanceGroup.netArg(instanceName, instanceMac, passtSocketPath))
+
+	hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.hypervisorSandboxArgs(false)...)
 
-		hypervisorCommand.Args = append(hypervisorCommand.Args, "--console",
-			fmt.Sprintf("file=%s", consolePath))
+	// Kernel, firmware and platform depend on whether this is a confidential VM
+	hypervisorCommand.Args = append(hypervisorCommand.Args, instanceGroup.platformHypervisorArgs(kernelFilePath, false, "")...)
+
+	// The prebuild's console is always kept, it is streamed into the log and shown when the prebuild hangs
+	consolePath := instanceGroup.getPrebuildConsolePath(instanceName)
+	hypervisorCommand.Args = append(hypervisorCommand.Args, "--console", fmt.Sprintf("file=%s", consolePath))
+
+	// The guest reports whether the prebuild commands succeeded on the serial port
+	serialPath := instanceGroup.getPrebuildSerialPath(instanceName)
+	hypervisorCommand.Args = append(hypervisorCommand.Args, "--serial", fmt.Sprintf("file=%s", serialPath))
+
+	logger.Info("starting instance VM")
+	err = hypervisorCommand.Start()
+	if err != nil {
+		i.lock.Unlock()
+		return fmt.Errorf("could not start cloud-hypervisor: %w", err)
 	}
 
-	instanceGroup.logger.Info("starting instance VM", "instance", instanceName)
-	hypervisorCommand.Start()
+	go instanceGroup.streamPrebuildOutput(instanceContext, consolePath, "console")
+	go instanceGroup.streamPrebuildOutput(instanceContext, serialPath, "serial")
+
+	// Buffered so the cleanup goroutine never blocks if we bail out early
+	prebuildDone := make(chan struct{}, 1)
+	removed := make(chan struct{})
 
 	go func() {
 		//
@@ -230,30 +1153,52 @@ func (i *Inventory) BootInstance(instanceGroup *InstanceGroup) error {
 		// Wait for VM to terminate (when context gets cancelled)
 		hypervisorCommand.Wait()
 
-		instanceGroup.logger.Info("instance process finished. cleaning up.", "instance", instanceName)
+		logger.Info("instance process finished. cleaning up.")
+
+		// Delete cloudinit data and the passt socket
+		removeInstanceFiles(instanceGroup, instanceName, []string{instanceGroup.getInstanceDir(instanceName)})
 
-		// Delete overlay and cloudinit data
-		err = os.Remove(overlayPath)
+		// The VM may have exited on its own, stop the DNS forwarder bound to the tap's address as well
+		instanceCancelFunc()
+
+		err := instanceGroup.stopInstanceSlice(instanceName)
 		if err != nil {
-			instanceGroup.logger.Error("error deleting overlay after instance has been stopped: %w", err)
+			logger.Error("error stopping slice after instance has been stopped", "error", err)
 		}
 
-		err = os.Remove(userdataPath)
+		// Delete the tap before the slot is released, the next instance in it uses the same name
+		err = deleteTap(instanceName)
 		if err != nil {
-			instanceGroup.logger.Error("error deleting userdata after instance has been stopped: %w", err)
+			logger.Error("error deleting tap after instance has been stopped", "error", err)
 		}
 
 		i.lock.Lock()
 
 		// Clear instance's IPAM lock
-		delete(i.ipamSlots, instanceGroup.MakeAddress(subnetBase)+"/30")
+		err = i.ipam.Release(subnetBase)
+		if err != nil {
+			logger.Error("error releasing address after instance has been stopped", "error", err)
+		}
 
-		// Clear instance from inventory
+		// Clear instance from inventory and wake up whoever is destroying it
 		delete(i.instances, instanceName)
+		close(removed)
 
 		i.lock.Unlock()
 
-		i.ApplyNftables(instanceGroup)
+		err = i.RemoveInstanceFirewall(instanceGroup, instanceName, instanceMac, "")
+		if err != nil {
+			logger.Error("error removing firewall rules after instance has been stopped", "error", err)
+		}
+
+		err = instanceGroup.removeTrafficShaping(instanceName)
+		if err != nil {
+			logger.Error("error removing traffic shaping after instance has been stopped", "error", err)
+		}
+
+		logger.close()
+
+		prebuildDone <- struct{}{}
 	}()
 
 	// Update inventory
@@ -264,274 +1209,277 @@ func (i *Inventory) BootInstance(instanceGroup *InstanceGroup) error {
 		HostTapIP:     hostTapIP,
 		InstanceTapIP: instanceTapIP,
 
+		HostTapIP6:     hostTapIP6,
+		InstanceTapIP6: instanceTapIP6,
+
 		InstanceTapMacAddress: instanceMac,
 
-		SSHPublicKey:  pubKey,
-		SSHPrivateKey: privKey,
+		Internal:   true,
+		LastActive: time.Now(),
+		CreatedAt:  time.Now(),
+
+		SSHPublicKey:  nil,
+		SSHPrivateKey: nil,
+
+		Removed: removed,
+
+		logger: logger,
 	}
+	registered = true
 
 	// Release lock for nftables
 	i.lock.Unlock()
 
-	// Wait for tap device to become available
-	checkCounter := 0
-	tapReady := false
-
-	for {
-		interfaces, err := net.Interfaces()
-		if err != nil {
-			return err
-		}
-		for _, device := range interfaces {
-			if device.Name == instanceName {
-				tapReady = true
-				break
-			}
-		}
+	err = instanceGroup.attachTapToBridge(instanceName)
+	if err != nil {
+		instanceCancelFunc()
+		return err
+	}
 
-		if tapReady || checkCounter > 100 {
-			break
-		}
+	err = instanceGroup.applyTrafficShaping(instanceName)
+	if err != nil {
+		instanceCancelFunc()
+		return err
+	}
 
-		time.Sleep(100 * time.Millisecond)
-		checkCounter++
+	err = configureTapIPv6(instanceName, hostTapIP6, instanceGroup.VMIPv6InstancePrefixLength)
+	if err != nil {
+		instanceCancelFunc()
+		return err
 	}
 
-	// Render and apply nftables rules (wait for tap interface)
-	return i.ApplyNftables(instanceGroup)
-}
+	// Add the instance's firewall rules
+	err = i.AddInstanceFirewall(instanceGroup, instanceName)
+	if err != nil {
+		instanceCancelFunc()
+		return err
+	}
 
-func (i *Inventory) PrebuildInstance(instanceGroup *InstanceGroup) error {
-	i.lock.RLock()
-	takenSlots := len(i.ipamSlots)
-	i.lock.RUnlock()
+	// Wait for prebuild to finish / cleanup
+	logger.Info("waiting for prebuild to finish.")
+	<-prebuildDone
 
-	// Short-circuit function instead of walking adddress space
-	if takenSlots >= MaxIPAMSlots {
-		return errors.New("available VM address space exhausted")
+	// The VM is killed once the prebuild deadline passed
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("prebuild did not finish within %d minutes, last console output:\n%s", instanceGroup.VMPrebuildTimeoutMinutes, readLastLines(consolePath, prebuildConsoleLines))
 	}
 
-	i.lock.Lock()
+	// The VM also exits when it was killed because of a shutdown
+	if ctx.Err() != nil {
+		return fmt.Errorf("prebuild cancelled: %w", ctx.Err())
+	}
 
-	if i.shuttingDown {
-		i.lock.Unlock()
-		return errors.New("system is shutting down")
+	// A powered off VM doesn't mean the prebuild commands succeeded
+	err = checkPrebuildStatus(serialPath, consolePath)
+	if err != nil {
+		return err
 	}
 
-	// Behold, the ultimate IPv4 subnet allocation algorithm
-	subnetBase := 0
-	stepSize := 4
+	logger.Info("prebuild finished.", "duration", logDuration(started))
+	i.publishEvent(instanceName, eventPrebuildFinished, started, nil)
 
-	// Walk subnets until a free slot is found and allocate it
-	for {
-		if subnetBase >= 255-stepSize {
-			i.lock.Unlock()
-			return errors.New("available VM address space exhausted")
-		}
+	return nil
+}
 
-		if _, ok := i.ipamSlots[instanceGroup.MakeAddress(subnetBase)+"/30"]; !ok {
-			break
-		}
+func (i *Inventory) cleanupInstance(instanceGroup *InstanceGroup, instance *InstanceInfo, exitReason string) {
+	// Remove everything an instance used once its hypervisor exited and release its slot, exitReason is set if it exited on its own
 
-		subnetBase += 4
-	}
+	instance.logger.setState(provider.StateDeleting)
 
-	i.ipamSlots[instanceGroup.MakeAddress(subnetBase)+"/30"] = struct{}{}
+	// The console's end is still in the instance directory
+	instance.console.stop()
 
-	instanceIndex := subnetBase / stepSize
-	instanceName := "fleetingd" + strconv.Itoa(instanceIndex)
+	// Delete overlay, cloudinit data, extra disks and sockets
+	removeInstanceFiles(instanceGroup, instance.Name, instance.Files)
+
+	// The VM may have exited on its own, stop the DNS forwarder bound to the tap's address as well
+	instance.InstanceContextCancelFunc()
 
-	// Generate random mac address
-	randomBytes := make([]byte, 4)
-	_, err := rand.Read(randomBytes)
+	// Helpers which didn't stop with the instance context are in its slice as well
+	err := instanceGroup.stopInstanceSlice(instance.Name)
 	if err != nil {
-		i.lock.Unlock()
-		return err
+		instance.logger.Error("error stopping slice after instance has been stopped", "error", err)
 	}
-	randomPart := hex.EncodeToString(randomBytes)
 
-	// slicing like this is okay since it is an ASCII string
-	instanceMac := fmt.Sprintf(
-		"de:51:%s:%s:%s:%s",
-		randomPart[0:2],
-		randomPart[2:4],
-		randomPart[4:6],
-		randomPart[6:])
-
-	hostTapIP := instanceGroup.MakeAddress(subnetBase + 1)
-	instanceTapIP := instanceGroup.MakeAddress(subnetBase + 2)
-
-	// Generate userdata image
-	userdataPath, err := instanceGroup.createUserdataPrebuild(instanceName,
-		instanceMac,
-		instanceTapIP,
-		hostTapIP,
-		"/30")
+	// The next instance in the slot gets a profile of its own
+	err = instanceGroup.releaseConfinement(instance.Name)
 	if err != nil {
-		i.lock.Unlock()
-		return err
+		instance.logger.Error("error unloading AppArmor profile after instance has been stopped", "error", err)
 	}
 
-	diskImageFileName, err := getFilenameFromURL(diskImageURL)
+	// Delete the tap before the slot is released, the next instance in it uses the same name
+	err = deleteTap(instance.Name)
 	if err != nil {
-		return err
+		instance.logger.Error("error deleting tap after instance has been stopped", "error", err)
 	}
-	diskImageFilePath := filepath.Join(instanceGroup.VMDiskDir, diskImageFileName)
-	decompressedPath := addSuffixToFilepath(diskImageFilePath, decompressedSuffix)
 
-	kernelFilePath, err := instanceGroup.getKernelFilePath()
+	i.lock.Lock()
+
+	err = i.releaseSlot(instance.SubnetBase, instance.PassthroughDevice, instance.SRIOVDevice)
 	if err != nil {
-		i.lock.Unlock()
-		return err
+		instance.logger.Error("error releasing address after instance has been stopped", "error", err)
 	}
 
-	// Start instance
-	instanceContext, instanceCancelFunc := context.WithCancel(context.Background())
+	// A hypervisor which exited on its own crashed or the guest powered off
+	if exitReason != "" {
+		i.auditLog.record(auditEventCrash, instance, exitReason)
+	} else {
+		i.auditLog.record(auditEventDestroy, instance, instance.FailureReason)
+	}
 
-	hypervisorCommand := exec.CommandContext(instanceContext, "cloud-hypervisor",
-		"--kernel",
-		kernelFilePath,
-		"--disk",
-		fmt.Sprintf("path=%s", decompressedPath),
-		fmt.Sprintf("path=%s,readonly=on", userdataPath),
-		"--cpus",
-		fmt.Sprintf("boot=%d", instanceGroup.VMNumCPUCores),
-		"--memory",
-		fmt.Sprintf("size=%dM", instanceGroup.VMMemoryMegabytes),
-		"--net",
-		fmt.Sprintf("tap=%s,mac=%s,ip=%s,mask=255.255.255.252", instanceName, instanceMac, hostTapIP),
-		"--balloon",
-		"size=0,free_page_reporting=on",
-		"--cmdline",
-		"console=hvc0 root=/dev/vda1 rw",
-		"--landlock")
+	// The instance never answered
+	if instance.readySpan != nil {
+		endSpan(instance.readySpan, fmt.Errorf("instance was removed before it became ready: %s", cmp.Or(exitReason, instance.FailureReason, "destroyed")))
+		instance.readySpan = nil
+	}
 
-	if instanceGroup.VMEnableVirtioConsole {
-		// Enable console
-		consolePath := filepath.Join(instanceGroup.VMDiskDir, vmWorkdir, fmt.Sprintf("%s_console", instanceName))
+	// Clear instance from inventory and wake up whoever is destroying it, no connect info is handed out for it anymore
+	instance.SSHPrivateKey.Destroy()
+	delete(i.instances, instance.Name)
+	close(instance.Removed)
 
-		hypervisorCommand.Args = append(hypervisorCommand.Args, "--console",
-			fmt.Sprintf("file=%s", consolePath))
+	if exitReason == "" {
+		exitReason = instance.FailureReason
 	}
 
-	instanceGroup.logger.Info("starting instance VM", "instance", instanceName)
-	hypervisorCommand.Start()
-	prebuildDone := make(chan struct{})
+	// An instance which exited before it was ever ready failed to boot
+	if !instance.Internal {
+		if instance.State == provider.StateCreating {
+			instance.logger.Warn("instance exited before it became ready")
+			i.removedInstances[instance.Name] = instanceStatus{State: provider.StateTimeout, Reason: exitReason}
+		} else {
+			i.removedInstances[instance.Name] = instanceStatus{State: provider.StateDeleted, Reason: exitReason}
+		}
+	}
 
-	go func() {
-		//
-		// VM cleanup - cancel VM context to trigger stopping the VM process and then calling this function
-		//
+	err = i.saveInstanceState()
+	if err != nil {
+		instance.logger.Error("could not save instance state", "error", err)
+	}
 
-		// Wait for VM to terminate (when context gets cancelled)
-		hypervisorCommand.Wait()
+	i.lock.Unlock()
 
-		instanceGroup.logger.Info("instance process finished. cleaning up.", "instance", instanceName)
+	err = i.RemoveInstanceFirewall(instanceGroup, instance.Name, instance.InstanceTapMacAddress, instance.ExternalSSHAddress)
+	if err != nil {
+		instance.logger.Error("error removing firewall rules after instance has been stopped", "error", err)
+	}
 
-		// Delete cloudinit data
-		err = os.Remove(userdataPath)
-		if err != nil {
-			instanceGroup.logger.Error("error deleting userdata after instance has been stopped: %w", err)
-		}
+	err = instanceGroup.removeTrafficShaping(instance.Name)
+	if err != nil {
+		instance.logger.Error("error removing traffic shaping after instance has been stopped", "error", err)
+	}
 
-		i.lock.Lock()
+	instance.logger.setState(provider.StateDeleted)
+	instance.logger.Info("instance removed", "duration", logDuration(instance.CreatedAt))
+	instance.logger.close()
+}
 
-		// Clear instance's IPAM lock
-		delete(i.ipamSlots, instanceGroup.MakeAddress(subnetBase)+"/30")
+func (i *Inventory) releaseSlot(subnetBase int, passthroughDevice string, sriovDevice string) error {
+	// Hand an instance's subnet and devices back, must be called with the inventory lock held
 
-		// Clear instance from inventory
-		delete(i.instances, instanceName)
+	// Release passthrough device
+	if passthroughDevice != "" {
+		delete(i.passthroughSlots, passthroughDevice)
+	}
 
-		i.lock.Unlock()
+	// Release virtual function
+	if sriovDevice != "" {
+		delete(i.sriovSlots, sriovDevice)
+	}
 
-		i.ApplyNftables(instanceGroup)
+	// Clear instance's IPAM lock
+	return i.ipam.Release(subnetBase)
+}
 
-		prebuildDone <- struct{}{}
-	}()
+func hypervisorExitReason(err error) string {
+	// Describe how a hypervisor exited on its own, cloud-hypervisor exits cleanly when the guest powers off
 
-	// Update inventory
-	i.instances[instanceName] = &InstanceInfo{
-		Name:                      instanceName,
-		InstanceContextCancelFunc: instanceCancelFunc,
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "hypervisor " + exitErr.ProcessState.String()
+	}
+	if err != nil {
+		return err.Error()
+	}
 
-		HostTapIP:     hostTapIP,
-		InstanceTapIP: instanceTapIP,
+	return "guest powered off"
+}
 
-		InstanceTapMacAddress: instanceMac,
+func (i *InstanceGroup) logInstanceFailure(instance *InstanceInfo, message string, reason string) {
+	// Log an instance which crashed or hung, the end of its console usually shows why
 
-		SSHPublicKey:  nil,
-		SSHPrivateKey: nil,
+	console := instance.console.lastLines(prebuildConsoleLines)
+	if console == "" {
+		instance.logger.Error(message, "reason", reason)
+		return
 	}
 
-	// Release lock for nftables
-	i.lock.Unlock()
-
-	// Wait for tap device to become available
-	checkCounter := 0
-	tapReady := false
+	instance.logger.Error(message, "reason", reason, "console", console)
+}
 
-	for {
-		interfaces, err := net.Interfaces()
-		if err != nil {
-			return err
-		}
-		for _, device := range interfaces {
-			if device.Name == instanceName {
-				tapReady = true
-				break
-			}
-		}
+func (i *Inventory) enforceBootDeadline(instanceGroup *InstanceGroup, instance *InstanceInfo) {
+	// Recycle an instance which did not become ready within vm_boot_timeout_minutes, it would keep its slot forever
 
-		if tapReady || checkCounter > 100 {
-			break
-		}
+	timer := time.NewTimer(time.Duration(instanceGroup.VMBootTimeoutMinutes) * time.Minute)
+	defer timer.Stop()
 
-		time.Sleep(100 * time.Millisecond)
-		checkCounter++
+	select {
+	case <-instance.Removed:
+		return
+	case <-timer.C:
 	}
 
-	// Render and apply nftables rules (wait for tap interface)
-	err = i.ApplyNftables(instanceGroup)
-	if err != nil {
-		return err
+	i.lock.Lock()
+	if instance.State != provider.StateCreating {
+		i.lock.Unlock()
+		return
 	}
+	instance.FailureReason = fmt.Sprintf("did not become ready within %d minutes", instanceGroup.VMBootTimeoutMinutes)
+	instance.InstanceContextCancelFunc()
+	i.lock.Unlock()
 
-	// Wait for prebuild to finish / cleanup
-	instanceGroup.logger.Info("waiting for prebuild to finish.")
-	<-prebuildDone
-	instanceGroup.logger.Info("prebuild finished.")
+	i.metrics.countBootFailure(newBootError(ErrHypervisorFailure, errors.New(instance.FailureReason)))
 
-	return nil
+	instanceGroup.logInstanceFailure(instance, "instance boot timed out, recycling it", instance.FailureReason)
 }
 
-func (i *Inventory) DestroyInstance(name string) error {
-	// Try to destroy an instance, return error if it did not work within 10 seconds
+func (i *Inventory) DestroyInstance(ctx context.Context, name string) error {
+	// Try to destroy an instance, return error if it was not cleaned up within instanceRemovalTimeout or the context ended first
 
 	i.lock.Lock()
-	i.instances[name].InstanceContextCancelFunc()
+	instance, ok := i.instances[name]
+	if !ok {
+		i.lock.Unlock()
+		return fmt.Errorf("instance %s not found", name)
+	}
+	// Only guests which became ready have their agent running
+	graceful := i.guestAgentSocketPath != nil && instance.State == provider.StateRunning && !instance.Internal && !instance.Paused
+	instance.State = provider.StateDeleting
+	instance.logger.setState(instance.State)
 	i.lock.Unlock()
 
-	waitCounter := 0
-	for {
-		i.lock.RLock()
-		_, instanceStillExists := i.instances[name]
-		i.lock.RUnlock()
+	// Jobs' services get to stop like on any shutdown, the hypervisor is stopped either way
+	if graceful {
+		i.shutdownGuest(ctx, instance, i.guestAgentSocketPath(name))
+	}
 
-		if !instanceStillExists {
-			return nil
-		}
+	instance.InstanceContextCancelFunc()
 
-		waitCounter++
-		if waitCounter > 100 {
-			return fmt.Errorf("timed out waiting for instance %s to be removed", name)
-		}
+	timeout := time.NewTimer(instanceRemovalTimeout)
+	defer timeout.Stop()
 
-		time.Sleep(time.Millisecond * 100)
+	select {
+	case <-instance.Removed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopped waiting for instance %s to be removed: %w", name, ctx.Err())
+	case <-timeout.C:
+		return fmt.Errorf("timed out waiting for instance %s to be removed", name)
 	}
 }
 
-func (i *Inventory) DestroyAllInstances() error {
-	// Try to destroy all instances
+func (i *Inventory) DestroyAllInstances(ctx context.Context) error {
+	// Try to destroy all instances, an error of one doesn't keep the others from being destroyed
 
 	instanceNames := []string{}
 
@@ -539,6 +1487,9 @@ func (i *Inventory) DestroyAllInstances() error {
 	// Block creation of new instances
 	i.shuttingDown = true
 
+	// Abort a prebuild that might still be running and stop background tasks
+	i.shutdownCancelFunc()
+
 	// Collect instance names to destroy
 	for name, _ := range i.instances {
 		instanceNames = append(instanceNames, name)
@@ -546,53 +1497,169 @@ func (i *Inventory) DestroyAllInstances() error {
 
 	i.lock.Unlock()
 
-	for _, instanceToDestroy := range instanceNames {
-		err := i.DestroyInstance(instanceToDestroy)
+	// Each instance may take up to 10 seconds, so wait for all of them at once
+	errs := make([]error, len(instanceNames))
+	var waitGroup sync.WaitGroup
+
+	for index, instanceToDestroy := range instanceNames {
+		waitGroup.Go(func() {
+			errs[index] = i.DestroyInstance(ctx, instanceToDestroy)
+		})
+	}
+
+	waitGroup.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (i *Inventory) ForceRemoveInstances(instanceGroup *InstanceGroup) {
+	// Kill the processes of the instances which are still not removed and delete their taps and files, their cleanup may still be running
+
+	i.lock.RLock()
+	var remaining []*InstanceInfo
+	for _, instance := range i.instances {
+		remaining = append(remaining, instance)
+	}
+	i.lock.RUnlock()
+
+	var pidfds []int
+	for _, instance := range remaining {
+		// Cancelling the context already killed the processes this plugin started, adopted ones are killed through their records
+		instance.InstanceContextCancelFunc()
+
+		for _, process := range instance.Processes {
+			pidfd, err := process.open()
+			if err == nil {
+				pidfds = append(pidfds, pidfd)
+			}
+		}
+	}
+	killProcesses(pidfds)
+
+	for _, instance := range remaining {
+		select {
+		case <-instance.Removed:
+			continue
+		default:
+		}
+
+		instance.logger.Warn("Forcing removal of instance which did not stop in time.")
+
+		err := instanceGroup.stopInstanceSlice(instance.Name)
 		if err != nil {
-			return err
+			instance.logger.Error("error stopping slice of instance", "error", err)
+		}
+
+		err = deleteTap(instance.Name)
+		if err != nil {
+			instance.logger.Error("error deleting tap of instance", "error", err)
 		}
+
+		files := instance.Files
+		if len(files) == 0 {
+			files = []string{instanceGroup.getInstanceDir(instance.Name)}
+		}
+		removeInstanceFiles(instanceGroup, instance.Name, files)
 	}
+}
 
-	return nil
+func (i *Inventory) GetInstanceStates() map[string]instanceStatus {
+	// Get the states of the instances handed to the runner, removed instances are only reported once
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	states := map[string]instanceStatus{}
+
+	for name, instance := range i.instances {
+		if instance.Internal {
+			continue
+		}
+		states[name] = instanceStatus{State: instance.State}
+	}
+
+	for name, status := range i.removedInstances {
+		states[name] = status
+	}
+	clear(i.removedInstances)
+
+	return states
 }
 
-func (i *Inventory) GetAllInstances() []string {
-	// List all instance names
+func (i *Inventory) MarkInstanceRunning(name string) provider.State {
+	// Promote a creating instance once it answered, returning its state, it may be deleted in the meantime
 
-	instanceNames := []string{}
+	i.lock.Lock()
+	defer i.lock.Unlock()
 
-	i.lock.RLock()
+	instance, ok := i.instances[name]
+	if !ok {
+		return provider.StateDeleted
+	}
 
-	for name, _ := range i.instances {
-		instanceNames = append(instanceNames, name)
+	if instance.State == provider.StateCreating {
+		instance.State = provider.StateRunning
+		instance.logger.setState(instance.State)
+		instance.logger.Info("instance is ready", "duration", logDuration(instance.CreatedAt))
+		i.auditLog.record(auditEventReady, instance, "")
+
+		// CreatedAt is when the boot started, so this includes preparing the disks
+		i.publishEvent(instance.Name, eventSSHReady, instance.CreatedAt, nil)
+
+		if instance.readySpan != nil {
+			instance.readySpan.End()
+			instance.readySpan = nil
+		}
 	}
 
-	i.lock.RUnlock()
+	return instance.State
+}
+
+func (i *Inventory) GetSSHHostPublicKey(name string) (string, error) {
+	// Get the host key an instance's guest has to present
+
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	instance, ok := i.instances[name]
+	if !ok {
+		return "", errors.New("instance not found")
+	}
 
-	return instanceNames
+	return instance.SSHHostPublicKey, nil
 }
 
-func (i *Inventory) GetConnectInfo(name string) (*provider.ConnectInfo, error) {
+func (i *Inventory) GetConnectInfo(instanceGroup *InstanceGroup, name string, preferIPv6 bool) (*provider.ConnectInfo, error) {
 	// Get an instance's conneciton info
 
 	i.lock.RLock()
+	defer i.lock.RUnlock()
 
 	instance, ok := i.instances[name]
 	if !ok {
 		return nil, errors.New("instance not found")
 	}
 
-	marshalledKey, err := ssh.MarshalPrivateKey(instance.SSHPrivateKey, "fleetingd")
+	marshalledKey, err := ssh.MarshalPrivateKey(ed25519.PrivateKey(instance.SSHPrivateKey.Bytes()), "fleetingd")
 	if err != nil {
 		return nil, err
 	}
 
+	internalAddress := instance.InstanceTapIP
+	if preferIPv6 && instance.InstanceTapIP6 != "" {
+		internalAddress = instance.InstanceTapIP6
+	}
+	if instance.PasstSSHAddress != "" {
+		internalAddress = instance.PasstSSHAddress
+	}
+
 	connectionInfo := provider.ConnectInfo{
 		ID:           instance.Name,
-		InternalAddr: instance.InstanceTapIP,
+		InternalAddr: internalAddress,
+		ExternalAddr: instance.ExternalSSHAddress,
 
 		ConnectorConfig: provider.ConnectorConfig{
-			Username: "ubuntu",
+			Username: instanceGroup.imageProfile.Username,
 			OS:       "linux",
 			Arch:     runtime.GOARCH,
 
@@ -604,66 +1671,5 @@ func (i *Inventory) GetConnectInfo(name string) (*provider.ConnectInfo, error) {
 		},
 	}
 
-	i.lock.RUnlock()
-
 	return &connectionInfo, nil
 }
-
-func (i *Inventory) ApplyNftables(instanceGroup *InstanceGroup) error {
-	// Render nftables template for setup and apply it
-
-	type nftablesTemplateInstanceInfo struct {
-		Name                  string
-		InstanceTapIP         string
-		InstanceTapMacAddress string
-		InstanceGateway       string
-	}
-
-	type nftablesTemplateArgs struct {
-		EgressInterface string
-		Instances       []nftablesTemplateInstanceInfo
-	}
-
-	templates, err := template.ParseFS(userDataTemplates, "templates/*.tpl")
-	if err != nil {
-		return err
-	}
-
-	templateArgs := nftablesTemplateArgs{
-		EgressInterface: instanceGroup.EgressInterface,
-		Instances:       []nftablesTemplateInstanceInfo{},
-	}
-
-	i.lock.RLock()
-	for _, instance := range i.instances {
-		templateArgs.Instances = append(templateArgs.Instances, nftablesTemplateInstanceInfo{
-			Name:                  instance.Name,
-			InstanceTapIP:         instance.InstanceTapIP,
-			InstanceTapMacAddress: instance.InstanceTapMacAddress,
-			InstanceGateway:       instance.HostTapIP,
-		})
-	}
-	i.lock.RUnlock()
-
-	rulesetPath := filepath.Join(instanceGroup.VMDiskDir, "ruleset.nft")
-
-	rulesetFile, err := os.Create(rulesetPath)
-	if err != nil {
-		return err
-	}
-	defer rulesetFile.Close()
-
-	err = templates.ExecuteTemplate(rulesetFile, "nftables-rules.tpl", templateArgs)
-	if err != nil {
-		return err
-	}
-
-	rulesetFile.Close()
-
-	err = exec.Command("nft", "-f", rulesetPath).Run()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,172 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Stands in for cloud-hypervisor, records its PID and blocks like a prebuild VM which doesn't power off
+const blockingHypervisorScript = `#!/bin/sh
+echo $$ > "$FLEETINGD_TEST_PID_FILE"
+exec sleep 600
+`
+
+// Stands in for passt, creates the socket the hypervisor would connect to and blocks
+const blockingPasstScript = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	if [ "$1" = "--socket" ]; then
+		touch "$2"
+	fi
+	shift
+done
+exec sleep 600
+`
+
+func newPrebuildTestInstanceGroup(t *testing.T) *InstanceGroup {
+	// Set up an instance group whose prebuild VM is started through the blocking hypervisor and passt, nothing on the host is touched
+
+	binDir := t.TempDir()
+	for name, script := range map[string]string{hypervisorBackend: blockingHypervisorScript, "passt": blockingPasstScript} {
+		err := os.WriteFile(filepath.Join(binDir, name), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FLEETINGD_TEST_PID_FILE", filepath.Join(binDir, "hypervisor.pid"))
+
+	instanceGroup := &InstanceGroup{
+		NetworkMode:              networkModePasst,
+		VMSubnet:                 "10.99.0.",
+		VMDiskDir:                t.TempDir(),
+		VMIPAMBackend:            ipamBackendMemory,
+		VMPrebuildTimeoutMinutes: 10,
+		VMNumCPUCores:            1,
+		VMMemoryMegabytes:        512,
+	}
+	instanceGroup.logger = newFieldLogger(hclog.NewNullLogger())
+	instanceGroup.inventory = NewInventory()
+
+	err := instanceGroup.prepareRender()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = instanceGroup.setupTracing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instanceGroup.inventory.ipam, err = instanceGroup.newIPAM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RunPrebuild creates the working directory before it starts the prebuild VM
+	err = instanceGroup.prepareWorkdir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return instanceGroup
+}
+
+func TestShutdownDuringPrebuild(t *testing.T) {
+	// Shutdown has to stop a prebuild VM which is still running and leave neither its directory nor its slot behind
+
+	instanceGroup := newPrebuildTestInstanceGroup(t)
+	inventory := instanceGroup.inventory
+
+	prebuildErr := make(chan error, 1)
+	go func() {
+		prebuildErr <- inventory.PrebuildInstance(inventory.shutdownContext, instanceGroup)
+	}()
+
+	// Wait for the prebuild VM to be in the inventory and its hypervisor to run
+	pidFile := os.Getenv("FLEETINGD_TEST_PID_FILE")
+	var pid int
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		inventory.lock.RLock()
+		registered := len(inventory.instances) == 1
+		inventory.lock.RUnlock()
+
+		contents, err := os.ReadFile(pidFile)
+		if registered && err == nil && len(contents) > 0 {
+			pid, err = strconv.Atoi(strings.TrimSpace(string(contents)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+
+		select {
+		case err := <-prebuildErr:
+			t.Fatalf("prebuild returned before shutdown: %v", err)
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("prebuild VM was not started")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- instanceGroup.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Fatalf("shutdown failed: %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("shutdown did not return while the prebuild was running")
+	}
+
+	select {
+	case err := <-prebuildErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("prebuild returned %v instead of being cancelled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("prebuild did not return after shutdown")
+	}
+
+	// The hypervisor was waited for, so the PID is gone once it was killed
+	err := syscall.Kill(pid, 0)
+	if !errors.Is(err, syscall.ESRCH) {
+		t.Fatalf("prebuild VM's hypervisor is still running: %v", err)
+	}
+
+	inventory.lock.RLock()
+	instances := len(inventory.instances)
+	slots := inventory.ipam.Count()
+	inventory.lock.RUnlock()
+
+	if instances != 0 {
+		t.Fatalf("%d instances left in the inventory", instances)
+	}
+	if slots != 0 {
+		t.Fatalf("%d IPAM slots left allocated", slots)
+	}
+
+	_, err = os.Stat(instanceGroup.getInstanceDir("fleetingd0"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("instance directory of the prebuild VM is left behind: %v", err)
+	}
+}
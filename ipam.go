@@ -0,0 +1,138 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+const ipamBackendFile = "file"
+const ipamBackendMemory = "memory"
+
+// IPAM allocates the instances' subnets, the inventory lock is held while it is called
+type IPAM interface {
+	// Allocate reserves a free subnet and returns its offset in vm_subnet
+	Allocate() (int, error)
+	// Release frees a subnet returned by Allocate
+	Release(subnetBase int) error
+	// Reserve takes the subnet of an instance adopted from an earlier run, it may already be taken by it
+	Reserve(subnetBase int) error
+	// Count returns the number of allocated subnets
+	Count() int
+}
+
+// Point-to-point /31 links (RFC 3021) up to /28 subnets per instance
+const minSubnetPrefixLength = 28
+const maxSubnetPrefixLength = 31
+const defaultSubnetPrefixLength = 30
+
+func (i *InstanceGroup) checkSubnetPrefixLength() error {
+	// Validate the per-instance subnet size
+
+	switch {
+	case i.VMSubnetPrefixLength == 0:
+		i.VMSubnetPrefixLength = defaultSubnetPrefixLength
+	case i.VMSubnetPrefixLength < minSubnetPrefixLength || i.VMSubnetPrefixLength > maxSubnetPrefixLength:
+		return fmt.Errorf("vm_subnet_prefix_length must be between %d and %d but is %d", minSubnetPrefixLength, maxSubnetPrefixLength, i.VMSubnetPrefixLength)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) ipamStepSize() int {
+	// Get the number of addresses in an instance subnet
+
+	return 1 << (32 - i.VMSubnetPrefixLength)
+}
+
+func (i *InstanceGroup) maxIPAMSlots() int {
+	// Get the number of instance subnets fitting into vm_subnet
+
+	return 255 / i.ipamStepSize()
+}
+
+func (i *InstanceGroup) subnetNetmask() string {
+	// Get the instance subnet's prefix length in the /nn notation used by the templates
+
+	return fmt.Sprintf("/%d", i.VMSubnetPrefixLength)
+}
+
+func (i *InstanceGroup) subnetMask() string {
+	// Get the instance subnet's netmask in dotted notation used by the hypervisor
+
+	return net.IP(net.CIDRMask(i.VMSubnetPrefixLength, 32)).String()
+}
+
+func (i *InstanceGroup) makeTapAddresses(subnetBase int) (string, string) {
+	// Get the host and guest tap addresses of an instance subnet, a /31 has no network and broadcast address
+
+	// Bridged guests use DHCP, their address is learned once they are up
+	if i.isBridged() {
+		return i.bridgeAddress, ""
+	}
+
+	if i.VMSubnetPrefixLength == 31 {
+		return i.MakeAddress(subnetBase), i.MakeAddress(subnetBase + 1)
+	}
+
+	return i.MakeAddress(subnetBase + 1), i.MakeAddress(subnetBase + 2)
+}
+
+func (i *InstanceGroup) newIPAM() (IPAM, error) {
+	// Create the configured IPAM backend
+
+	switch i.VMIPAMBackend {
+	case "":
+		i.VMIPAMBackend = ipamBackendFile
+	case ipamBackendFile, ipamBackendMemory:
+	default:
+		return nil, fmt.Errorf("unknown vm_ipam_backend '%s', must be one of: %s, %s", i.VMIPAMBackend, ipamBackendFile, ipamBackendMemory)
+	}
+
+	memory := newMemoryIPAM(i.ipamStepSize())
+
+	if i.VMIPAMBackend == ipamBackendMemory {
+		return memory, nil
+	}
+
+	return loadFileIPAM(i, memory)
+}
+
+type memoryIPAM struct {
+	stepSize int
+	subnets  map[int]struct{}
+}
+
+func newMemoryIPAM(stepSize int) *memoryIPAM {
+	return &memoryIPAM{
+		stepSize: stepSize,
+		subnets:  make(map[int]struct{}),
+	}
+}
+
+func (m *memoryIPAM) Allocate() (int, error) {
+	// Behold, the ultimate IPv4 subnet allocation algorithm: walk subnets until a free one is found
+
+	for subnetBase := 0; subnetBase < 255-m.stepSize; subnetBase += m.stepSize {
+		if _, ok := m.subnets[subnetBase]; !ok {
+			m.subnets[subnetBase] = struct{}{}
+			return subnetBase, nil
+		}
+	}
+
+	return 0, errors.New("available VM address space exhausted")
+}
+
+func (m *memoryIPAM) Release(subnetBase int) error {
+	delete(m.subnets, subnetBase)
+	return nil
+}
+
+func (m *memoryIPAM) Reserve(subnetBase int) error {
+	m.subnets[subnetBase] = struct{}{}
+	return nil
+}
+
+func (m *memoryIPAM) Count() int {
+	return len(m.subnets)
+}
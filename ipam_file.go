@@ -0,0 +1,144 @@
+package fleetingd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Lives outside of the working directory, which is cleared on startup
+const ipamStateFileName = "ipam.json"
+
+type ipamState struct {
+	Subnet       string `json:"subnet"`
+	PrefixLength int    `json:"prefix_length"`
+	Subnets      []int  `json:"subnets"`
+}
+
+// Persists the allocations so VMs left running by an earlier plugin process keep their addresses
+type fileIPAM struct {
+	*memoryIPAM
+
+	path  string
+	state ipamState
+}
+
+func loadFileIPAM(instanceGroup *InstanceGroup, memory *memoryIPAM) (*fileIPAM, error) {
+	// Load the allocations of an earlier run, only subnets of instances which are still running are kept
+
+	ipam := &fileIPAM{
+		memoryIPAM: memory,
+		path:       filepath.Join(instanceGroup.VMDiskDir, ipamStateFileName),
+		state: ipamState{
+			Subnet:       instanceGroup.VMSubnet,
+			PrefixLength: instanceGroup.VMSubnetPrefixLength,
+		},
+	}
+
+	contents, err := os.ReadFile(ipam.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ipam, ipam.save()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read IPAM state: %w", err)
+	}
+
+	var previousState ipamState
+	err = json.Unmarshal(contents, &previousState)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse IPAM state %s: %w", ipam.path, err)
+	}
+
+	if previousState.Subnet != ipam.state.Subnet || previousState.PrefixLength != ipam.state.PrefixLength {
+		instanceGroup.logger.Warn("vm_subnet or vm_subnet_prefix_length changed, discarding previous address allocations")
+		return ipam, ipam.save()
+	}
+
+	for _, subnetBase := range previousState.Subnets {
+		if subnetBase%memory.stepSize != 0 || !instanceGroup.isSlotInUse(subnetBase/memory.stepSize) {
+			continue
+		}
+
+		instanceGroup.logger.Warn("keeping address of an instance still running from an earlier run", "instance", "fleetingd"+strconv.Itoa(subnetBase/memory.stepSize), "address", instanceGroup.MakeAddress(subnetBase)+instanceGroup.subnetNetmask())
+		memory.subnets[subnetBase] = struct{}{}
+	}
+
+	return ipam, ipam.save()
+}
+
+func (f *fileIPAM) Allocate() (int, error) {
+	subnetBase, err := f.memoryIPAM.Allocate()
+	if err != nil {
+		return 0, err
+	}
+
+	err = f.save()
+	if err != nil {
+		f.memoryIPAM.Release(subnetBase)
+		return 0, err
+	}
+
+	return subnetBase, nil
+}
+
+func (f *fileIPAM) Release(subnetBase int) error {
+	f.memoryIPAM.Release(subnetBase)
+
+	return f.save()
+}
+
+func (f *fileIPAM) Reserve(subnetBase int) error {
+	f.memoryIPAM.Reserve(subnetBase)
+
+	return f.save()
+}
+
+func (f *fileIPAM) save() error {
+	// Write the allocations to a temporary file first, so a crash never leaves a truncated state behind
+
+	f.state.Subnets = []int{}
+	for subnetBase := range f.subnets {
+		f.state.Subnets = append(f.state.Subnets, subnetBase)
+	}
+	slices.Sort(f.state.Subnets)
+
+	contents, err := json.Marshal(f.state)
+	if err != nil {
+		return err
+	}
+
+	temporaryPath := f.path + ".tmp"
+	err = os.WriteFile(temporaryPath, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write IPAM state: %w", err)
+	}
+
+	err = os.Rename(temporaryPath, f.path)
+	if err != nil {
+		return fmt.Errorf("could not write IPAM state: %w", err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) isSlotInUse(instanceIndex int) bool {
+	// Check whether the hypervisor of an earlier run is still attached to a slot
+
+	instanceName := "fleetingd" + strconv.Itoa(instanceIndex)
+
+	// A tap only has carrier while a hypervisor holds it open
+	link, err := netlink.LinkByName(instanceName)
+	if err == nil && link.Attrs().RawFlags&unix.IFF_LOWER_UP != 0 {
+		return true
+	}
+
+	return newHypervisorAPIClient(i.getAPISocketPath(instanceName)).Ping() == nil
+}
@@ -0,0 +1,100 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/netip"
+)
+
+const ipv6ModeNAT = "nat"
+const ipv6ModeRouted = "routed"
+
+// Each instance gets a point-to-point /127 or a /64 out of the configured prefix
+const ipv6DefaultInstancePrefixLength = 127
+
+func (i *InstanceGroup) parseIPv6Prefix() error {
+	// Validate the IPv6 settings, IPv6 stays disabled without a prefix
+
+	if i.VMIPv6Prefix == "" {
+		return nil
+	}
+
+	prefix, err := netip.ParsePrefix(i.VMIPv6Prefix)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as vm_ipv6_prefix but is not a valid prefix: %w", i.VMIPv6Prefix, err)
+	}
+
+	switch i.VMIPv6InstancePrefixLength {
+	case 0:
+		i.VMIPv6InstancePrefixLength = ipv6DefaultInstancePrefixLength
+	case 64, 127:
+	default:
+		return fmt.Errorf("vm_ipv6_instance_prefix_length must be 64 or 127 but is %d", i.VMIPv6InstancePrefixLength)
+	}
+
+	// The IPv4 slot numbering is reused, so the prefix needs 8 bits of space for the instance prefixes
+	maxPrefixLength := i.VMIPv6InstancePrefixLength - 8
+	if i.VMIPv6InstancePrefixLength == 127 {
+		maxPrefixLength = 120
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() > maxPrefixLength {
+		return fmt.Errorf("vm_ipv6_prefix must be an IPv6 prefix of /%d or larger but is %s", maxPrefixLength, i.VMIPv6Prefix)
+	}
+
+	switch i.VMIPv6Mode {
+	case "":
+		i.VMIPv6Mode = ipv6ModeNAT
+	case ipv6ModeNAT, ipv6ModeRouted:
+	default:
+		return fmt.Errorf("unknown vm_ipv6_mode '%s', must be one of: %s, %s", i.VMIPv6Mode, ipv6ModeNAT, ipv6ModeRouted)
+	}
+
+	i.ipv6Prefix = prefix.Masked()
+
+	return nil
+}
+
+func (i *InstanceGroup) MakeAddresses6(slot int) (string, string) {
+	// Get the host and guest IPv6 addresses of an IPAM slot, empty if IPv6 is disabled
+
+	if !i.ipv6Prefix.IsValid() {
+		return "", ""
+	}
+
+	// Host and guest are the two addresses of a /127, or ::1 and ::2 of a /64
+	hostOffset := int64(0)
+	if i.VMIPv6InstancePrefixLength == 64 {
+		hostOffset = 1
+	}
+
+	baseAddress := i.ipv6Prefix.Addr().As16()
+	instancePrefix := new(big.Int).SetBytes(baseAddress[:])
+	instancePrefix.Add(instancePrefix, new(big.Int).Lsh(big.NewInt(int64(slot)), uint(128-i.VMIPv6InstancePrefixLength)))
+
+	makeAddress := func(offset int64) string {
+		address := new(big.Int).Add(instancePrefix, big.NewInt(offset))
+
+		addressBytes := [16]byte{}
+		address.FillBytes(addressBytes[:])
+
+		return netip.AddrFrom16(addressBytes).String()
+	}
+
+	return makeAddress(hostOffset), makeAddress(hostOffset + 1)
+}
+
+func configureTapIPv6(tapName string, hostTapIP6 string, prefixLength int) error {
+	// cloud-hypervisor only configures IPv4 on the tap, add the host side IPv6 address
+
+	if hostTapIP6 == "" {
+		return nil
+	}
+
+	_, err := runCommand(context.Background(), "ip", "-6", "addr", "replace", fmt.Sprintf("%s/%d", hostTapIP6, prefixLength), "dev", tapName)
+	if err != nil {
+		return fmt.Errorf("could not add IPv6 address to tap %s: %w", tapName, err)
+	}
+
+	return nil
+}
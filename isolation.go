@@ -0,0 +1,67 @@
+package fleetingd
+
+import (
+	"net/netip"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func (i *InstanceGroup) checkInstanceIsolation() {
+	// Guests are isolated from each other unless explicitly disabled
+
+	if i.IsolateInstances == nil {
+		isolate := true
+		i.IsolateInstances = &isolate
+	}
+}
+
+func (i *InstanceGroup) isolateInstances() bool {
+	return i.IsolateInstances == nil || *i.IsolateInstances
+}
+
+func (i *InstanceGroup) addInstanceIsolationRules(connection nftablesBatch, chain *nftables.Chain, vmSubnet netip.Prefix) {
+	// Queue the rules of an instance's ingress chain deciding whether it may reach the other instances
+
+	if i.isBridged() {
+		if !i.isolateInstances() {
+			return
+		}
+
+		// Bridged frames never pass the host's forwarding, so drop the ones addressed to other instances
+		// ether daddr @macs drop
+		macSet := firewallMACSet()
+		addRule(connection, chain,
+			[]expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 0, Len: 6},
+				&expr.Lookup{SourceRegister: 1, SetName: macSet.Name},
+			},
+			drop())
+		return
+	}
+
+	if i.isolateInstances() {
+		// ip daddr vm_subnet drop
+		addRule(connection, chain,
+			matchProtocol(unix.ETH_P_IP),
+			matchPrefix(expr.PayloadBaseNetworkHeader, 16, expr.CmpOpEq, vmSubnet),
+			drop())
+		return
+	}
+
+	// Traffic between the instances bypasses the egress policy, the forwarding chain routes it between the taps
+	// ip daddr vm_subnet accept
+	addRule(connection, chain,
+		matchProtocol(unix.ETH_P_IP),
+		matchPrefix(expr.PayloadBaseNetworkHeader, 16, expr.CmpOpEq, vmSubnet),
+		accept())
+
+	if i.ipv6Prefix.IsValid() {
+		// ip6 daddr vm_ipv6_prefix accept
+		addRule(connection, chain,
+			matchProtocol(unix.ETH_P_IPV6),
+			matchPrefix(expr.PayloadBaseNetworkHeader, 24, expr.CmpOpEq, i.ipv6Prefix),
+			accept())
+	}
+}
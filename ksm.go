@@ -0,0 +1,85 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Kernel samepage merging is controlled and reported in sysfs
+const ksmDirectory = "/sys/kernel/mm/ksm"
+
+func (i *InstanceGroup) setupKSM() error {
+	// Start kernel samepage merging with host_ksm, the job VMs' memory is marked mergeable on boot
+
+	if !i.HostKSM {
+		return nil
+	}
+
+	// Encrypted guest memory looks different in every VM
+	if i.VMConfidentialComputing != "" {
+		return errors.New("host_ksm can not be combined with vm_confidential_computing")
+	}
+
+	_, err := os.Stat(ksmDirectory)
+	if err != nil {
+		return fmt.Errorf("host_ksm requires a kernel with CONFIG_KSM: %w", err)
+	}
+
+	// Set the rate before starting, so the kernel's default is never applied to the VMs
+	if i.HostKSMPagesToScan > 0 {
+		err = writeKSMSetting("pages_to_scan", i.HostKSMPagesToScan)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeKSMSetting("run", 1)
+	if err != nil {
+		return err
+	}
+
+	i.logger.Info("Enabled kernel samepage merging.", "pages_to_scan", readKSMValue("pages_to_scan"))
+
+	return nil
+}
+
+func writeKSMSetting(name string, value uint64) error {
+	// Write one of the settings in /sys/kernel/mm/ksm
+
+	err := os.WriteFile(filepath.Join(ksmDirectory, name), []byte(strconv.FormatUint(value, 10)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("could not set ksm %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func readKSMValue(name string) uint64 {
+	// Read one of the counters or settings in /sys/kernel/mm/ksm, 0 if the kernel has none
+
+	contents, err := os.ReadFile(filepath.Join(ksmDirectory, name))
+	if err != nil {
+		return 0
+	}
+
+	value, _ := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+
+	return value
+}
+
+func (i *InstanceGroup) writeKSMMetrics(w io.Writer) {
+	// Write how much the VMs' memory is deduplicated, the counters are the whole host's
+
+	if !i.HostKSM {
+		return
+	}
+
+	writeMetric(w, "fleetingd_ksm_pages_shared", "gauge", "Merged pages kept by kernel samepage merging.", float64(readKSMValue("pages_shared")))
+	writeMetric(w, "fleetingd_ksm_pages_sharing", "gauge", "Pages backed by a merged page, roughly how many are saved.", float64(readKSMValue("pages_sharing")))
+	writeMetric(w, "fleetingd_ksm_page_size_bytes", "gauge", "Size of the pages counted by kernel samepage merging.", float64(os.Getpagesize()))
+}
@@ -0,0 +1,67 @@
+package fleetingd
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Labels every instance gets at boot, configured labels can't replace them
+const (
+	labelDistro      = "distro"
+	labelImageSerial = "image_serial"
+	labelGoldenImage = "golden_image"
+	labelArch        = "arch"
+	labelCPUs        = "cpus"
+	labelMemory      = "memory_mb"
+)
+
+var bootLabels = []string{labelDistro, labelImageSerial, labelGoldenImage, labelArch, labelCPUs, labelMemory}
+
+func (i *InstanceGroup) checkLabels() error {
+	// Validate the labels attached to every instance
+
+	for name := range i.VMLabels {
+		if !labelNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid label name '%s' in vm_labels, only letters, digits, '_', '.' and '-' are allowed", name)
+		}
+
+		if slices.Contains(bootLabels, name) {
+			return fmt.Errorf("label %s in vm_labels is set by the plugin itself", name)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) instanceLabels() map[string]string {
+	// Get the labels of an instance booted now, the configured ones and what it is booted from
+
+	labels := maps.Clone(i.VMLabels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	imageSerial := i.VMImageSerial
+	if imageSerial == "" {
+		imageSerial = imageSerialCurrent
+	}
+
+	labels[labelDistro] = i.Distro
+	labels[labelImageSerial] = imageSerial
+	labels[labelArch] = runtime.GOARCH
+	labels[labelCPUs] = strconv.FormatUint(i.VMNumCPUCores, 10)
+	labels[labelMemory] = strconv.FormatUint(i.VMMemoryMegabytes, 10)
+
+	// Identifies the prebuilt image exactly, a "current" serial changes with every update
+	if i.goldenImageKey != "" {
+		labels[labelGoldenImage] = i.goldenImageKey
+	}
+
+	return labels
+}
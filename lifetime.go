@@ -0,0 +1,74 @@
+package fleetingd
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func (i *InstanceGroup) runLifetimePolicy(ctx context.Context) {
+	// Recycle instances which are older than vm_max_lifetime_minutes
+
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			i.inventory.RecycleExpiredInstances(i)
+		}
+	}
+}
+
+func (i *Inventory) RecycleExpiredInstances(instanceGroup *InstanceGroup) {
+	// Destroy running instances without SSH sessions once they exceeded their lifetime, jobs are never interrupted
+
+	maxLifetime := time.Duration(instanceGroup.VMMaxLifetimeMinutes) * time.Minute
+
+	sessions, err := instanceGroup.getSSHSessions()
+	if err != nil {
+		instanceGroup.logger.Error("could not determine active SSH sessions", "error", err)
+		return
+	}
+
+	// Hold the lock while deciding so ConnectInfo can't hand out an instance that is about to be destroyed
+	i.lock.Lock()
+
+	var expired []*InstanceInfo
+	for _, instance := range i.instances {
+		if instance.Internal || instance.State != provider.StateRunning {
+			continue
+		}
+
+		if time.Since(instance.CreatedAt) < maxLifetime {
+			continue
+		}
+
+		// A job is connected to the instance
+		if sessions.active(instance) {
+			instance.LastActive = time.Now()
+			continue
+		}
+
+		// The runner just requested the instance, its job may not have connected yet
+		if time.Since(instance.LastActive) < idleCheckInterval {
+			continue
+		}
+
+		// Reported as deleting until the cleanup removed it, the runner then boots a replacement
+		instance.State = provider.StateDeleting
+		expired = append(expired, instance)
+	}
+
+	i.lock.Unlock()
+
+	// The instances already count as deleting, stopping their hypervisors doesn't need the lock
+	for _, instance := range expired {
+		instance.InstanceContextCancelFunc()
+
+		instance.logger.Info("Recycling instance which exceeded vm_max_lifetime_minutes.", "duration", logDuration(instance.CreatedAt))
+	}
+}
@@ -0,0 +1,211 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Checksums of local images are always SHA256
+const localImageChecksumAlgorithm = "sha256"
+
+var sha256Regexp = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+func parseLocalImagePath(source string) (string, error) {
+	// Get the path of a local image given as file:// URL or absolute path
+
+	if strings.HasPrefix(source, "file://") {
+		sourceURL, err := url.Parse(source)
+		if err != nil {
+			return "", err
+		}
+		if sourceURL.Host != "" && sourceURL.Host != "localhost" {
+			return "", fmt.Errorf("'%s' refers to another host, file URLs have to be local", source)
+		}
+		source = sourceURL.Path
+	}
+
+	if !filepath.IsAbs(source) {
+		return "", fmt.Errorf("'%s' is neither a file:// URL nor an absolute path", source)
+	}
+
+	return filepath.Clean(source), nil
+}
+
+func parseLocalImage(setting string, source string, checksum string, sums string) (resolvedImageFile, error) {
+	// Validate a local image and where its checksum comes from
+
+	path, err := parseLocalImagePath(source)
+	if err != nil {
+		return resolvedImageFile{}, fmt.Errorf("invalid %s: %w", setting, err)
+	}
+
+	_, err = os.Stat(path)
+	if err != nil {
+		return resolvedImageFile{}, fmt.Errorf("'%s' was specified as %s but can not be accessed: %w", path, setting, err)
+	}
+
+	localImage := resolvedImageFile{
+		URL:  (&url.URL{Scheme: "file", Path: path}).String(),
+		Path: path,
+	}
+
+	switch {
+	case checksum != "" && sums != "":
+		return resolvedImageFile{}, fmt.Errorf("%s_sha256 and %s_sums can not be combined", setting, setting)
+	case checksum != "":
+		if !sha256Regexp.MatchString(checksum) {
+			return resolvedImageFile{}, fmt.Errorf("invalid %s_sha256 '%s', must be a hex encoded SHA256", setting, checksum)
+		}
+		localImage.Checksum = strings.ToLower(checksum)
+	case sums != "":
+		localImage.SumsPath, err = parseLocalImagePath(sums)
+		if err != nil {
+			return resolvedImageFile{}, fmt.Errorf("invalid %s_sums: %w", setting, err)
+		}
+	default:
+		return resolvedImageFile{}, fmt.Errorf("%s needs either %s_sha256 or %s_sums to be verified", setting, setting, setting)
+	}
+
+	return localImage, nil
+}
+
+func isHTTPURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func parseRemoteImage(setting string, source string, checksum string, sums string) (resolvedImageFile, error) {
+	// Validate an image downloaded from a configured URL and where its checksum comes from
+
+	fileName, err := getFilenameFromURL(source)
+	if err != nil {
+		return resolvedImageFile{}, fmt.Errorf("invalid %s: %w", setting, err)
+	}
+	if fileName == "" {
+		return resolvedImageFile{}, fmt.Errorf("invalid %s '%s', the URL has to end with a file name", setting, source)
+	}
+
+	remoteImage := resolvedImageFile{
+		URL:               source,
+		ChecksumAlgorithm: localImageChecksumAlgorithm,
+		Configured:        true,
+	}
+
+	switch {
+	case checksum != "" && sums != "":
+		return resolvedImageFile{}, fmt.Errorf("%s_sha256 and %s_sums can not be combined", setting, setting)
+	case checksum != "":
+		if !sha256Regexp.MatchString(checksum) {
+			return resolvedImageFile{}, fmt.Errorf("invalid %s_sha256 '%s', must be a hex encoded SHA256", setting, checksum)
+		}
+		remoteImage.Checksum = strings.ToLower(checksum)
+	case sums != "":
+		// The SUMS file is downloaded along with the image
+		if !isHTTPURL(sums) {
+			return resolvedImageFile{}, fmt.Errorf("invalid %s_sums '%s', must be a http or https URL for a %s URL", setting, sums, setting)
+		}
+		fileName, err = getFilenameFromURL(sums)
+		if err != nil {
+			return resolvedImageFile{}, fmt.Errorf("invalid %s_sums: %w", setting, err)
+		}
+		if fileName == "" {
+			return resolvedImageFile{}, fmt.Errorf("invalid %s_sums '%s', the URL has to end with a file name", setting, sums)
+		}
+		remoteImage.SumsURL = sums
+	default:
+		return resolvedImageFile{}, fmt.Errorf("%s needs either %s_sha256 or %s_sums to be verified", setting, setting, setting)
+	}
+
+	return remoteImage, nil
+}
+
+func (i *InstanceGroup) parseLocalImages() error {
+	// Validate the local or registry disk image and local or downloaded kernel replacing the ones of the image profile
+
+	var err error
+
+	if isOCIReference(i.VMDiskImage) {
+		// Artifacts are verified by their digest
+		if i.VMDiskImageSHA256 != "" || i.VMDiskImageSums != "" {
+			return errors.New("vm_disk_image_sha256 and vm_disk_image_sums can not be used with an oci:// vm_disk_image")
+		}
+
+		reference, err := parseOCIReference(i.VMDiskImage)
+		if err != nil {
+			return err
+		}
+		i.registryImage = &reference
+	} else if i.VMDiskImage != "" {
+		i.localDiskImage, err = parseLocalImage("vm_disk_image", i.VMDiskImage, i.VMDiskImageSHA256, i.VMDiskImageSums)
+		if err != nil {
+			return err
+		}
+	} else if i.VMDiskImageSHA256 != "" || i.VMDiskImageSums != "" {
+		return errors.New("vm_disk_image_sha256 and vm_disk_image_sums need vm_disk_image to be set")
+	}
+
+	if i.registryImage == nil && (i.VMImageRegistryUsername != "" || i.VMImageRegistryPassword != "") {
+		return errors.New("vm_image_registry_username and vm_image_registry_password need an oci:// vm_disk_image")
+	}
+
+	if i.VMKernel != "" {
+		if !i.bootsKernel() {
+			return fmt.Errorf("vm_kernel can not be used with distro %s which does not boot a separate kernel", i.Distro)
+		}
+
+		if isHTTPURL(i.VMKernel) {
+			i.localKernel, err = parseRemoteImage("vm_kernel", i.VMKernel, i.VMKernelSHA256, i.VMKernelSums)
+		} else {
+			i.localKernel, err = parseLocalImage("vm_kernel", i.VMKernel, i.VMKernelSHA256, i.VMKernelSums)
+		}
+		if err != nil {
+			return err
+		}
+	} else if i.VMKernelSHA256 != "" || i.VMKernelSums != "" {
+		return errors.New("vm_kernel_sha256 and vm_kernel_sums need vm_kernel to be set")
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) verifyLocalImage(description string, file resolvedImageFile, path string) error {
+	// Check a local image, or a copy of it at path, against its configured checksum
+
+	expectedChecksum := file.Checksum
+	if expectedChecksum == "" {
+		var err error
+		expectedChecksum, err = getChecksumByFilename(file.SumsPath, filepath.Base(file.Path), localImageChecksumAlgorithm)
+		if err != nil {
+			return fmt.Errorf("could not find the checksum of %s in %s: %w", file.Path, file.SumsPath, err)
+		}
+	}
+
+	localChecksum, err := i.cachedFileChecksum(path, localImageChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	if localChecksum != expectedChecksum {
+		return fmt.Errorf("checksum of %s does not match the configured checksum, refusing to use it", file.Path)
+	}
+
+	i.logger.Info(description+" verified.", "path", file.Path)
+
+	return nil
+}
+
+func (i *InstanceGroup) copyLocalImage(description string, file resolvedImageFile, targetPath string) error {
+	// Copy a local image and verify the copy, so changes to the source don't affect the VMs
+
+	_, err := hostCommands.Run(context.Background(), hostCommand{Args: []string{"cp", "-f", file.Path, targetPath}, Timeout: noCommandTimeout})
+	if err != nil {
+		return fmt.Errorf("could not copy %s: %w", file.Path, err)
+	}
+
+	return i.verifyLocalImage(description, file, targetPath)
+}
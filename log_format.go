@@ -0,0 +1,140 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Classes of errors which log pipelines can alert on without parsing messages
+const (
+	errorKindTimeout    = "timeout"
+	errorKindCanceled   = "canceled"
+	errorKindNotFound   = "not_found"
+	errorKindPermission = "permission"
+	errorKindCommand    = "command"
+	errorKindNetwork    = "network"
+	errorKindOther      = "other"
+)
+
+func (i *InstanceGroup) checkLogFormat() error {
+	// Check log_format, it applies to the logs the plugin writes itself, the runner formats the lines it takes over
+
+	if i.LogFormat == "" {
+		i.LogFormat = logFormatText
+	}
+
+	if i.LogFormat != logFormatText && i.LogFormat != logFormatJSON {
+		return fmt.Errorf("invalid log_format '%s', must be text or json", i.LogFormat)
+	}
+
+	return nil
+}
+
+func errorKind(err error) string {
+	// Classify an error by what went wrong rather than where
+
+	var exitErr *exec.ExitError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return errorKindTimeout
+	case errors.Is(err, context.Canceled):
+		return errorKindCanceled
+	case errors.Is(err, fs.ErrNotExist):
+		return errorKindNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return errorKindPermission
+	case errors.As(err, &exitErr):
+		return errorKindCommand
+	case errors.As(err, &netErr):
+		return errorKindNetwork
+	default:
+		return errorKindOther
+	}
+}
+
+func logDuration(started time.Time) float64 {
+	// Get the seconds since started, logged as duration by every module
+
+	return time.Since(started).Round(time.Millisecond).Seconds()
+}
+
+// Adds error_kind next to every error logged, so all modules' lines carry the same fields
+type fieldLogger struct {
+	hclog.Logger
+}
+
+func newFieldLogger(logger hclog.Logger) hclog.Logger {
+	return &fieldLogger{Logger: logger}
+}
+
+func addErrorKind(args []any) []any {
+	// Insert error_kind after the value of an error key, other arguments are left as they are
+
+	for index := 0; index+1 < len(args); index += 2 {
+		if key, ok := args[index].(string); !ok || key != "error" {
+			continue
+		}
+
+		err, ok := args[index+1].(error)
+		if !ok || err == nil {
+			continue
+		}
+
+		withKind := append([]any{}, args[:index+2]...)
+		withKind = append(withKind, "error_kind", errorKind(err))
+		return append(withKind, args[index+2:]...)
+	}
+
+	return args
+}
+
+func (l *fieldLogger) Log(level hclog.Level, message string, args ...any) {
+	l.Logger.Log(level, message, addErrorKind(args)...)
+}
+
+func (l *fieldLogger) Trace(message string, args ...any) {
+	l.Logger.Trace(message, addErrorKind(args)...)
+}
+
+func (l *fieldLogger) Debug(message string, args ...any) {
+	l.Logger.Debug(message, addErrorKind(args)...)
+}
+
+func (l *fieldLogger) Info(message string, args ...any) {
+	l.Logger.Info(message, addErrorKind(args)...)
+}
+
+func (l *fieldLogger) Warn(message string, args ...any) {
+	l.Logger.Warn(message, addErrorKind(args)...)
+}
+
+func (l *fieldLogger) Error(message string, args ...any) {
+	l.Logger.Error(message, addErrorKind(args)...)
+}
+
+func (l *fieldLogger) With(args ...any) hclog.Logger {
+	return &fieldLogger{Logger: l.Logger.With(addErrorKind(args)...)}
+}
+
+func (l *fieldLogger) Named(name string) hclog.Logger {
+	return &fieldLogger{Logger: l.Logger.Named(name)}
+}
+
+func (l *fieldLogger) ResetNamed(name string) hclog.Logger {
+	return &fieldLogger{Logger: l.Logger.ResetNamed(name)}
+}
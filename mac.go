@@ -0,0 +1,63 @@
+package fleetingd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const defaultMACPrefix = "de:51"
+
+func (i *InstanceGroup) parseMACPrefix() error {
+	// Validate the prefix of the instances' MAC addresses, e.g. an OUI
+
+	if i.VMMACPrefix == "" {
+		i.VMMACPrefix = defaultMACPrefix
+	}
+
+	prefix := []byte{}
+	for _, octet := range strings.Split(i.VMMACPrefix, ":") {
+		value, err := hex.DecodeString(octet)
+		if err != nil || len(value) != 1 {
+			return fmt.Errorf("'%s' was specified as vm_mac_prefix but is not of the form 'xx:xx[:xx...]'", i.VMMACPrefix)
+		}
+		prefix = append(prefix, value...)
+	}
+
+	// Leave enough room to tell the slots apart
+	if len(prefix) > 4 {
+		return fmt.Errorf("vm_mac_prefix '%s' is too long, at most 4 octets are allowed", i.VMMACPrefix)
+	}
+
+	// The guests' addresses must be unicast
+	if prefix[0]&1 != 0 {
+		return fmt.Errorf("vm_mac_prefix '%s' is a multicast prefix", i.VMMACPrefix)
+	}
+
+	i.macPrefix = prefix
+
+	return nil
+}
+
+func (i *InstanceGroup) makeMACAddress(instanceIndex int) (string, error) {
+	// Get the MAC address of an instance, either random or derived from its slot
+
+	address := make(net.HardwareAddr, 6)
+	copy(address, i.macPrefix)
+
+	if i.VMMACDeterministic {
+		// The slot goes into the last octets, so slot N always gets the same address
+		suffix := binary.BigEndian.AppendUint64(nil, uint64(instanceIndex))
+		copy(address[len(i.macPrefix):], suffix[8-(6-len(i.macPrefix)):])
+	} else {
+		_, err := rand.Read(address[len(i.macPrefix):])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return address.String(), nil
+}
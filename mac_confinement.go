@@ -0,0 +1,368 @@
+package fleetingd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Values of vm_mac_confinement, auto picks the mandatory access control the kernel has enabled
+const (
+	macConfinementNone     = "none"
+	macConfinementAuto     = "auto"
+	macConfinementAppArmor = "apparmor"
+	macConfinementSELinux  = "selinux"
+)
+
+const (
+	appArmorEnabledPath  = "/sys/module/apparmor/parameters/enabled"
+	appArmorProfilesPath = "/sys/kernel/security/apparmor/profiles"
+	appArmorRemovePath   = "/sys/kernel/security/apparmor/.remove"
+	selinuxEnforcePath   = "/sys/fs/selinux/enforce"
+)
+
+// The generated profile of an instance is named after it
+const appArmorProfilePrefix = "fleetingd-"
+
+// Process context of the hypervisors, each instance gets its own pair of categories on top like libvirt's sVirt
+const defaultSELinuxContext = "system_u:system_r:svirt_t:s0"
+
+// Types of the files the hypervisors may use, the instance's own ones carry its categories
+const selinuxImageType = "svirt_image_t"
+const selinuxContentType = "virt_content_t"
+
+func (i *InstanceGroup) checkMACConfinement() error {
+	// Resolve vm_mac_confinement and check the kernel enforces it and its tools are installed
+
+	if i.VMMACConfinement == "" {
+		i.VMMACConfinement = macConfinementNone
+	}
+
+	switch i.VMMACConfinement {
+	case macConfinementNone:
+		if i.VMAppArmorProfile != "" || i.VMSELinuxContext != "" {
+			return errors.New("vm_apparmor_profile and vm_selinux_context require vm_mac_confinement")
+		}
+		return nil
+	case macConfinementAuto:
+		switch {
+		case appArmorEnabled():
+			i.VMMACConfinement = macConfinementAppArmor
+		case selinuxEnabled():
+			i.VMMACConfinement = macConfinementSELinux
+		default:
+			return errors.New("vm_mac_confinement = 'auto' but neither AppArmor nor SELinux is enabled")
+		}
+	case macConfinementAppArmor, macConfinementSELinux:
+	default:
+		return fmt.Errorf("invalid vm_mac_confinement '%s', must be none, auto, apparmor or selinux", i.VMMACConfinement)
+	}
+
+	// These need devices and files the confined hypervisor isn't allowed to open
+	unsupported := map[string]bool{
+		"vm_passthrough_devices":    len(i.VMPassthroughDevices) > 0,
+		"vm_net_sriov_devices":      len(i.VMNetSRIOVDevices) > 0,
+		"vm_snapshot_boot":          i.VMSnapshotBoot,
+		"vm_confidential_computing": i.VMConfidentialComputing != "",
+	}
+	for _, setting := range slices.Sorted(maps.Keys(unsupported)) {
+		if unsupported[setting] {
+			return fmt.Errorf("vm_mac_confinement can not be combined with %s", setting)
+		}
+	}
+
+	if i.VMMACConfinement == macConfinementAppArmor {
+		return i.checkAppArmor()
+	}
+	return i.checkSELinux()
+}
+
+func appArmorEnabled() bool {
+	contents, err := os.ReadFile(appArmorEnabledPath)
+	return err == nil && strings.TrimSpace(string(contents)) == "Y"
+}
+
+func selinuxEnabled() bool {
+	_, err := os.Stat(selinuxEnforcePath)
+	return err == nil
+}
+
+func (i *InstanceGroup) checkAppArmor() error {
+	// Check AppArmor is enabled and the configured profile is loaded, the generated ones are loaded by the plugin
+
+	if i.VMSELinuxContext != "" {
+		return errors.New("vm_selinux_context requires vm_mac_confinement = 'selinux'")
+	}
+
+	if !appArmorEnabled() {
+		return errors.New("vm_mac_confinement = 'apparmor' but AppArmor is not enabled in the kernel")
+	}
+
+	for _, binary := range []string{"aa-exec", "apparmor_parser"} {
+		_, err := exec.LookPath(binary)
+		if err != nil {
+			return fmt.Errorf("vm_mac_confinement = 'apparmor' requires %s, please install apparmor: %w", binary, err)
+		}
+	}
+
+	if i.VMAppArmorProfile == "" {
+		return nil
+	}
+
+	// Lines look like "name (enforce)"
+	profiles, err := os.ReadFile(appArmorProfilesPath)
+	if err != nil {
+		return fmt.Errorf("could not list the loaded AppArmor profiles, securityfs has to be mounted: %w", err)
+	}
+	for _, line := range strings.Split(string(profiles), "\n") {
+		name, mode, _ := strings.Cut(line, " ")
+		if name != i.VMAppArmorProfile {
+			continue
+		}
+
+		if mode != "(enforce)" {
+			i.logger.Warn("AppArmor profile of the VMs is not enforced.", "profile", i.VMAppArmorProfile, "mode", strings.Trim(mode, "()"))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("vm_apparmor_profile '%s' is not loaded, load it with apparmor_parser -r", i.VMAppArmorProfile)
+}
+
+func (i *InstanceGroup) checkSELinux() error {
+	// Check SELinux is enabled and its tools are installed, permissive mode only logs what would be denied
+
+	if i.VMAppArmorProfile != "" {
+		return errors.New("vm_apparmor_profile requires vm_mac_confinement = 'apparmor'")
+	}
+
+	if !selinuxEnabled() {
+		return errors.New("vm_mac_confinement = 'selinux' but SELinux is not enabled in the kernel")
+	}
+
+	for _, binary := range []string{"runcon", "chcon"} {
+		_, err := exec.LookPath(binary)
+		if err != nil {
+			return fmt.Errorf("vm_mac_confinement = 'selinux' requires %s, please install coreutils: %w", binary, err)
+		}
+	}
+
+	if i.VMSELinuxContext == "" {
+		i.VMSELinuxContext = defaultSELinuxContext
+	}
+
+	// The categories are added per instance
+	if strings.Count(i.VMSELinuxContext, ":") != 3 || strings.Contains(i.VMSELinuxContext, ",") {
+		return fmt.Errorf("invalid vm_selinux_context '%s', must be user:role:type:level without categories", i.VMSELinuxContext)
+	}
+
+	enforce, err := os.ReadFile(selinuxEnforcePath)
+	if err == nil && strings.TrimSpace(string(enforce)) != "1" {
+		i.logger.Warn("SELinux is permissive, the VMs' confinement is only logged.")
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) macConfined() bool {
+	return i.VMMACConfinement == macConfinementAppArmor || i.VMMACConfinement == macConfinementSELinux
+}
+
+func (i *InstanceGroup) appArmorProfileName(instanceName string) string {
+	// Get the profile an instance's hypervisor runs under, vm_apparmor_profile is shared by all
+
+	if i.VMAppArmorProfile != "" {
+		return i.VMAppArmorProfile
+	}
+	return appArmorProfilePrefix + instanceName
+}
+
+func (i *InstanceGroup) selinuxCategories(instanceName string) (string, error) {
+	// Get an instance's pair of categories, unique per slot so no two instances can access each other's files
+
+	instanceIndex, err := strconv.Atoi(strings.TrimPrefix(instanceName, "fleetingd"))
+	if err != nil {
+		return "", err
+	}
+
+	// c0 to c511 and c512 to c1023 give 262144 distinct pairs
+	if instanceIndex >= 512*512 {
+		return "", fmt.Errorf("no SELinux categories left for %s", instanceName)
+	}
+
+	return fmt.Sprintf("c%d,c%d", instanceIndex/512, 512+instanceIndex%512), nil
+}
+
+func (i *InstanceGroup) selinuxLevel(instanceName string) (string, error) {
+	// Get the level of an instance's process and files, the configured sensitivity with its categories
+
+	categories, err := i.selinuxCategories(instanceName)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(i.VMSELinuxContext, ":")
+	return parts[3] + ":" + categories, nil
+}
+
+func (i *InstanceGroup) confinementWrapper(instanceName string) []string {
+	// Get the command starting an instance's hypervisor confined, it execs the hypervisor once the profile or context is set
+
+	switch i.VMMACConfinement {
+	case macConfinementAppArmor:
+		return []string{"aa-exec", "-p", i.appArmorProfileName(instanceName), "--"}
+	case macConfinementSELinux:
+		// The level was checked when the instance's files were labeled
+		level, _ := i.selinuxLevel(instanceName)
+		parts := strings.Split(i.VMSELinuxContext, ":")
+		return []string{"runcon", strings.Join(append(parts[:3], level), ":")}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) confineInstance(instanceName string, paths ...string) error {
+	// Let an instance's hypervisor open its own directory, the given files and the shared images only, empty paths are skipped
+
+	if !i.macConfined() {
+		return nil
+	}
+
+	writablePaths := slices.DeleteFunc(slices.Clone(paths), func(path string) bool { return path == "" })
+
+	readOnlyPaths, err := i.sharedHypervisorPaths()
+	if err != nil {
+		return err
+	}
+
+	if i.VMMACConfinement == macConfinementAppArmor {
+		if i.VMAppArmorProfile != "" {
+			return nil
+		}
+		return i.loadAppArmorProfile(instanceName, writablePaths, readOnlyPaths)
+	}
+
+	return i.labelInstanceFiles(instanceName, writablePaths, readOnlyPaths)
+}
+
+func (i *InstanceGroup) sharedHypervisorPaths() ([]string, error) {
+	// Get the files all instances' hypervisors read, the firmware and kernel they boot and the image their overlays are backed by
+
+	var paths []string
+
+	if i.bootsKernel() {
+		kernelFilePath, err := i.getBootKernelPath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, kernelFilePath)
+	} else {
+		paths = append(paths, i.VMFirmware)
+	}
+
+	if i.VMDiskOverlay {
+		paths = append(paths, i.getBaseImagePath())
+	}
+
+	return paths, nil
+}
+
+func (i *InstanceGroup) loadAppArmorProfile(instanceName string, writablePaths []string, readOnlyPaths []string) error {
+	// Generate the instance's profile and load it, one loaded by an earlier instance in the slot is replaced
+
+	binary, err := exec.LookPath(hypervisorBackend)
+	if err != nil {
+		return err
+	}
+	binary, err = filepath.EvalSymlinks(binary)
+	if err != nil {
+		return err
+	}
+
+	profile := bytes.Buffer{}
+	err = i.templates.ExecuteTemplate(&profile, "apparmor-profile.tpl", struct {
+		InstanceName  string
+		Profile       string
+		Binary        string
+		InstanceDir   string
+		WritablePaths []string
+		ReadOnlyPaths []string
+	}{
+		InstanceName:  instanceName,
+		Profile:       i.appArmorProfileName(instanceName),
+		Binary:        binary,
+		InstanceDir:   i.getInstanceDir(instanceName),
+		WritablePaths: writablePaths,
+		ReadOnlyPaths: readOnlyPaths,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = hostCommands.Run(context.Background(), hostCommand{Args: []string{"apparmor_parser", "--replace", "--skip-cache"}, Stdin: &profile})
+	if err != nil {
+		return fmt.Errorf("could not load AppArmor profile of %s: %w", instanceName, err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) labelInstanceFiles(instanceName string, writablePaths []string, readOnlyPaths []string) error {
+	// Label the instance's files with its categories and the shared ones readable by every instance
+
+	level, err := i.selinuxLevel(instanceName)
+	if err != nil {
+		return err
+	}
+
+	labels := []struct {
+		recursive bool
+		paths     []string
+		context   string
+	}{
+		{true, []string{i.getInstanceDir(instanceName)}, "system_u:object_r:" + selinuxImageType + ":" + level},
+		{false, writablePaths, "system_u:object_r:" + selinuxImageType + ":" + level},
+		{false, readOnlyPaths, "system_u:object_r:" + selinuxContentType + ":" + strings.Split(i.VMSELinuxContext, ":")[3]},
+	}
+
+	for _, label := range labels {
+		if len(label.paths) == 0 {
+			continue
+		}
+
+		args := []string{label.context}
+		if label.recursive {
+			args = []string{"-R", label.context}
+		}
+
+		_, err := runCommand(context.Background(), append(append([]string{"chcon"}, args...), label.paths...)...)
+		if err != nil {
+			return fmt.Errorf("could not label the files of %s: %w", instanceName, err)
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) releaseConfinement(instanceName string) error {
+	// Unload an instance's generated AppArmor profile, labels go with the files
+
+	if i.VMMACConfinement != macConfinementAppArmor || i.VMAppArmorProfile != "" {
+		return nil
+	}
+
+	err := os.WriteFile(appArmorRemovePath, []byte(i.appArmorProfileName(instanceName)), 0)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not unload AppArmor profile of %s: %w", instanceName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package fleetingd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+const memoryCheckInterval = 10 * time.Second
+
+func (i *InstanceGroup) runMemoryManager(ctx context.Context) {
+	// Periodically balance guest memory against host memory pressure
+
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := i.inventory.BalanceMemory(i)
+			if err != nil {
+				i.logger.Error("memory balancing failed", "error", err)
+			}
+		}
+	}
+}
+
+func (i *Inventory) BalanceMemory(instanceGroup *InstanceGroup) error {
+	// Inflate the balloons of idle guests when the host runs low on memory and deflate them once it recovered
+
+	availableMegabytes, err := getHostAvailableMemoryMegabytes()
+	if err != nil {
+		return err
+	}
+
+	sessions, err := instanceGroup.getSSHSessions()
+	if err != nil {
+		return err
+	}
+
+	// Keep some hysteresis so balloons don't flap around the threshold
+	underPressure := availableMegabytes < instanceGroup.HostMinAvailableMemoryMegabytes
+	recovered := availableMegabytes > 2*instanceGroup.HostMinAvailableMemoryMegabytes
+
+	// The balloons are resized without the lock, a hanging hypervisor would block the whole inventory otherwise
+	var resizes []balloonResize
+
+	i.lock.RLock()
+	for _, instance := range i.instances {
+		// Booting instances don't answer yet and deleted ones are on their way out
+		if instance.Internal || instance.Paused || instance.State != provider.StateRunning {
+			continue
+		}
+
+		active := sessions.active(instance)
+
+		targetMegabytes := instance.BalloonMegabytes
+		switch {
+		case active || recovered:
+			// Jobs get the full memory, instances idle for vm_idle_balloon_minutes keep their balloon
+			targetMegabytes = instanceGroup.idleBalloonMegabytes(instance, active)
+		case underPressure:
+			targetMegabytes = instanceGroup.maxBalloonMegabytes()
+		}
+
+		if targetMegabytes == instance.BalloonMegabytes {
+			continue
+		}
+
+		resizes = append(resizes, balloonResize{instance: instance, fromMegabytes: instance.BalloonMegabytes, toMegabytes: targetMegabytes})
+	}
+	i.lock.RUnlock()
+
+	for _, resize := range resizes {
+		resized, err := i.resizeBalloon(instanceGroup, resize)
+		if err != nil {
+			resize.instance.logger.Error("could not resize memory balloon", "error", err)
+			continue
+		}
+
+		if resized {
+			resize.instance.logger.Info("resized memory balloon", "balloon_mb", resize.toMegabytes, "host_available_mb", availableMegabytes)
+		}
+	}
+
+	return nil
+}
+
+// Balloon of an instance picked under the inventory lock, resized once the lock was released
+type balloonResize struct {
+	instance      *InstanceInfo
+	fromMegabytes uint64
+	toMegabytes   uint64
+}
+
+func (i *Inventory) resizeBalloon(instanceGroup *InstanceGroup, resize balloonResize) (bool, error) {
+	// Resize an instance's balloon unless it was paused, removed or resized by someone else since it was picked
+
+	instance := resize.instance
+
+	instance.apiLock.Lock()
+	defer instance.apiLock.Unlock()
+
+	i.lock.RLock()
+	unchanged := i.instances[instance.Name] == instance && instance.State == provider.StateRunning && !instance.Paused && instance.BalloonMegabytes == resize.fromMegabytes
+	i.lock.RUnlock()
+
+	if !unchanged {
+		return false, nil
+	}
+
+	err := newHypervisorAPIClient(instanceGroup.getAPISocketPath(instance.Name)).ResizeBalloon(resize.toMegabytes * 1024 * 1024)
+	if err != nil {
+		return false, err
+	}
+
+	i.lock.Lock()
+	instance.BalloonMegabytes = resize.toMegabytes
+	i.lock.Unlock()
+
+	return true, nil
+}
+
+func (i *InstanceGroup) maxBalloonMegabytes() uint64 {
+	// Get the largest balloon of an instance, it keeps at least vm_memory_floor_mb
+
+	return i.VMMemoryMegabytes - min(i.VMMemoryFloorMegabytes, i.VMMemoryMegabytes)
+}
+
+func getHostAvailableMemoryMegabytes() (uint64, error) {
+	// Read MemAvailable from /proc/meminfo
+
+	meminfo, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer meminfo.Close()
+
+	scanner := bufio.NewScanner(meminfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		availableKilobytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return availableKilobytes / 1024, nil
+	}
+	if scanner.Err() != nil {
+		return 0, scanner.Err()
+	}
+
+	return 0, errors.New("MemAvailable not found in /proc/meminfo")
+}
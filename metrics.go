@@ -0,0 +1,257 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// Version 0.0.4 of the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Boots take seconds to a few minutes, prebuilds up to vm_prebuild_timeout_minutes
+var bootDurationBuckets = []float64{5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600}
+var prebuildDurationBuckets = []float64{30, 60, 120, 180, 300, 600, 900, 1200, 1800, 3600}
+
+// The steps of a boot take from milliseconds to the whole boot
+var bootEventBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// Cumulative histogram in the form Prometheus expects it
+type histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Counters and histograms of the plugin, the gauges are read from the inventory when scraped
+type metrics struct {
+	heartbeatFailures  atomic.Uint64
+	downloadedBytes    atomic.Uint64
+	guestPanics        atomic.Uint64
+	hypervisorOOMKills atomic.Uint64
+	diskSpaceRecycles  atomic.Uint64
+	diskReclaimedBytes atomic.Uint64
+
+	bootDuration     *histogram
+	prebuildDuration *histogram
+
+	// Time from the start of a boot until each of its events
+	bootEvents map[string]*histogram
+
+	// Failed boots by the label of their kind
+	bootFailures map[string]*atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func newMetrics() *metrics {
+	bootEvents := map[string]*histogram{}
+	for _, event := range bootEventNames {
+		bootEvents[event] = newHistogram(bootEventBuckets)
+	}
+
+	bootFailures := map[string]*atomic.Uint64{otherBootFailureLabel: {}}
+	for _, kind := range bootFailureKinds {
+		bootFailures[kind.label] = &atomic.Uint64{}
+	}
+
+	return &metrics{
+		bootDuration:     newHistogram(bootDurationBuckets),
+		prebuildDuration: newHistogram(prebuildDurationBuckets),
+		bootEvents:       bootEvents,
+		bootFailures:     bootFailures,
+	}
+}
+
+func (m *metrics) countBootFailure(err error) {
+	// Count a failed boot under the kind of its error, a cancelled one didn't fail
+
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	m.bootFailures[bootFailureLabel(err)].Add(1)
+}
+
+func (m *metrics) observeEvent(event lifecycleEvent) {
+	// Time the boots and prebuilds by their events
+
+	switch event.Event {
+	case eventSSHReady:
+		m.bootDuration.observe(event.ElapsedSeconds)
+	case eventPrebuildFinished:
+		m.prebuildDuration.observe(event.ElapsedSeconds)
+	}
+
+	histogram, ok := m.bootEvents[event.Event]
+	if ok {
+		histogram.observe(event.ElapsedSeconds)
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	// Count a value in every bucket it fits into
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for index, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[index]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	h.writeSamples(w, name, "")
+}
+
+func (h *histogram) writeSamples(w io.Writer, name string, labels string) {
+	// Write the buckets, sum and count of a histogram, labels such as event="tap_up" tell the histograms of one metric apart
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	bucketLabels := ""
+	sampleLabels := ""
+	if labels != "" {
+		bucketLabels = labels + ","
+		sampleLabels = "{" + labels + "}"
+	}
+
+	for index, bucket := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, bucketLabels, formatMetricValue(bucket), h.counts[index])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, bucketLabels, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, sampleLabels, formatMetricValue(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, sampleLabels, h.count)
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatMetricValue(value))
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (i *Inventory) countInstanceStates() map[provider.State]int {
+	// Count the instances handed to the runner by state, unlike GetInstanceStates this leaves the removed ones to be reported
+
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	counts := map[provider.State]int{
+		provider.StateCreating: 0,
+		provider.StateRunning:  0,
+		provider.StateDeleting: 0,
+	}
+
+	for _, instance := range i.instances {
+		if instance.Internal {
+			continue
+		}
+		counts[instance.State]++
+	}
+
+	return counts
+}
+
+func (i *InstanceGroup) writeMetrics(w io.Writer) {
+	// Write all metrics in the Prometheus text format
+
+	metrics := i.inventory.metrics
+	states := i.inventory.countInstanceStates()
+
+	fmt.Fprintf(w, "# HELP fleetingd_instances Instances handed to the runner by state.\n# TYPE fleetingd_instances gauge\n")
+	for _, state := range []provider.State{provider.StateCreating, provider.StateRunning, provider.StateDeleting} {
+		fmt.Fprintf(w, "fleetingd_instances{state=\"%s\"} %d\n", state, states[state])
+	}
+
+	i.inventory.lock.RLock()
+	usedSlots := i.inventory.ipam.Count()
+	i.inventory.lock.RUnlock()
+
+	writeMetric(w, "fleetingd_ipam_slots_used", "gauge", "Instance subnets allocated, the prebuild VM's included.", float64(usedSlots))
+	writeMetric(w, "fleetingd_ipam_slots", "gauge", "Instance subnets fitting into vm_subnet.", float64(i.maxIPAMSlots()))
+
+	metrics.bootDuration.write(w, "fleetingd_boot_duration_seconds", "Time from the start of a boot until the instance could be logged in to.")
+	metrics.prebuildDuration.write(w, "fleetingd_prebuild_duration_seconds", "Time the prebuild VM took to provision the golden image.")
+
+	fmt.Fprintf(w, "# HELP fleetingd_boot_event_seconds Time from the start of a boot until each of its steps finished.\n# TYPE fleetingd_boot_event_seconds histogram\n")
+	for _, event := range bootEventNames {
+		metrics.bootEvents[event].writeSamples(w, "fleetingd_boot_event_seconds", fmt.Sprintf("event=\"%s\"", event))
+	}
+
+	fmt.Fprintf(w, "# HELP fleetingd_boot_failures_total Boots which failed or did not become ready within vm_boot_timeout_minutes by the kind of failure.\n# TYPE fleetingd_boot_failures_total counter\n")
+	for _, kind := range bootFailureKinds {
+		fmt.Fprintf(w, "fleetingd_boot_failures_total{kind=\"%s\"} %d\n", kind.label, metrics.bootFailures[kind.label].Load())
+	}
+	fmt.Fprintf(w, "fleetingd_boot_failures_total{kind=\"%s\"} %d\n", otherBootFailureLabel, metrics.bootFailures[otherBootFailureLabel].Load())
+
+	writeMetric(w, "fleetingd_image_download_bytes_total", "counter", "Bytes downloaded of disk images, kernels, checksums and signatures.", float64(metrics.downloadedBytes.Load()))
+	writeMetric(w, "fleetingd_heartbeat_failures_total", "counter", "Heartbeats which could not log in to an instance.", float64(metrics.heartbeatFailures.Load()))
+	writeMetric(w, "fleetingd_guest_panics_total", "counter", "Instances recycled because their kernel panicked.", float64(metrics.guestPanics.Load()))
+	writeMetric(w, "fleetingd_hypervisor_oom_kills_total", "counter", "Hypervisors killed for exceeding their vm_cgroup_limits memory limit.", float64(metrics.hypervisorOOMKills.Load()))
+	writeMetric(w, "fleetingd_disk_space_recycles_total", "counter", "Idle instances recycled with host_disk_recycle_idle to free space in vm_disk_directory.", float64(metrics.diskSpaceRecycles.Load()))
+	writeMetric(w, "fleetingd_disk_reclaimed_bytes_total", "counter", "Space the job instances' disks shrank by, e.g. after the trims of vm_fstrim_interval_minutes.", float64(metrics.diskReclaimedBytes.Load()))
+
+	// A filesystem which can't be read is left out rather than reported as empty
+	freeBytes, totalBytes, err := getDiskSpace(i.VMDiskDir)
+	if err == nil {
+		writeMetric(w, "fleetingd_disk_free_bytes", "gauge", "Space left in vm_disk_directory for the overlays to grow.", float64(freeBytes))
+		writeMetric(w, "fleetingd_disk_size_bytes", "gauge", "Size of the filesystem vm_disk_directory is on.", float64(totalBytes))
+	}
+
+	i.writeKSMMetrics(w)
+
+	// Asked from the hypervisors while scraping, counters of replaced instances start over
+	writeVMStatsMetrics(w, i.collectVMStats())
+}
+
+func (i *InstanceGroup) serveMetrics() error {
+	// Serve the metrics on metrics_listen_address until shutdown, absolute paths are unix sockets and anything else a TCP address
+
+	if i.MetricsListenAddress == "" {
+		return nil
+	}
+
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(i.MetricsListenAddress, "/") {
+		listener, err = listenUnixSocket(i.MetricsListenAddress)
+	} else {
+		listener, err = net.Listen("tcp", i.MetricsListenAddress)
+	}
+	if err != nil {
+		return fmt.Errorf("could not listen on metrics_listen_address '%s': %w", i.MetricsListenAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		i.writeMetrics(w)
+	})
+
+	i.serveHTTP(listener, mux)
+
+	i.logger.Info("Serving metrics.", "address", i.MetricsListenAddress)
+
+	return nil
+}
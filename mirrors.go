@@ -0,0 +1,57 @@
+package fleetingd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+func (i *InstanceGroup) parseImageMirrors() error {
+	// Validate the image mirrors, each one is the base URL the canonical files' paths are appended to
+
+	for index, mirror := range i.VMImageMirrors {
+		mirrorURL, err := url.Parse(mirror)
+		if err != nil {
+			return fmt.Errorf("invalid mirror '%s' in vm_image_mirrors: %w", mirror, err)
+		}
+
+		if (mirrorURL.Scheme != "http" && mirrorURL.Scheme != "https") || mirrorURL.Host == "" {
+			return fmt.Errorf("invalid mirror '%s' in vm_image_mirrors, must be a http or https URL", mirror)
+		}
+
+		if mirrorURL.RawQuery != "" || mirrorURL.Fragment != "" {
+			return fmt.Errorf("invalid mirror '%s' in vm_image_mirrors, must not have a query or fragment", mirror)
+		}
+
+		if !strings.HasSuffix(mirror, "/") {
+			i.VMImageMirrors[index] = mirror + "/"
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) imageSources(canonicalURL string, canonicalFirst bool) []string {
+	// Get the URLs a file is tried at in order, the mirrors keep the canonical URL's path
+
+	parsedURL, err := url.Parse(canonicalURL)
+	if err != nil {
+		return []string{canonicalURL}
+	}
+
+	path := strings.TrimPrefix(parsedURL.EscapedPath(), "/")
+	if parsedURL.RawQuery != "" {
+		path += "?" + parsedURL.RawQuery
+	}
+
+	sources := []string{}
+	for _, mirror := range i.VMImageMirrors {
+		sources = append(sources, mirror+path)
+	}
+
+	if canonicalFirst {
+		return append([]string{canonicalURL}, sources...)
+	}
+
+	return append(sources, canonicalURL)
+}
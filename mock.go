@@ -0,0 +1,437 @@
+package fleetingd
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"golang.org/x/crypto/ssh"
+)
+
+// Simulates the instances instead of booting VMs, for testing runner configurations where there is no KVM
+const hypervisorBackendMock = "mock"
+
+// The simulated instances answer SSH here, only the runner on the same host can reach them
+const mockListenAddress = "127.0.0.1:0"
+
+// An instance which exists only as a directory its jobs run in
+type mockInstance struct {
+	name      string
+	directory string
+	key       ed25519.PrivateKey
+	publicKey ssh.PublicKey
+}
+
+// The instances of hypervisor_backend mock and the SSH server running their jobs' commands on the host
+type mockHypervisor struct {
+	logger   hclog.Logger
+	maxSize  int
+	username string
+
+	directory string
+	listener  net.Listener
+	sshConfig *ssh.ServerConfig
+
+	lock      sync.Mutex
+	instances map[string]*mockInstance
+}
+
+func (i *InstanceGroup) checkHypervisorBackend() error {
+	// Validate hypervisor_backend
+
+	switch i.HypervisorBackend {
+	case "", hypervisorBackend, hypervisorBackendMock:
+		return nil
+	}
+
+	return fmt.Errorf("unknown hypervisor_backend '%s', must be one of: %s, %s", i.HypervisorBackend, hypervisorBackend, hypervisorBackendMock)
+}
+
+func (i *InstanceGroup) initMock() (provider.ProviderInfo, error) {
+	// Start the SSH server of the simulated instances, nothing on the host is touched besides a temporary directory
+
+	err := i.checkSubnetPrefixLength()
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	i.logger.Warn("Simulating the instances with hypervisor_backend mock, their jobs run on the host as the plugin's user.")
+
+	currentUser, err := user.Current()
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("could not determine the plugin's user: %w", err)
+	}
+
+	directory, err := os.MkdirTemp("", "fleetingd-mock-")
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	_, hostKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return provider.ProviderInfo{}, err
+	}
+
+	listener, err := net.Listen("tcp", mockListenAddress)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("could not listen for SSH of the simulated instances: %w", err)
+	}
+
+	mock := &mockHypervisor{
+		logger:    i.logger.Named("mock"),
+		maxSize:   i.maxIPAMSlots() - 1,
+		username:  currentUser.Username,
+		directory: directory,
+		listener:  listener,
+		instances: map[string]*mockInstance{},
+	}
+
+	mock.sshConfig = &ssh.ServerConfig{PublicKeyCallback: mock.authenticate}
+	mock.sshConfig.AddHostKey(hostSigner)
+
+	go mock.serve()
+
+	i.mock = mock
+
+	i.logger.Info("Simulated instances listening for SSH.", "address", listener.Addr().String(), "directory", directory)
+
+	return provider.ProviderInfo{
+		ID:        "fleetingd",
+		MaxSize:   mock.maxSize,
+		Version:   Version.Version,
+		BuildInfo: BuildInfo(),
+	}, nil
+}
+
+func (m *mockHypervisor) Update(updateFunc func(instance string, state provider.State)) {
+	// Report every simulated instance as running, they are ready as soon as they exist
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for name := range m.instances {
+		updateFunc(name, provider.StateRunning)
+	}
+}
+
+func (m *mockHypervisor) Increase(n int) (int, error) {
+	// Create instances in the free slots, slot 0 is the prebuild's in real VMs and stays unused
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	created := 0
+	for index := 1; index <= m.maxSize && created < n; index++ {
+		name := "fleetingd" + strconv.Itoa(index)
+		if _, ok := m.instances[name]; ok {
+			continue
+		}
+
+		instance, err := m.createInstance(name)
+		if err != nil {
+			return created, err
+		}
+
+		m.instances[name] = instance
+		created++
+
+		m.logger.Info("Created simulated instance.", "instance", name)
+	}
+
+	if created < n {
+		return created, fmt.Errorf("only %d of %d instances could be created, all slots are taken", created, n)
+	}
+
+	return created, nil
+}
+
+func (m *mockHypervisor) createInstance(name string) (*mockInstance, error) {
+	// Give an instance its key and the directory its jobs run in
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	directory := filepath.Join(m.directory, name)
+	err = os.Mkdir(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mockInstance{name: name, directory: directory, key: privateKey, publicKey: sshPublicKey}, nil
+}
+
+func (m *mockHypervisor) Decrease(instances []string) ([]string, error) {
+	// Remove instances and their directories, commands still running in them are not waited for
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	removed := []string{}
+	var errs []error
+	for _, name := range instances {
+		instance, ok := m.instances[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("instance %s not found", name))
+			continue
+		}
+
+		delete(m.instances, name)
+
+		err := os.RemoveAll(instance.directory)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		m.logger.Info("Removed simulated instance.", "instance", name)
+		removed = append(removed, name)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+func (m *mockHypervisor) ConnectInfo(name string) (provider.ConnectInfo, error) {
+	// Point the runner at the SSH server with the instance's key
+
+	m.lock.Lock()
+	instance, ok := m.instances[name]
+	m.lock.Unlock()
+	if !ok {
+		return provider.ConnectInfo{}, errors.New("instance not found")
+	}
+
+	marshalledKey, err := ssh.MarshalPrivateKey(instance.key, "fleetingd")
+	if err != nil {
+		return provider.ConnectInfo{}, err
+	}
+
+	host, port, err := net.SplitHostPort(m.listener.Addr().String())
+	if err != nil {
+		return provider.ConnectInfo{}, err
+	}
+
+	protocolPort, err := strconv.Atoi(port)
+	if err != nil {
+		return provider.ConnectInfo{}, err
+	}
+
+	return provider.ConnectInfo{
+		ID:           instance.name,
+		InternalAddr: host,
+
+		ConnectorConfig: provider.ConnectorConfig{
+			Username: m.username,
+			OS:       "linux",
+			Arch:     runtime.GOARCH,
+
+			Protocol:     provider.ProtocolSSH,
+			ProtocolPort: protocolPort,
+			Key:          pem.EncodeToMemory(marshalledKey),
+			Keepalive:    time.Second * 10,
+			Timeout:      time.Second * 3,
+		},
+	}, nil
+}
+
+func (m *mockHypervisor) Heartbeat(name string) error {
+	// Simulated instances are healthy as long as they exist
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.instances[name]
+	if !ok {
+		return errors.New("instance not found")
+	}
+
+	return nil
+}
+
+func (m *mockHypervisor) Shutdown() error {
+	// Stop the SSH server and remove the instances' directories
+
+	m.lock.Lock()
+	m.instances = map[string]*mockInstance{}
+	m.lock.Unlock()
+
+	return errors.Join(m.listener.Close(), os.RemoveAll(m.directory))
+}
+
+func (m *mockHypervisor) authenticate(metadata ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	// Let the key of an instance log in to that instance, whatever user name the runner uses
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, instance := range m.instances {
+		if string(instance.publicKey.Marshal()) == string(key.Marshal()) {
+			return &ssh.Permissions{Extensions: map[string]string{"instance": instance.name}}, nil
+		}
+	}
+
+	return nil, errors.New("unknown key")
+}
+
+func (m *mockHypervisor) serve() {
+	// Accept SSH connections until the listener is closed
+
+	for {
+		connection, err := m.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				m.logger.Error("could not accept SSH connection", "error", err)
+			}
+			return
+		}
+
+		go m.handleConnection(connection)
+	}
+}
+
+func (m *mockHypervisor) handleConnection(connection net.Conn) {
+	// Run the commands of one SSH connection's sessions, other channels like port forwards are refused
+
+	serverConnection, channels, requests, err := ssh.NewServerConn(connection, m.sshConfig)
+	if err != nil {
+		m.logger.Debug("SSH handshake failed", "error", err)
+		return
+	}
+	defer serverConnection.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	instanceName := serverConnection.Permissions.Extensions["instance"]
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are simulated")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go m.handleSession(instanceName, channel, channelRequests)
+	}
+}
+
+func (m *mockHypervisor) handleSession(instanceName string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	// Run a session's command or shell with /bin/sh in the instance's directory, without a terminal
+
+	defer channel.Close()
+
+	m.lock.Lock()
+	instance, ok := m.instances[instanceName]
+	m.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	var environment []string
+	for request := range requests {
+		switch request.Type {
+		case "env":
+			var variable struct {
+				Name  string
+				Value string
+			}
+			err := ssh.Unmarshal(request.Payload, &variable)
+			if err == nil {
+				environment = append(environment, variable.Name+"="+variable.Value)
+			}
+			request.Reply(err == nil, nil)
+		case "exec", "shell":
+			args := []string{"/bin/sh"}
+			if request.Type == "exec" {
+				var command struct {
+					Command string
+				}
+				err := ssh.Unmarshal(request.Payload, &command)
+				if err != nil {
+					request.Reply(false, nil)
+					continue
+				}
+				args = append(args, "-c", command.Command)
+			}
+			request.Reply(true, nil)
+
+			exitStatus := m.runCommand(instance, channel, args, environment)
+
+			status := make([]byte, 4)
+			binary.BigEndian.PutUint32(status, exitStatus)
+			channel.SendRequest("exit-status", false, status)
+			return
+		default:
+			// Terminals and subsystems like SFTP are not simulated
+			request.Reply(false, nil)
+		}
+	}
+}
+
+func (m *mockHypervisor) runCommand(instance *mockInstance, channel ssh.Channel, args []string, environment []string) uint32 {
+	// Run a command with the session as its standard streams and get its exit status
+
+	command := exec.Command(args[0], args[1:]...)
+	command.Dir = instance.directory
+	command.Env = append(append(os.Environ(), "HOME="+instance.directory), environment...)
+	command.Stdout = channel
+	command.Stderr = channel.Stderr()
+
+	// The runner may never close its end, so the command must not wait for the copy of its input
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err)
+		return 255
+	}
+
+	err = command.Start()
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err)
+		return 127
+	}
+
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	err = command.Wait()
+
+	// Commands killed by a signal have no exit code
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) && exitError.ExitCode() >= 0 {
+		return uint32(exitError.ExitCode())
+	}
+	if err != nil {
+		return 255
+	}
+
+	return 0
+}
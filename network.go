@@ -0,0 +1,93 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A backend creates its socket right after it started up
+const backendSocketTimeout = 5 * time.Second
+
+func (i *InstanceGroup) getVhostUserNetSocketPath(instanceName string) string {
+	// Get the path of the socket an instance's vhost-user-net backend listens on
+
+	return filepath.Join(i.getInstanceDir(instanceName), "net.sock")
+}
+
+func (i *InstanceGroup) netQueueOptions() string {
+	// Queue tuning shared by virtio-net and vhost-user-net
+
+	options := strings.Builder{}
+
+	if i.VMNetNumQueues > 0 {
+		fmt.Fprintf(&options, ",num_queues=%d", i.VMNetNumQueues)
+	}
+
+	if i.VMNetQueueSize > 0 {
+		fmt.Fprintf(&options, ",queue_size=%d", i.VMNetQueueSize)
+	}
+
+	return options.String()
+}
+
+func (i *InstanceGroup) netArg(instanceName string, macAddress string, vhostUserSocketPath string) string {
+	// Get the --net argument for an instance's tap device
+
+	if vhostUserSocketPath != "" {
+		return fmt.Sprintf("vhost_user=true,socket=%s,mac=%s%s", vhostUserSocketPath, macAddress, i.netQueueOptions())
+	}
+
+	// The tap is created and configured beforehand, see createTap
+	return fmt.Sprintf("tap=%s,mac=%s%s", instanceName, macAddress, i.netQueueOptions())
+}
+
+func (i *InstanceGroup) startVhostUserNet(ctx context.Context, instanceName string, hostTapIP string, socketPath string) (*exec.Cmd, error) {
+	// Start a vhost-user-net backend creating the instance's tap device, it stops when the context is cancelled
+
+	backendArgs := fmt.Sprintf("tap=%s,ip=%s,mask=%s,socket=%s%s", instanceName, hostTapIP, i.subnetMask(), socketPath, i.netQueueOptions())
+
+	backendCommand := i.instanceCommand(ctx, instanceName, nil, true, "vhost_user_net", "--net-backend", backendArgs)
+
+	err := backendCommand.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start vhost_user_net: %w", err)
+	}
+
+	err = waitForBackendSocket(ctx, backendCommand, socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("vhost_user_net did not become ready: %w", err)
+	}
+
+	return backendCommand, nil
+}
+
+func waitForBackendSocket(ctx context.Context, backendCommand *exec.Cmd, socketPath string) error {
+	// The hypervisor fails to start if the socket of a vhost-user backend is not there yet, the backend is killed on timeout
+
+	ctx, cancel := context.WithTimeout(ctx, backendSocketTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		_, err := os.Stat(socketPath)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			backendCommand.Process.Kill()
+			backendCommand.Wait()
+
+			return fmt.Errorf("socket %s did not appear: %w", socketPath, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
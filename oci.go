@@ -0,0 +1,495 @@
+package fleetingd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const ociScheme = "oci://"
+
+const ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+const ociMediaTypeIndex = "application/vnd.oci.image.index.v1+json"
+const dockerMediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+const dockerMediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// Set by ORAS and most other artifact tools to the name of the pushed file
+const ociAnnotationTitle = "org.opencontainers.image.title"
+
+// Docker Hub is addressed as docker.io but served and authenticated elsewhere
+const dockerHubRegistry = "docker.io"
+const dockerHubAPIHost = "registry-1.docker.io"
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+var ociDigestRegexp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+var ociRepositoryRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+var ociTagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// Parameters of a WWW-Authenticate challenge
+var authChallengeParameterRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// An artifact in a registry, e.g. oci://harbor.example.org/vm/ubuntu:2024-09 or pinned with @sha256:...
+type ociReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+// Image manifests and indexes share the media type field, only one of Layers and Manifests is set
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+func isOCIReference(source string) bool {
+	return strings.HasPrefix(source, ociScheme)
+}
+
+func parseOCIReference(source string) (ociReference, error) {
+	// Split an oci:// reference into registry, repository and tag or digest
+
+	name := strings.TrimPrefix(source, ociScheme)
+
+	registry, repository, found := strings.Cut(name, "/")
+	if !found || registry == "" {
+		return ociReference{}, fmt.Errorf("invalid OCI reference '%s', must be of the form oci://REGISTRY/REPOSITORY[:TAG|@DIGEST]", source)
+	}
+
+	reference := ociReference{Registry: registry, Tag: "latest"}
+
+	repository, reference.Digest, found = strings.Cut(repository, "@")
+	if found {
+		if !ociDigestRegexp.MatchString(reference.Digest) {
+			return ociReference{}, fmt.Errorf("invalid digest in OCI reference '%s', only sha256 digests are supported", source)
+		}
+		reference.Tag = ""
+	}
+
+	// The last colon after the last slash separates the tag
+	if lastColon := strings.LastIndex(repository, ":"); lastColon > strings.LastIndex(repository, "/") {
+		if reference.Digest != "" {
+			return ociReference{}, fmt.Errorf("invalid OCI reference '%s', it can have either a tag or a digest", source)
+		}
+		reference.Tag = repository[lastColon+1:]
+		repository = repository[:lastColon]
+
+		if !ociTagRegexp.MatchString(reference.Tag) {
+			return ociReference{}, fmt.Errorf("invalid tag in OCI reference '%s'", source)
+		}
+	}
+
+	if !ociRepositoryRegexp.MatchString(repository) {
+		return ociReference{}, fmt.Errorf("invalid repository in OCI reference '%s'", source)
+	}
+
+	// Official images on Docker Hub live in the library namespace
+	if registry == dockerHubRegistry && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	reference.Repository = repository
+
+	return reference, nil
+}
+
+func (r ociReference) apiBaseURL() string {
+	// Get the base URL of the registry's API
+
+	host := r.Registry
+	if host == dockerHubRegistry {
+		host = dockerHubAPIHost
+	}
+
+	return "https://" + host + "/v2/"
+}
+
+func (r ociReference) apiURL(kind string, reference string) string {
+	// Get the URL of a manifest or blob in the registry's API
+
+	return fmt.Sprintf("%s%s/%s/%s", r.apiBaseURL(), r.Repository, kind, reference)
+}
+
+func (i *InstanceGroup) resolveRegistryImage(ctx context.Context) (resolvedImageFile, error) {
+	// Find the disk image blob of the configured artifact, it is downloaded and verified like any other image
+
+	reference := *i.registryImage
+
+	header, err := i.authorizeRegistry(ctx, reference)
+	if err != nil {
+		return resolvedImageFile{}, fmt.Errorf("could not authenticate to registry %s: %w", reference.Registry, err)
+	}
+
+	manifestReference := reference.Digest
+	if manifestReference == "" {
+		manifestReference = reference.Tag
+	}
+
+	manifest, manifestDigest, err := i.fetchOCIManifest(ctx, reference, manifestReference, header)
+	if err != nil {
+		return resolvedImageFile{}, err
+	}
+
+	// The signature covers the manifest the tag points to, an index covers the platform manifests by their digests
+	if i.cosignKey != nil {
+		err = i.verifyRegistryImageCosign(ctx, reference, manifestDigest, header)
+		if err != nil {
+			return resolvedImageFile{}, err
+		}
+	}
+
+	// Multi-platform artifacts point to one manifest per architecture
+	if len(manifest.Manifests) > 0 {
+		platformDigest := ""
+		for _, descriptor := range manifest.Manifests {
+			if descriptor.Platform == nil || (descriptor.Platform.OS == "linux" && descriptor.Platform.Architecture == runtime.GOARCH) {
+				platformDigest = descriptor.Digest
+				break
+			}
+		}
+		if platformDigest == "" {
+			return resolvedImageFile{}, fmt.Errorf("%s%s/%s has no manifest for linux/%s", ociScheme, reference.Registry, reference.Repository, runtime.GOARCH)
+		}
+
+		manifest, _, err = i.fetchOCIManifest(ctx, reference, platformDigest, header)
+		if err != nil {
+			return resolvedImageFile{}, err
+		}
+	}
+
+	layer, err := findDiskImageLayer(manifest)
+	if err != nil {
+		return resolvedImageFile{}, fmt.Errorf("could not find the disk image in %s%s/%s: %w", ociScheme, reference.Registry, reference.Repository, err)
+	}
+
+	checksum := strings.TrimPrefix(layer.Digest, "sha256:")
+
+	return resolvedImageFile{
+		URL:               reference.apiURL("blobs", layer.Digest),
+		Checksum:          checksum,
+		FileName:          "oci-" + checksum[:16] + ".qcow2",
+		ChecksumAlgorithm: "sha256",
+		Header:            header,
+	}, nil
+}
+
+func findDiskImageLayer(manifest ociManifest) (ociDescriptor, error) {
+	// Pick the layer holding the disk image, either the only one or the one named like a disk image
+
+	if len(manifest.Layers) == 1 {
+		return manifest.Layers[0], nil
+	}
+
+	for _, layer := range manifest.Layers {
+		title := layer.Annotations[ociAnnotationTitle]
+		if strings.HasSuffix(title, ".qcow2") || strings.HasSuffix(title, ".img") {
+			return layer, nil
+		}
+	}
+
+	return ociDescriptor{}, fmt.Errorf("found %d layers but none is titled *.qcow2 or *.img", len(manifest.Layers))
+}
+
+func (i *InstanceGroup) fetchOCIManifest(ctx context.Context, reference ociReference, manifestReference string, header http.Header) (ociManifest, string, error) {
+	// Fetch a manifest and compute its digest, manifests referenced by digest have to match it
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, reference.apiURL("manifests", manifestReference), nil)
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("Accept", strings.Join([]string{ociMediaTypeManifest, ociMediaTypeIndex, dockerMediaTypeManifest, dockerMediaTypeManifestList}, ", "))
+
+	client := i.imageHTTPClient(time.Minute)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return ociManifest{}, "", fmt.Errorf("could not fetch manifest %s of %s/%s: %s", manifestReference, reference.Registry, reference.Repository, response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 4*1024*1024))
+	if err != nil {
+		return ociManifest{}, "", err
+	}
+
+	checksum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(checksum[:])
+
+	if strings.HasPrefix(manifestReference, "sha256:") {
+		if digest != manifestReference {
+			return ociManifest{}, "", fmt.Errorf("manifest of %s/%s does not match digest %s", reference.Registry, reference.Repository, manifestReference)
+		}
+	}
+
+	manifest := ociManifest{}
+	err = json.Unmarshal(body, &manifest)
+	if err != nil {
+		return ociManifest{}, "", fmt.Errorf("could not parse manifest %s of %s/%s: %w", manifestReference, reference.Registry, reference.Repository, err)
+	}
+
+	return manifest, digest, nil
+}
+
+func (i *InstanceGroup) fetchOCIBlob(ctx context.Context, reference ociReference, digest string, header http.Header, maxSize int64) ([]byte, error) {
+	// Fetch a small blob, e.g. a signature, into memory and check it matches its digest
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, reference.apiURL("blobs", digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	client := i.imageHTTPClient(time.Minute)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch blob %s of %s/%s: %s", digest, reference.Registry, reference.Repository, response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := sha256.Sum256(body)
+	if "sha256:"+hex.EncodeToString(checksum[:]) != digest {
+		return nil, fmt.Errorf("blob of %s/%s does not match digest %s", reference.Registry, reference.Repository, digest)
+	}
+
+	return body, nil
+}
+
+func (i *InstanceGroup) authorizeRegistry(ctx context.Context, reference ociReference) (http.Header, error) {
+	// Get the header authorizing pulls from a repository, registries without authentication get an empty one
+
+	client := i.imageHTTPClient(time.Minute)
+
+	// The API base answers with the challenge to authenticate with
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, reference.apiBaseURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	header := http.Header{}
+
+	if response.StatusCode != http.StatusUnauthorized {
+		return header, nil
+	}
+
+	username, password, err := i.registryCredentials(reference.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := response.Header.Get("WWW-Authenticate")
+	scheme, parameters, _ := strings.Cut(challenge, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return nil, errors.New("registry requires credentials but none are configured")
+		}
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+		return header, nil
+	case "bearer":
+	default:
+		return nil, fmt.Errorf("unsupported authentication challenge '%s'", challenge)
+	}
+
+	challengeParameters := map[string]string{}
+	for _, match := range authChallengeParameterRegexp.FindAllStringSubmatch(parameters, -1) {
+		challengeParameters[strings.ToLower(match[1])] = match[2]
+	}
+
+	tokenURL, err := url.Parse(challengeParameters["realm"])
+	if err != nil || tokenURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid token realm in challenge '%s'", challenge)
+	}
+
+	query := tokenURL.Query()
+	if challengeParameters["service"] != "" {
+		query.Set("service", challengeParameters["service"])
+	}
+	query.Set("scope", "repository:"+reference.Repository+":pull")
+	tokenURL.RawQuery = query.Encode()
+
+	tokenRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		tokenRequest.SetBasicAuth(username, password)
+	}
+
+	tokenResponse, err := client.Do(tokenRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer tokenResponse.Body.Close()
+
+	if tokenResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not get a token from %s: %s", tokenURL.Host, tokenResponse.Status)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(tokenResponse.Body, 1024*1024)).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return nil, fmt.Errorf("%s answered without a token", tokenURL.Host)
+	}
+
+	header.Set("Authorization", "Bearer "+token.Token)
+
+	return header, nil
+}
+
+func (i *InstanceGroup) registryCredentials(registry string) (string, string, error) {
+	// Get the credentials for a registry from the config or, like docker does, from its config file and credential helpers
+
+	if i.VMImageRegistryUsername != "" {
+		return i.VMImageRegistryUsername, i.VMImageRegistryPassword, nil
+	}
+
+	configDirectory := os.Getenv("DOCKER_CONFIG")
+	if configDirectory == "" {
+		homeDirectory, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		configDirectory = filepath.Join(homeDirectory, ".docker")
+	}
+
+	configData, err := os.ReadFile(filepath.Join(configDirectory, "config.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	config := dockerConfig{}
+	err = json.Unmarshal(configData, &config)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse docker config: %w", err)
+	}
+
+	configKey := registry
+	if registry == dockerHubRegistry {
+		configKey = dockerHubConfigKey
+	}
+
+	if helper, ok := config.CredHelpers[configKey]; ok {
+		return runCredentialHelper(helper, configKey)
+	}
+
+	for key, auth := range config.Auths {
+		if strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://"), "/") != strings.TrimSuffix(strings.TrimPrefix(configKey, "https://"), "/") {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth of %s in docker config: %w", key, err)
+		}
+
+		username, password, _ := strings.Cut(string(decoded), ":")
+		if username != "" {
+			return username, password, nil
+		}
+	}
+
+	if config.CredsStore != "" {
+		return runCredentialHelper(config.CredsStore, configKey)
+	}
+
+	return "", "", nil
+}
+
+func runCredentialHelper(helper string, serverURL string) (string, string, error) {
+	// Ask a docker credential helper for the credentials of a registry
+
+	output, err := hostCommands.Run(context.Background(), hostCommand{Args: []string{"docker-credential-" + helper, "get"}, Stdin: strings.NewReader(serverURL)})
+	if err != nil {
+		// Helpers report unknown registries as an error
+		if bytes.Contains(output, []byte("credentials not found")) {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("credential helper %s failed: %w", helper, err)
+	}
+
+	credentials := struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}{}
+	err = json.Unmarshal(output, &credentials)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse the answer of credential helper %s: %w", helper, err)
+	}
+
+	return credentials.Username, credentials.Secret, nil
+}
@@ -0,0 +1,282 @@
+package fleetingd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Taps are named after their instance, the prebuild VM's included
+var instanceNameRegexp = regexp.MustCompile(`^fleetingd[0-9]+$`)
+
+// Binaries the plugin starts for its instances, only they are killed for the instance files on their command line
+var instanceBinaries = map[string]struct{}{
+	hypervisorBackend:  {},
+	"vhost_user_block": {},
+	"vhost_user_net":   {},
+	"passt":            {},
+}
+
+// A process left behind by an earlier run, found through the instance files on its command line
+type orphanedProcess struct {
+	pid          int
+	instanceName string
+}
+
+// What instances of an earlier run left behind without a running owner
+type orphans struct {
+	slices    []string
+	processes []orphanedProcess
+	taps      []string
+	files     []string
+}
+
+func (i *Inventory) RemoveOrphans(instanceGroup *InstanceGroup) {
+	// Remove what instances of an earlier run left behind without a running owner, adopted instances are kept
+
+	i.removeOrphans(instanceGroup, i.findOrphans(instanceGroup))
+}
+
+func (i *Inventory) findOrphans(instanceGroup *InstanceGroup) orphans {
+	// Look for slices, processes, taps and instance files of instances the inventory doesn't know
+
+	workdir := filepath.Join(instanceGroup.VMDiskDir, vmWorkdir)
+
+	i.lock.RLock()
+	owned := map[int]struct{}{}
+	known := map[string]struct{}{}
+	for name, instance := range i.instances {
+		known[name] = struct{}{}
+		for _, process := range instance.Processes {
+			owned[process.PID] = struct{}{}
+		}
+	}
+	i.lock.RUnlock()
+
+	found := orphans{}
+
+	// Stopping a slice kills every process in it, whatever it was started as
+	if instanceGroup.VMSystemdScopes {
+		sliceInstances, err := instanceGroup.listInstanceSlices()
+		if err != nil {
+			instanceGroup.logger.Error("could not look for orphaned slices", "error", err)
+		}
+
+		for _, name := range sliceInstances {
+			if _, ok := known[name]; !ok {
+				found.slices = append(found.slices, name)
+			}
+		}
+	}
+
+	// Hypervisors and their helpers have files of the working directory on their command line
+	processes, err := findWorkdirProcesses(workdir)
+	if err != nil {
+		instanceGroup.logger.Error("could not look for orphaned processes", "error", err)
+	}
+
+	for _, process := range processes {
+		if _, ok := owned[process.pid]; !ok {
+			found.processes = append(found.processes, process)
+		}
+	}
+
+	// Persistent taps outlive their hypervisor, their rules went with the nftables table set up from scratch at Init
+	if !instanceGroup.usesPasst() {
+		links, err := netlink.LinkList()
+		if err != nil {
+			instanceGroup.logger.Error("could not look for orphaned taps", "error", err)
+		}
+
+		for _, link := range links {
+			name := link.Attrs().Name
+			if link.Type() != "tuntap" || !instanceNameRegexp.MatchString(name) {
+				continue
+			}
+			if _, ok := known[name]; !ok {
+				found.taps = append(found.taps, name)
+			}
+		}
+	}
+
+	// Nothing is booting yet, so unlike the garbage collector there is no need to wait for files to age
+	entries, err := os.ReadDir(workdir)
+	if err != nil && !os.IsNotExist(err) {
+		instanceGroup.logger.Error("could not look for orphaned instance files", "error", err)
+	}
+
+	for _, entry := range entries {
+		match := instanceFileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		if _, ok := known[match[1]]; ok {
+			continue
+		}
+
+		// Console and instance logs outlive their instance for troubleshooting, the garbage collector removes old ones
+		if isInstanceLogName(entry.Name()) {
+			continue
+		}
+
+		found.files = append(found.files, entry.Name())
+	}
+
+	return found
+}
+
+func (i *Inventory) removeOrphans(instanceGroup *InstanceGroup, found orphans) {
+	// Stop, kill and delete what findOrphans found, then release the slots they kept in use
+
+	workdir := filepath.Join(instanceGroup.VMDiskDir, vmWorkdir)
+
+	// Slots which looked in use because of the leftovers are released once those are gone
+	orphanedSlots := map[string]struct{}{}
+
+	for _, name := range found.slices {
+		err := instanceGroup.stopInstanceSlice(name)
+		if err != nil {
+			instanceGroup.logger.Error("could not stop orphaned slice", "instance", name, "error", err)
+			continue
+		}
+
+		instanceGroup.logger.Info("Stopped orphaned slice of an earlier run.", "instance", name)
+		orphanedSlots[name] = struct{}{}
+	}
+
+	var pidfds []int
+	for _, process := range found.processes {
+		// Gone with its slice, the pid may already belong to another process
+		if _, ok := orphanedSlots[process.instanceName]; ok {
+			continue
+		}
+
+		pidfd, err := unix.PidfdOpen(process.pid, 0)
+		if err != nil {
+			continue
+		}
+		pidfds = append(pidfds, pidfd)
+
+		instanceGroup.logger.Info("Killing orphaned process of an earlier run.", "instance", process.instanceName, "pid", process.pid)
+		orphanedSlots[process.instanceName] = struct{}{}
+	}
+	killProcesses(pidfds)
+
+	for _, name := range found.taps {
+		err := deleteTap(name)
+		if err != nil {
+			instanceGroup.logger.Error("could not delete orphaned tap", "tap", name, "error", err)
+			continue
+		}
+
+		instanceGroup.logger.Info("Deleted orphaned tap of an earlier run.", "tap", name)
+		orphanedSlots[name] = struct{}{}
+	}
+
+	for _, name := range found.files {
+		err := os.RemoveAll(filepath.Join(workdir, name))
+		if err != nil {
+			instanceGroup.logger.Error("could not remove orphaned instance file", "file", name, "error", err)
+			continue
+		}
+
+		instanceGroup.logger.Info("removed orphaned instance file", "file", name)
+	}
+
+	// Without an IPAM, e.g. for the cleanup command, the next start drops the allocations of instances which are gone
+	if i.ipam == nil {
+		return
+	}
+
+	stepSize := instanceGroup.ipamStepSize()
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for name := range orphanedSlots {
+		index, err := strconv.Atoi(strings.TrimPrefix(name, "fleetingd"))
+		if err != nil {
+			continue
+		}
+
+		err = i.ipam.Release(index * stepSize)
+		if err != nil {
+			instanceGroup.logger.Error("could not release address of orphaned instance", "instance", name, "error", err)
+		}
+	}
+}
+
+func findWorkdirProcesses(workdir string) ([]orphanedProcess, error) {
+	// Find the instance processes referring to instance files in the working directory, e.g. path=/tmp/fleetingd/.instance_data/fleetingd3.img
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := []byte(workdir + "/")
+
+	var processes []orphanedProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		// Processes may exit while they are looked at
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		for _, arg := range bytes.Split(cmdline, []byte{0}) {
+			index := bytes.Index(arg, prefix)
+			if index == -1 {
+				continue
+			}
+
+			match := instanceFileRegexp.FindSubmatch(arg[index+len(prefix):])
+			if match == nil {
+				continue
+			}
+
+			// A shell or an editor of an operator may have the file on its command line as well
+			if !isInstanceProcess(pid, string(match[1])) {
+				break
+			}
+
+			processes = append(processes, orphanedProcess{pid: pid, instanceName: string(match[1])})
+			break
+		}
+	}
+
+	return processes, nil
+}
+
+func isInstanceProcess(pid int, instanceName string) bool {
+	// Tell if a process runs one of the instance binaries or in the instance's slice
+
+	procPath := filepath.Join("/proc", strconv.Itoa(pid))
+
+	// A binary replaced by an update since is reported as deleted
+	executable, err := os.Readlink(filepath.Join(procPath, "exe"))
+	if err == nil {
+		if _, ok := instanceBinaries[filepath.Base(strings.TrimSuffix(executable, " (deleted)"))]; ok {
+			return true
+		}
+	}
+
+	// With vm_systemd_scopes the processes are in a scope below the instance's slice
+	cgroups, err := os.ReadFile(filepath.Join(procPath, "cgroup"))
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(string(cgroups), "/"+instanceSliceName(instanceName)+"/")
+}
@@ -0,0 +1,140 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Overlays created ahead of the boots wait in the working directory until an instance takes one, a restart clears them
+const overlayPoolDirectory = "overlay-pool"
+
+// Overlays of the base image ready to be moved into booting instances' directories
+type overlayPool struct {
+	lock     sync.Mutex
+	basePath string
+	paths    []string
+	created  uint64
+
+	// Signalled whenever an overlay was taken or none was ready
+	refill chan struct{}
+}
+
+func (i *InstanceGroup) checkOverlayPool() error {
+	// Validate vm_disk_overlay_pool_size, the pooled overlays are backed by the golden image
+
+	if i.VMDiskOverlayPoolSize == 0 {
+		return nil
+	}
+
+	// Restored instances get overlays of the snapshot's disk
+	if i.VMSnapshotBoot {
+		return errors.New("vm_disk_overlay_pool_size can not be combined with vm_snapshot_boot")
+	}
+
+	i.overlayPool.refill = make(chan struct{}, 1)
+
+	return nil
+}
+
+func (i *InstanceGroup) runOverlayPool(ctx context.Context) {
+	// Keep vm_disk_overlay_pool_size overlays of the base image ready until the plugin shuts down
+
+	directory := filepath.Join(i.VMDiskDir, vmWorkdir, overlayPoolDirectory)
+
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		i.logger.Error("could not create the overlay pool, instances create their own overlays", "error", err)
+		return
+	}
+
+	for {
+		i.fillOverlayPool(ctx, directory)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-i.overlayPool.refill:
+		}
+	}
+}
+
+func (i *InstanceGroup) fillOverlayPool(ctx context.Context, directory string) {
+	// Create overlays until the pool is full, after a failure the next boot creates its own and asks for a refill
+
+	basePath := i.getBaseImagePath()
+
+	for ctx.Err() == nil {
+		pool := &i.overlayPool
+
+		pool.lock.Lock()
+		if pool.basePath != basePath {
+			for _, path := range pool.paths {
+				os.Remove(path)
+			}
+			pool.basePath = basePath
+			pool.paths = nil
+		}
+		full := uint64(len(pool.paths)) >= i.VMDiskOverlayPoolSize
+		pool.created++
+		path := filepath.Join(directory, fmt.Sprintf("overlay%d.qcow2", pool.created))
+		pool.lock.Unlock()
+
+		if full {
+			return
+		}
+
+		err := i.createOverlay(ctx, basePath, path)
+		if err != nil {
+			os.Remove(path)
+			if ctx.Err() == nil {
+				i.logger.Warn("could not create pooled overlay", "error", err)
+			}
+			return
+		}
+
+		pool.lock.Lock()
+		pool.paths = append(pool.paths, path)
+		pool.lock.Unlock()
+	}
+}
+
+func (i *InstanceGroup) takePooledOverlay(basePath string, targetPath string) bool {
+	// Move a pooled overlay of the base image to targetPath and have the pool refilled, false if none was ready
+
+	if i.VMDiskOverlayPoolSize == 0 {
+		return false
+	}
+
+	pool := &i.overlayPool
+
+	pool.lock.Lock()
+	path := ""
+	if pool.basePath == basePath && len(pool.paths) > 0 {
+		path = pool.paths[0]
+		pool.paths = pool.paths[1:]
+	}
+	pool.lock.Unlock()
+
+	// A refill already asked for covers this one as well
+	select {
+	case pool.refill <- struct{}{}:
+	default:
+	}
+
+	if path == "" {
+		return false
+	}
+
+	err := os.Rename(path, targetPath)
+	if err != nil {
+		os.Remove(path)
+		i.logger.Warn("could not take pooled overlay", "error", err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,129 @@
+package fleetingd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cloud-hypervisor writes its events here, a panic the guest signals through the pvpanic device among them
+const guestEventsFileName = "events.json"
+
+// How often the events are checked for a panic
+const guestEventsInterval = time.Second
+
+const defaultPanicConsoleLines = 200
+
+// The part of a cloud-hypervisor event telling what happened
+type guestEvent struct {
+	Source string `json:"source"`
+	Event  string `json:"event"`
+}
+
+func (i *InstanceGroup) getGuestEventsPath(instanceName string) string {
+	return filepath.Join(i.getInstanceDir(instanceName), guestEventsFileName)
+}
+
+func (i *InstanceGroup) getPanicPath(instanceName string) string {
+	// Get the path of the marker written when an instance panicked, it is kept next to its console log
+
+	return filepath.Join(i.VMDiskDir, vmWorkdir, fmt.Sprintf("%s_panic", instanceName))
+}
+
+func (i *InstanceGroup) eventMonitorArgs(instanceName string) []string {
+	// Let the hypervisor report its events, restored VMs get the pvpanic device from the snapshot
+
+	return []string{"--event-monitor", fmt.Sprintf("path=%s", i.getGuestEventsPath(instanceName))}
+}
+
+func countGuestPanics(path string) (int, error) {
+	// Count the panics among the events written so far, the hypervisor starts the file over when it is restarted
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	// Events are JSON objects one after another, the last one may still be written
+	panics := 0
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	for {
+		var event guestEvent
+		err = decoder.Decode(&event)
+		if err != nil {
+			break
+		}
+
+		if event.Source == "guest" && event.Event == "panic" {
+			panics++
+		}
+	}
+
+	return panics, nil
+}
+
+func (i *Inventory) watchGuestPanics(instanceGroup *InstanceGroup, instance *InstanceInfo, instanceContext context.Context) {
+	// Recycle an instance once its kernel panicked, a panicked guest hangs or reboots into the same job environment
+
+	ticker := time.NewTicker(guestEventsInterval)
+	defer ticker.Stop()
+
+	seen := 0
+	for {
+		select {
+		case <-instanceContext.Done():
+			return
+		case <-ticker.C:
+		}
+
+		panics, err := countGuestPanics(instanceGroup.getGuestEventsPath(instance.Name))
+		if err != nil {
+			instance.logger.Error("could not read hypervisor events", "error", err)
+			continue
+		}
+
+		// A restarted hypervisor starts over
+		if panics < seen {
+			seen = panics
+		}
+		if panics == seen {
+			continue
+		}
+
+		i.handleGuestPanic(instanceGroup, instance)
+		return
+	}
+}
+
+func (i *Inventory) handleGuestPanic(instanceGroup *InstanceGroup, instance *InstanceInfo) {
+	// Keep the end of the console next to the console log and remove the instance
+
+	// The panic is only in the console log once the capture moved it
+	time.Sleep(2 * consoleCaptureInterval)
+
+	console := instance.console.lastLines(int(instanceGroup.VMPanicConsoleLines))
+	marker := fmt.Sprintf("Guest kernel of %s panicked at %s, last console output:\n\n%s\n", instance.Name, time.Now().UTC().Format(time.RFC3339), console)
+
+	panicPath := instanceGroup.getPanicPath(instance.Name)
+	err := os.WriteFile(panicPath, []byte(marker), 0600)
+	if err != nil {
+		instance.logger.Error("could not write panic marker", "error", err)
+	}
+
+	i.metrics.guestPanics.Add(1)
+	i.publishEvent(instance.Name, eventGuestPanic, instance.CreatedAt, nil)
+
+	i.lock.Lock()
+	instance.FailureReason = "guest kernel panicked"
+	instance.InstanceContextCancelFunc()
+	i.lock.Unlock()
+
+	instanceGroup.logInstanceFailure(instance, "guest kernel panicked, recycling the instance", fmt.Sprintf("%s, console saved to %s", instance.FailureReason, panicPath))
+}
@@ -0,0 +1,92 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+)
+
+const networkModePasst = "passt"
+
+const defaultPasstSSHPortBase = 22000
+
+func (i *InstanceGroup) checkPasstNetworking() error {
+	// Validate user-mode networking, passt does not give the host any control over the guests' traffic
+
+	_, err := exec.LookPath("passt")
+	if err != nil {
+		return fmt.Errorf("network_mode is set to passt but passt could not be found on PATH: %w", err)
+	}
+
+	// Restored VMs keep the template's vhost-user connection and passt already is a vhost-user backend
+	if i.VMSnapshotBoot || i.VMNetVhostUser || i.VMIPv6Prefix != "" || len(i.VMPassthroughDevices) > 0 {
+		return errors.New("network_mode passt can not be combined with vm_snapshot_boot, vm_net_vhost_user, vm_ipv6_prefix or vm_passthrough_devices")
+	}
+
+	// Everything below needs nftables or tc on a tap device
+	if i.ExternalAddress != "" || i.trafficShapingEnabled() {
+		return errors.New("network_mode passt can not be combined with external_address, vm_net_download_rate_mbit or vm_net_upload_rate_mbit")
+	}
+
+	if i.EgressPolicy == egressPolicyDeny || len(i.EgressAllow) > 0 || len(i.EgressDeny) > 0 || len(i.EgressNetworks) > 0 || i.EgressBlockPrivateNetworks {
+		return errors.New("network_mode passt can not be combined with egress_policy deny, egress_allow, egress_deny, egress_networks or egress_block_private_networks")
+	}
+
+	if i.NetworkPasstSSHPortBase == 0 {
+		i.NetworkPasstSSHPortBase = defaultPasstSSHPortBase
+	}
+
+	if i.NetworkPasstSSHPortBase+i.maxIPAMSlots() > 65535 {
+		return fmt.Errorf("network_passt_ssh_port_base %d leaves no room for %d instances", i.NetworkPasstSSHPortBase, i.maxIPAMSlots())
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) usesPasst() bool {
+	return i.NetworkMode == networkModePasst
+}
+
+func (i *InstanceGroup) getPasstSSHAddress(instanceIndex int) string {
+	// Get the loopback address passt forwards to an instance's SSH port
+
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(i.NetworkPasstSSHPortBase+instanceIndex))
+}
+
+func (i *InstanceGroup) startPasst(ctx context.Context, instanceName string, instanceIndex int, instanceTapIP string, hostTapIP string, socketPath string, unprivileged bool) (*exec.Cmd, error) {
+	// Start passt as the instance's vhost-user-net backend, it stops when the context is cancelled, unprivileged runs it as vm_hypervisor_user like the hypervisor connecting to it
+
+	// Connections from the host's loopback show up in the guest as coming from the gateway, the address SSH is allowed from
+	passtCommand := i.instanceCommand(ctx, instanceName, nil, unprivileged, "passt",
+		"--foreground",
+		"--quiet",
+		"--vhost-user",
+		"--socket", socketPath,
+		"--ipv4-only",
+		"--address", instanceTapIP,
+		"--netmask", i.subnetMask(),
+		"--gateway", hostTapIP,
+		"--tcp-ports", fmt.Sprintf("127.0.0.1/%d:22", i.NetworkPasstSSHPortBase+instanceIndex),
+		"--udp-ports", "none",
+	)
+
+	// passt maps the gateway address to the host's loopback unless told otherwise, that would let guests reach the host's local services
+	if !i.EgressDisableHostProtection {
+		passtCommand.Args = append(passtCommand.Args, "--no-map-gw")
+	}
+
+	err := passtCommand.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start passt: %w", err)
+	}
+
+	err = waitForBackendSocket(ctx, passtCommand, socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("passt did not become ready: %w", err)
+	}
+
+	return passtCommand, nil
+}
@@ -0,0 +1,181 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const pciDevicesPath = "/sys/bus/pci/devices"
+const vfioDriverName = "vfio-pci"
+
+func normalizePCIAddress(address string) string {
+	// Add the default PCI domain if it was omitted (e.g. 01:00.0 -> 0000:01:00.0)
+
+	address = strings.ToLower(strings.TrimSpace(address))
+	if strings.Count(address, ":") == 1 {
+		return "0000:" + address
+	}
+
+	return address
+}
+
+func (i *InstanceGroup) checkPassthroughDevices() error {
+	// Normalize the addresses of the passthrough devices and virtual functions, each of them can only be listed once
+
+	for index, device := range i.VMPassthroughDevices {
+		i.VMPassthroughDevices[index] = normalizePCIAddress(device)
+	}
+	for index, device := range i.VMNetSRIOVDevices {
+		i.VMNetSRIOVDevices[index] = normalizePCIAddress(device)
+	}
+
+	// A repeated device would be handed to two VMs at once and count twice towards the reported max size
+	configuredDevices := map[string]struct{}{}
+	for _, device := range append(append([]string{}, i.VMPassthroughDevices...), i.VMNetSRIOVDevices...) {
+		if _, ok := configuredDevices[device]; ok {
+			return fmt.Errorf("passthrough device %s is configured more than once", device)
+		}
+		configuredDevices[device] = struct{}{}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) preparePassthroughDevices() error {
+	// Check the configured PCI devices can be passed through and bind them to vfio-pci
+
+	if len(i.VMPassthroughDevices) == 0 && len(i.VMNetSRIOVDevices) == 0 {
+		return nil
+	}
+
+	// IOMMU groups only show up if the IOMMU is enabled in firmware and on the kernel cmdline
+	iommuGroups, err := os.ReadDir("/sys/kernel/iommu_groups")
+	if err != nil || len(iommuGroups) == 0 {
+		return errors.New("vm_passthrough_devices or vm_net_sriov_devices is set but no IOMMU groups were found, please enable the IOMMU (e.g. intel_iommu=on or amd_iommu=on)")
+	}
+
+	_, err = os.Stat(filepath.Join("/sys/bus/pci/drivers", vfioDriverName))
+	if err != nil {
+		return fmt.Errorf("the %s driver is not available, please load it with 'modprobe %s': %w", vfioDriverName, vfioDriverName, err)
+	}
+
+	// SR-IOV virtual functions are passed through the same way
+	devices := append(append([]string{}, i.VMPassthroughDevices...), i.VMNetSRIOVDevices...)
+
+	configuredDevices := map[string]struct{}{}
+	for _, device := range devices {
+		configuredDevices[device] = struct{}{}
+	}
+
+	for _, device := range devices {
+		devicePath := filepath.Join(pciDevicesPath, device)
+
+		_, err := os.Stat(devicePath)
+		if err != nil {
+			return fmt.Errorf("passthrough device %s does not exist: %w", device, err)
+		}
+
+		// All devices sharing an IOMMU group have to be handed to the same VM, so only allow groups we fully control
+		groupDevices, err := os.ReadDir(filepath.Join(devicePath, "iommu_group", "devices"))
+		if err != nil {
+			return fmt.Errorf("could not determine IOMMU group of passthrough device %s: %w", device, err)
+		}
+
+		for _, groupDevice := range groupDevices {
+			groupDeviceName := groupDevice.Name()
+			if groupDeviceName == device {
+				continue
+			}
+
+			if _, ok := configuredDevices[groupDeviceName]; ok {
+				return fmt.Errorf("passthrough devices %s and %s share an IOMMU group and can not be given to different VMs", device, groupDeviceName)
+			}
+
+			driver, err := getPCIDeviceDriver(groupDeviceName)
+			if err != nil {
+				return err
+			}
+
+			if driver != "" && driver != vfioDriverName && driver != "pcieport" {
+				return fmt.Errorf("passthrough device %s shares its IOMMU group with %s which is in use by driver %s", device, groupDeviceName, driver)
+			}
+		}
+
+		err = bindPCIDeviceToVFIO(device)
+		if err != nil {
+			return err
+		}
+
+		i.logger.Info("passthrough device ready", "device", device)
+	}
+
+	return nil
+}
+
+func getPCIDeviceDriver(device string) (string, error) {
+	// Get the name of the driver currently bound to a PCI device, empty if unbound
+
+	driverPath, err := os.Readlink(filepath.Join(pciDevicesPath, device, "driver"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return filepath.Base(driverPath), nil
+}
+
+func bindPCIDeviceToVFIO(device string) error {
+	// Rebind a PCI device to the vfio-pci driver
+
+	driver, err := getPCIDeviceDriver(device)
+	if err != nil {
+		return err
+	}
+
+	if driver == vfioDriverName {
+		return nil
+	}
+
+	devicePath := filepath.Join(pciDevicesPath, device)
+
+	err = os.WriteFile(filepath.Join(devicePath, "driver_override"), []byte(vfioDriverName), 0200)
+	if err != nil {
+		return fmt.Errorf("could not set driver override for passthrough device %s: %w", device, err)
+	}
+
+	if driver != "" {
+		err = os.WriteFile(filepath.Join(devicePath, "driver", "unbind"), []byte(device), 0200)
+		if err != nil {
+			return fmt.Errorf("could not unbind passthrough device %s from %s: %w", device, driver, err)
+		}
+	}
+
+	err = os.WriteFile("/sys/bus/pci/drivers_probe", []byte(device), 0200)
+	if err != nil {
+		return fmt.Errorf("could not bind passthrough device %s to %s: %w", device, vfioDriverName, err)
+	}
+
+	return nil
+}
+
+func (i *Inventory) allocatePassthroughDevice(instanceGroup *InstanceGroup) (string, error) {
+	// Reserve a free passthrough device, must be called with the inventory lock held
+
+	if len(instanceGroup.VMPassthroughDevices) == 0 {
+		return "", nil
+	}
+
+	for _, device := range instanceGroup.VMPassthroughDevices {
+		if _, ok := i.passthroughSlots[device]; !ok {
+			i.passthroughSlots[device] = struct{}{}
+			return device, nil
+		}
+	}
+
+	return "", errors.New("all passthrough devices are in use")
+}
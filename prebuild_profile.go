@@ -0,0 +1,105 @@
+package fleetingd
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const prebuildProfileDocker = "docker"
+
+// Bumped whenever the steps of a prebuild profile change, it is part of the golden image's inputs
+const prebuildProfileDockerRevision = 1
+
+// Signing keys of Docker's package repositories, a downloaded key with another fingerprint fails the prebuild
+const dockerAptKeyFingerprint = "9DC858229FC7DD38854AE2D88D81803C0EBFCD88"
+const dockerRPMKeyFingerprint = "060A61C51B558A7F742B77AAC52FEB6B621E9F35"
+
+// Where the key is checked before the package manager trusts it
+const dockerKeyDownloadPath = "/tmp/fleetingd-docker.gpg"
+
+func (i *InstanceGroup) checkPrebuildProfile() error {
+	// Validate prebuild_profile
+
+	switch i.PrebuildProfile {
+	case "":
+		return nil
+	case prebuildProfileDocker:
+	default:
+		return fmt.Errorf("unknown prebuild_profile '%s', must be one of: %s", i.PrebuildProfile, prebuildProfileDocker)
+	}
+
+	// Docker is part of the Ignition distributions' images
+	if i.usesIgnition() {
+		return fmt.Errorf("prebuild_profile can not be used with distro %s which is provisioned through Ignition", i.Distro)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) prebuildProfileVersion() string {
+	// Get the profile and the revision of its steps, empty without prebuild_profile
+
+	if i.PrebuildProfile == "" {
+		return ""
+	}
+
+	return i.PrebuildProfile + "@" + strconv.Itoa(prebuildProfileDockerRevision)
+}
+
+func (i *InstanceGroup) prebuildProfileCommands() []string {
+	// Get the prebuild commands of prebuild_profile, run before vm_prebuild_cloudinit_extra_cmds so those can build on them
+
+	if i.PrebuildProfile != prebuildProfileDocker {
+		return nil
+	}
+
+	verifyKey := func(fingerprint string) string {
+		return fmt.Sprintf(`gpg --show-keys --with-colons %s | grep -qx 'fpr:*%s:'`, dockerKeyDownloadPath, fingerprint)
+	}
+
+	var commands []string
+	switch i.imageProfile.Family {
+	case "debian":
+		// Docker's repositories are named after the distribution and its codename
+		repository := `https://download.docker.com/linux/$(. /etc/os-release && echo "$ID")`
+		commands = []string{
+			// The generic cloud images only have what apt needs to verify signatures
+			"DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends gnupg",
+			"curl -fsSL " + repository + "/gpg -o " + dockerKeyDownloadPath,
+			verifyKey(dockerAptKeyFingerprint),
+			"install -m 0644 -D " + dockerKeyDownloadPath + " /etc/apt/keyrings/docker.asc",
+			`echo "deb [arch=$(dpkg --print-architecture) signed-by=/etc/apt/keyrings/docker.asc] ` + repository + ` $(. /etc/os-release && echo "$VERSION_CODENAME") stable" > /etc/apt/sources.list.d/docker.list`,
+			"apt-get update",
+			"DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin git git-lfs",
+		}
+	case "fedora":
+		commands = []string{
+			"curl -fsSL https://download.docker.com/linux/fedora/gpg -o " + dockerKeyDownloadPath,
+			verifyKey(dockerRPMKeyFingerprint),
+			"rpm --import " + dockerKeyDownloadPath,
+			"curl -fsSL https://download.docker.com/linux/fedora/docker-ce.repo -o /etc/yum.repos.d/docker-ce.repo",
+			"dnf install -y docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin git git-lfs",
+		}
+	case "suse":
+		// Docker has no repository for openSUSE, the distribution's packages are signed by it
+		commands = []string{
+			"zypper --non-interactive install docker docker-buildx docker-compose git git-lfs",
+		}
+	case "alpine":
+		commands = []string{
+			"apk add docker docker-cli-buildx docker-cli-compose git git-lfs",
+			"rc-update add docker default",
+		}
+	}
+
+	commands = append(commands, "rm -f "+dockerKeyDownloadPath, "git lfs install --system")
+
+	// The image's user runs the jobs and talks to the daemon
+	if i.imageProfile.Family == "alpine" {
+		commands = append(commands, "addgroup "+i.imageProfile.Username+" docker")
+	} else {
+		commands = append(commands, "systemctl enable docker.service", "usermod -aG docker "+i.imageProfile.Username)
+	}
+
+	return append(commands, "docker --version")
+}
@@ -0,0 +1,163 @@
+package fleetingd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The prebuild guest reports on its serial port how its commands ended, e.g. FLEETINGD_PREBUILD_STATUS=0
+const prebuildStatusMarker = "FLEETINGD_PREBUILD"
+
+// Package upgrades and extra commands can take a while, a prebuild taking longer is considered hung
+const defaultPrebuildTimeoutMinutes = 60
+
+// Lines of the cloud-init output shown when the prebuild failed
+const prebuildLogLines = 100
+
+// Lines of the console shown when the prebuild timed out or did not report a status
+const prebuildConsoleLines = 50
+
+// How often the prebuild's console is checked for new output
+const prebuildStreamInterval = 500 * time.Millisecond
+
+func (i *InstanceGroup) getPrebuildConsolePath(instanceName string) string {
+	// Get the path of the file the prebuild VM's console is written to
+
+	return i.getConsolePath(instanceName)
+}
+
+func (i *InstanceGroup) getPrebuildSerialPath(instanceName string) string {
+	// Get the path of the file the prebuild VM's serial port is written to
+
+	return filepath.Join(i.VMDiskDir, vmWorkdir, fmt.Sprintf("%s_serial", instanceName))
+}
+
+func serialDevice() string {
+	// Get the guest's device of cloud-hypervisor's serial port
+
+	if runtime.GOARCH == "arm64" {
+		return "/dev/ttyAMA0"
+	}
+
+	return "/dev/ttyS0"
+}
+
+func checkPrebuildStatus(serialPath string, consolePath string) error {
+	// Find the status the prebuild guest reported before powering off, failures come with the end of the cloud-init output
+
+	serial, err := os.Open(serialPath)
+	if err != nil {
+		return fmt.Errorf("could not read the prebuild status: %w", err)
+	}
+	defer serial.Close()
+
+	statusPrefix := prebuildStatusMarker + "_STATUS="
+	logBegin := prebuildStatusMarker + "_LOG_BEGIN"
+	logEnd := prebuildStatusMarker + "_LOG_END"
+
+	var log []string
+	inLog := false
+
+	scanner := bufio.NewScanner(serial)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		switch {
+		case line == logBegin:
+			inLog = true
+			log = nil
+		case line == logEnd:
+			inLog = false
+		case inLog:
+			log = append(log, line)
+		case strings.HasPrefix(line, statusPrefix):
+			status, err := strconv.Atoi(strings.TrimPrefix(line, statusPrefix))
+			if err != nil {
+				return fmt.Errorf("could not parse the prebuild status '%s': %w", line, err)
+			}
+
+			if status != 0 {
+				return fmt.Errorf("prebuild commands failed with exit status %d, cloud-init output:\n%s", status, strings.Join(log, "\n"))
+			}
+
+			return nil
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("could not read the prebuild status: %w", err)
+	}
+
+	return fmt.Errorf("prebuild VM powered off without reporting a status, last console output:\n%s", readLastLines(consolePath, prebuildConsoleLines))
+}
+
+func (i *InstanceGroup) streamPrebuildOutput(ctx context.Context, path string, source string) {
+	// Follow a file the prebuild VM writes to and log its lines at debug level until the context is cancelled
+
+	var file *os.File
+	for file == nil {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			// The hypervisor creates the file once it is up
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(prebuildStreamInterval):
+				continue
+			}
+		}
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	partialLine := ""
+
+	for {
+		chunk, err := reader.ReadString('\n')
+		partialLine += chunk
+
+		if err == nil {
+			i.logger.Debug("prebuild output", "source", source, "line", strings.TrimRight(partialLine, "\r\n"))
+			partialLine = ""
+			continue
+		}
+
+		if !errors.Is(err, io.EOF) {
+			i.logger.Debug("could not read prebuild output", "source", source, "error", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(prebuildStreamInterval):
+		}
+	}
+}
+
+func readLastLines(path string, count int) string {
+	// Read the last lines of a file for error messages
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Sprintf("(could not read %s: %s)", path, err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(contents), "\r\n"), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+
+	return strings.Join(lines, "\n")
+}
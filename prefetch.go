@@ -0,0 +1,92 @@
+package fleetingd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func PrefetchImages(ctx context.Context, configPath string, prebuild bool) error {
+	// Prepare the images of the plugin_config in configPath, given as JSON, as the first boot would, so it doesn't have to wait for them
+
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	instanceGroup := &InstanceGroup{}
+	err = json.Unmarshal(contents, instanceGroup)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", configPath, err)
+	}
+
+	// Init replaces the firewall table and the sockets of a running plugin
+	_, err = requestControlStatus(instanceGroup.VMDiskDir)
+	if err == nil {
+		return fmt.Errorf("the plugin is running with vm_disk_directory %s, prefetch the images before the runner is started", instanceGroup.VMDiskDir)
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "prefetch-images", Output: os.Stderr})
+
+	_, err = instanceGroup.Init(ctx, logger, provider.Settings{})
+	if err != nil {
+		return err
+	}
+
+	err = instanceGroup.prefetchImages(ctx, prebuild)
+
+	return errors.Join(err, instanceGroup.stopWithoutDestroying(ctx))
+}
+
+func (i *InstanceGroup) prefetchImages(ctx context.Context, prebuild bool) error {
+	// Download, verify and convert the images, with prebuild also run the prebuild and keep its result as the golden image
+
+	if prebuild {
+		err := i.inventory.RunPrebuild(ctx, i)
+		if err != nil {
+			return err
+		}
+
+		i.logger.Info("Images prefetched, the plugin boots from the golden image.", "path", i.goldenImagePath)
+		return nil
+	}
+
+	err := i.prepareWorkdir()
+	if err != nil {
+		return err
+	}
+
+	err = i.ensureImages(ctx)
+	if err != nil {
+		return err
+	}
+
+	i.collectGarbage()
+
+	i.logger.Info("Images prefetched and converted, the plugin runs the prebuild on them.")
+
+	return nil
+}
+
+func (i *InstanceGroup) stopWithoutDestroying(ctx context.Context) error {
+	// Undo what Init set up on the host without destroying instances an earlier plugin left running, the plugin adopts them when it starts
+
+	i.inventory.shutdownCancelFunc()
+
+	var errs []error
+
+	errs = append(errs, i.RemoveEgressRoutes())
+
+	if !i.usesPasst() {
+		errs = append(errs, i.inventory.RemoveNftables())
+	}
+
+	errs = append(errs, i.shutdownTracing(ctx))
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const ipv4ForwardingPath = "/proc/sys/net/ipv4/ip_forward"
+const ipv6ForwardingPath = "/proc/sys/net/ipv6/conf/all/forwarding"
+
+func (i *InstanceGroup) checkNetworkPrerequisites() error {
+	// Check the host can provide the guests' networking, so problems surface at startup instead of the first boot
+
+	// passt needs neither tap devices nor forwarding
+	if i.usesPasst() {
+		return nil
+	}
+
+	_, err := os.Stat("/dev/net/tun")
+	if err != nil {
+		return fmt.Errorf("/dev/net/tun is not available, is the tun module loaded? %w", err)
+	}
+
+	// Bridged traffic is not routed by the host
+	if i.isBridged() {
+		return nil
+	}
+
+	egressInterface, err := net.InterfaceByName(i.EgressInterface)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as egress_interface but can not be found: %w", i.EgressInterface, err)
+	}
+	if egressInterface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("egress_interface %s is down", i.EgressInterface)
+	}
+
+	err = i.checkForwarding(ipv4ForwardingPath)
+	if err != nil {
+		return err
+	}
+
+	// Routed and NATed IPv6 is forwarded as well
+	if i.ipv6Prefix.IsValid() {
+		err = i.checkForwarding(ipv6ForwardingPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) checkForwarding(sysctlPath string) error {
+	// Check forwarding is enabled in the given sysctl, enable it if configured to
+
+	sysctlName := strings.ReplaceAll(strings.TrimPrefix(sysctlPath, "/proc/sys/"), "/", ".")
+
+	value, err := os.ReadFile(sysctlPath)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", sysctlName, err)
+	}
+
+	if strings.TrimSpace(string(value)) == "1" {
+		return nil
+	}
+
+	if !i.HostEnableIPForwarding {
+		return errors.New(sysctlName + " is disabled, the VMs' traffic can't be forwarded. Enable it or set host_enable_ip_forwarding")
+	}
+
+	err = os.WriteFile(sysctlPath, []byte("1\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("could not enable %s: %w", sysctlName, err)
+	}
+
+	i.logger.Info("enabled forwarding", "sysctl", sysctlName)
+
+	return nil
+}
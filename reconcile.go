@@ -0,0 +1,215 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+	"golang.org/x/sys/unix"
+)
+
+const reconcileInterval = time.Minute
+
+func (i *InstanceGroup) runReconciler(ctx context.Context) {
+	// Periodically compare the inventory with the host's processes, taps and firewall
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			i.inventory.Reconcile(i)
+		}
+	}
+}
+
+func (i *Inventory) Reconcile(instanceGroup *InstanceGroup) {
+	// Repair what got out of sync with the inventory: instances without hypervisor, taps and rules without instance
+
+	// Reported on the health socket
+	defer func() {
+		now := time.Now()
+		i.lastReconcile.Store(&now)
+	}()
+
+	i.lock.RLock()
+	known := map[string]*InstanceInfo{}
+	hypervisors := map[string]processRecord{}
+	for name, instance := range i.instances {
+		known[name] = instance
+		if len(instance.Processes) > 0 {
+			hypervisors[name] = instance.Processes[0]
+		}
+	}
+	for name := range i.booting {
+		known[name] = nil
+	}
+	i.lock.RUnlock()
+
+	// The hypervisor's exit should have triggered the cleanup already
+	for name, hypervisor := range hypervisors {
+		pidfd, err := hypervisor.open()
+		if err == nil {
+			unix.Close(pidfd)
+			continue
+		}
+
+		instance := known[name]
+
+		select {
+		case <-instance.Removed:
+			continue
+		default:
+		}
+
+		instance.logger.Warn("Reconciler: hypervisor of instance is gone, removing it.")
+		instance.InstanceContextCancelFunc()
+	}
+
+	// passt instances have neither taps nor firewall rules
+	if instanceGroup.usesPasst() {
+		return
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		instanceGroup.logger.Error("reconciler could not list taps", "error", err)
+		return
+	}
+
+	for _, link := range links {
+		name := link.Attrs().Name
+		if link.Type() != "tuntap" || !instanceNameRegexp.MatchString(name) {
+			continue
+		}
+		if _, ok := known[name]; ok {
+			continue
+		}
+
+		// The instance may have been removed meanwhile, its cleanup deletes the tap as well
+		if i.instanceExists(name) {
+			continue
+		}
+
+		err = deleteTap(name)
+		if err != nil {
+			instanceGroup.logger.Error("reconciler could not delete tap", "tap", name, "error", err)
+			continue
+		}
+
+		instanceGroup.logger.Warn("Reconciler: deleted tap without instance.", "tap", name)
+	}
+
+	err = i.reconcileFirewall(instanceGroup, known)
+	if err != nil {
+		instanceGroup.logger.Error("reconciler could not check the firewall", "error", err)
+	}
+}
+
+func (i *Inventory) reconcileFirewall(instanceGroup *InstanceGroup, known map[string]*InstanceInfo) error {
+	// Remove the rules of instances which are gone and add the missing rules of running instances
+
+	connection, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("could not connect to nftables: %w", err)
+	}
+
+	chains, err := connection.ListChainsOfTableFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return err
+	}
+
+	elements, err := connection.GetSetElements(firewallTapSet())
+	if err != nil {
+		return fmt.Errorf("could not list nftables tap set: %w", err)
+	}
+
+	// Instances have a chain named after them and their tap in the forwarding set
+	referenced := map[string]bool{}
+	chainNames := map[string]struct{}{}
+	for _, chain := range chains {
+		if chain.Table.Name == firewallTableName && instanceNameRegexp.MatchString(chain.Name) {
+			referenced[chain.Name] = true
+			chainNames[chain.Name] = struct{}{}
+		}
+	}
+	for _, element := range elements {
+		name := strings.TrimRight(string(element.Key), "\x00")
+		if instanceNameRegexp.MatchString(name) {
+			referenced[name] = true
+		}
+	}
+
+	for name := range referenced {
+		if _, ok := known[name]; ok || i.instanceExists(name) {
+			continue
+		}
+
+		// The forwarded port follows from the instance's slot
+		externalSSHAddress := ""
+		if instanceGroup.externalAccessEnabled() {
+			index, err := strconv.Atoi(strings.TrimPrefix(name, "fleetingd"))
+			if err == nil {
+				externalSSHAddress = net.JoinHostPort(instanceGroup.ExternalAddress, strconv.Itoa(instanceGroup.getExternalSSHPort(index)))
+			}
+		}
+
+		err = i.RemoveInstanceFirewall(instanceGroup, name, "", externalSSHAddress)
+		if err != nil {
+			instanceGroup.logger.Error("reconciler could not remove rules", "instance", name, "error", err)
+			continue
+		}
+
+		instanceGroup.logger.Warn("Reconciler: removed firewall rules without instance.", "instance", name)
+	}
+
+	// Running instances got their rules before they were ever reported as running
+	for name, instance := range known {
+		if instance == nil || instance.Internal {
+			continue
+		}
+		if _, ok := chainNames[name]; ok {
+			continue
+		}
+
+		i.lock.RLock()
+		running := instance.State == provider.StateRunning
+		i.lock.RUnlock()
+		if !running {
+			continue
+		}
+
+		err = i.AddInstanceFirewall(instanceGroup, name)
+		if err != nil {
+			instanceGroup.logger.Error("reconciler could not add missing rules", "instance", name, "error", err)
+			continue
+		}
+
+		instanceGroup.logger.Warn("Reconciler: added missing firewall rules of instance.", "instance", name)
+	}
+
+	return nil
+}
+
+func (i *Inventory) instanceExists(name string) bool {
+	// Check an instance is in the inventory or being prepared
+
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	_, ok := i.instances[name]
+	if !ok {
+		_, ok = i.booting[name]
+	}
+
+	return ok
+}
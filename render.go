@@ -0,0 +1,201 @@
+package fleetingd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Name of the rendered firewall rules next to the config drive files
+const renderedFirewallFileName = "nftables.nft"
+
+func (i *InstanceGroup) prepareRender() error {
+	// Run the parts of Init the config drive and firewall rules depend on, without touching the host
+
+	// Keep the guests apart unless configured otherwise
+	i.checkInstanceIsolation()
+
+	checks := []func() error{
+		i.parseTemplates,
+		i.checkSubnetPrefixLength,
+		i.parseIPv6Prefix,
+		i.checkNetworkMode,
+		i.checkEgressInterface,
+		i.parseMACPrefix,
+		i.checkExternalAccess,
+		i.parseEgressPolicy,
+		i.parseEgressNetworks,
+		i.parseEgressRoutes,
+		i.parseDNSForwarder,
+		i.checkHostProtection,
+		i.checkConnectionLimits,
+		i.parseExtraDisks,
+		i.parseSlotCacheDisk,
+		i.parseImageProfile,
+		i.checkCloudinitExtraUserdata,
+		i.checkPrebuildProfile,
+		i.parseCACertificates,
+		i.parseGuestProxy,
+		i.parseGuestTime,
+		i.checkGuestSwap,
+		i.checkGuestTrim,
+		i.checkGuestTuning,
+		i.parseHostEntries,
+		i.checkGuestAgent,
+		i.checkSeedMode,
+		i.checkConfigDriveFormat,
+		i.prepareRenderSSHCA,
+		i.parseExtraAuthorizedKeys,
+	}
+
+	for _, check := range checks {
+		err := check()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) renderInstance(instanceName string, prebuild bool) ([]renderedFile, error) {
+	// Render the config drive and firewall rules the instance with the given name would get if it booted now
+
+	instanceIndex, err := strconv.Atoi(strings.TrimPrefix(instanceName, "fleetingd"))
+	if err != nil || !instanceNameRegexp.MatchString(instanceName) || instanceIndex >= i.maxIPAMSlots() {
+		return nil, fmt.Errorf("invalid instance name '%s', instances are named fleetingd0 to fleetingd%d", instanceName, i.maxIPAMSlots()-1)
+	}
+
+	subnetBase := instanceIndex * i.ipamStepSize()
+
+	// The keys are thrown away, every instance gets fresh ones
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := generateSSHHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	instanceMac, err := i.makeMACAddress(instanceIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	sriovMac := ""
+	if len(i.VMNetSRIOVDevices) > 0 {
+		sriovMac, err = i.makeSRIOVMACAddress(instanceIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hostTapIP, instanceTapIP := i.makeTapAddresses(subnetBase)
+	hostTapIP6, instanceTapIP6 := i.MakeAddresses6(instanceIndex)
+
+	externalSSHAddress := ""
+	if i.externalAccessEnabled() && !prebuild {
+		externalSSHAddress = net.JoinHostPort(i.ExternalAddress, strconv.Itoa(i.getExternalSSHPort(instanceIndex)))
+	}
+
+	var files []renderedFile
+	if prebuild {
+		files, err = i.renderUserdataPrebuild(instanceName, instanceMac, instanceTapIP, hostTapIP, i.subnetNetmask(), instanceTapIP6, hostTapIP6)
+	} else {
+		files, err = i.renderUserdata("user-data.tpl", instanceName, instanceMac, instanceTapIP, hostTapIP, i.subnetNetmask(), instanceTapIP6, hostTapIP6, sriovMac, publicKey, hostKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// passt instances have no tap device to filter
+	var firewall bytes.Buffer
+	if i.usesPasst() {
+		fmt.Fprintln(&firewall, "# network_mode passt adds no nftables rules")
+	} else {
+		instance := &InstanceInfo{
+			Name:                  instanceName,
+			HostTapIP:             hostTapIP,
+			InstanceTapIP:         instanceTapIP,
+			InstanceTapMacAddress: instanceMac,
+			HostTapIP6:            hostTapIP6,
+			InstanceTapIP6:        instanceTapIP6,
+			ExternalSSHAddress:    externalSSHAddress,
+		}
+
+		renderer := newFirewallRenderer()
+
+		err = i.addSharedChains(renderer, firewallTable())
+		if err != nil {
+			return nil, err
+		}
+
+		err = i.addInstanceRules(renderer, instance)
+		if err != nil {
+			return nil, err
+		}
+
+		renderer.write(&firewall)
+	}
+
+	return append(files, renderedFile{Name: "/" + renderedFirewallFileName, Contents: firewall.Bytes()}), nil
+}
+
+func Render(configPath string, instanceName string, prebuild bool, outputDir string) error {
+	// Write what an instance would get from the plugin_config in configPath, given as JSON, to outputDir or stdout if it is empty
+
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	instanceGroup := &InstanceGroup{}
+	err = json.Unmarshal(contents, instanceGroup)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %w", configPath, err)
+	}
+
+	instanceGroup.logger = hclog.NewNullLogger()
+
+	err = instanceGroup.prepareRender()
+	if err != nil {
+		return err
+	}
+
+	files, err := instanceGroup.renderInstance(instanceName, prebuild)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := strings.TrimPrefix(file.Name, "/")
+
+		if outputDir == "" {
+			fmt.Printf("==> %s <==\n%s\n", name, file.Contents)
+			continue
+		}
+
+		path := filepath.Join(outputDir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(path, file.Contents, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+func (i *InstanceGroup) checkRootPmem() error {
+	// Validate vm_root_pmem, the guest maps its reflinked copy of the base image with DAX instead of reading it through virtio-blk
+
+	if !i.VMRootPmem {
+		return nil
+	}
+
+	// The root partition is only known for directly booted kernels
+	if !i.bootsKernel() || i.imageProfile.RootDevice == "" {
+		return fmt.Errorf("vm_root_pmem needs a directly booted kernel, distro %s has none", i.Distro)
+	}
+
+	// A pmem device exposes the file as it is, qcow2 would be seen as garbage
+	if i.VMDiskFormat != diskFormatRaw {
+		return fmt.Errorf("vm_root_pmem requires vm_disk_format %s on a filesystem with reflinks", diskFormatRaw)
+	}
+
+	if i.VMDiskVhostUser {
+		return errors.New("vm_root_pmem can not be combined with vm_disk_vhost_user")
+	}
+
+	// The snapshot's configuration attaches the template's root disk
+	if i.VMSnapshotBoot {
+		return errors.New("vm_root_pmem can not be combined with vm_snapshot_boot")
+	}
+
+	if i.VMConfidentialComputing != "" {
+		return errors.New("vm_root_pmem can not be combined with vm_confidential_computing")
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) rootDiskArgs(diskPath string, vhostUserSocketPath string) []string {
+	// Get the arguments attaching an instance's root disk, a writable pmem device backed by the instance's own copy with vm_root_pmem
+
+	if i.VMRootPmem {
+		return []string{"--pmem", fmt.Sprintf("file=%s,discard_writes=off", diskPath)}
+	}
+
+	return []string{"--disk", i.rootDiskArg(diskPath, vhostUserSocketPath)}
+}
+
+func (i *InstanceGroup) pmemRootDevice() string {
+	// Get the root partition on the pmem device, the disk's partitions keep their numbers, e.g. /dev/pmem0p1 for /dev/vda1
+
+	return strings.Replace(i.imageProfile.RootDevice, "/dev/vda", "/dev/pmem0p", 1)
+}
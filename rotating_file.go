@@ -0,0 +1,88 @@
+package fleetingd
+
+import (
+	"fmt"
+	"os"
+)
+
+// A file which is rotated to .1, .2, ... once it reaches its maximum size, the oldest copy is dropped
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func (f *rotatingFile) open() error {
+	// Open the current file for appending
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	// Shift the rotated files by one, dropping the oldest, and start a new current file
+
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for index := f.maxFiles - 1; index >= 1; index-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, index), fmt.Sprintf("%s.%d", f.path, index+1))
+	}
+
+	err = os.Rename(f.path, f.path+".1")
+	if err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	// Append to the current file, rotating it first if the data would not fit anymore, a file which failed to rotate is opened again
+
+	var err error
+	if f.file == nil {
+		err = f.open()
+	} else if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err = f.rotate()
+	}
+	if err != nil {
+		f.file = nil
+		return 0, err
+	}
+
+	written, err := f.file.Write(p)
+	f.size += int64(written)
+
+	return written, err
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
@@ -0,0 +1,77 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Values cloud-hypervisor's --seccomp accepts, log only reports forbidden system calls instead of killing the VMM
+const (
+	seccompOn  = "true"
+	seccompLog = "log"
+	seccompOff = "false"
+)
+
+// Lists the active Linux security modules if securityfs is mounted
+const lsmListPath = "/sys/kernel/security/lsm"
+
+func (i *InstanceGroup) checkHypervisorSandbox() error {
+	// Check vm_seccomp and vm_landlock, and that the installed cloud-hypervisor and kernel support them
+
+	if i.VMSeccomp == "" {
+		i.VMSeccomp = seccompOn
+	}
+	if !slices.Contains([]string{seccompOn, seccompLog, seccompOff}, i.VMSeccomp) {
+		return fmt.Errorf("invalid vm_seccomp '%s', must be true, log or false", i.VMSeccomp)
+	}
+
+	if i.VMLandlock == nil {
+		landlock := true
+		i.VMLandlock = &landlock
+	}
+
+	// Older releases don't know the options and refuse to start
+	help, err := runCommand(context.Background(), hypervisorBackend, "--help")
+	if err != nil {
+		return fmt.Errorf("could not get the options of %s: %w", hypervisorBackend, err)
+	}
+
+	if i.VMSeccomp != seccompOn && !strings.Contains(string(help), "--seccomp") {
+		return fmt.Errorf("vm_seccomp = '%s' is not supported by the installed %s, please upgrade it", i.VMSeccomp, hypervisorVersion())
+	}
+
+	if !i.landlockEnabled() {
+		return nil
+	}
+
+	if !strings.Contains(string(help), "--landlock") {
+		return fmt.Errorf("vm_landlock is not supported by the installed %s, please upgrade it or set vm_landlock = false", hypervisorVersion())
+	}
+
+	// The VMM fails to start if the kernel can't apply the ruleset, the list is only readable with securityfs mounted
+	modules, err := os.ReadFile(lsmListPath)
+	if err == nil && !slices.Contains(strings.Split(strings.TrimSpace(string(modules)), ","), "landlock") {
+		return fmt.Errorf("vm_landlock requires a kernel with landlock enabled, active security modules are %s, add landlock to the lsm= kernel parameter or set vm_landlock = false", strings.TrimSpace(string(modules)))
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) landlockEnabled() bool {
+	return i.VMLandlock == nil || *i.VMLandlock
+}
+
+func (i *InstanceGroup) hypervisorSandboxArgs(restoring bool) []string {
+	// Get the arguments confining the hypervisor, restored VMs get the landlock setting with the rest of their configuration from the snapshot
+
+	args := []string{"--seccomp", i.VMSeccomp}
+
+	if i.landlockEnabled() && !restoring {
+		args = append(args, "--landlock")
+	}
+
+	return args
+}
@@ -0,0 +1,120 @@
+package fleetingd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// AES-256, the key file holds the key raw or hex encoded
+const stateEncryptionKeySize = 32
+
+// Key material kept outside of the Go heap, locked against being swapped out, left out of core dumps and zeroed once destroyed
+type lockedSecret struct {
+	mapping []byte
+	size    int
+}
+
+func newLockedSecret(contents []byte) (*lockedSecret, error) {
+	// Move contents into memory of their own, the given slice is zeroed
+
+	defer clear(contents)
+
+	pageSize := os.Getpagesize()
+	mapping, err := unix.Mmap(-1, 0, (len(contents)+pageSize-1)/pageSize*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("could not allocate memory for secret: %w", err)
+	}
+
+	// Locking fails beyond RLIMIT_MEMLOCK without CAP_IPC_LOCK, the secret is still zeroed and kept out of core dumps then
+	unix.Mlock(mapping)
+	unix.Madvise(mapping, unix.MADV_DONTDUMP)
+
+	copy(mapping, contents)
+
+	return &lockedSecret{mapping: mapping, size: len(contents)}, nil
+}
+
+func (s *lockedSecret) Bytes() []byte {
+	// Get the secret, it must not be used after Destroy
+
+	if s == nil || s.mapping == nil {
+		return nil
+	}
+
+	return s.mapping[:s.size]
+}
+
+func (s *lockedSecret) Destroy() {
+	// Zero the secret and free its memory, destroying it again or a nil secret does nothing
+
+	if s == nil || s.mapping == nil {
+		return
+	}
+
+	clear(s.mapping)
+	unix.Munlock(s.mapping)
+	unix.Munmap(s.mapping)
+	s.mapping = nil
+}
+
+func (i *InstanceGroup) loadStateEncryptionKey() (cipher.AEAD, error) {
+	// Read the key the SSH keys in the instance state are encrypted with, nil leaves them out of it
+
+	if i.StateEncryptionKeyFile == "" {
+		return nil, nil
+	}
+
+	contents, err := os.ReadFile(i.StateEncryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read state_encryption_key_file: %w", err)
+	}
+	defer clear(contents)
+
+	key := contents
+	if len(key) != stateEncryptionKeySize {
+		decoded, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+		if err != nil || len(decoded) != stateEncryptionKeySize {
+			return nil, fmt.Errorf("state_encryption_key_file %s must contain a key of %d bytes, raw or hex encoded", i.StateEncryptionKeyFile, stateEncryptionKeySize)
+		}
+		defer clear(decoded)
+
+		key = decoded
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealSecret(aead cipher.AEAD, plaintext []byte, name string) ([]byte, error) {
+	// Encrypt a secret bound to the name of its owner, the nonce is prepended
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, []byte(name)), nil
+}
+
+func openSecret(aead cipher.AEAD, sealed []byte, name string) ([]byte, error) {
+	// Decrypt a secret sealed for the same owner
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed secret is too short")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+}
@@ -0,0 +1,131 @@
+package fleetingd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Values of vm_seed_mode, how the job instances get their cloud-init seed
+const (
+	seedModeConfigDrive = "config-drive"
+	seedModeHTTP        = "http"
+)
+
+// Port of the NoCloud seeds on the host tap addresses, the one OpenStack serves its metadata on
+const seedServerPort = 8775
+
+func (i *InstanceGroup) checkSeedMode() error {
+	// Validate vm_seed_mode, the HTTP seed is found through the kernel command line and reached on the host tap address
+
+	switch i.VMSeedMode {
+	case "", seedModeConfigDrive:
+		return nil
+	case seedModeHTTP:
+	default:
+		return fmt.Errorf("unknown vm_seed_mode '%s', must be one of: %s, %s", i.VMSeedMode, seedModeConfigDrive, seedModeHTTP)
+	}
+
+	if i.usesIgnition() || !i.bootsKernel() {
+		return fmt.Errorf("vm_seed_mode %s needs a directly booted kernel and cloud-init, distro %s has none", seedModeHTTP, i.Distro)
+	}
+
+	if i.isBridged() || i.usesPasst() {
+		return fmt.Errorf("vm_seed_mode %s can only be used with network_mode nat", seedModeHTTP)
+	}
+
+	// Restored instances keep the template's drives
+	if i.VMSnapshotBoot {
+		return fmt.Errorf("vm_seed_mode %s can not be combined with vm_snapshot_boot", seedModeHTTP)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) usesHTTPSeed() bool {
+	return i.VMSeedMode == seedModeHTTP
+}
+
+func seedCmdline(files []renderedFile, hostTapIP string) (string, error) {
+	// Get the kernel command line pointing cloud-init at the seed, the network config rides along so the guest can reach it
+
+	var networkConfig []byte
+	for _, file := range files {
+		if file.Name == "/network-config" {
+			networkConfig = file.Contents
+		}
+	}
+
+	// The kernel's command line is limited to 2 kB, cloud-init takes the config gzipped
+	compressed := bytes.Buffer{}
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write(networkConfig)
+	if err != nil {
+		return "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", err
+	}
+
+	seedURL := "http://" + net.JoinHostPort(hostTapIP, strconv.Itoa(seedServerPort)) + "/"
+
+	return fmt.Sprintf("ds=nocloud-net;s=%s network-config=%s", seedURL, base64.StdEncoding.EncodeToString(compressed.Bytes())), nil
+}
+
+func (i *InstanceGroup) startSeedServer(ctx context.Context, files []renderedFile, hostTapIP string, instanceTapIP string) error {
+	// Serve an instance's seed on its host tap address until the context is cancelled, only to the instance itself
+
+	// cloud-init asks for vendor data as well
+	contents := map[string][]byte{"/vendor-data": {}}
+	for _, file := range files {
+		contents[file.Name] = file.Contents
+	}
+
+	address := net.JoinHostPort(hostTapIP, strconv.Itoa(seedServerPort))
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("could not serve the seed on %s: %w", address, err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The seed carries the instance's SSH host key, other guests may reach the address as well
+		remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || remoteIP != instanceTapIP {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		file, ok := contents[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(file)
+	})
+
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			i.logger.Error("seed server stopped", "address", address, "error", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/term"
+)
+
+// Ctrl-], as in telnet
+const consoleDetachKey = 0x1d
+
+func (i *InstanceGroup) getSerialSocketPath(instanceName string) string {
+	// Get the path of the socket cloud-hypervisor exposes an instance's serial port on
+
+	return filepath.Join(i.getInstanceDir(instanceName), "serial.sock")
+}
+
+func AttachConsole(vmDiskDir string, instanceName string) error {
+	// Connect the terminal to the serial port of an instance of the plugin using vmDiskDir until Ctrl-] is pressed
+
+	if !instanceNameRegexp.MatchString(instanceName) {
+		return fmt.Errorf("invalid instance name '%s', instances are named fleetingd<N>", instanceName)
+	}
+
+	socketPath := (&InstanceGroup{VMDiskDir: vmDiskDir}).getSerialSocketPath(instanceName)
+
+	connection, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("could not connect to the serial port of %s, is it running?: %w", instanceName, err)
+	}
+	defer connection.Close()
+
+	// Keys are passed on as they are typed, Ctrl-C included
+	stdin := int(os.Stdin.Fd())
+	if term.IsTerminal(stdin) {
+		state, err := term.MakeRaw(stdin)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(stdin, state)
+	}
+
+	fmt.Fprintf(os.Stderr, "Connected to the serial port of %s, press Ctrl-] to detach.\r\n", instanceName)
+
+	done := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(os.Stdout, connection)
+		done <- err
+	}()
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buffer)
+			if n > 0 {
+				index := slices.Index(buffer[:n], consoleDetachKey)
+				if index != -1 {
+					_, err = connection.Write(buffer[:index])
+					done <- err
+					return
+				}
+
+				_, err = connection.Write(buffer[:n])
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	err = <-done
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+
+	fmt.Fprintf(os.Stderr, "\r\nDetached from %s.\r\n", instanceName)
+
+	return err
+}
@@ -0,0 +1,172 @@
+package fleetingd
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// UEC Image Automatic Signing Key <cdimage@ubuntu.com>, signs the SUMS files of the Ubuntu cloud images
+const ubuntuCloudImageKeyFingerprint = "D2EB44626FDDC30B513D5BB71A5D6C4C7DB87C81"
+
+// Installed on Ubuntu hosts by the ubuntu-cloudimage-keyring package
+const ubuntuCloudImageKeyring = "/usr/share/keyrings/ubuntu-cloudimage-keyring.gpg"
+
+// Keys pinned by their fingerprint are fetched from here if the host has no keyring containing them
+const keyserverLookupURL = "https://keyserver.ubuntu.com/pks/lookup?op=get&options=mr&search=0x"
+
+func (i *InstanceGroup) checkImageSignatures() error {
+	// Validate the image signature settings
+
+	if i.VMImageSigningKey == "" {
+		return nil
+	}
+
+	if i.imageProfile.SumsSignatureSuffix == "" {
+		return fmt.Errorf("vm_image_signing_key can not be used with distro %s which does not publish signed checksums", i.Distro)
+	}
+
+	if i.VMImageSkipSignatureCheck {
+		return errors.New("vm_image_signing_key can not be combined with vm_image_skip_signature_check")
+	}
+
+	_, err := os.Stat(i.VMImageSigningKey)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as vm_image_signing_key but can not be accessed: %w", i.VMImageSigningKey, err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) verifySumsFile(ctx context.Context, sumsURL string, sumsFilePath string) error {
+	// Verify the detached signature of a downloaded SUMS file
+
+	if i.imageProfile.SumsSignatureSuffix == "" {
+		return nil
+	}
+
+	if i.VMImageSkipSignatureCheck {
+		i.logger.Warn("Not verifying the signature of checksums as requested by vm_image_skip_signature_check", "url", sumsURL)
+		return nil
+	}
+
+	keyring, err := i.loadSigningKeyring(ctx)
+	if err != nil {
+		return fmt.Errorf("could not load the key to verify %s with: %w", sumsURL, err)
+	}
+
+	signatureFilePath := sumsFilePath + i.imageProfile.SumsSignatureSuffix
+
+	err = i.downloadFile(ctx, sumsURL+i.imageProfile.SumsSignatureSuffix, signatureFilePath, nil)
+	if err != nil {
+		return err
+	}
+
+	sumsFile, err := os.Open(sumsFilePath)
+	if err != nil {
+		return err
+	}
+	defer sumsFile.Close()
+
+	signature, err := os.ReadFile(signatureFilePath)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(signature, []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, sumsFile, bytes.NewReader(signature))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, sumsFile, bytes.NewReader(signature))
+	}
+	if err != nil {
+		return fmt.Errorf("signature of %s could not be verified, refusing to use the images it lists: %w", sumsURL, err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) loadSigningKeyring(ctx context.Context) (openpgp.EntityList, error) {
+	// Get the keys SUMS files have to be signed by: the configured key or the distribution's key pinned by its fingerprint
+
+	if i.VMImageSigningKey != "" {
+		keyData, err := os.ReadFile(i.VMImageSigningKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return readKeyring(keyData)
+	}
+
+	keyData, err := os.ReadFile(i.imageProfile.SigningKeyring)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		keyData, err = i.fetchKey(ctx, i.imageProfile.SigningKeyFingerprint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyring, err := readKeyring(keyData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything but the pinned key is ignored, e.g. other keys of a shared keyring
+	pinnedKeyring := openpgp.EntityList{}
+	for _, entity := range keyring {
+		if strings.EqualFold(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]), i.imageProfile.SigningKeyFingerprint) {
+			pinnedKeyring = append(pinnedKeyring, entity)
+		}
+	}
+
+	if len(pinnedKeyring) == 0 {
+		return nil, fmt.Errorf("no key with fingerprint %s found", i.imageProfile.SigningKeyFingerprint)
+	}
+
+	return pinnedKeyring, nil
+}
+
+func readKeyring(keyData []byte) (openpgp.EntityList, error) {
+	// Read ASCII armored or binary public keys
+
+	if bytes.HasPrefix(bytes.TrimSpace(keyData), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(keyData))
+}
+
+func (i *InstanceGroup) fetchKey(ctx context.Context, fingerprint string) ([]byte, error) {
+	// Fetch a public key from the keyserver, the caller has to check its fingerprint
+
+	client := i.imageHTTPClient(time.Minute)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, keyserverLookupURL+fingerprint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch key %s: %s", fingerprint, response.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(response.Body, 1024*1024))
+}
@@ -0,0 +1,54 @@
+package fleetingd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reads 1 while sibling hyperthreads are online
+const smtActivePath = "/sys/devices/system/cpu/smt/active"
+
+func (i *InstanceGroup) checkSMTIsolation() error {
+	// Check the kernel supports core scheduling, without it vm_smt_isolation can't be enforced
+
+	if !i.VMSMTIsolation {
+		return nil
+	}
+
+	// Kernels built without CONFIG_SCHED_CORE reject the prctl
+	var cookie uint64
+	err := unix.Prctl(unix.PR_SCHED_CORE, unix.PR_SCHED_CORE_GET, 0, unix.PR_SCHED_CORE_SCOPE_THREAD, uintptr(unsafe.Pointer(&cookie)))
+	if err != nil {
+		return fmt.Errorf("vm_smt_isolation requires a kernel with core scheduling: %w", err)
+	}
+
+	active, err := os.ReadFile(smtActivePath)
+	if err == nil && strings.TrimSpace(string(active)) != "1" {
+		i.logger.Info("SMT is not active, vm_smt_isolation has no effect.")
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) isolateSMT(command *exec.Cmd) error {
+	// Give a started hypervisor a core scheduling cookie of its own, its threads only share a core with each other from then on
+
+	if !i.VMSMTIsolation {
+		return nil
+	}
+
+	// The threads started later inherit the cookie, and it is kept when a wrapper execs the hypervisor
+	err := unix.Prctl(unix.PR_SCHED_CORE, unix.PR_SCHED_CORE_CREATE, uintptr(command.Process.Pid), unix.PR_SCHED_CORE_SCOPE_THREAD_GROUP, 0)
+	if err != nil {
+		command.Process.Kill()
+		command.Wait()
+		return fmt.Errorf("could not isolate the hypervisor's cores: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package fleetingd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const snapshotDirName = "snapshot"
+
+type bootSnapshot struct {
+	Dir          string
+	DiskPath     string
+	UserdataPath string
+
+	// Identity of the template VM, restored VMs start out with it
+	MACAddress       string
+	TemplateGateway  string
+	TemplateGateway6 string
+}
+
+func (i *Inventory) CreateBootSnapshot(ctx context.Context, instanceGroup *InstanceGroup) error {
+	// Boot a template VM from the prebuilt image and snapshot it once it is fully booted
+
+	instanceGroup.logger.Info("Booting snapshot template VM...")
+
+	templateName, err := i.bootInstance(ctx, instanceGroup, true)
+	if err != nil {
+		return err
+	}
+
+	// The template has to be gone before its slot is used again, even if the prebuild was aborted
+	defer i.DestroyInstance(context.WithoutCancel(ctx), templateName)
+
+	i.lock.RLock()
+	templateInstance, ok := i.instances[templateName]
+	if !ok {
+		i.lock.RUnlock()
+		return errors.New("snapshot template VM exited unexpectedly")
+	}
+	templateMAC := templateInstance.InstanceTapMacAddress
+	templateGateway := templateInstance.HostTapIP
+	templateGateway6 := templateInstance.HostTapIP6
+	i.lock.RUnlock()
+
+	vsockSocketPath := instanceGroup.getVsockSocketPath(templateName)
+
+	waitContext, cancel := context.WithTimeout(ctx, 15*time.Minute)
+	defer cancel()
+
+	err = waitForGuestAgent(waitContext, vsockSocketPath)
+	if err != nil {
+		return fmt.Errorf("snapshot template VM did not become ready: %w", err)
+	}
+
+	// Exit code 2 means cloud-init finished with warnings only
+	_, err = runGuestAgentScript(waitContext, vsockSocketPath, "cloud-init status --wait > /dev/null || [ $? -eq 2 ]; sync")
+	if err != nil {
+		return fmt.Errorf("snapshot template VM failed to boot: %w", err)
+	}
+
+	snapshotDir := filepath.Join(instanceGroup.VMDiskDir, vmWorkdir, snapshotDirName)
+	err = os.RemoveAll(snapshotDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(snapshotDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	instanceGroup.logger.Info("Snapshotting template VM...")
+
+	apiClient := newHypervisorAPIClient(instanceGroup.getAPISocketPath(templateName))
+	err = apiClient.Pause()
+	if err != nil {
+		return err
+	}
+
+	err = apiClient.Snapshot(snapshotDir)
+	if err != nil {
+		return err
+	}
+
+	// The snapshot only contains the VM state, the disks have to match it so copy them while the VM is paused
+	snapshot := &bootSnapshot{
+		Dir:          snapshotDir,
+		DiskPath:     filepath.Join(snapshotDir, "disk.img"),
+		UserdataPath: filepath.Join(snapshotDir, "userdata.img"),
+
+		MACAddress:       templateMAC,
+		TemplateGateway:  templateGateway,
+		TemplateGateway6: templateGateway6,
+	}
+
+	diskCopies := map[string]string{
+		instanceGroup.getOverlayPath(templateName):  snapshot.DiskPath,
+		instanceGroup.getUserdataPath(templateName): snapshot.UserdataPath,
+	}
+
+	for source, destination := range diskCopies {
+		_, err = hostCommands.Run(ctx, hostCommand{Args: []string{"cp", "--sparse=always", "-f", source, destination}, Timeout: noCommandTimeout})
+		if err != nil {
+			return fmt.Errorf("could not copy snapshot disk %s: %w", source, err)
+		}
+	}
+
+	i.bootSnapshot = snapshot
+
+	instanceGroup.logger.Info("Boot snapshot created.")
+
+	return nil
+}
+
+func (i *InstanceGroup) prepareSnapshotRestore(snapshot *bootSnapshot, instanceName string, overlayPath string, hostTapIP string) (string, error) {
+	// Create a restore directory for an instance, its config points the snapshot at the instance's own resources
+
+	restorePath := filepath.Join(i.getInstanceDir(instanceName), "restore")
+
+	err := os.MkdirAll(restorePath, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	configContents, err := os.ReadFile(filepath.Join(snapshot.Dir, "config.json"))
+	if err != nil {
+		return "", err
+	}
+
+	// Decode into plain maps so fields unknown to us survive the rewrite
+	var config map[string]any
+	err = json.Unmarshal(configContents, &config)
+	if err != nil {
+		return "", fmt.Errorf("could not parse snapshot config: %w", err)
+	}
+
+	disks, ok := config["disks"].([]any)
+	if !ok || len(disks) < 2 {
+		return "", errors.New("snapshot config does not contain the expected disks")
+	}
+	rootDisk, rootOk := disks[0].(map[string]any)
+	userdataDisk, userdataOk := disks[1].(map[string]any)
+	if !rootOk || !userdataOk {
+		return "", errors.New("snapshot config contains invalid disks")
+	}
+	rootDisk["path"] = overlayPath
+	userdataDisk["path"] = snapshot.UserdataPath
+
+	networks, ok := config["net"].([]any)
+	if !ok || len(networks) < 1 {
+		return "", errors.New("snapshot config does not contain the expected network device")
+	}
+	network, ok := networks[0].(map[string]any)
+	if !ok {
+		return "", errors.New("snapshot config contains an invalid network device")
+	}
+	network["tap"] = instanceName
+	network["ip"] = hostTapIP
+	network["mask"] = i.subnetMask()
+
+	vsock, ok := config["vsock"].(map[string]any)
+	if !ok {
+		return "", errors.New("snapshot config does not contain the expected vsock device")
+	}
+	vsock["socket"] = i.getVsockSocketPath(instanceName)
+
+	if console, ok := config["console"].(map[string]any); ok {
+		if _, ok := console["file"].(string); ok {
+			console["file"] = i.getConsoleRawPath(instanceName)
+		}
+	}
+
+	if serial, ok := config["serial"].(map[string]any); ok {
+		if _, ok := serial["socket"].(string); ok {
+			serial["socket"] = i.getSerialSocketPath(instanceName)
+		}
+	}
+
+	configContents, err = json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.WriteFile(filepath.Join(restorePath, "config.json"), configContents, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	// The VM state and memory are only read during restore, so hardlinks are enough
+	snapshotFiles, err := os.ReadDir(snapshot.Dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, snapshotFile := range snapshotFiles {
+		name := snapshotFile.Name()
+		if name == "config.json" || snapshotFile.IsDir() || strings.HasSuffix(name, ".img") {
+			continue
+		}
+
+		err = os.Link(filepath.Join(snapshot.Dir, name), filepath.Join(restorePath, name))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return restorePath, nil
+}
+
+func (i *InstanceGroup) finishSnapshotRestore(ctx context.Context, snapshot *bootSnapshot, instanceName string, ip string, gateway string, netmask string, ip6 string, gateway6 string, sshAuthorizedPublicKey ssh.PublicKey, hostKey sshHostKey) error {
+	// Resume a restored VM and give it the identity of the instance
+
+	apiClient := newHypervisorAPIClient(i.getAPISocketPath(instanceName))
+
+	err := apiClient.waitReady(10 * time.Second)
+	if err != nil {
+		return err
+	}
+
+	err = apiClient.Resume()
+	if err != nil {
+		return err
+	}
+
+	type fixupTemplateInput struct {
+		InstanceName           string
+		Timestamp              int64
+		IP                     string
+		Gateway                string
+		Netmask                string
+		IP6                    string
+		Gateway6               string
+		Netmask6               string
+		DNSServer              string
+		NTPFollowsGateway      bool
+		TimesyncdConfigPath    string
+		TemplateGateway        string
+		TemplateGateway6       string
+		SSHAuthorizedPublicKey string
+		ExtraAuthorizedKeys    []string
+		SSHHostPrivateKey      string
+		SSHHostPublicKey       string
+		GuestFiles             []guestFile
+		Hardening              bool
+		Username               string
+	}
+
+	fixupScript := strings.Builder{}
+	err = i.templates.ExecuteTemplate(&fixupScript, "snapshot-fixup.tpl", fixupTemplateInput{
+		InstanceName:           instanceName,
+		Timestamp:              time.Now().Unix(),
+		IP:                     ip,
+		Gateway:                gateway,
+		Netmask:                netmask,
+		IP6:                    ip6,
+		Gateway6:               gateway6,
+		Netmask6:               fmt.Sprintf("/%d", i.VMIPv6InstancePrefixLength),
+		DNSServer:              i.dnsServer(gateway),
+		NTPFollowsGateway:      i.ntpFollowsGateway(),
+		TimesyncdConfigPath:    guestTimesyncdConfigPath,
+		TemplateGateway:        snapshot.TemplateGateway,
+		TemplateGateway6:       snapshot.TemplateGateway6,
+		SSHAuthorizedPublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshAuthorizedPublicKey))),
+		ExtraAuthorizedKeys:    i.extraAuthorizedKeys,
+		SSHHostPrivateKey:      hostKey.PrivateKey,
+		SSHHostPublicKey:       hostKey.PublicKey,
+		GuestFiles:             i.guestFiles(instanceName),
+		Hardening:              i.VMHardening,
+		Username:               i.imageProfile.Username,
+	})
+	if err != nil {
+		return err
+	}
+
+	fixupContext, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err = runGuestAgentScript(fixupContext, i.getVsockSocketPath(instanceName), fixupScript.String())
+	if err != nil {
+		return fmt.Errorf("could not re-identify restored instance %s: %w", instanceName, err)
+	}
+
+	return nil
+}
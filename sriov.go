@@ -0,0 +1,160 @@
+package fleetingd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+type sriovFunction struct {
+	// Network device of the physical function the VF belongs to
+	PhysicalFunction string
+	Index            int
+}
+
+func (i *InstanceGroup) prepareSRIOVDevices() error {
+	// Validate the pool of SR-IOV virtual functions and find the physical function of each
+
+	if len(i.VMNetSRIOVDevices) == 0 {
+		return nil
+	}
+
+	// The VF carries the guests' IPv4 traffic straight onto the physical network, the tap only remains for SSH
+	if i.NetworkMode != networkModeNAT {
+		return errors.New("vm_net_sriov_devices can only be used with network_mode nat")
+	}
+
+	// Replies to forwarded connections would leave through the VF, and none of the traffic passes the host's firewall
+	if i.ExternalAddress != "" || len(i.egressRoutes) > 0 {
+		return errors.New("vm_net_sriov_devices can not be combined with external_address or egress_routes")
+	}
+
+	if i.EgressPolicy == egressPolicyDeny || len(i.EgressAllow) > 0 || len(i.EgressDeny) > 0 || len(i.EgressNetworks) > 0 || i.EgressBlockPrivateNetworks {
+		return errors.New("vm_net_sriov_devices can not be combined with egress_policy deny, egress_allow, egress_deny, egress_networks or egress_block_private_networks")
+	}
+
+	i.sriovFunctions = map[string]sriovFunction{}
+
+	for _, device := range i.VMNetSRIOVDevices {
+		function, err := findSRIOVFunction(device)
+		if err != nil {
+			return err
+		}
+
+		i.sriovFunctions[device] = function
+	}
+
+	return nil
+}
+
+func findSRIOVFunction(device string) (sriovFunction, error) {
+	// Find the physical function's network device and the index of a virtual function on it
+
+	devicePath := filepath.Join(pciDevicesPath, device)
+
+	physicalFunctionPath, err := filepath.EvalSymlinks(filepath.Join(devicePath, "physfn"))
+	if err != nil {
+		return sriovFunction{}, fmt.Errorf("SR-IOV device %s is not a virtual function: %w", device, err)
+	}
+
+	networkDevices, err := os.ReadDir(filepath.Join(physicalFunctionPath, "net"))
+	if err != nil || len(networkDevices) == 0 {
+		return sriovFunction{}, fmt.Errorf("physical function %s of SR-IOV device %s has no network device", filepath.Base(physicalFunctionPath), device)
+	}
+
+	entries, err := os.ReadDir(physicalFunctionPath)
+	if err != nil {
+		return sriovFunction{}, err
+	}
+
+	for _, entry := range entries {
+		indexString, ok := strings.CutPrefix(entry.Name(), "virtfn")
+		if !ok {
+			continue
+		}
+
+		virtualFunction, err := os.Readlink(filepath.Join(physicalFunctionPath, entry.Name()))
+		if err != nil || filepath.Base(virtualFunction) != device {
+			continue
+		}
+
+		index, err := strconv.Atoi(indexString)
+		if err != nil {
+			continue
+		}
+
+		return sriovFunction{PhysicalFunction: networkDevices[0].Name(), Index: index}, nil
+	}
+
+	return sriovFunction{}, fmt.Errorf("could not find SR-IOV device %s on its physical function %s", device, filepath.Base(physicalFunctionPath))
+}
+
+func (i *Inventory) allocateSRIOVDevice(instanceGroup *InstanceGroup) (string, error) {
+	// Reserve a free virtual function, must be called with the inventory lock held
+
+	if len(instanceGroup.VMNetSRIOVDevices) == 0 {
+		return "", nil
+	}
+
+	for _, device := range instanceGroup.VMNetSRIOVDevices {
+		if _, ok := i.sriovSlots[device]; !ok {
+			i.sriovSlots[device] = struct{}{}
+			return device, nil
+		}
+	}
+
+	return "", errors.New("all SR-IOV devices are in use")
+}
+
+func (i *InstanceGroup) makeSRIOVMACAddress(instanceIndex int) (string, error) {
+	// Get the MAC address of an instance's virtual function, it must differ from the tap's
+
+	address := make(net.HardwareAddr, 6)
+	copy(address, i.macPrefix)
+
+	if i.VMMACDeterministic {
+		// Like the tap's address but with the top bit of the slot set, there are never that many slots
+		suffix := binary.BigEndian.AppendUint64(nil, uint64(instanceIndex))
+		suffix = suffix[8-(6-len(i.macPrefix)):]
+		suffix[0] |= 0x80
+		copy(address[len(i.macPrefix):], suffix)
+	} else {
+		_, err := rand.Read(address[len(i.macPrefix):])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return address.String(), nil
+}
+
+func (i *InstanceGroup) configureSRIOVDevice(device string, macAddress string) error {
+	// Set the MAC address of a virtual function on its physical function before it is handed to a VM
+
+	function := i.sriovFunctions[device]
+
+	physicalFunction, err := netlink.LinkByName(function.PhysicalFunction)
+	if err != nil {
+		return fmt.Errorf("could not find physical function %s of SR-IOV device %s: %w", function.PhysicalFunction, device, err)
+	}
+
+	hardwareAddress, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return err
+	}
+
+	err = netlink.LinkSetVfHardwareAddr(physicalFunction, function.Index, hardwareAddress)
+	if err != nil {
+		return fmt.Errorf("could not set MAC address of SR-IOV device %s: %w", device, err)
+	}
+
+	return nil
+}
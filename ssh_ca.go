@@ -0,0 +1,216 @@
+package fleetingd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Generated in the vm_disk_directory unless vm_ssh_ca_key_file is set, kept across restarts so adopted instances still trust it
+const sshCAKeyFileName = "ssh_ca"
+
+// Where the guests keep the CA's public key and the sshd setting trusting it
+const guestSSHCAKeyPath = "/etc/ssh/fleetingd_user_ca.pub"
+const guestSSHCAConfigPath = "/etc/ssh/sshd_config.d/fleetingd-ca.conf"
+
+const defaultSSHCertificateLifetimeMinutes = 60
+
+// Clocks of freshly booted or restored guests may lag behind the host's
+const sshCertificateClockSkew = time.Minute
+
+func (i *InstanceGroup) sshCAKeyPath() string {
+	if i.VMSSHCAKeyFile != "" {
+		return i.VMSSHCAKeyFile
+	}
+	return filepath.Join(i.VMDiskDir, sshCAKeyFileName)
+}
+
+func (i *InstanceGroup) checkSSHCA() error {
+	// Check the SSH CA settings
+
+	if !i.VMSSHCA {
+		if i.VMSSHCAKeyFile != "" {
+			return errors.New("vm_ssh_ca_key_file requires vm_ssh_ca")
+		}
+		return nil
+	}
+
+	if i.VMSSHCertificateLifetimeMinutes == 0 {
+		i.VMSSHCertificateLifetimeMinutes = defaultSSHCertificateLifetimeMinutes
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) loadSSHCA() error {
+	// Load the SSH CA the guests trust for user certificates, a new one is generated on first use
+
+	err := i.checkSSHCA()
+	if err != nil || !i.VMSSHCA {
+		return err
+	}
+
+	keyPath := i.sshCAKeyPath()
+	if i.VMSSHCAKeyFile == "" {
+		err = generateSSHCAKey(keyPath)
+		if err != nil {
+			return fmt.Errorf("could not generate the SSH CA key %s: %w", keyPath, err)
+		}
+	}
+
+	i.sshCA, err = readSSHCAKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	i.logger.Info("Guests trust the SSH CA.", "path", keyPath, "fingerprint", ssh.FingerprintSHA256(i.sshCA.PublicKey()))
+
+	return nil
+}
+
+func (i *InstanceGroup) prepareRenderSSHCA() error {
+	// Render with the CA the plugin would load, a throwaway one if the plugin didn't generate it yet
+
+	err := i.checkSSHCA()
+	if err != nil || !i.VMSSHCA {
+		return err
+	}
+
+	keyPath := i.sshCAKeyPath()
+	_, err = os.Stat(keyPath)
+	if errors.Is(err, fs.ErrNotExist) && i.VMSSHCAKeyFile == "" {
+		_, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return err
+		}
+
+		i.sshCA, err = ssh.NewSignerFromKey(privateKey)
+		return err
+	}
+
+	i.sshCA, err = readSSHCAKey(keyPath)
+	return err
+}
+
+func readSSHCAKey(keyPath string) (ssh.Signer, error) {
+	contents, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the SSH CA key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(contents)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the SSH CA key %s, it has to be an unencrypted OpenSSH private key: %w", keyPath, err)
+	}
+
+	return signer, nil
+}
+
+func generateSSHCAKey(keyPath string) error {
+	// Write a new ed25519 CA key next to its public key as ssh-keygen does, an existing key is kept
+
+	_, err := os.Stat(keyPath)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+
+	marshalledKey, err := ssh.MarshalPrivateKey(privateKey, "fleetingd-ca")
+	if err != nil {
+		return err
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	// ssh-keygen -s takes the key path, its public key is looked up with .pub appended
+	err = os.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(sshPublicKey), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyPath, pem.EncodeToMemory(marshalledKey), 0600)
+}
+
+func (i *InstanceGroup) sshCAPublicKey() string {
+	// Get the CA's public key in authorized_keys format, empty without vm_ssh_ca
+
+	if i.sshCA == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(i.sshCA.PublicKey())))
+}
+
+// A file the guest gets written on its first boot, by cloud-init or Ignition
+type guestFile struct {
+	Path     string
+	Contents string
+
+	// Added to the end of the file the image already has instead of replacing it
+	Append bool
+}
+
+func (i *InstanceGroup) guestSSHCAFiles() []guestFile {
+	// Get the files letting a guest's sshd accept certificates of the CA, none without vm_ssh_ca
+
+	if i.sshCA == nil {
+		return nil
+	}
+
+	return []guestFile{
+		{Path: guestSSHCAKeyPath, Contents: i.sshCAPublicKey() + "\n"},
+		{Path: guestSSHCAConfigPath, Contents: "TrustedUserCAKeys " + guestSSHCAKeyPath + "\n"},
+	}
+}
+
+func (i *InstanceGroup) issueSSHCertificate(signer ssh.Signer, principal string, keyID string) (ssh.Signer, error) {
+	// Sign a short-lived user certificate for the key, valid for logging in as the principal only
+
+	serial := make([]byte, 8)
+	_, err := rand.Read(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	certificate := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		ValidAfter:      uint64(now.Add(-sshCertificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(time.Duration(i.VMSSHCertificateLifetimeMinutes) * time.Minute).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-port-forwarding":  "",
+				"permit-agent-forwarding": "",
+			},
+		},
+	}
+
+	err = certificate.SignCert(rand.Reader, i.sshCA)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewCertSigner(certificate, signer)
+}
@@ -0,0 +1,154 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// How much of the hypervisor's stderr is kept, the reason it exited is at the end
+const hypervisorStderrSize = 4096
+
+// Keeps the last size bytes of a process's output
+type outputTail struct {
+	lock sync.Mutex
+	size int
+	data []byte
+}
+
+func (o *outputTail) Write(p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.data = append(o.data, p...)
+	if len(o.data) > o.size {
+		o.data = o.data[len(o.data)-o.size:]
+	}
+
+	return len(p), nil
+}
+
+func (o *outputTail) String() string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return strings.TrimSpace(string(o.data))
+}
+
+func (o *outputTail) Reset() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.data = nil
+}
+
+func (i *Inventory) superviseHypervisor(instanceGroup *InstanceGroup, instance *InstanceInfo, instanceContext context.Context, command *exec.Cmd, stderr *outputTail, restartable bool) string {
+	// Wait for an instance's hypervisor to exit and restart it up to vm_max_restarts times after crashes, returns why it exited on its own
+
+	var restarts uint64
+
+	// The slice's count includes kills of earlier hypervisors of the instance
+	oomKills, _ := instanceGroup.countOOMKills(instance.Name)
+
+	for {
+		err := command.Wait()
+
+		// Instances are stopped by cancelling their context, any other exit is a crash or the guest powering off
+		if instanceContext.Err() != nil {
+			return ""
+		}
+
+		// A guest being destroyed may have been asked to power off by the plugin
+		i.lock.RLock()
+		deleting := instance.State == provider.StateDeleting
+		i.lock.RUnlock()
+		if deleting {
+			return ""
+		}
+
+		exitReason := hypervisorExitReason(err)
+		if output := stderr.String(); output != "" {
+			exitReason += ": " + output
+		}
+
+		// The kernel kills the hypervisor without it noticing, only its cgroup tells
+		kills, countErr := instanceGroup.countOOMKills(instance.Name)
+		if countErr != nil {
+			instance.logger.Warn("could not check whether the hypervisor was killed for its memory usage", "error", countErr)
+		}
+		if kills > oomKills {
+			oomKills = kills
+			i.metrics.hypervisorOOMKills.Add(1)
+			exitReason = fmt.Sprintf("hypervisor was killed for exceeding its memory limit of %d MB, %s", instanceGroup.cgroupMemoryLimitMegabytes(), exitReason)
+		}
+
+		// A guest powering off did so on purpose
+		if err == nil || !restartable || restarts >= instanceGroup.VMMaxRestarts {
+			instanceGroup.logInstanceFailure(instance, "instance exited unexpectedly", exitReason)
+			return exitReason
+		}
+
+		restarts++
+		instanceGroup.logInstanceFailure(instance, fmt.Sprintf("instance crashed, restarting it (%d of %d)", restarts, instanceGroup.VMMaxRestarts), exitReason)
+
+		command, err = i.restartHypervisor(instanceGroup, instance, instanceContext, command, stderr)
+		if err != nil {
+			if instanceContext.Err() != nil {
+				return ""
+			}
+
+			instance.logger.Error("could not restart crashed instance", "error", err)
+			return exitReason
+		}
+	}
+}
+
+func (i *Inventory) restartHypervisor(instanceGroup *InstanceGroup, instance *InstanceInfo, instanceContext context.Context, command *exec.Cmd, stderr *outputTail) (*exec.Cmd, error) {
+	// Start a crashed instance's hypervisor again with the same arguments, the guest boots again from its overlay
+
+	// The crashed process left its API socket behind, which keeps the new one from binding it
+	err := os.Remove(instanceGroup.getAPISocketPath(instance.Name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	stderr.Reset()
+
+	restarted := exec.CommandContext(instanceContext, command.Args[0], command.Args[1:]...)
+	restarted.Stderr = stderr
+	restarted.SysProcAttr = command.SysProcAttr
+
+	// Destroying the instance cancels its context under the lock, so it can't miss the new process
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if instanceContext.Err() != nil {
+		return nil, errors.New("instance is being removed")
+	}
+
+	err = restarted.Start()
+	if err != nil {
+		return nil, fmt.Errorf("could not start cloud-hypervisor: %w", err)
+	}
+
+	err = instanceGroup.isolateSMT(restarted)
+	if err != nil {
+		return nil, err
+	}
+
+	// A restarted plugin has to find the new process
+	instance.Processes[0] = newProcessRecord(restarted.Process.Pid)
+
+	err = i.saveInstanceState()
+	if err != nil {
+		instance.logger.Error("could not save instance state", "error", err)
+	}
+
+	return restarted, nil
+}
@@ -0,0 +1,137 @@
+package fleetingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Instance slices are children of this slice, systemd derives the hierarchy from the dashes in their names
+const systemdSlicePrefix = "fleetingd-"
+
+func (i *InstanceGroup) checkSystemdScopes() error {
+	// Check systemd can run the instances' processes in transient scopes
+
+	if !i.VMSystemdScopes {
+		if len(i.VMSystemdScopeProperties) > 0 {
+			return errors.New("vm_systemd_scope_properties requires vm_systemd_scopes")
+		}
+		return nil
+	}
+
+	// Only set up by systemd when it is the init system
+	_, err := os.Stat("/run/systemd/system")
+	if err != nil {
+		return fmt.Errorf("vm_systemd_scopes requires systemd as the init system: %w", err)
+	}
+
+	for _, binary := range []string{"systemd-run", "systemctl"} {
+		_, err = exec.LookPath(binary)
+		if err != nil {
+			return fmt.Errorf("vm_systemd_scopes requires %s: %w", binary, err)
+		}
+	}
+
+	return nil
+}
+
+func instanceSliceName(instanceName string) string {
+	return systemdSlicePrefix + instanceName + ".slice"
+}
+
+func instanceSliceCgroupPath(instanceName string) string {
+	// Get the cgroup of an instance's slice, systemd nests fleetingd-fleetingd1.slice in fleetingd.slice
+
+	return filepath.Join(cgroupRoot, strings.TrimSuffix(systemdSlicePrefix, "-")+".slice", instanceSliceName(instanceName))
+}
+
+func (i *InstanceGroup) instanceCommand(ctx context.Context, instanceName string, properties []string, unprivileged bool, name string, args ...string) *exec.Cmd {
+	// Build the command of one of an instance's processes, in its own scope in the instance's slice if vm_systemd_scopes is set, unprivileged runs it as vm_hypervisor_user
+
+	credential := i.hypervisorCredential
+	if !unprivileged {
+		credential = nil
+	}
+
+	// Long-running processes aren't run through hostCommands, so at least log what is started
+	i.logger.Debug("instance command", "instance", instanceName, "argv", commandLine(append([]string{name}, args...)))
+
+	if !i.VMSystemdScopes {
+		command := exec.CommandContext(ctx, name, args...)
+		if credential != nil {
+			command.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+		}
+		return command
+	}
+
+	// systemd-run execs the command once the scope is set up, so it stays our child with the same PID
+	scopeArgs := []string{"--scope", "--quiet", "--collect", "--slice=" + instanceSliceName(instanceName)}
+	for _, property := range properties {
+		scopeArgs = append(scopeArgs, "--property="+property)
+	}
+
+	// systemd-run needs its privileges for setting up the scope and switches to the user before it execs the command
+	if credential != nil {
+		scopeArgs = append(scopeArgs, fmt.Sprintf("--uid=%d", credential.Uid), fmt.Sprintf("--gid=%d", credential.Gid))
+	}
+	scopeArgs = append(scopeArgs, "--", name)
+
+	return exec.CommandContext(ctx, "systemd-run", append(scopeArgs, args...)...)
+}
+
+func (i *InstanceGroup) hypervisorCommand(ctx context.Context, instanceName string, unprivileged bool, args ...string) *exec.Cmd {
+	// Build an instance's cloud-hypervisor command, vm_cgroup_limits and vm_systemd_scope_properties limit its scope, the latter win, job VMs are confined by vm_mac_confinement
+
+	properties := append(i.cgroupLimitProperties(), i.VMSystemdScopeProperties...)
+
+	wrapper := i.confinementWrapper(instanceName)
+	if !unprivileged || len(wrapper) == 0 {
+		return i.instanceCommand(ctx, instanceName, properties, unprivileged, hypervisorBackend, args...)
+	}
+
+	return i.instanceCommand(ctx, instanceName, properties, unprivileged, wrapper[0], append(append(wrapper[1:], hypervisorBackend), args...)...)
+}
+
+func (i *InstanceGroup) stopInstanceSlice(instanceName string) error {
+	// Kill whatever is left in an instance's slice
+
+	if !i.VMSystemdScopes {
+		return nil
+	}
+
+	_, err := runCommand(context.Background(), "systemctl", "stop", instanceSliceName(instanceName))
+	if err != nil {
+		return fmt.Errorf("could not stop %s: %w", instanceSliceName(instanceName), err)
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) listInstanceSlices() ([]string, error) {
+	// Get the names of the instances which have a slice, including those of an earlier run
+
+	output, err := runCommand(context.Background(), "systemctl", "list-units", "--all", "--plain", "--no-legend", "--type=slice", systemdSlicePrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("could not list instance slices: %w", err)
+	}
+
+	var instanceNames []string
+	for line := range strings.Lines(string(output)) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		instanceName := strings.TrimSuffix(strings.TrimPrefix(fields[0], systemdSlicePrefix), ".slice")
+		if instanceNameRegexp.MatchString(instanceName) {
+			instanceNames = append(instanceNames, instanceName)
+		}
+	}
+
+	return instanceNames, nil
+}
@@ -0,0 +1,118 @@
+package fleetingd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Matches the MTU in the guests' network config
+const tapMTU = 1500
+
+func (i *InstanceGroup) parseTapOwner() error {
+	// Resolve the user owning the tap devices, vm_hypervisor_user or else the plugin's own user by default
+
+	if i.NetworkTapOwner == "" && i.hypervisorCredential != nil {
+		i.tapOwnerUID = i.hypervisorCredential.Uid
+		i.tapOwnerGID = i.hypervisorCredential.Gid
+		return nil
+	}
+
+	if i.NetworkTapOwner == "" {
+		i.tapOwnerUID = uint32(os.Getuid())
+		i.tapOwnerGID = uint32(os.Getgid())
+		return nil
+	}
+
+	owner, err := lookupUser(i.NetworkTapOwner)
+	if err != nil {
+		return fmt.Errorf("'%s' was specified as network_tap_owner but is not a known user: %w", i.NetworkTapOwner, err)
+	}
+
+	uid, err := strconv.ParseUint(owner.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(owner.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	i.tapOwnerUID = uint32(uid)
+	i.tapOwnerGID = uint32(gid)
+
+	return nil
+}
+
+func (i *InstanceGroup) createTap(tapName string, hostTapIP string) error {
+	// Create an instance's persistent tap device, the hypervisor attaches to it by name
+
+	// A tap left behind by a crashed run would have the wrong configuration
+	err := deleteTap(tapName)
+	if err != nil {
+		return err
+	}
+
+	// The hypervisor refuses to attach if multi-queue doesn't match its queue pairs
+	flags := netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR
+	if i.VMNetNumQueues > 2 {
+		flags |= netlink.TUNTAP_MULTI_QUEUE
+	}
+
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: tapName},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     flags,
+		Owner:     i.tapOwnerUID,
+		Group:     i.tapOwnerGID,
+	}
+
+	err = netlink.LinkAdd(tap)
+	if err != nil {
+		return fmt.Errorf("could not create tap %s: %w", tapName, err)
+	}
+
+	err = netlink.LinkSetMTU(tap, tapMTU)
+	if err != nil {
+		return fmt.Errorf("could not set MTU of tap %s: %w", tapName, err)
+	}
+
+	// Bridged taps have no address of their own
+	if !i.isBridged() {
+		address := &netlink.Addr{IPNet: &net.IPNet{
+			IP:   net.ParseIP(hostTapIP),
+			Mask: net.CIDRMask(i.VMSubnetPrefixLength, 32),
+		}}
+
+		err = netlink.AddrAdd(tap, address)
+		if err != nil {
+			return fmt.Errorf("could not add address to tap %s: %w", tapName, err)
+		}
+	}
+
+	err = netlink.LinkSetUp(tap)
+	if err != nil {
+		return fmt.Errorf("could not set tap %s up: %w", tapName, err)
+	}
+
+	return nil
+}
+
+func deleteTap(tapName string) error {
+	// Delete a tap device if it exists, persistent taps outlive the hypervisor
+
+	link, err := netlink.LinkByName(tapName)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+
+	return netlink.LinkDel(link)
+}
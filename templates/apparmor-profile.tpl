@@ -0,0 +1,39 @@
+abi <abi/3.0>,
+
+#include <tunables/global>
+
+# Generated by fleeting-plugin-fleetingd for {{ .InstanceName }}, replaced on its next boot
+profile {{ .Profile }} flags=(attach_disconnected) {
+  #include <abstractions/base>
+
+  # Opening the pre-created tap and raising the locked memory and file limits
+  capability net_admin,
+  capability sys_resource,
+
+  network unix,
+  network vsock,
+  signal (receive) peer=unconfined,
+
+  {{ .Binary }} mr,
+
+  /dev/kvm rw,
+  /dev/net/tun rw,
+  /dev/urandom r,
+  /sys/devices/system/cpu/** r,
+  /sys/devices/system/node/** r,
+  /sys/kernel/mm/transparent_hugepage/** r,
+  @{PROC}/@{pid}/** rw,
+  @{PROC}/sys/vm/overcommit_memory r,
+
+  # The instance's directory with its disks, config drive, console and sockets
+  {{ .InstanceDir }}/ r,
+  {{ .InstanceDir }}/** rwk,
+{{- range .WritablePaths }}
+  {{ . }} rwk,
+{{- end }}
+
+  # Images and firmware shared by all instances
+{{- range .ReadOnlyPaths }}
+  {{ . }} rk,
+{{- end }}
+}
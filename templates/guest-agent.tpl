@@ -0,0 +1,74 @@
+{{- define "guest-agent-files" }}
+{{- if .GuestAgent }}
+  # Status agent of vm_guest_agent, it only answers the host and runs nothing it is sent
+  - path: /usr/local/sbin/fleetingd-guest-agent
+    permissions: "0755"
+    content: |
+      #!/usr/bin/env python3
+      import json
+      import os
+      import socket
+      import subprocess
+
+      def cloud_init_status():
+          result = subprocess.run(["cloud-init", "status"], stdout=subprocess.PIPE, stderr=subprocess.DEVNULL, text=True)
+          for line in result.stdout.splitlines():
+              if line.startswith("status:"):
+                  return line.split(":", 1)[1].strip()
+          return "unknown"
+
+      def status():
+          memory = {}
+          with open("/proc/meminfo") as meminfo:
+              for line in meminfo:
+                  name, value = line.split(":", 1)
+                  memory[name] = int(value.split()[0])
+          with open("/proc/uptime") as uptime:
+              uptime_seconds = float(uptime.read().split()[0])
+          return {
+              "cloud_init": cloud_init_status(),
+              "load1": os.getloadavg()[0],
+              "memory_total_kb": memory.get("MemTotal", 0),
+              "memory_available_kb": memory.get("MemAvailable", 0),
+              "uptime_seconds": uptime_seconds,
+          }
+
+      server = socket.socket(socket.AF_VSOCK, socket.SOCK_STREAM)
+      server.bind((socket.VMADDR_CID_ANY, {{ .AgentPort }}))
+      server.listen()
+
+      while True:
+          connection, (cid, _) = server.accept()
+          request = ""
+          with connection:
+              # Processes in the guest can connect as well
+              if cid != socket.VMADDR_CID_HOST:
+                  continue
+              connection.settimeout(5)
+              try:
+                  request = connection.makefile().readline().strip()
+                  if request == "status":
+                      response = status()
+                  elif request == "shutdown":
+                      response = {"shutdown": True}
+                  else:
+                      response = {"error": "unknown request"}
+                  connection.sendall(json.dumps(response).encode() + b"\n")
+              except OSError:
+                  continue
+          if request == "shutdown":
+              subprocess.run(["systemctl", "poweroff"])
+  - path: /etc/systemd/system/fleetingd-guest-agent.service
+    permissions: "0644"
+    content: |
+      [Unit]
+      Description=fleetingd guest status agent
+
+      [Service]
+      ExecStart=/usr/local/sbin/fleetingd-guest-agent
+      Restart=always
+
+      [Install]
+      WantedBy=multi-user.target
+{{- end }}
+{{- end }}
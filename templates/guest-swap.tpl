@@ -0,0 +1,21 @@
+{{- define "guest-swap-bootcmd" }}
+{{- if .Swap.Swappiness }}
+  - [ sysctl, -w, "vm.swappiness={{ .Swap.Swappiness }}" ]
+{{- end }}
+{{- if eq .Swap.Mode "zram" }}
+  # vm_swap zram, compressed in the guest's memory
+  - modprobe zram num_devices=1
+  - echo {{ .Swap.SizeMB }}M > /sys/block/zram0/disksize
+  - mkswap /dev/zram0
+  - swapon -p 100 /dev/zram0
+{{- end }}
+{{- end }}
+{{- define "guest-swap" }}
+{{- if eq .Swap.Mode "file" }}
+# vm_swap file on the root disk
+swap:
+  filename: {{ .Swap.Path }}
+  size: {{ .Swap.SizeMB }}M
+  maxsize: {{ .Swap.SizeMB }}M
+{{- end }}
+{{- end }}
@@ -0,0 +1,14 @@
+{{- define "guest-time" }}
+{{- if .NTPServers }}
+# vm_ntp_servers, or the host's NTP server with vm_ntp_relay
+ntp:
+  enabled: true
+  servers:
+{{- range .NTPServers }}
+    - {{ printf "%q" . }}
+{{- end }}
+{{- end }}
+{{- if .Timezone }}
+timezone: {{ printf "%q" .Timezone }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,7 @@
+{{- define "guest-trim-runcmd" }}
+{{- if .FstrimInterval }}
+  # vm_fstrim_interval_minutes, trimmed blocks let the host shrink the instance's disks
+  - systemctl daemon-reload
+  - systemctl enable --now fstrim.timer
+{{- end }}
+{{- end }}
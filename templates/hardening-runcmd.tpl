@@ -0,0 +1,20 @@
+{{- define "hardening-runcmd" }}
+{{- if .Hardening }}
+  # vm_hardening: no root password, nothing updating the image under the job and nothing but SSH from the host
+  - passwd -l root
+{{- if eq .Profile.Family "debian" }}
+  - systemctl disable --now apt-daily.timer apt-daily-upgrade.timer unattended-upgrades.service || true
+{{- else if eq .Profile.Family "fedora" }}
+  - systemctl disable --now dnf-automatic.timer dnf5-automatic.timer packagekit.service || true
+{{- else if eq .Profile.Family "suse" }}
+  - systemctl disable --now transactional-update.timer || true
+{{- end }}
+{{- if eq .Profile.Firewall "firewalld" }}
+  - firewall-cmd --permanent --zone=public --set-target=DROP
+  - firewall-cmd --reload
+{{- else }}
+  - ufw default deny incoming
+  - ufw --force enable
+{{- end }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,11 @@
+[Unit]
+Description=Let the host learn the address assigned by DHCP
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=-/usr/bin/ping -c 3 {{ .Gateway }}
+
+[Install]
+WantedBy=multi-user.target
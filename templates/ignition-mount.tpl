@@ -0,0 +1,11 @@
+[Unit]
+Description=Mount the extra disk {{ .Device }}
+Before=local-fs.target
+
+[Mount]
+What={{ .Device }}
+Where={{ .Mountpoint }}
+Type={{ .Filesystem }}
+
+[Install]
+RequiredBy=local-fs.target
@@ -0,0 +1,25 @@
+[Match]
+MACAddress={{ .MACAddress }}
+
+[Network]
+{{- if .DHCP }}
+DHCP=ipv4
+{{- else }}
+Address={{ .IP }}{{ .Netmask }}
+{{- if not .SRIOVMACAddress }}
+Gateway={{ .Gateway }}
+{{- end }}
+{{- if .IP6 }}
+Address={{ .IP6 }}{{ .Netmask6 }}
+Gateway={{ .Gateway6 }}
+{{- end }}
+{{- if .DNSServer }}
+DNS={{ .DNSServer }}
+{{- else }}
+DNS=1.1.1.3 1.0.0.3{{ if .IP6 }} 2606:4700:4700::1113 2606:4700:4700::1003{{ end }}
+{{- end }}
+{{- end }}
+IPv6AcceptRA=false
+
+[Link]
+MTUBytes=1500
@@ -0,0 +1,32 @@
+[connection]
+id=veth0
+type=ethernet
+autoconnect-priority=100
+
+[ethernet]
+mac-address={{ .MACAddress }}
+mtu=1500
+
+[ipv4]
+{{- if .DHCP }}
+method=auto
+{{- else }}
+method=manual
+address1={{ .IP }}{{ .Netmask }}{{ if not .SRIOVMACAddress }},{{ .Gateway }}{{ end }}
+{{- if .DNSServer }}
+dns={{ .DNSServer }};
+{{- else }}
+dns=1.1.1.3;1.0.0.3;
+{{- end }}
+{{- end }}
+
+[ipv6]
+{{- if .IP6 }}
+method=manual
+address1={{ .IP6 }}{{ .Netmask6 }},{{ .Gateway6 }}
+{{- if not .DNSServer }}
+dns=2606:4700:4700::1113;2606:4700:4700::1003;
+{{- end }}
+{{- else }}
+method=disabled
+{{- end }}
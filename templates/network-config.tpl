@@ -6,13 +6,41 @@ network:
       match:
         macaddress: {{ .MACAddress }}
       set-name: veth0
+{{- if .DHCP }}
+      dhcp4: true
+      dhcp6: false
+{{- else }}
       dhcp4: false
       dhcp6: false
       mtu: 1500
       addresses:
         - {{ .IP }}{{ .Netmask }}
+{{- if .IP6 }}
+        - {{ .IP6 }}{{ .Netmask6 }}
+{{- end }}
+{{- if or (not .SRIOVMACAddress) .IP6 }}
       routes:
+{{- if not .SRIOVMACAddress }}
         - to: default
           via: {{ .Gateway }}
+{{- end }}
+{{- if .IP6 }}
+        - to: "::/0"
+          via: {{ .Gateway6 }}
+{{- end }}
+{{- end }}
       nameservers:
-        addresses: [1.1.1.3, 1.0.0.3]
\ No newline at end of file
+{{- if .DNSServer }}
+        addresses: [{{ .DNSServer }}]
+{{- else }}
+        addresses: [1.1.1.3, 1.0.0.3{{ if .IP6 }}, 2606:4700:4700::1113, 2606:4700:4700::1003{{ end }}]
+{{- end }}
+{{- end }}
+{{- if .SRIOVMACAddress }}
+    vf0:
+      match:
+        macaddress: {{ .SRIOVMACAddress }}
+      set-name: vf0
+      dhcp4: true
+      dhcp6: false
+{{- end }}
\ No newline at end of file
@@ -0,0 +1,12 @@
+{{- define "proxy-apt" }}
+{{- if and (eq .Profile.Family "debian") (or .HTTPProxy .HTTPSProxy) }}
+# vm_http_proxy and vm_https_proxy for apt, cloud-init removes its proxy settings from the image without them
+apt:
+{{- if .HTTPProxy }}
+  http_proxy: {{ printf "%q" .HTTPProxy }}
+{{- end }}
+{{- if .HTTPSProxy }}
+  https_proxy: {{ printf "%q" .HTTPSProxy }}
+{{- end }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,62 @@
+set -e
+
+# Restored VMs share the template's memory, give this one its own identity
+hostnamectl set-hostname {{ .InstanceName }}
+date -s @{{ .Timestamp }}
+
+rm -f /etc/machine-id
+systemd-machine-id-setup
+
+# Move to the instance's address
+ip addr flush dev veth0
+ip addr add {{ .IP }}{{ .Netmask }} dev veth0
+ip route replace default via {{ .Gateway }}
+{{- if .IP6 }}
+ip -6 addr flush dev veth0 scope global
+ip -6 addr add {{ .IP6 }}{{ .Netmask6 }} dev veth0
+ip -6 route replace default via {{ .Gateway6 }}
+{{- end }}
+{{- if .DNSServer }}
+resolvectl dns veth0 {{ .DNSServer }}
+{{- end }}
+{{- if .NTPFollowsGateway }}
+printf '[Time]\nNTP={{ .Gateway }}\n' > {{ .TimesyncdConfigPath }}
+systemctl try-restart systemd-timesyncd
+{{- end }}
+
+ufw delete allow from {{ .TemplateGateway }} proto tcp to any port 22
+{{- if .TemplateGateway6 }}
+ufw delete allow from {{ .TemplateGateway6 }} proto tcp to any port 22
+{{- end }}
+ufw allow from {{ .Gateway }} proto tcp to any port 22
+{{- if .Gateway6 }}
+ufw allow from {{ .Gateway6 }} proto tcp to any port 22
+{{- end }}
+
+# Fresh SSH credentials
+echo "{{ .SSHAuthorizedPublicKey }}" > /home/{{ .Username }}/.ssh/authorized_keys
+{{- range .ExtraAuthorizedKeys }}
+cat >> /home/{{ $.Username }}/.ssh/authorized_keys <<'EOF'
+{{ . }}
+EOF
+{{- end }}
+rm -f /etc/ssh/ssh_host_*
+cat > /etc/ssh/ssh_host_ed25519_key <<'EOF'
+{{ .SSHHostPrivateKey }}EOF
+chmod 600 /etc/ssh/ssh_host_ed25519_key
+echo "{{ .SSHHostPublicKey }}" > /etc/ssh/ssh_host_ed25519_key.pub
+{{- range .GuestFiles }}
+{{- if not .Append }}
+mkdir -p "$(dirname {{ .Path }})"
+cat > {{ .Path }} <<'EOF'
+{{ .Contents }}EOF
+{{- end }}
+{{- end }}
+systemctl restart ssh
+
+# The agent runs whatever reaches its vsock port as root, the instance has no more use for it
+systemctl disable fleetingd-agent
+rm -f /etc/systemd/system/fleetingd-agent.service /usr/local/sbin/fleetingd-agent
+systemctl daemon-reload
+# Stopping it right away would kill this script before the agent sent its output back
+systemd-run --on-active=5s --timer-property=AccuracySec=1s systemctl stop fleetingd-agent
@@ -4,11 +4,66 @@ package_upgrade: true
 disable_root: true
 ssh_pwauth: false
 packages:
+{{- if eq .Profile.Firewall "firewalld" }}
+  - firewalld
+{{- else }}
   - ufw
+{{- end }}
   - fail2ban
   - ca-certificates
   - curl
+{{- if .CACertificates }}
+# vm_ca_certificates, added to the system's trust store
+ca_certs:
+  trusted:
+{{- range .CACertificates }}
+    - {{ printf "%q" . }}
+{{- end }}
+{{- end }}
+{{- template "proxy-apt" . }}
+{{- template "guest-time" . }}
+write_files:
+  # Reports the result of the commands below on the serial port and powers off, the host fails the prebuild unless they succeeded
+  - path: /usr/local/sbin/fleetingd-prebuild-finish
+    permissions: "0700"
+    content: |
+      #!/bin/sh
+      status="$1"
+      exec > {{ .SerialDevice }} 2>&1
+      if [ "$status" -ne 0 ]; then
+        echo "{{ .StatusMarker }}_LOG_BEGIN"
+        tail -n {{ .LogLines }} /var/log/cloud-init-output.log
+        echo "{{ .StatusMarker }}_LOG_END"
+      else
+        # Reset cloudinit so each machine gets a fresh SSH key
+        cloud-init clean --logs --machine-id --seed --configs all
+      fi
+      echo "{{ .StatusMarker }}_STATUS=$status"
+      sync
+{{- if eq .Profile.Family "alpine" }}
+      poweroff
+{{- else }}
+      shutdown -hP now
+{{- end }}
+{{- template "guest-agent-files" . }}
+{{- if .ProxyFiles }}
+  # vm_http_proxy and vm_https_proxy, baked into the golden image
+{{- end }}
+{{- range .ProxyFiles }}
+  - path: {{ .Path }}
+    permissions: "0644"
+{{- if .Append }}
+    append: true
+{{- end }}
+    content: {{ printf "%q" .Contents }}
+{{- end }}
 runcmd:
+  # All commands run in one script, report how it ended
+  - trap '/usr/local/sbin/fleetingd-prebuild-finish $?' EXIT
+{{- range .ProxyVariables }}
+  - export {{ .Name }}={{ printf "%q" .Value }}
+{{- end }}
+
   # Mitigate CVE-2026-46333
   - sysctl -w kernel.yama.ptrace_scope=3
   - echo "kernel.yama.ptrace_scope = 3" > /etc/sysctl.d/cve202646333.conf
@@ -23,15 +78,46 @@ runcmd:
   - rmmod esp4 esp6 rxrpc 2>/dev/null
 
   # Firewall
+{{- if eq .Profile.Firewall "firewalld" }}
+  - systemctl enable --now firewalld
+  - firewall-cmd --permanent --zone=public --remove-service=ssh
+  - firewall-cmd --reload
+{{- else }}
   - ufw default deny incoming
   - ufw enable
+{{- end }}
+{{- if eq .Profile.Family "alpine" }}
+  - rc-update add ufw default
+{{- end }}
 
   # fail2ban
+{{- if eq .Profile.Family "alpine" }}
+  - rc-update add fail2ban default
+{{- else }}
   - systemctl enable fail2ban
+{{- end }}
+
+  # From here on any failing command fails the prebuild
+  - set -e
 
   # Install latest GitLab runner so artifacts can be pulled
-  - curl -L "https://packages.gitlab.com/install/repositories/runner/gitlab-runner/script.deb.sh" | os=ubuntu dist=noble bash
-  - apt install -y gitlab-runner
+{{- if .Profile.RunnerRepositoryScript }}
+  - curl -L "https://packages.gitlab.com/install/repositories/runner/gitlab-runner/{{ .Profile.RunnerRepositoryScript }}" | os={{ .Profile.RunnerRepositoryOS }} dist={{ .Profile.RunnerRepositoryDist }} bash
+{{- end }}
+  - {{ .Profile.InstallCommand }} gitlab-runner
+{{- if .GuestAgent }}
+
+  # Started on the instances' boots, the host asks it whether they are ready
+  - systemctl enable fleetingd-guest-agent
+{{- end }}
+
+{{- if .ProfileCommands }}
+
+  # prebuild_profile {{ .ProfileVersion }}
+{{- end }}
+{{- range .ProfileCommands }}
+  - {{ printf "%q" . }}
+{{- end }}
 
   # CUSTOM COMMANDS START
 
@@ -41,6 +127,5 @@ runcmd:
 
   # CUSTOM COMMANDS END
 
-  # Reset cloudinit so each machine gets a fresh SSH key
-  - cloud-init clean --logs --machine-id --seed --configs all
-  - shutdown -hP now
\ No newline at end of file
+  # The runner has to be there for the jobs
+  - command -v gitlab-runner
@@ -0,0 +1,105 @@
+#cloud-config
+hostname: {{ .InstanceName }}
+# vm_hardening boots the image as it was built
+package_update: {{ not .Hardening }}
+package_upgrade: {{ not .Hardening }}
+disable_root: true
+ssh_pwauth: false
+ssh_authorized_keys:
+  - "{{ .SSHAuthorizedPublicKey }}"
+{{- if .ExtraAuthorizedKeys }}
+  # Operators' keys of vm_extra_authorized_keys, for debugging
+{{- end }}
+{{- range .ExtraAuthorizedKeys }}
+  - {{ printf "%q" . }}
+{{- end }}
+# The plugin only accepts the host key it generated for the instance
+ssh_deletekeys: true
+ssh_genkeytypes: []
+ssh_keys:
+  ed25519_private: {{ printf "%q" .SSHHostPrivateKey }}
+  ed25519_public: "{{ .SSHHostPublicKey }}"
+{{- if .CACertificates }}
+# vm_ca_certificates, added to the system's trust store
+ca_certs:
+  trusted:
+{{- range .CACertificates }}
+    - {{ printf "%q" . }}
+{{- end }}
+{{- end }}
+{{- template "proxy-apt" . }}
+{{- template "guest-time" . }}
+{{- template "guest-swap" . }}
+bootcmd:
+  # The host exposes the serial port on a socket for debugging, see fleeting-plugin-fleetingd console
+  - [ systemctl, start, --no-block, "serial-getty@{{ .SerialTTY }}.service" ]
+{{- range .Sysctls }}
+  - [ sysctl, -w, {{ printf "%q" (printf "%s=%s" .Name .Value) }} ]
+{{- end }}
+{{- template "guest-swap-bootcmd" . }}
+write_files:
+{{- if .GuestFiles }}
+  # sshd settings of vm_hardening and the plugin's SSH CA written before sshd starts, vm_sysctls, vm_ulimits, vm_fstrim_interval_minutes, vm_host_entries and the instance's metadata, a second write_files key would replace the agent's
+{{- end }}
+{{- range .GuestFiles }}
+  - path: {{ .Path }}
+    permissions: "0644"
+{{- if .Append }}
+    append: true
+    # After cloud-init's own modules, update_etc_hosts rewrites /etc/hosts on some images
+    defer: true
+{{- end }}
+    content: {{ printf "%q" .Contents }}
+{{- end }}
+  # Minimal agent used by the host to re-identify VMs restored from the snapshot
+  - path: /usr/local/sbin/fleetingd-agent
+    permissions: "0700"
+    content: |
+      #!/usr/bin/env python3
+      import socket
+      import subprocess
+
+      server = socket.socket(socket.AF_VSOCK, socket.SOCK_STREAM)
+      server.bind((socket.VMADDR_CID_ANY, {{ .AgentPort }}))
+      server.listen()
+
+      while True:
+          connection, _ = server.accept()
+          with connection:
+              script = b""
+              while True:
+                  chunk = connection.recv(65536)
+                  if not chunk:
+                      break
+                  script += chunk
+
+              result = subprocess.run(["/bin/bash", "-c", script.decode()], stdout=subprocess.PIPE, stderr=subprocess.STDOUT)
+              connection.sendall(result.stdout)
+              connection.sendall(b"\n{{ .AgentExitMarker }}%d\n" % result.returncode)
+  - path: /etc/systemd/system/fleetingd-agent.service
+    content: |
+      [Unit]
+      Description=fleetingd guest agent
+
+      [Service]
+      ExecStart=/usr/local/sbin/fleetingd-agent
+      Restart=always
+
+      [Install]
+      WantedBy=multi-user.target
+runcmd:
+  - ufw allow from {{ .Gateway }} proto tcp to any port 22
+{{- if .Gateway6 }}
+  - ufw allow from {{ .Gateway6 }} proto tcp to any port 22
+{{- end }}
+{{- template "hardening-runcmd" . }}
+{{- template "guest-trim-runcmd" . }}
+{{- if .DHCP }}
+  # Let the host learn the address assigned by DHCP
+  - ping -c 3 {{ .Gateway }} || true
+{{- end }}
+{{- range .ExtraCommands }}
+  - {{ . }}
+{{- end }}
+  - systemctl daemon-reload
+  - systemctl enable --now fleetingd-agent
@@ -1,10 +1,87 @@
 #cloud-config
 hostname: {{ .InstanceName }}
-package_update: true
-package_upgrade: true
+# vm_hardening boots the image as it was built
+package_update: {{ not .Hardening }}
+package_upgrade: {{ not .Hardening }}
 disable_root: true
 ssh_pwauth: false
 ssh_authorized_keys:
   - "{{ .SSHAuthorizedPublicKey }}"
+{{- if .ExtraAuthorizedKeys }}
+  # Operators' keys of vm_extra_authorized_keys, for debugging
+{{- end }}
+{{- range .ExtraAuthorizedKeys }}
+  - {{ printf "%q" . }}
+{{- end }}
+# The plugin only accepts the host key it generated for the instance
+ssh_deletekeys: true
+ssh_genkeytypes: []
+ssh_keys:
+  ed25519_private: {{ printf "%q" .SSHHostPrivateKey }}
+  ed25519_public: "{{ .SSHHostPublicKey }}"
+{{- if .CACertificates }}
+# vm_ca_certificates, added to the system's trust store
+ca_certs:
+  trusted:
+{{- range .CACertificates }}
+    - {{ printf "%q" . }}
+{{- end }}
+{{- end }}
+{{- template "proxy-apt" . }}
+{{- template "guest-time" . }}
+{{- template "guest-swap" . }}
+{{- if .GuestFiles }}
+# sshd settings of vm_hardening and the plugin's SSH CA written before sshd starts, vm_sysctls, vm_ulimits, vm_fstrim_interval_minutes, vm_host_entries and the instance's metadata
+write_files:
+{{- range .GuestFiles }}
+  - path: {{ .Path }}
+    permissions: "0644"
+{{- if .Append }}
+    append: true
+    # After cloud-init's own modules, update_etc_hosts rewrites /etc/hosts on some images
+    defer: true
+{{- end }}
+    content: {{ printf "%q" .Contents }}
+{{- end }}
+{{- end }}
+bootcmd:
+  # The host exposes the serial port on a socket for debugging, see fleeting-plugin-fleetingd console
+  - [ systemctl, start, --no-block, "serial-getty@{{ .SerialTTY }}.service" ]
+{{- range .Sysctls }}
+  - [ sysctl, -w, {{ printf "%q" (printf "%s=%s" .Name .Value) }} ]
+{{- end }}
+{{- template "guest-swap-bootcmd" . }}
+{{- if .ExtraDisks }}
+fs_setup:
+{{- range .ExtraDisks }}
+  - device: {{ .Device }}
+    filesystem: {{ .Filesystem }}
+    partition: none
+{{- end }}
+mounts:
+{{- range .ExtraDisks }}
+  - [ "{{ .Device }}", "{{ .Mountpoint }}", "{{ .Filesystem }}", "defaults,nofail", "0", "2" ]
+{{- end }}
+{{- end }}
 runcmd:
-  - ufw allow from {{ .Gateway }} proto tcp to any port 22
\ No newline at end of file
+{{- if eq .Profile.Firewall "firewalld" }}
+  - firewall-cmd --permanent --zone=public --add-rich-rule='rule family="ipv4" source address="{{ .Gateway }}" service name="ssh" accept'
+{{- if .Gateway6 }}
+  - firewall-cmd --permanent --zone=public --add-rich-rule='rule family="ipv6" source address="{{ .Gateway6 }}" service name="ssh" accept'
+{{- end }}
+  - firewall-cmd --reload
+{{- else }}
+  - ufw allow from {{ .Gateway }} proto tcp to any port 22
+{{- if .Gateway6 }}
+  - ufw allow from {{ .Gateway6 }} proto tcp to any port 22
+{{- end }}
+{{- end }}
+{{- template "hardening-runcmd" . }}
+{{- template "guest-trim-runcmd" . }}
+{{- if .DHCP }}
+  # Let the host learn the address assigned by DHCP
+  - ping -c 3 {{ .Gateway }} || true
+{{- end }}
+{{- range .ExtraCommands }}
+  - {{ . }}
+{{- end }}
\ No newline at end of file
@@ -0,0 +1,118 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Spans are exported to this path below tracing_otlp_endpoint
+const otlpTracesPath = "/v1/traces"
+
+// A collector which doesn't answer in time loses the batch, the boots themselves never wait for it
+const otlpExportTimeout = 10 * time.Second
+
+// Scope of the plugin's spans
+const tracerName = "fleetingd"
+
+// Spans of the consecutive phases of a boot, starting a phase ends the previous one
+type bootPhases struct {
+	ctx    context.Context
+	tracer trace.Tracer
+	span   trace.Span
+
+	// The phase started last, kept after it ended
+	name string
+}
+
+func (i *InstanceGroup) setupTracing() error {
+	// Export the spans of the instances' lifecycles to tracing_otlp_endpoint, without one they are dropped right away
+
+	i.tracer = noop.NewTracerProvider().Tracer(tracerName)
+
+	if i.TracingOTLPEndpoint == "" {
+		return nil
+	}
+
+	endpoint, err := url.Parse(i.TracingOTLPEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid tracing_otlp_endpoint '%s', must be an http:// or https:// URL", i.TracingOTLPEndpoint)
+	}
+
+	// Headers and the collector's CA come from the OTEL_EXPORTER_OTLP_ environment variables, failed exports are retried
+	exportURL := strings.TrimSuffix(i.TracingOTLPEndpoint, "/") + otlpTracesPath
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(exportURL),
+		otlptracehttp.WithTimeout(otlpExportTimeout),
+	)
+	if err != nil {
+		return fmt.Errorf("could not set up trace export: %w", err)
+	}
+
+	i.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", Version.Name),
+			attribute.String("service.version", Version.Version),
+		)),
+	)
+	i.tracer = i.tracerProvider.Tracer(tracerName)
+
+	i.logger.Info("Exporting traces.", "endpoint", exportURL)
+
+	return nil
+}
+
+func (i *InstanceGroup) shutdownTracing(ctx context.Context) error {
+	// Export the spans which are still queued
+
+	if i.tracerProvider == nil {
+		return nil
+	}
+
+	return i.tracerProvider.Shutdown(ctx)
+}
+
+func endSpan(span trace.Span, err error) {
+	// End a span, marking it as failed if err is set
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+func (i *InstanceGroup) startBootPhases(ctx context.Context) *bootPhases {
+	return &bootPhases{ctx: ctx, tracer: i.tracer}
+}
+
+func (p *bootPhases) start(name string) {
+	// End the current phase and start the next one
+
+	p.end(nil)
+	_, p.span = p.tracer.Start(p.ctx, name)
+	p.name = name
+}
+
+func (p *bootPhases) end(err error) {
+	// End the current phase, a boot failing in it marks it as failed
+
+	if p.span == nil {
+		return
+	}
+
+	endSpan(p.span, err)
+	p.span = nil
+}
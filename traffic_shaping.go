@@ -0,0 +1,101 @@
+package fleetingd
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Default burst if none is configured, enough for a couple of full sized packets at high rates
+const defaultNetBurstKilobytes = 64
+
+func (i *InstanceGroup) trafficShapingEnabled() bool {
+	return i.VMNetDownloadRateMegabits > 0 || i.VMNetUploadRateMegabits > 0
+}
+
+func runTC(args ...string) error {
+	// Run a tc command and include its output in errors
+
+	_, err := runCommand(context.Background(), append([]string{"tc"}, args...)...)
+
+	return err
+}
+
+func (i *InstanceGroup) applyTrafficShaping(tapName string) error {
+	// Shape the traffic of an instance's tap, what the host sends out of the tap is what the guest downloads
+
+	if !i.trafficShapingEnabled() {
+		return nil
+	}
+
+	burst := i.VMNetBurstKilobytes
+	if burst == 0 {
+		burst = defaultNetBurstKilobytes
+	}
+
+	if i.VMNetDownloadRateMegabits > 0 {
+		rate := fmt.Sprintf("%dmbit", i.VMNetDownloadRateMegabits)
+
+		// HTB limits the rate, fq_codel keeps latency low when the class is saturated
+		err := runTC("qdisc", "replace", "dev", tapName, "root", "handle", "1:", "htb", "default", "10")
+		if err != nil {
+			return err
+		}
+
+		err = runTC("class", "replace", "dev", tapName, "parent", "1:", "classid", "1:10", "htb",
+			"rate", rate, "ceil", rate, "burst", fmt.Sprintf("%dkb", burst))
+		if err != nil {
+			return err
+		}
+
+		err = runTC("qdisc", "replace", "dev", tapName, "parent", "1:10", "handle", "10:", "fq_codel")
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.VMNetUploadRateMegabits > 0 {
+		// Incoming traffic can't be queued, so it is policed
+		err := runTC("qdisc", "replace", "dev", tapName, "ingress")
+		if err != nil {
+			return err
+		}
+
+		err = runTC("filter", "replace", "dev", tapName, "parent", "ffff:", "protocol", "all", "prio", "1", "matchall",
+			"action", "police", "rate", fmt.Sprintf("%dmbit", i.VMNetUploadRateMegabits), "burst", fmt.Sprintf("%dkb", burst),
+			"conform-exceed", "drop")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *InstanceGroup) removeTrafficShaping(tapName string) error {
+	// Remove the qdiscs of an instance's tap, they are gone already if the tap was removed together with the VM
+
+	if !i.trafficShapingEnabled() {
+		return nil
+	}
+
+	if _, err := net.InterfaceByName(tapName); err != nil {
+		return nil
+	}
+
+	if i.VMNetDownloadRateMegabits > 0 {
+		err := runTC("qdisc", "del", "dev", tapName, "root")
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.VMNetUploadRateMegabits > 0 {
+		err := runTC("qdisc", "del", "dev", tapName, "ingress")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
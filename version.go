@@ -1,11 +1,124 @@
 package fleetingd
 
-import "gitlab.com/gitlab-org/fleeting/fleeting/plugin"
-
-var Version = plugin.VersionInfo{
-	Name:      "fleeting-plugin-fleetingd",
-	Version:   "0.0.0-git+unknown",
-	Revision:  "latest",
-	Reference: "latest",
-	BuiltAt:   "N/A",
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/plugin"
+)
+
+// Set when building a release, e.g. go build -ldflags "-X github.com/helmholtzcloud/fleeting-plugin-fleetingd.version=1.2.3 -X github.com/helmholtzcloud/fleeting-plugin-fleetingd.builtAt=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   string
+	revision  string
+	reference string
+	builtAt   string
+)
+
+// The hypervisor the instances are run with
+const hypervisorBackend = "cloud-hypervisor"
+
+// Version of the fleeting plugin protocol the plugin speaks, the handshake of the fleeting module it is built with
+const pluginProtocolVersion = 0
+
+// The version as version --json prints it for provisioning tools
+type versionDescription struct {
+	Name               string   `json:"name"`
+	Version            string   `json:"version"`
+	Revision           string   `json:"revision"`
+	Reference          string   `json:"reference"`
+	BuiltAt            string   `json:"built_at"`
+	GoVersion          string   `json:"go_version"`
+	Platform           string   `json:"platform"`
+	HypervisorBackends []string `json:"hypervisor_backends"`
+	ProtocolVersion    int      `json:"protocol_version"`
+}
+
+var Version = newVersionInfo()
+
+func newVersionInfo() plugin.VersionInfo {
+	// Take what was set at build time, the revision and time fall back to the git checkout the Go toolchain recorded
+
+	info := plugin.VersionInfo{
+		Name:      "fleeting-plugin-fleetingd",
+		Version:   version,
+		Revision:  revision,
+		Reference: reference,
+		BuiltAt:   builtAt,
+	}
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok {
+		// Set by go install of a tagged release
+		if info.Version == "" && buildInfo.Main.Version != "(devel)" {
+			info.Version = buildInfo.Main.Version
+		}
+
+		modified := false
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = cmp.Or(info.Revision, setting.Value)
+			case "vcs.time":
+				info.BuiltAt = cmp.Or(info.BuiltAt, setting.Value)
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+
+		if modified && revision == "" {
+			info.Revision += "-dirty"
+		}
+	}
+
+	info.Version = cmp.Or(info.Version, "0.0.0-git+unknown")
+	info.Revision = cmp.Or(info.Revision, "unknown")
+	info.Reference = cmp.Or(info.Reference, "unknown")
+	info.BuiltAt = cmp.Or(info.BuiltAt, "N/A")
+
+	return info
+}
+
+func BuildInfo() string {
+	// Describe the build in one line, as the runner shows it for the plugin
+
+	return fmt.Sprintf("%s; hypervisor=%s", Version.BuildInfo(), hypervisorBackend)
+}
+
+func FullVersion() string {
+	// Describe the build on several lines, as the licenses command prints it
+
+	return Version.Full() + fmt.Sprintf("Hypervisor:   %s\n", hypervisorBackend)
+}
+
+func VersionJSON() ([]byte, error) {
+	// Describe the build as indented JSON, for tools provisioning the runner
+
+	return json.MarshalIndent(versionDescription{
+		Name:               Version.Name,
+		Version:            Version.Version,
+		Revision:           Version.Revision,
+		Reference:          Version.Reference,
+		BuiltAt:            Version.BuiltAt,
+		GoVersion:          runtime.Version(),
+		Platform:           runtime.GOOS + "/" + runtime.GOARCH,
+		HypervisorBackends: []string{hypervisorBackend, hypervisorBackendMock},
+		ProtocolVersion:    pluginProtocolVersion,
+	}, "", "  ")
+}
+
+func hypervisorVersion() string {
+	// Ask the installed cloud-hypervisor for its version, e.g. cloud-hypervisor v43.0
+
+	output, err := runCommand(context.Background(), hypervisorBackend, "--version")
+	if err != nil {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(output))
 }
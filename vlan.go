@@ -0,0 +1,71 @@
+package fleetingd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+func (i *InstanceGroup) checkVLAN(bridgeIndex int) error {
+	// Check the bridge can put the guests into vm_vlan_id and find the host's interface in that VLAN
+
+	if i.VMVLANID == 0 {
+		return nil
+	}
+
+	if i.VMVLANID < 1 || i.VMVLANID > 4094 {
+		return fmt.Errorf("vm_vlan_id must be between 1 and 4094 but is %d", i.VMVLANID)
+	}
+
+	vlanFiltering, err := os.ReadFile(filepath.Join("/sys/class/net", i.NetworkBridge, "bridge", "vlan_filtering"))
+	if err != nil {
+		return fmt.Errorf("could not check VLAN filtering of network_bridge %s: %w", i.NetworkBridge, err)
+	}
+	if strings.TrimSpace(string(vlanFiltering)) != "1" {
+		return fmt.Errorf("vm_vlan_id is set but VLAN filtering is disabled on network_bridge %s", i.NetworkBridge)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		vlan, ok := link.(*netlink.Vlan)
+		if ok && vlan.ParentIndex == bridgeIndex && vlan.VlanId == i.VMVLANID {
+			i.bridgeDevice = vlan.Name
+			return nil
+		}
+	}
+
+	return fmt.Errorf("network_bridge %s has no VLAN interface for vm_vlan_id %d, the host needs one to reach the VMs (e.g. %s.%d)", i.NetworkBridge, i.VMVLANID, i.NetworkBridge, i.VMVLANID)
+}
+
+func (i *InstanceGroup) configureTapVLAN(tapName string) error {
+	// Make a bridged tap an untagged port of vm_vlan_id instead of the bridge's default VLAN
+
+	if i.VMVLANID == 0 {
+		return nil
+	}
+
+	tap, err := netlink.LinkByName(tapName)
+	if err != nil {
+		return err
+	}
+
+	// New ports join the default VLAN 1, the guests must not see it
+	err = netlink.BridgeVlanDel(tap, 1, true, true, false, true)
+	if err != nil {
+		return fmt.Errorf("could not remove tap %s from the default VLAN: %w", tapName, err)
+	}
+
+	err = netlink.BridgeVlanAdd(tap, uint16(i.VMVLANID), true, true, false, true)
+	if err != nil {
+		return fmt.Errorf("could not add tap %s to VLAN %d: %w", tapName, i.VMVLANID, err)
+	}
+
+	return nil
+}
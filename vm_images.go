@@ -1,19 +1,22 @@
 package fleetingd
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/sha256"
+	"crypto/sha512"
 	"embed"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"net/http"
+	"io/fs"
 	"net/url"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"text/template"
 	"time"
@@ -25,219 +28,546 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-const kernelSHA256SumsURL = "https://cloud-images.ubuntu.com/daily/server/resolute/current/unpacked/SHA256SUMS"
-const diskImageSHA256SumsURL = "https://cloud-images.ubuntu.com/daily/server/resolute/current/SHA256SUMS"
-
 const vmWorkdir = ".instance_data"
-const decompressedSuffix = "_decompressed"
 
-var diskImageURL = fmt.Sprintf("https://cloud-images.ubuntu.com/daily/server/resolute/current/resolute-server-cloudimg-%s.img", runtime.GOARCH)
-var kernelURL = fmt.Sprintf("https://cloud-images.ubuntu.com/daily/server/resolute/current/unpacked/resolute-server-cloudimg-%s-vmlinuz-generic", runtime.GOARCH)
+// cloud-init finds its NoCloud data on a volume labeled like this
+const cloudInitVolumeLabel = "CIDATA"
+const decompressedSuffix = "_decompressed"
 
 //go:embed templates/*.tpl
 var userDataTemplates embed.FS
 
+func (i *InstanceGroup) parseTemplates() error {
+	// Parse the embedded templates once, a syntax error fails Init instead of the first boot
+
+	templates, err := template.ParseFS(userDataTemplates, "templates/*.tpl")
+	if err != nil {
+		return fmt.Errorf("could not parse templates: %w", err)
+	}
+
+	i.templates = templates
+
+	return nil
+}
+
 func (i *InstanceGroup) prepareWorkdir() error {
-	// Clear working directory of leftover VM files
+	// Clear working directory of leftover VM files, the files of instances adopted from an earlier run are kept
 
 	workdirAbsPath := filepath.Join(i.VMDiskDir, vmWorkdir)
 
-	err := os.RemoveAll(workdirAbsPath)
-	if err != nil {
+	entries, err := os.ReadDir(workdirAbsPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
+	i.inventory.lock.RLock()
+	defer i.inventory.lock.RUnlock()
+
+	for _, entry := range entries {
+		match := instanceFileRegexp.FindStringSubmatch(entry.Name())
+		if match != nil {
+			if _, ok := i.inventory.instances[match[1]]; ok {
+				continue
+			}
+		}
+
+		err = os.RemoveAll(filepath.Join(workdirAbsPath, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
 	return os.MkdirAll(workdirAbsPath, 0700)
 }
 
-func (i *InstanceGroup) ensureImages() error {
+func (i *InstanceGroup) getInstanceDir(instanceName string) string {
+	// Get the directory of an instance's disks, userdata and sockets in the working directory
+
+	return filepath.Join(i.VMDiskDir, vmWorkdir, instanceName)
+}
+
+func (i *InstanceGroup) createInstanceDir(instanceName string) error {
+	// Create an instance's directory, starting out empty even if a removal of the slot's previous instance failed
+
+	instanceDir := i.getInstanceDir(instanceName)
+
+	err := os.RemoveAll(instanceDir)
+	if err != nil {
+		return err
+	}
+
+	return os.Mkdir(instanceDir, 0700)
+}
+
+func (i *InstanceGroup) getOverlayPath(instanceName string) string {
+	return filepath.Join(i.getInstanceDir(instanceName), "disk.img")
+}
+
+func (i *InstanceGroup) getUserdataPath(instanceName string) string {
+	return filepath.Join(i.getInstanceDir(instanceName), "userdata.img")
+}
+
+func (i *InstanceGroup) getConsolePath(instanceName string) string {
+	// Get the path of an instance's console log, it is kept next to the instance directories since it outlives the instance
+
+	return filepath.Join(i.VMDiskDir, vmWorkdir, fmt.Sprintf("%s_console", instanceName))
+}
+
+func (i *InstanceGroup) ensureImages(ctx context.Context) error {
 	// Download and convert current VM disk images
-	i.logger.Info("Checking for OS image updates...")
+	i.logger.Info("Checking for OS image updates...", "distro", i.Distro, "channel", i.VMImageChannel, "serial", i.VMImageSerial)
 
-	i.logger.Info("Checking kernel")
+	// The garbage collector must not see half-resolved images
+	i.imagesLock.Lock()
+	defer i.imagesLock.Unlock()
 
-	kernelFilePath, err := i.getKernelFilePath()
+	// Upstream is only asked every vm_image_check_interval_minutes, the images of the last check are used if it can't be reached
+	diskImageFilePath, err := i.checkImageUpdates(ctx)
 	if err != nil {
 		return err
 	}
 
-	kernelFileExists, err := checkFileExists(kernelFilePath)
+	diskImageFileName, err := i.diskImage.fileName()
 	if err != nil {
 		return err
 	}
 
-	kernelDownloadNeeded := true
-	if kernelFileExists {
-		checksumFileName, err := getFilenameFromURL(kernelSHA256SumsURL)
+	// Registry artifacts were verified when they were resolved
+	if i.cosignKey != nil && i.registryImage == nil {
+		err = i.verifyImageCosign(ctx, i.diskImage, diskImageFilePath)
 		if err != nil {
 			return err
 		}
-		checksumFilePath := filepath.Join(i.VMDiskDir, checksumFileName+"_kernel")
+	}
 
-		err = downloadFile(kernelSHA256SumsURL, checksumFilePath)
-		if err != nil {
-			return err
-		}
+	// A golden image built from the same inputs makes the conversion and the prebuild unnecessary
+	i.goldenImageInputs, i.goldenImageKey, err = i.computeGoldenImageKey(diskImageFilePath)
+	if err != nil {
+		return err
+	}
+
+	goldenImageFound, err := i.findGoldenImage()
+	if err != nil {
+		return err
+	}
+
+	if goldenImageFound {
+		i.goldenImagePath, _ = i.goldenImagePaths(i.goldenImageKey)
+		i.logger.Info("Golden image of the current inputs found.", "path", i.goldenImagePath)
+		return nil
+	}
+
+	decompressedPath := i.getDecompressedImagePath()
+
+	// Restarts before a prebuild finished find the current image converted already
+	integrity, converted, err := i.findConvertedImage(decompressedPath)
+	if err != nil {
+		return err
+	}
+
+	if converted {
+		i.logger.Info("Disk image already decompressed and resized.", "path", decompressedPath)
+		i.baseImageIntegrity = integrity
+		return nil
+	}
 
-		kernelFileName, err := getFilenameFromURL(kernelURL)
+	// A conversion which doesn't finish must not look like a current one
+	err = removeConversionStamp(decompressedPath)
+	if err != nil {
+		return err
+	}
+
+	// Some distributions publish their images compressed as a whole
+	compression := i.diskCompression()
+	if compression != nil {
+		i.logger.Info("Uncompressing disk image...", "compression", compression.String())
+
+		uncompressedPath := filepath.Join(i.VMDiskDir, compression.uncompressedName(diskImageFileName))
+
+		err = compression.uncompress(diskImageFilePath, uncompressedPath)
 		if err != nil {
 			return err
 		}
 
-		onlineChecksum, err := getChecksumByFilename(checksumFilePath, kernelFileName)
+		diskImageFilePath = uncompressedPath
+	}
+
+	// Decompress image either way
+	// cloud-hypervisor can't read compressed QCOW2 images, so decompress the image first
+	i.logger.Info("Decompressing disk image...", "converter", i.VMImageConverter)
+
+	err = i.imageConverter.Convert(ctx, diskImageFilePath, decompressedPath, i.VMDiskFormat)
+	if err != nil {
+		return fmt.Errorf("could not decompress disk image: %w", err)
+	}
+
+	i.logger.Info("Disk image decompressed.")
+
+	// Expand available space
+	i.logger.Info("Resizing disk image...")
+
+	err = i.imageConverter.Resize(ctx, decompressedPath, i.VMDiskFormat, i.VMDiskSizeGB)
+	if err != nil {
+		return fmt.Errorf("could not resize disk image: %w", err)
+	}
+
+	i.logger.Info("Disk image resized.")
+
+	// Remembered for the checks before the prebuild modifies it
+	i.baseImageIntegrity, err = recordImageIntegrity(decompressedPath)
+	if err != nil {
+		return err
+	}
+
+	return i.writeConversionStamp(i.baseImageIntegrity)
+}
+
+func (i *InstanceGroup) fetchImages(ctx context.Context) (string, error) {
+	// Download the resolved images unless the local copies are current, local images are only verified, and get the disk image's path
+
+	diskImageFileName, err := i.diskImage.fileName()
+	if err != nil {
+		return "", err
+	}
+	diskImageFilePath := filepath.Join(i.VMDiskDir, diskImageFileName)
+
+	// Local disk images are converted right from where they are
+	if i.diskImage.Path != "" {
+		diskImageFilePath = i.diskImage.Path
+	}
+
+	// The kernel and the disk image are fetched side by side, each after its SUMS file
+	tasks := []func(context.Context) error{
+		func(ctx context.Context) error {
+			i.logger.Info("Checking disk image")
+
+			if i.diskImage.Path != "" {
+				return i.verifyLocalImage("Disk image", i.diskImage, diskImageFilePath)
+			}
+			return i.ensureFile(ctx, "Disk image", i.diskImage, diskImageFilePath, "_image")
+		},
+	}
+	if i.bootsKernel() {
+		tasks = append(tasks, i.ensureKernel)
+	}
+
+	i.parallelDownloads = min(i.VMImageParallelDownloads, uint64(len(tasks)))
+
+	err = runParallel(ctx, i.parallelDownloads, tasks)
+	if err != nil {
+		return "", err
+	}
+
+	return diskImageFilePath, nil
+}
+
+func (i *InstanceGroup) resolveImages(ctx context.Context) error {
+	// Find the current files of the image profile unless local ones are configured
+
+	var err error
+	i.diskImage = i.localDiskImage
+	if i.registryImage != nil {
+		i.diskImage, err = i.resolveRegistryImage(ctx)
 		if err != nil {
-			return err
+			return fmt.Errorf("could not find disk image %s: %w", i.VMDiskImage, err)
 		}
-
-		localChecksum, err := computeFileSHA256(kernelFilePath)
+	} else if i.diskImage.Path == "" {
+		i.diskImage, err = i.imageProfile.DiskImage.resolve(ctx, i.imageHTTPClient(time.Minute))
 		if err != nil {
-			return err
+			return fmt.Errorf("could not find disk image of distro %s: %w", i.Distro, err)
 		}
+	}
 
-		if localChecksum == onlineChecksum {
-			i.logger.Info("Kernel image is up-to-date.")
-			kernelDownloadNeeded = false
+	if i.bootsKernel() {
+		i.kernel = i.localKernel
+		if i.kernel.URL == "" {
+			i.kernel, err = i.imageProfile.Kernel.resolve(ctx, i.imageHTTPClient(time.Minute))
+			if err != nil {
+				return fmt.Errorf("could not find kernel of distro %s: %w", i.Distro, err)
+			}
 		}
 	}
 
-	if kernelDownloadNeeded {
-		i.logger.Info("Kernel image update available! Downloading...")
+	return nil
+}
 
-		err = downloadFile(kernelURL, kernelFilePath)
-		if err != nil {
-			return err
-		}
+func (i *InstanceGroup) ensureKernel(ctx context.Context) error {
+	// Download the current kernel if the local copy is outdated
 
-		i.logger.Info("Kernel image download done.")
+	i.logger.Info("Checking kernel")
+
+	kernelFilePath, err := i.getKernelFilePath()
+	if err != nil {
+		return err
+	}
+
+	if i.kernel.Path != "" {
+		err = i.copyLocalImage("Kernel image", i.kernel, kernelFilePath)
+	} else {
+		err = i.ensureFile(ctx, "Kernel image", i.kernel, kernelFilePath, "_kernel")
+	}
+	if err != nil {
+		return err
+	}
+
+	return i.unpackKernel()
+}
+
+func (i *InstanceGroup) diskCompression() *imageCompression {
+	// Get the compression of the disk image from its name, registry images are never compressed
+
+	if i.registryImage != nil {
+		return nil
+	}
+
+	diskImageFileName, err := i.diskImage.fileName()
+	if err != nil {
+		return nil
 	}
 
-	i.logger.Info("Checking disk image")
+	return detectImageCompression(diskImageFileName)
+}
 
-	diskImageFileName, err := getFilenameFromURL(diskImageURL)
+func (i *InstanceGroup) ensureFile(ctx context.Context, description string, file resolvedImageFile, filePath string, sumsFileSuffix string) error {
+	// Download a file unless the local copy matches the published checksum, downloads have to match it as well
+
+	onlineChecksum, err := i.getOnlineChecksum(ctx, file, sumsFileSuffix)
 	if err != nil {
 		return err
 	}
-	diskImageFilePath := filepath.Join(i.VMDiskDir, diskImageFileName)
 
-	diskImageFileExists, err := checkFileExists(diskImageFilePath)
+	checksumAlgorithm := i.imageChecksumAlgorithm(file)
+
+	fileExists, err := checkFileExists(filePath)
 	if err != nil {
 		return err
 	}
 
-	diskImageDownloadNeeded := true
-	if diskImageFileExists {
-		checksumFileName, err := getFilenameFromURL(diskImageSHA256SumsURL)
+	if fileExists {
+		localChecksum, err := i.cachedFileChecksum(filePath, checksumAlgorithm)
 		if err != nil {
 			return err
 		}
-		checksumFilePath := filepath.Join(i.VMDiskDir, checksumFileName+"_image")
 
-		err = downloadFile(diskImageSHA256SumsURL, checksumFilePath)
-		if err != nil {
-			return err
+		if localChecksum == onlineChecksum {
+			i.logger.Info(description + " is up-to-date.")
+			return nil
 		}
+	}
 
-		onlineChecksum, err := getChecksumByFilename(checksumFilePath, diskImageFileName)
+	i.logger.Info(description + " update available! Downloading...")
+
+	// Mirrors come first, a stale or broken copy is skipped because of its checksum
+	sources := i.imageSources(file.URL, false)
+	if file.Header != nil || file.Configured {
+		// Credentials are only ever sent to the registry, configured files aren't mirrored
+		sources = []string{file.URL}
+	}
+
+	for _, source := range sources {
+		started := time.Now()
+		err = i.downloadFile(ctx, source, filePath, file.Header)
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return err
+			}
+
+			i.logger.Warn("Download failed, trying the next source", "error", err)
+			continue
 		}
 
-		localChecksum, err := computeFileSHA256(diskImageFilePath)
+		downloadedChecksum, err := i.cachedFileChecksum(filePath, checksumAlgorithm)
 		if err != nil {
 			return err
 		}
 
-		if localChecksum == onlineChecksum {
-			i.logger.Info("Disk image is up-to-date.")
-			diskImageDownloadNeeded = false
+		// Keep the broken download from being booted
+		if downloadedChecksum != onlineChecksum {
+			i.logger.Warn("Checksum of the download does not match the published checksum, trying the next source", "url", source)
+
+			err = os.Remove(filePath)
+			if err != nil {
+				return err
+			}
+			continue
 		}
+
+		i.logger.Info(description+" download done.", "url", source, "duration", logDuration(started))
+
+		return nil
 	}
 
-	if diskImageDownloadNeeded {
-		i.logger.Info("Disk image update available! Downloading...")
+	return fmt.Errorf("could not download %s with the published checksum from any source", file.URL)
+}
 
-		err = downloadFile(diskImageURL, diskImageFilePath)
-		if err != nil {
-			return err
-		}
+func (i *InstanceGroup) getOnlineChecksum(ctx context.Context, file resolvedImageFile, sumsFileSuffix string) (string, error) {
+	// Get the published checksum of a file, downloading its SUMS file unless the checksum came with the file's location
 
-		i.logger.Info("Disk image download done.")
+	if file.Checksum != "" {
+		return file.Checksum, nil
 	}
 
-	// Decompress image either way
-	// cloud-hypervisor can't read compressed QCOW2 images, so decompress the image first
-	i.logger.Info("Decompressing disk image...")
-
-	decompressedPath := addSuffixToFilepath(diskImageFilePath, decompressedSuffix)
+	checksumFileName, err := getFilenameFromURL(file.SumsURL)
+	if err != nil {
+		return "", err
+	}
+	checksumFilePath := filepath.Join(i.VMDiskDir, checksumFileName+sumsFileSuffix)
 
-	imageDecompressionCommand := exec.Command("qemu-img", "convert", "-f", "qcow2", "-O", "qcow2", diskImageFilePath, decompressedPath)
-	err = imageDecompressionCommand.Run()
+	fileName, err := getFilenameFromURL(file.URL)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	i.logger.Info("Disk image decompressed.")
+	// The canonical SUMS file comes first, mirrored ones are still checked against the distribution's signature
+	sources := i.imageSources(file.SumsURL, true)
+	if file.Configured {
+		sources = []string{file.SumsURL}
+	}
 
-	// Expand available space
-	i.logger.Info("Resizing disk image...")
+	for _, source := range sources {
+		err = i.downloadFile(ctx, source, checksumFilePath, nil)
+		if err == nil && !file.Configured {
+			// Only trust checksums signed by the distribution
+			err = i.verifySumsFile(ctx, source, checksumFilePath)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", err
+			}
 
-	imageExpansionCommand := exec.Command("qemu-img", "resize", decompressedPath, fmt.Sprintf("%dG", i.VMDiskSizeGB))
-	err = imageExpansionCommand.Run()
-	if err != nil {
-		return err
-	}
+			i.logger.Warn("Could not get checksums, trying the next source", "url", source, "error", err)
+			continue
+		}
 
-	i.logger.Info("Disk image resized.")
+		return getChecksumByFilename(checksumFilePath, fileName, i.imageChecksumAlgorithm(file))
+	}
 
-	return nil
+	return "", fmt.Errorf("could not get the checksums of %s from any source", file.URL)
 }
 
-func (i *InstanceGroup) copyImage(instanceName string) (string, error) {
-	// Create a new copy of the base image
+func (i *InstanceGroup) copyImage(ctx context.Context, sourcePath string, instanceName string) (string, error) {
+	// Create a new copy of a disk image for an instance
 
-	diskImageFileName, err := getFilenameFromURL(diskImageURL)
+	copyPath := i.getOverlayPath(instanceName)
+
+	// Raw images are only used where they can be reflinked, a full copy would take ages
+	var err error
+	if i.VMDiskFormat == diskFormatRaw {
+		err = reflinkFile(sourcePath, copyPath)
+	} else if i.VMDiskOverlay {
+		// Pooled overlays were created after the prebuild, instances only wait for one if the pool ran dry
+		if !i.takePooledOverlay(sourcePath, copyPath) {
+			err = i.createOverlay(ctx, sourcePath, copyPath)
+		}
+	} else {
+		err = i.imageConverter.Copy(ctx, sourcePath, copyPath)
+	}
 	if err != nil {
 		return "", err
 	}
-	diskImageFilePath := filepath.Join(i.VMDiskDir, diskImageFileName)
-	decompressedPath := addSuffixToFilepath(diskImageFilePath, decompressedSuffix)
 
-	copyPath := filepath.Join(i.VMDiskDir, vmWorkdir, instanceName+".img")
+	return copyPath, nil
+}
 
-	imageCopyCommand := exec.Command("cp", "-f", decompressedPath, copyPath)
-	err = imageCopyCommand.Run()
-	if err != nil {
-		return "", err
+func (i *InstanceGroup) getBaseImagePath() string {
+	// Get the path of the image instances are copied from, the golden image once the prebuild is done
+
+	if i.goldenImagePath != "" {
+		return i.goldenImagePath
 	}
 
-	return copyPath, nil
+	return i.getDecompressedImagePath()
+}
+
+func (i *InstanceGroup) getDecompressedImagePath() string {
+	// Get the path of the decompressed base image the prebuild runs on
+
+	diskImageFileName, _ := i.diskImage.fileName()
+	compression := i.diskCompression()
+	if compression != nil {
+		diskImageFileName = compression.uncompressedName(diskImageFileName)
+	}
+
+	return addSuffixToFilepath(filepath.Join(i.VMDiskDir, diskImageFileName), decompressedSuffix)
 }
 
 func (i *InstanceGroup) getKernelFilePath() (string, error) {
 	// Get kernel file path
 
-	kernelFileName, err := getFilenameFromURL(kernelURL)
+	if !i.bootsKernel() {
+		return "", nil
+	}
+
+	kernelFileName, err := i.kernel.fileName()
 	if err != nil {
 		return "", err
 	}
 	return filepath.Join(i.VMDiskDir, kernelFileName), nil
 }
 
-func (i *InstanceGroup) createUserdata(instanceName string, macAddress string, ip string, gateway string, netmask string, sshAuthorizedPublicKey ed25519.PublicKey) (string, error) {
-	// Render userdata
+// A file of a config drive, rendered before the drive is written
+type renderedFile struct {
+	Name     string
+	Contents []byte
+}
 
-	sshKey, err := ssh.NewPublicKey(sshAuthorizedPublicKey)
+func (i *InstanceGroup) createUserdata(userDataTemplate string, instanceName string, macAddress string, ip string, gateway string, netmask string, ip6 string, gateway6 string, sriovMACAddress string, sshAuthorizedPublicKey ed25519.PublicKey, hostKey sshHostKey) (string, error) {
+	// Render userdata and write it to the instance's config drive
+
+	files, err := i.renderUserdata(userDataTemplate, instanceName, macAddress, ip, gateway, netmask, ip6, gateway6, sriovMACAddress, sshAuthorizedPublicKey, hostKey)
 	if err != nil {
 		return "", err
 	}
 
+	// Container-optimized distributions find their Ignition config on a config drive the way OpenStack provides it
+	volumeLabel := cloudInitVolumeLabel
+	if i.usesIgnition() {
+		volumeLabel = ignitionConfigDriveLabel
+	}
+
+	return i.writeConfigDrive(instanceName, volumeLabel, files)
+}
+
+func (i *InstanceGroup) renderUserdata(userDataTemplate string, instanceName string, macAddress string, ip string, gateway string, netmask string, ip6 string, gateway6 string, sriovMACAddress string, sshAuthorizedPublicKey ed25519.PublicKey, hostKey sshHostKey) ([]renderedFile, error) {
+	// Render the files of an instance's config drive
+
+	sshKey, err := ssh.NewPublicKey(sshAuthorizedPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
 	type userDataTemplateInput struct {
 		InstanceName           string
 		MACAddress             string
 		IP                     string
 		Gateway                string
 		Netmask                string
+		IP6                    string
+		Gateway6               string
+		Netmask6               string
+		DNSServer              string
+		DHCP                   bool
+		SRIOVMACAddress        string
 		SSHAuthorizedPublicKey string
+		ExtraAuthorizedKeys    []string
+		SSHHostPrivateKey      string
+		SSHHostPublicKey       string
+		GuestFiles             []guestFile
+		Hardening              bool
+		AgentPort              int
+		AgentExitMarker        string
+		ExtraDisks             []extraDiskMount
+		ExtraCommands          []string
+		CACertificates         []string
+		HTTPProxy              string
+		HTTPSProxy             string
+		NTPServers             []string
+		Timezone               string
+		Swap                   guestSwap
+		FstrimInterval         uint64
+		Sysctls                []guestSysctl
+		Profile                imageProfile
+		SerialTTY              string
 	}
 
 	templateInput := userDataTemplateInput{
@@ -246,113 +576,183 @@ func (i *InstanceGroup) createUserdata(instanceName string, macAddress string, i
 		IP:                     ip,
 		Gateway:                gateway,
 		Netmask:                netmask,
+		IP6:                    ip6,
+		Gateway6:               gateway6,
+		Netmask6:               fmt.Sprintf("/%d", i.VMIPv6InstancePrefixLength),
+		DNSServer:              i.dnsServer(gateway),
+		DHCP:                   i.isBridged(),
+		SRIOVMACAddress:        sriovMACAddress,
 		SSHAuthorizedPublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))),
+		ExtraAuthorizedKeys:    i.extraAuthorizedKeys,
+		SSHHostPrivateKey:      hostKey.PrivateKey,
+		SSHHostPublicKey:       hostKey.PublicKey,
+		GuestFiles:             i.guestFiles(instanceName),
+		Hardening:              i.VMHardening,
+		AgentPort:              guestAgentVsockPort,
+		AgentExitMarker:        guestAgentExitMarker,
+		ExtraDisks:             i.extraDiskMounts(),
+		ExtraCommands:          i.VMCloudinitExtraCmds,
+		CACertificates:         i.caCertificates,
+		HTTPProxy:              i.VMHTTPProxy,
+		HTTPSProxy:             i.VMHTTPSProxy,
+		NTPServers:             i.ntpServers(gateway),
+		Timezone:               i.VMTimezone,
+		Swap:                   i.guestSwap(),
+		FstrimInterval:         i.VMFstrimIntervalMinutes,
+		Sysctls:                i.guestSysctls(),
+		Profile:                i.imageProfile,
+		SerialTTY:              filepath.Base(serialDevice()),
+	}
+
+	// Container-optimized distributions read an Ignition config instead
+	if i.usesIgnition() {
+		ignitionConfig, err := i.renderIgnitionConfig(i.templates, instanceName, templateInput.SSHAuthorizedPublicKey, hostKey, templateInput.DHCP, templateInput)
+		if err != nil {
+			return nil, err
+		}
+
+		return []renderedFile{{Name: ignitionConfigDriveDirectory + "/user_data", Contents: ignitionConfig}}, nil
 	}
 
-	templates, err := template.ParseFS(userDataTemplates, "templates/*.tpl")
-	if err != nil {
-		return "", err
+	files, err := renderCloudInitFiles(i.templates, userDataTemplate, templateInput)
+	if err != nil || len(i.VMCloudinitExtraUserdata) == 0 {
+		return files, err
 	}
 
-	userdataPath := filepath.Join(i.VMDiskDir, vmWorkdir, fmt.Sprintf("%s_userdata.img", instanceName))
+	for index, file := range files {
+		if file.Name != "/user-data" {
+			continue
+		}
 
-	diskFile, err := file.CreateFromPath(userdataPath, 10*1024*1024)
-	if err != nil {
-		return "", err
+		files[index].Contents, err = mergeUserdataFragments(file.Contents, i.VMCloudinitExtraUserdata)
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer diskFile.Close()
 
-	userDataDisk, err := diskfs.OpenBackend(diskFile)
-	if err != nil {
-		return "", err
-	}
-	defer userDataDisk.Close()
+	return files, nil
+}
 
-	fs, err := userDataDisk.CreateFilesystem(disk.FilesystemSpec{
-		// Entire blockdevice, no table
-		Partition: 0,
-		FSType:    filesystem.TypeFat32,
-		// Label so cloudinit can find the volume
-		VolumeLabel: "CIDATA",
-		WorkDir:     "/",
-	})
-	if err != nil {
-		return "", err
-	}
-	defer fs.Close()
+func (i *InstanceGroup) createUserdataPrebuild(instanceName string, macAddress string, ip string, gateway string, netmask string, ip6 string, gateway6 string) (string, error) {
+	// Render userdata of the prebuild VM and write it to its config drive
 
-	// Render metadata
-	metaDataFile, err := fs.OpenFile("/meta-data", os.O_RDWR|os.O_CREATE)
+	files, err := i.renderUserdataPrebuild(instanceName, macAddress, ip, gateway, netmask, ip6, gateway6)
 	if err != nil {
 		return "", err
 	}
-	defer metaDataFile.Close()
 
-	err = templates.ExecuteTemplate(metaDataFile, "meta-data.tpl", templateInput)
-	if err != nil {
-		return "", err
-	}
+	return i.writeConfigDrive(instanceName, cloudInitVolumeLabel, files)
+}
 
-	// Render user data for cloudinit
-	userDataFile, err := fs.OpenFile("/user-data", os.O_RDWR|os.O_CREATE)
-	if err != nil {
-		return "", err
-	}
-	defer userDataFile.Close()
+func (i *InstanceGroup) renderUserdataPrebuild(instanceName string, macAddress string, ip string, gateway string, netmask string, ip6 string, gateway6 string) ([]renderedFile, error) {
+	// Render the files of the prebuild VM's config drive
 
-	err = templates.ExecuteTemplate(userDataFile, "user-data.tpl", templateInput)
-	if err != nil {
-		return "", err
+	type userDataTemplateInput struct {
+		InstanceName    string
+		MACAddress      string
+		IP              string
+		Gateway         string
+		Netmask         string
+		IP6             string
+		Gateway6        string
+		Netmask6        string
+		DNSServer       string
+		DHCP            bool
+		SRIOVMACAddress string
+		ProfileCommands []string
+		ProfileVersion  string
+		ExtraCommands   []string
+		CACertificates  []string
+		HTTPProxy       string
+		HTTPSProxy      string
+		NTPServers      []string
+		Timezone        string
+		ProxyFiles      []guestFile
+		ProxyVariables  []proxyVariable
+		GuestAgent      bool
+		AgentPort       int
+		Profile         imageProfile
+		SerialDevice    string
+		StatusMarker    string
+		LogLines        int
 	}
 
-	// Render network config
-	networkConfigFile, err := fs.OpenFile("/network-config", os.O_RDWR|os.O_CREATE)
-	if err != nil {
-		return "", err
-	}
-	defer networkConfigFile.Close()
+	templateInput := userDataTemplateInput{
+		InstanceName:    instanceName,
+		MACAddress:      macAddress,
+		IP:              ip,
+		Gateway:         gateway,
+		Netmask:         netmask,
+		IP6:             ip6,
+		Gateway6:        gateway6,
+		Netmask6:        fmt.Sprintf("/%d", i.VMIPv6InstancePrefixLength),
+		DNSServer:       i.dnsServer(gateway),
+		DHCP:            i.isBridged(),
+		ProfileCommands: i.prebuildProfileCommands(),
+		ProfileVersion:  i.prebuildProfileVersion(),
+		ExtraCommands:   i.VMPrebuildCloudinitExtraCmds,
+		CACertificates:  i.caCertificates,
+		HTTPProxy:       i.VMHTTPProxy,
+		HTTPSProxy:      i.VMHTTPSProxy,
+		NTPServers:      i.ntpServers(gateway),
+		Timezone:        i.VMTimezone,
+		ProxyFiles:      i.guestProxyFiles(),
+		ProxyVariables:  i.guestProxyVariables(),
+		GuestAgent:      i.VMGuestAgent,
+		AgentPort:       guestStatusAgentVsockPort,
+		Profile:         i.imageProfile,
+		SerialDevice:    serialDevice(),
+		StatusMarker:    prebuildStatusMarker,
+		LogLines:        prebuildLogLines,
+	}
+
+	return renderCloudInitFiles(i.templates, "user-data-prebuild.tpl", templateInput)
+}
 
-	err = templates.ExecuteTemplate(networkConfigFile, "network-config.tpl", templateInput)
-	if err != nil {
-		return "", err
+func renderCloudInitFiles(templates *template.Template, userDataTemplate string, templateInput any) ([]renderedFile, error) {
+	// Render the meta data, user data and network config cloud-init reads
+
+	var files []renderedFile
+	for _, file := range []struct {
+		name     string
+		template string
+	}{
+		{"/meta-data", "meta-data.tpl"},
+		{"/user-data", userDataTemplate},
+		{"/network-config", "network-config.tpl"},
+	} {
+		var contents bytes.Buffer
+		err := templates.ExecuteTemplate(&contents, file.template, templateInput)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, renderedFile{Name: file.name, Contents: contents.Bytes()})
 	}
 
-	return userdataPath, nil
+	return files, nil
 }
 
-func (i *InstanceGroup) createUserdataPrebuild(instanceName string, macAddress string, ip string, gateway string, netmask string) (string, error) {
-	// Render userdata
+func (i *InstanceGroup) writeConfigDrive(instanceName string, volumeLabel string, files []renderedFile) (string, error) {
+	// Write rendered files to a FAT or ISO9660 volume the guest finds by its label
 
-	type userDataTemplateInput struct {
-		InstanceName  string
-		MACAddress    string
-		IP            string
-		Gateway       string
-		Netmask       string
-		ExtraCommands []string
-	}
+	userdataPath := i.getUserdataPath(instanceName)
 
-	templateInput := userDataTemplateInput{
-		InstanceName:  instanceName,
-		MACAddress:    macAddress,
-		IP:            ip,
-		Gateway:       gateway,
-		Netmask:       netmask,
-		ExtraCommands: i.VMPrebuildCloudinitExtraCmds,
+	if i.configDriveFormat() == configDriveFormatISO9660 {
+		return userdataPath, writeISOConfigDrive(userdataPath, volumeLabel, files)
 	}
 
-	templates, err := template.ParseFS(userDataTemplates, "templates/*.tpl")
+	diskFile, err := file.CreateFromPath(userdataPath, 10*1024*1024)
 	if err != nil {
 		return "", err
 	}
+	defer diskFile.Close()
 
-	userdataPath := filepath.Join(i.VMDiskDir, vmWorkdir, fmt.Sprintf("%s_userdata.img", instanceName))
-
-	diskFile, err := file.CreateFromPath(userdataPath, 10*1024*1024)
+	// The drive carries the guest's SSH host key
+	err = os.Chmod(userdataPath, 0600)
 	if err != nil {
 		return "", err
 	}
-	defer diskFile.Close()
 
 	userDataDisk, err := diskfs.OpenBackend(diskFile)
 	if err != nil {
@@ -362,10 +762,9 @@ func (i *InstanceGroup) createUserdataPrebuild(instanceName string, macAddress s
 
 	fs, err := userDataDisk.CreateFilesystem(disk.FilesystemSpec{
 		// Entire blockdevice, no table
-		Partition: 0,
-		FSType:    filesystem.TypeFat32,
-		// Label so cloudinit can find the volume
-		VolumeLabel: "CIDATA",
+		Partition:   0,
+		FSType:      filesystem.TypeFat32,
+		VolumeLabel: volumeLabel,
 		WorkDir:     "/",
 	})
 	if err != nil {
@@ -373,40 +772,27 @@ func (i *InstanceGroup) createUserdataPrebuild(instanceName string, macAddress s
 	}
 	defer fs.Close()
 
-	// Render metadata
-	metaDataFile, err := fs.OpenFile("/meta-data", os.O_RDWR|os.O_CREATE)
-	if err != nil {
-		return "", err
-	}
-	defer metaDataFile.Close()
-
-	err = templates.ExecuteTemplate(metaDataFile, "meta-data.tpl", templateInput)
-	if err != nil {
-		return "", err
-	}
-
-	// Render user data for cloudinit
-	userDataFile, err := fs.OpenFile("/user-data", os.O_RDWR|os.O_CREATE)
-	if err != nil {
-		return "", err
-	}
-	defer userDataFile.Close()
-
-	err = templates.ExecuteTemplate(userDataFile, "user-data-prebuild.tpl", templateInput)
-	if err != nil {
-		return "", err
-	}
+	directories := map[string]bool{"/": true}
+	for _, renderedFile := range files {
+		directory := path.Dir(renderedFile.Name)
+		if !directories[directory] {
+			err = fs.Mkdir(directory)
+			if err != nil {
+				return "", err
+			}
+			directories[directory] = true
+		}
 
-	// Render network config
-	networkConfigFile, err := fs.OpenFile("/network-config", os.O_RDWR|os.O_CREATE)
-	if err != nil {
-		return "", err
-	}
-	defer networkConfigFile.Close()
+		driveFile, err := fs.OpenFile(renderedFile.Name, os.O_RDWR|os.O_CREATE)
+		if err != nil {
+			return "", err
+		}
 
-	err = templates.ExecuteTemplate(networkConfigFile, "network-config.tpl", templateInput)
-	if err != nil {
-		return "", err
+		_, err = driveFile.Write(renderedFile.Contents)
+		driveFile.Close()
+		if err != nil {
+			return "", err
+		}
 	}
 
 	return userdataPath, nil
@@ -425,69 +811,72 @@ func getFilenameFromURL(httpURL string) (string, error) {
 	return pathFragments[len(pathFragments)-1], nil
 }
 
-func getChecksumByFilename(sumsFilePath string, filename string) (string, error) {
-	// Find the checksum of a file in a SUMS file
+func getChecksumByFilename(sumsFilePath string, filename string, algorithm string) (string, error) {
+	// Find the checksum of a file in a SUMS file, both GNU ("HASH *FILE" or "HASH  FILE") and BSD ("ALGO (FILE) = HASH") lines are understood
 
 	checksumContents, err := os.ReadFile(sumsFilePath)
 	if err != nil {
 		return "", err
 	}
 
-	fileLineSuffix := fmt.Sprintf(" *%s", filename)
+	hasher, err := newChecksumHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	// Files like Flatcar's DIGESTS list the same file with several algorithms
+	checksumLength := hex.EncodedLen(hasher.Size())
+
+	bsdLinePrefix := fmt.Sprintf(" (%s) = ", filename)
 
 	for line := range strings.Lines(string(checksumContents)) {
-		if strings.HasSuffix(strings.TrimSpace(line), fileLineSuffix) {
-			return strings.Split(line, " ")[0], nil
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == filename && len(fields[0]) == checksumLength {
+			return strings.ToLower(fields[0]), nil
+		}
+
+		_, checksum, found := strings.Cut(strings.TrimSpace(line), bsdLinePrefix)
+		if found && len(checksum) == checksumLength {
+			return strings.ToLower(checksum), nil
 		}
 	}
 
 	return "", errors.New("unable to find file's name in SUMS file")
 }
 
-func computeFileSHA256(filePath string) (string, error) {
-	// Compute a file's SHA256
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
+func newChecksumHasher(algorithm string) (hash.Hash, error) {
+	// Get a hasher for sha256 or sha512
 
-	streamingHasher := sha256.New()
-	_, err = io.Copy(streamingHasher, file)
-	if err != nil {
-		return "", err
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
 	}
 
-	return hex.EncodeToString(streamingHasher.Sum(nil)), nil
+	return nil, fmt.Errorf("unknown checksum algorithm '%s'", algorithm)
 }
 
-func downloadFile(url string, targetPath string) error {
-	// Download a file to the filesystem
+func computeFileChecksum(filePath string, algorithm string) (string, error) {
+	// Compute a file's SHA256 or SHA512
 
-	file, err := os.Create(targetPath)
+	streamingHasher, err := newChecksumHasher(algorithm)
 	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	client := http.Client{
-		// A long timeout is better than no timeout
-		Timeout: time.Hour,
+		return "", err
 	}
 
-	response, err := client.Get(url)
+	file, err := os.Open(filePath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer response.Body.Close()
+	defer file.Close()
 
-	_, err = io.Copy(file, response.Body)
+	_, err = io.Copy(streamingHasher, file)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return hex.EncodeToString(streamingHasher.Sum(nil)), nil
 }
 
 func checkFileExists(path string) (bool, error) {
@@ -0,0 +1,189 @@
+package fleetingd
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+// A hung hypervisor must not hold up the whole scrape
+const vmStatsTimeout = 5 * time.Second
+
+// /proc/<pid>/stat counts CPU time in clock ticks, which are always 1/100 s for userspace
+const clockTicksPerSecond = 100
+
+// Device counters of cloud-hypervisor exposed as metrics, devices without a counter are skipped
+var vmCounterMetrics = []struct {
+	counter string
+	name    string
+	help    string
+}{
+	{"read_bytes", "fleetingd_instance_disk_read_bytes_total", "Bytes read from a disk of an instance."},
+	{"write_bytes", "fleetingd_instance_disk_write_bytes_total", "Bytes written to a disk of an instance."},
+	{"read_ops", "fleetingd_instance_disk_read_ops_total", "Read requests to a disk of an instance."},
+	{"write_ops", "fleetingd_instance_disk_write_ops_total", "Write requests to a disk of an instance."},
+	{"rx_bytes", "fleetingd_instance_network_receive_bytes_total", "Bytes received by a network device of an instance."},
+	{"tx_bytes", "fleetingd_instance_network_transmit_bytes_total", "Bytes sent by a network device of an instance."},
+	{"rx_frames", "fleetingd_instance_network_receive_frames_total", "Frames received by a network device of an instance."},
+	{"tx_frames", "fleetingd_instance_network_transmit_frames_total", "Frames sent by a network device of an instance."},
+}
+
+// Resource usage of an instance, CPU time and memory are the ones of its hypervisor process
+type vmStats struct {
+	Name     string         `json:"name"`
+	State    provider.State `json:"state"`
+	Internal bool           `json:"internal"`
+
+	CPUSeconds   float64 `json:"cpu_seconds"`
+	MemoryBytes  uint64  `json:"memory_bytes"`
+	BalloonBytes uint64  `json:"balloon_bytes"`
+
+	// Counters of the disks and network devices by device id, e.g. _disk0 or _net1
+	Counters map[string]map[string]uint64 `json:"counters"`
+
+	// Why some of the statistics are missing
+	Errors []string `json:"errors,omitempty"`
+}
+
+func readProcessUsage(pid int) (float64, uint64, error) {
+	// Read the CPU time in seconds and the resident memory in bytes a process uses
+
+	fields, err := readProcessStat(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// utime and stime are the 14th and 15th fields, rss the 24th
+	var values [3]uint64
+	for index, field := range []int{11, 12, 21} {
+		values[index], err = strconv.ParseUint(fields[field], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not parse /proc/%d/stat: %w", pid, err)
+		}
+	}
+
+	return float64(values[0]+values[1]) / clockTicksPerSecond, values[2] * uint64(os.Getpagesize()), nil
+}
+
+func (i *InstanceGroup) collectVMStats() []vmStats {
+	// Collect the resource usage of all instances at the same time, sorted by name
+
+	i.inventory.lock.RLock()
+	var stats []vmStats
+	var pids []int
+	for _, instance := range i.inventory.instances {
+		stats = append(stats, vmStats{Name: instance.Name, State: instance.State, Internal: instance.Internal})
+
+		// The hypervisor comes first
+		pid := 0
+		if len(instance.Processes) > 0 {
+			pid = instance.Processes[0].PID
+		}
+		pids = append(pids, pid)
+	}
+	i.inventory.lock.RUnlock()
+
+	var waitGroup sync.WaitGroup
+	for index := range stats {
+		waitGroup.Go(func() {
+			i.collectInstanceStats(&stats[index], pids[index])
+		})
+	}
+	waitGroup.Wait()
+
+	slices.SortFunc(stats, func(a vmStats, b vmStats) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return stats
+}
+
+func (i *InstanceGroup) collectInstanceStats(stats *vmStats, pid int) {
+	// Ask the hypervisor for the device counters and balloon size and read its process's usage
+
+	if pid > 0 {
+		var err error
+		stats.CPUSeconds, stats.MemoryBytes, err = readProcessUsage(pid)
+		if err != nil {
+			stats.Errors = append(stats.Errors, err.Error())
+		}
+	}
+
+	apiClient := newHypervisorAPIClient(i.getAPISocketPath(stats.Name))
+	apiClient.client.Timeout = vmStatsTimeout
+
+	counters, err := apiClient.Counters()
+	if err != nil {
+		stats.Errors = append(stats.Errors, err.Error())
+	}
+	stats.Counters = counters
+
+	info, err := apiClient.Info()
+	if err != nil {
+		stats.Errors = append(stats.Errors, err.Error())
+	} else if info.MemoryActualSize > 0 && info.MemoryActualSize < info.Config.Memory.Size {
+		stats.BalloonBytes = info.Config.Memory.Size - info.MemoryActualSize
+	}
+}
+
+func writeVMStatsMetrics(w io.Writer, stats []vmStats) {
+	// Write the resource usage of the job instances in the Prometheus text format, every metric lists all instances
+
+	var jobStats []vmStats
+	for _, instance := range stats {
+		if !instance.Internal {
+			jobStats = append(jobStats, instance)
+		}
+	}
+
+	instanceMetrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(vmStats) float64
+	}{
+		{"fleetingd_instance_cpu_seconds_total", "counter", "CPU time used by the hypervisor of an instance.", func(s vmStats) float64 { return s.CPUSeconds }},
+		{"fleetingd_instance_memory_bytes", "gauge", "Resident memory of the hypervisor of an instance, the guest memory it touched included.", func(s vmStats) float64 { return float64(s.MemoryBytes) }},
+		{"fleetingd_instance_balloon_bytes", "gauge", "Guest memory reclaimed from an instance through its balloon device.", func(s vmStats) float64 { return float64(s.BalloonBytes) }},
+	}
+
+	for _, metric := range instanceMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, instance := range jobStats {
+			fmt.Fprintf(w, "%s{instance=\"%s\"} %s\n", metric.name, instance.Name, formatMetricValue(metric.value(instance)))
+		}
+	}
+
+	for _, metric := range vmCounterMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, instance := range jobStats {
+			for _, device := range slices.Sorted(maps.Keys(instance.Counters)) {
+				value, ok := instance.Counters[device][metric.counter]
+				if !ok {
+					continue
+				}
+				fmt.Fprintf(w, "%s{instance=\"%s\",device=\"%s\"} %d\n", metric.name, instance.Name, device, value)
+			}
+		}
+	}
+}
+
+func (i *InstanceGroup) serveVMStats(w http.ResponseWriter, r *http.Request) {
+	// List the resource usage of all instances as JSON, the prebuild and snapshot template VMs included
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(i.collectVMStats())
+}
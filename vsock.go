@@ -0,0 +1,134 @@
+package fleetingd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port the guest side agent listens on, see templates/user-data-template.tpl
+const guestAgentVsockPort = 1024
+const guestAgentExitMarker = "FLEETINGD_EXIT "
+
+func (i *InstanceGroup) getVsockSocketPath(instanceName string) string {
+	// Get the path of the host side unix socket of an instance's vsock device
+
+	return filepath.Join(i.getInstanceDir(instanceName), "vsock.sock")
+}
+
+func dialGuestVsock(ctx context.Context, socketPath string, port int) (*net.UnixConn, error) {
+	// Connect to a guest vsock port through cloud-hypervisor's hybrid vsock unix socket
+
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	unixConnection := connection.(*net.UnixConn)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		unixConnection.SetDeadline(deadline)
+	}
+
+	_, err = fmt.Fprintf(unixConnection, "CONNECT %d\n", port)
+	if err != nil {
+		unixConnection.Close()
+		return nil, err
+	}
+
+	// Read the handshake byte by byte so no payload is consumed by a buffered reader
+	handshake := []byte{}
+	buffer := make([]byte, 1)
+	for {
+		_, err := unixConnection.Read(buffer)
+		if err != nil {
+			unixConnection.Close()
+			return nil, fmt.Errorf("vsock handshake failed: %w", err)
+		}
+		if buffer[0] == '\n' {
+			break
+		}
+		handshake = append(handshake, buffer[0])
+	}
+
+	if !strings.HasPrefix(string(handshake), "OK ") {
+		unixConnection.Close()
+		return nil, fmt.Errorf("vsock handshake failed: %s", handshake)
+	}
+
+	return unixConnection, nil
+}
+
+func runGuestAgentScript(ctx context.Context, socketPath string, script string) (string, error) {
+	// Run a shell script as root inside the guest through the vsock agent and return its output
+
+	connection, err := dialGuestVsock(ctx, socketPath, guestAgentVsockPort)
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+
+	_, err = io.WriteString(connection, script)
+	if err != nil {
+		return "", err
+	}
+
+	// The agent starts executing once the script is complete
+	err = connection.CloseWrite()
+	if err != nil {
+		return "", err
+	}
+
+	output := strings.Builder{}
+	exitCode := -1
+
+	scanner := bufio.NewScanner(connection)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if code, found := strings.CutPrefix(line, guestAgentExitMarker); found {
+			exitCode, err = strconv.Atoi(code)
+			if err != nil {
+				return output.String(), err
+			}
+			continue
+		}
+
+		output.WriteString(line)
+		output.WriteString("\n")
+	}
+	if scanner.Err() != nil {
+		return output.String(), scanner.Err()
+	}
+
+	if exitCode != 0 {
+		return output.String(), fmt.Errorf("guest script failed with exit code %d: %s", exitCode, strings.TrimSpace(output.String()))
+	}
+
+	return output.String(), nil
+}
+
+func waitForGuestAgent(ctx context.Context, socketPath string) error {
+	// Wait until the guest agent accepts commands
+
+	for {
+		attemptContext, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := runGuestAgentScript(attemptContext, socketPath, "true")
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), err)
+		case <-time.After(time.Second):
+		}
+	}
+}